@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+// dumpRecord is a line of a JSON Lines dump, which is a superset of what the stdout engine of
+// magneticod prints (persistence.SimpleTorrentSummary), so that the latter can be imported too.
+type dumpRecord struct {
+	InfoHash   string             `json:"infoHash"`
+	InfoHashV2 string             `json:"infoHashV2,omitempty"`
+	Name       string             `json:"name"`
+	Files      []persistence.File `json:"files"`
+	persistence.TorrentAttributes
+
+	DiscoveredOn int64               `json:"discoveredOn,omitempty"`
+	InfoDict     []byte              `json:"infoDict,omitempty"`
+	Readme       *persistence.Readme `json:"readme,omitempty"`
+}
+
+// dumpWriter writes the torrents to a dump in one of the formats.
+type dumpWriter interface {
+	write(t *persistence.DumpedTorrent) error
+	// flush flushes the dump to the disk, and returns the offsets of its files (see checkpoint).
+	flush() ([]int64, error)
+	close() error
+}
+
+// dumpReader reads the torrents from a dump in one of the formats.
+type dumpReader interface {
+	// read returns the next torrent of the dump, or io.EOF at its end.
+	read() (*persistence.DumpedTorrent, error)
+	// offsets returns the offsets of the files of the dump right after the last torrent read, so
+	// that reading can be resumed there (see checkpoint).
+	offsets() []int64
+	close() error
+}
+
+// newDumpWriter creates the dump at @output (a file for JSON Lines, and a directory for CSV), or
+// truncates it to the @offsets of its files to resume writing it.
+func newDumpWriter(format string, output string, offsets []int64) (dumpWriter, error) {
+	if format == "csv" {
+		if err := os.MkdirAll(output, 0755); err != nil {
+			return nil, errors.Wrap(err, "os.MkdirAll")
+		}
+		if offsets == nil {
+			offsets = []int64{0, 0}
+		}
+		torrents, err := openDumpFile(path.Join(output, "torrents.csv"), offsets[0])
+		if err != nil {
+			return nil, err
+		}
+		files, err := openDumpFile(path.Join(output, "files.csv"), offsets[1])
+		if err != nil {
+			torrents.Close()
+			return nil, err
+		}
+		return newCSVWriter(torrents, files, offsets[0] == 0)
+	}
+
+	if output == "-" {
+		return newJSONLinesWriter(os.Stdout), nil
+	}
+	if offsets == nil {
+		offsets = []int64{0}
+	}
+	file, err := openDumpFile(output, offsets[0])
+	if err != nil {
+		return nil, err
+	}
+	return newJSONLinesWriter(file), nil
+}
+
+func openDumpFile(path string, offset int64) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "os.OpenFile")
+	}
+	// Whatever is written after the offset (of the last checkpoint) is written again.
+	if err = file.Truncate(offset); err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "truncate %s", path)
+	}
+	return file, nil
+}
+
+// newDumpReader opens the dump at @input (see newDumpWriter), and seeks to the @offsets of its
+// files (unless nil) to resume reading it.
+func newDumpReader(format string, input string, offsets []int64) (dumpReader, error) {
+	if format == "csv" {
+		torrents, err := os.Open(path.Join(input, "torrents.csv"))
+		if err != nil {
+			return nil, errors.Wrap(err, "os.Open")
+		}
+		files, err := os.Open(path.Join(input, "files.csv"))
+		if err != nil {
+			torrents.Close()
+			return nil, errors.Wrap(err, "os.Open")
+		}
+		return newCSVReader(torrents, files, offsets)
+	}
+
+	if input == "-" {
+		return &jsonLinesReader{reader: bufio.NewReader(os.Stdin)}, nil
+	}
+	file, err := os.Open(input)
+	if err != nil {
+		return nil, errors.Wrap(err, "os.Open")
+	}
+	r := &jsonLinesReader{file: file}
+	if offsets != nil {
+		if r.offset, err = file.Seek(offsets[0], io.SeekStart); err != nil {
+			file.Close()
+			return nil, errors.Wrapf(err, "seek %s", input)
+		}
+	}
+	r.reader = bufio.NewReader(file)
+	return r, nil
+}
+
+// flushFile flushes @file to the disk, and returns its offset (unless it is the standard output).
+func flushFile(file *os.File) (int64, error) {
+	if file == os.Stdout {
+		return 0, nil
+	}
+	if err := file.Sync(); err != nil {
+		return 0, errors.Wrap(err, "file.Sync")
+	}
+	return file.Seek(0, io.SeekCurrent)
+}
+
+type jsonLinesWriter struct {
+	file    *os.File
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func newJSONLinesWriter(file *os.File) *jsonLinesWriter {
+	w := &jsonLinesWriter{file: file, writer: bufio.NewWriter(file)}
+	w.encoder = json.NewEncoder(w.writer)
+	return w
+}
+
+func (w *jsonLinesWriter) write(t *persistence.DumpedTorrent) error {
+	return w.encoder.Encode(dumpRecord{
+		InfoHash:          hex.EncodeToString(t.InfoHash),
+		InfoHashV2:        hex.EncodeToString(t.InfoHashV2),
+		Name:              t.Name,
+		Files:             t.Files,
+		TorrentAttributes: t.Attributes,
+		DiscoveredOn:      t.DiscoveredOn,
+		InfoDict:          t.InfoDict,
+		Readme:            t.Readme,
+	})
+}
+
+func (w *jsonLinesWriter) flush() ([]int64, error) {
+	if err := w.writer.Flush(); err != nil {
+		return nil, errors.Wrap(err, "Flush")
+	}
+	offset, err := flushFile(w.file)
+	if err != nil {
+		return nil, err
+	}
+	return []int64{offset}, nil
+}
+
+func (w *jsonLinesWriter) close() error {
+	if _, err := w.flush(); err != nil {
+		return err
+	}
+	if w.file == os.Stdout {
+		return nil
+	}
+	return w.file.Close()
+}
+
+type jsonLinesReader struct {
+	// file is nil for the standard input.
+	file   *os.File
+	reader *bufio.Reader
+	// offset is the offset of the file right after the last line read.
+	offset int64
+}
+
+func (r *jsonLinesReader) read() (*persistence.DumpedTorrent, error) {
+	for {
+		line, err := r.reader.ReadBytes('\n')
+		r.offset += int64(len(line))
+		if len(strings.TrimSpace(string(line))) == 0 {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// The last line might not end with a newline, in which case the error is io.EOF.
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		var record dumpRecord
+		if err = json.Unmarshal(line, &record); err != nil {
+			return nil, errors.Wrap(err, "json.Unmarshal")
+		}
+
+		t := &persistence.DumpedTorrent{Readme: record.Readme}
+		if t.InfoHash, err = hex.DecodeString(record.InfoHash); err != nil {
+			return nil, errors.Wrap(err, "couldn't decode infohash")
+		}
+		if record.InfoHashV2 != "" {
+			if t.InfoHashV2, err = hex.DecodeString(record.InfoHashV2); err != nil {
+				return nil, errors.Wrap(err, "couldn't decode infohash v2")
+			}
+		}
+		t.Name, t.Files, t.Attributes = record.Name, record.Files, record.TorrentAttributes
+		t.DiscoveredOn, t.InfoDict = record.DiscoveredOn, record.InfoDict
+		return t, nil
+	}
+}
+
+func (r *jsonLinesReader) offsets() []int64 {
+	return []int64{r.offset}
+}
+
+func (r *jsonLinesReader) close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// The CSV dumps are directories of two files, torrents.csv and files.csv, whose rows are in the
+// same order of the torrents. The binary columns are hex-encoded except the info dictionaries,
+// which are base64-encoded, and the lists (tags and quality flags) are comma-separated.
+var (
+	csvTorrentColumns = []string{"info_hash", "info_hash_v2", "name", "discovered_on", "piece_length",
+		"private", "source", "encoding", "original_name", "undecodable", "tags", "category",
+		"sub_category", "spam_score", "quality_flags", "release_title", "release_year",
+		"release_season", "release_episode", "release_resolution", "release_source", "release_codec",
+		"release_audio", "release_language", "release_group", "info_dict", "readme_path",
+		"readme_content"}
+	csvFileColumns = []string{"info_hash", "size", "path", "attributes", "original_path"}
+)
+
+type csvWriter struct {
+	torrentsFile, filesFile *os.File
+	torrents, files         *csv.Writer
+}
+
+func newCSVWriter(torrentsFile *os.File, filesFile *os.File, header bool) (*csvWriter, error) {
+	w := &csvWriter{
+		torrentsFile: torrentsFile,
+		filesFile:    filesFile,
+		torrents:     csv.NewWriter(torrentsFile),
+		files:        csv.NewWriter(filesFile),
+	}
+	if header {
+		if err := w.torrents.Write(csvTorrentColumns); err != nil {
+			return nil, err
+		}
+		if err := w.files.Write(csvFileColumns); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *csvWriter) write(t *persistence.DumpedTorrent) error {
+	a := t.Attributes
+	r := a.Release
+	if r == nil {
+		r = new(persistence.Release)
+	}
+	var readmePath, readmeContent string
+	if t.Readme != nil {
+		readmePath, readmeContent = t.Readme.Path, t.Readme.Content
+	}
+	var infoDict string
+	if t.InfoDict != nil {
+		infoDict = base64.StdEncoding.EncodeToString(t.InfoDict)
+	}
+
+	infoHash := hex.EncodeToString(t.InfoHash)
+	err := w.torrents.Write([]string{infoHash, hex.EncodeToString(t.InfoHashV2), t.Name,
+		strconv.FormatInt(t.DiscoveredOn, 10), strconv.FormatInt(a.PieceLength, 10),
+		strconv.FormatBool(a.Private), a.Source, a.Encoding, hex.EncodeToString(a.OriginalName),
+		strconv.FormatBool(a.Undecodable), strings.Join(a.Tags, ","), a.Category, a.SubCategory,
+		strconv.Itoa(a.SpamScore), strings.Join(a.QualityFlags, ","), r.Title, csvInt(r.Year),
+		csvInt(r.Season), csvInt(r.Episode), r.Resolution, r.Source, r.Codec, r.Audio, r.Language,
+		r.Group, infoDict, readmePath, readmeContent})
+	if err != nil {
+		return err
+	}
+
+	for _, file := range t.Files {
+		err = w.files.Write([]string{infoHash, strconv.FormatInt(file.Size, 10), file.Path,
+			file.Attributes, hex.EncodeToString(file.OriginalPath)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// csvInt formats the optional integers, which are empty if zero.
+func csvInt(i int) string {
+	if i == 0 {
+		return ""
+	}
+	return strconv.Itoa(i)
+}
+
+func (w *csvWriter) flush() ([]int64, error) {
+	offsets := make([]int64, 2)
+	for i, pair := range []struct {
+		writer *csv.Writer
+		file   *os.File
+	}{{w.torrents, w.torrentsFile}, {w.files, w.filesFile}} {
+		pair.writer.Flush()
+		if err := pair.writer.Error(); err != nil {
+			return nil, errors.Wrap(err, "csv.Writer.Flush")
+		}
+		var err error
+		if offsets[i], err = flushFile(pair.file); err != nil {
+			return nil, err
+		}
+	}
+	return offsets, nil
+}
+
+func (w *csvWriter) close() error {
+	_, err := w.flush()
+	if closeErr := w.torrentsFile.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := w.filesFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type csvReader struct {
+	torrents, files *csvFile
+	// nextFile is the row of files.csv that is read but is not of the last torrent, if any, and
+	// nextFileOffset is its offset.
+	nextFile       []string
+	nextFileOffset int64
+}
+
+// csvFile is a CSV file that is read keeping track of the offsets of its rows.
+type csvFile struct {
+	file    *os.File
+	columns []string
+	counter *countingReader
+	// buffer is read by reader as it is (see bufio.NewReader), hence what is read from the file
+	// but not from buffer is what is buffered.
+	buffer *bufio.Reader
+	reader *csv.Reader
+}
+
+func newCSVFile(file *os.File, columns []string) (*csvFile, error) {
+	f := &csvFile{file: file, columns: columns}
+	f.reset(0)
+
+	header, err := f.reader.Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't read header")
+	}
+	if strings.Join(header, ",") != strings.Join(columns, ",") {
+		return nil, fmt.Errorf("unexpected header: %s", strings.Join(header, ","))
+	}
+	return f, nil
+}
+
+// reset resets the reader of the file, whose offset is @offset.
+func (f *csvFile) reset(offset int64) {
+	f.counter = &countingReader{Reader: f.file, n: offset}
+	f.buffer = bufio.NewReader(f.counter)
+	f.reader = csv.NewReader(f.buffer)
+	f.reader.FieldsPerRecord = len(f.columns)
+}
+
+// offset returns the offset of the file right after the last row read.
+func (f *csvFile) offset() int64 {
+	return f.counter.n - int64(f.buffer.Buffered())
+}
+
+// seek seeks to @offset, which must be the offset of a row.
+func (f *csvFile) seek(offset int64) error {
+	if _, err := f.file.Seek(offset, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "seek %s", f.file.Name())
+	}
+	f.reset(offset)
+	return nil
+}
+
+// countingReader counts the bytes read from its Reader.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func newCSVReader(torrentsFile *os.File, filesFile *os.File, offsets []int64) (*csvReader, error) {
+	r := new(csvReader)
+	var err error
+	if r.torrents, err = newCSVFile(torrentsFile, csvTorrentColumns); err == nil {
+		r.files, err = newCSVFile(filesFile, csvFileColumns)
+	}
+	if err == nil && offsets != nil {
+		if err = r.torrents.seek(offsets[0]); err == nil {
+			err = r.files.seek(offsets[1])
+		}
+	}
+	if err != nil {
+		torrentsFile.Close()
+		filesFile.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *csvReader) read() (*persistence.DumpedTorrent, error) {
+	row, err := r.torrents.reader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	t := new(persistence.DumpedTorrent)
+	a := &t.Attributes
+	ints := make([]int64, 7)
+	for i, column := range []int{3, 4, 13, 16, 17, 18} {
+		if row[column] == "" {
+			continue
+		}
+		if ints[i], err = strconv.ParseInt(row[column], 10, 64); err != nil {
+			return nil, errors.Wrapf(err, "couldn't parse %s", csvTorrentColumns[column])
+		}
+	}
+	binaries := make([][]byte, 3)
+	for i, column := range []int{0, 1, 8} {
+		if row[column] == "" {
+			continue
+		}
+		if binaries[i], err = hex.DecodeString(row[column]); err != nil {
+			return nil, errors.Wrapf(err, "couldn't decode %s", csvTorrentColumns[column])
+		}
+	}
+	if a.Private, err = strconv.ParseBool(row[5]); err != nil {
+		return nil, errors.Wrap(err, "couldn't parse private")
+	}
+	if a.Undecodable, err = strconv.ParseBool(row[9]); err != nil {
+		return nil, errors.Wrap(err, "couldn't parse undecodable")
+	}
+	if row[25] != "" {
+		if t.InfoDict, err = base64.StdEncoding.DecodeString(row[25]); err != nil {
+			return nil, errors.Wrap(err, "couldn't decode info_dict")
+		}
+	}
+
+	t.InfoHash, t.InfoHashV2, t.Name = binaries[0], binaries[1], row[2]
+	t.DiscoveredOn, a.PieceLength, a.SpamScore = ints[0], ints[1], int(ints[2])
+	a.Source, a.Encoding, a.OriginalName = row[6], row[7], binaries[2]
+	a.Tags, a.Category, a.SubCategory = splitList(row[10]), row[11], row[12]
+	a.QualityFlags = splitList(row[14])
+	if row[15] != "" {
+		a.Release = &persistence.Release{Title: row[15], Year: int(ints[3]), Season: int(ints[4]),
+			Episode: int(ints[5]), Resolution: row[19], Source: row[20], Codec: row[21], Audio: row[22],
+			Language: row[23], Group: row[24]}
+	}
+	if row[26] != "" {
+		t.Readme = &persistence.Readme{Path: row[26], Content: row[27]}
+	}
+
+	// The files of the torrent are the rows of files.csv up to the first one of another torrent.
+	for {
+		if r.nextFile == nil {
+			r.nextFileOffset = r.files.offset()
+			if r.nextFile, err = r.files.reader.Read(); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, errors.Wrap(err, "files.csv")
+			}
+		}
+		if r.nextFile[0] != row[0] {
+			break
+		}
+
+		file := persistence.File{Path: r.nextFile[2], Attributes: r.nextFile[3]}
+		if file.Size, err = strconv.ParseInt(r.nextFile[1], 10, 64); err != nil {
+			return nil, errors.Wrap(err, "couldn't parse size")
+		}
+		if file.OriginalPath, err = hex.DecodeString(r.nextFile[4]); err != nil {
+			return nil, errors.Wrap(err, "couldn't decode original_path")
+		} else if len(file.OriginalPath) == 0 {
+			file.OriginalPath = nil
+		}
+		t.Files = append(t.Files, file)
+		r.nextFile = nil
+	}
+
+	return t, nil
+}
+
+// splitList splits a comma-separated list, which is empty (nil) if the string is.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// offsets returns the offset of files.csv before the row that is read but is not of the last
+// torrent, if any, since it is read again on resuming.
+func (r *csvReader) offsets() []int64 {
+	if r.nextFile != nil {
+		return []int64{r.torrents.offset(), r.nextFileOffset}
+	}
+	return []int64{r.torrents.offset(), r.files.offset()}
+}
+
+func (r *csvReader) close() error {
+	err := r.torrents.file.Close()
+	if filesErr := r.files.file.Close(); err == nil {
+		err = filesErr
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+func TestDumpRoundTrip(t *testing.T) {
+	torrents := []persistence.DumpedTorrent{
+		{
+			NewTorrent: persistence.NewTorrent{
+				InfoHash:   []byte("01234567890123456789"),
+				InfoHashV2: []byte("01234567890123456789012345678901"),
+				Name:       "Name, with \"quotes\"\nand a newline",
+				Files: []persistence.File{
+					{Size: 10, Path: "a/README.txt"},
+					{Size: 20, Path: "a/b\xef\xbf\xbd.mkv", Attributes: "x", OriginalPath: []byte("a/b\xe9.mkv")},
+				},
+				Attributes: persistence.TorrentAttributes{
+					PieceLength:  16384,
+					Encoding:     "windows-1252",
+					OriginalName: []byte("Name\xe9"),
+					Tags:         []string{"a", "b"},
+					Category:     "video",
+					Release:      &persistence.Release{Title: "Title", Year: 2001, Resolution: "1080p"},
+					SpamScore:    10,
+					QualityFlags: []string{"fake"},
+				},
+				InfoDict:     []byte("d4:name4:Namee"),
+				DiscoveredOn: 1600000000,
+			},
+			Readme: &persistence.Readme{Path: "a/README.txt", Content: "Hello,\n\"world\""},
+		},
+		{
+			NewTorrent: persistence.NewTorrent{
+				InfoHash: []byte("98765432109876543210"),
+				Name:     "Without files",
+				Attributes: persistence.TorrentAttributes{
+					Private: true,
+				},
+				DiscoveredOn: 1600000001,
+			},
+		},
+	}
+
+	for _, format := range []string{"jsonl", "csv"} {
+		dir, err := ioutil.TempDir("", "magneticoctl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		output := path.Join(dir, "dump")
+
+		writer, err := newDumpWriter(format, output, nil)
+		if err != nil {
+			t.Fatalf("%s: newDumpWriter: %s", format, err.Error())
+		}
+		for i := range torrents {
+			if err = writer.write(&torrents[i]); err != nil {
+				t.Fatalf("%s: write: %s", format, err.Error())
+			}
+		}
+		if err = writer.close(); err != nil {
+			t.Fatalf("%s: close: %s", format, err.Error())
+		}
+
+		reader, err := newDumpReader(format, output, nil)
+		if err != nil {
+			t.Fatalf("%s: newDumpReader: %s", format, err.Error())
+		}
+		for i := range torrents {
+			torrent, err := reader.read()
+			if err != nil {
+				t.Fatalf("%s: read: %s", format, err.Error())
+			}
+			if !reflect.DeepEqual(*torrent, torrents[i]) {
+				t.Errorf("%s: torrent %d is read as\n%+v\nnot\n%+v", format, i, *torrent, torrents[i])
+			}
+		}
+		if _, err = reader.read(); err != io.EOF {
+			t.Errorf("%s: read after the last torrent returned %v instead of io.EOF", format, err)
+		}
+		_ = reader.close()
+	}
+}
@@ -0,0 +1,221 @@
+// magneticoctl manages the blocklist of a magnetico database, and shows its audit log. It also
+// exports the torrents of a database to dumps, imports them, and migrates them to other databases.
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Wessie/appdirs"
+	"github.com/jessevdk/go-flags"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/boramalper/magnetico/pkg/blocklist"
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+var opts struct {
+	DatabaseURL string `long:"database" description:"URL of the database."`
+	Actor       string `long:"actor" description:"Who is making the change, as recorded in the audit log (the current user by default)."`
+}
+
+type blockCommand struct {
+	InfoHash    string `long:"infohash" description:"Infohash (v1 or v2, in hex) of the torrent to take down and block."`
+	NamePattern string `long:"name-pattern" description:"Regular expression (RE2) of the names of the torrents to block."`
+	Reason      string `long:"reason" description:"Why the torrent(s) are blocked (e.g. the reference of the takedown notice)." required:"true"`
+}
+
+type unblockCommand struct {
+	Reason string `long:"reason" description:"Why the block is removed." required:"true"`
+	Args   struct {
+		ID uint64 `positional-arg-name:"ID" description:"ID of the block (see list)."`
+	} `positional-args:"true" required:"true"`
+}
+
+type deleteCommand struct {
+	InfoHash string `long:"infohash" description:"Infohash (v1 or v2, in hex) of the torrent to delete." required:"true"`
+	Reason   string `long:"reason" description:"Why the torrent is deleted." required:"true"`
+}
+
+type listCommand struct{}
+
+type auditCommand struct {
+	Limit uint `long:"limit" description:"Maximum number of entries to show, newest first." default:"50"`
+}
+
+func main() {
+	// magneticoctl is interactive, hence only the warnings (e.g. of migrations) and errors are
+	// logged.
+	logger := zap.New(zapcore.NewCore(
+		zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig()),
+		zapcore.Lock(os.Stderr),
+		zap.WarnLevel,
+	))
+	defer logger.Sync()
+	zap.ReplaceGlobals(logger)
+
+	parser := flags.NewParser(&opts, flags.Default)
+	_, _ = parser.AddCommand("block", "Block a torrent", "Takes down and blocks the torrent of an infohash, or blocks the torrents whose names match a pattern.", new(blockCommand))
+	_, _ = parser.AddCommand("unblock", "Remove a block", "Removes a block from the blocklist.", new(unblockCommand))
+	_, _ = parser.AddCommand("delete", "Delete a torrent", "Deletes a torrent without blocking it (it might be discovered again).", new(deleteCommand))
+	_, _ = parser.AddCommand("list", "List the blocklist", "Lists the blocklist.", new(listCommand))
+	_, _ = parser.AddCommand("audit", "Show the audit log", "Shows the audit log of the blocklist and the deletions.", new(auditCommand))
+	_, _ = parser.AddCommand("export", "Export the torrents", "Exports the torrents (with their files and readmes) to a JSON Lines or CSV dump.", new(exportCommand))
+	_, _ = parser.AddCommand("import", "Import the torrents", "Imports the torrents from a JSON Lines or CSV dump, skipping the ones that exist already.", new(importCommand))
+	_, _ = parser.AddCommand("migrate", "Migrate the torrents", "Copies the torrents (with their files and readmes) to another database, skipping the ones that exist there already.", new(migrateCommand))
+
+	if _, err := parser.Parse(); err != nil {
+		// jessevdk/go-flags already printed the error, be it of the arguments or of the command.
+		os.Exit(1)
+	}
+}
+
+// databaseURL returns the URL of the database, which is the default database of magneticod unless
+// supplied.
+func databaseURL() string {
+	if opts.DatabaseURL == "" {
+		opts.DatabaseURL = "sqlite3://" +
+			appdirs.UserDataDir("magneticod", "", "", false) +
+			"/database.sqlite3" +
+			"?_journal_mode=WAL" + // https://github.com/mattn/go-sqlite3#connection-string
+			"&_busy_timeout=3000" + // in milliseconds
+			"&_foreign_keys=true"
+	}
+	return opts.DatabaseURL
+}
+
+// open opens the database and loads its blocklist.
+func open() (persistence.Database, *blocklist.Blocklist, error) {
+	database, err := persistence.MakeDatabase(databaseURL(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	blocks, err := blocklist.Load(database)
+	if err != nil {
+		_ = database.Close()
+		return nil, nil, err
+	}
+
+	return database, blocks, nil
+}
+
+func actor() string {
+	if opts.Actor != "" {
+		return opts.Actor
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+func (c *blockCommand) Execute(args []string) error {
+	block := persistence.Block{NamePattern: c.NamePattern, Reason: c.Reason, AddedBy: actor()}
+	if c.InfoHash != "" {
+		var err error
+		if block.InfoHash, err = hex.DecodeString(c.InfoHash); err != nil {
+			return fmt.Errorf("couldn't decode infohash: %s", err.Error())
+		}
+	}
+	if err := blocklist.Validate(block); err != nil {
+		return err
+	}
+
+	database, blocks, err := open()
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	id, err := blocks.Block(block)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added block %d.\n", id)
+	return nil
+}
+
+func (c *unblockCommand) Execute(args []string) error {
+	database, blocks, err := open()
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	return blocks.Unblock(c.Args.ID, actor(), c.Reason)
+}
+
+func (c *deleteCommand) Execute(args []string) error {
+	infoHash, err := hex.DecodeString(c.InfoHash)
+	if err != nil {
+		return fmt.Errorf("couldn't decode infohash: %s", err.Error())
+	}
+
+	database, blocks, err := open()
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	return blocks.Delete(infoHash, actor(), c.Reason)
+}
+
+func (c *listCommand) Execute(args []string) error {
+	database, _, err := open()
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	blockList, err := database.GetBlocks()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tINFOHASH / NAME PATTERN\tADDED BY\tADDED ON\tREASON")
+	for _, b := range blockList {
+		subject := hex.EncodeToString(b.InfoHash)
+		if b.InfoHash == nil {
+			subject = b.NamePattern
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", strconv.FormatUint(b.ID, 10), subject, b.AddedBy,
+			formatTime(b.AddedOn), b.Reason)
+	}
+	return tw.Flush()
+}
+
+func (c *auditCommand) Execute(args []string) error {
+	database, _, err := open()
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	entries, err := database.GetAuditLog(c.Limit)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PERFORMED ON\tACTION\tINFOHASH / NAME PATTERN\tACTOR\tREASON")
+	for _, e := range entries {
+		subject := hex.EncodeToString(e.InfoHash)
+		if e.InfoHash == nil {
+			subject = e.NamePattern
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", formatTime(e.PerformedOn), e.Action, subject, e.Actor, e.Reason)
+	}
+	return tw.Flush()
+}
+
+func formatTime(t int64) string {
+	return time.Unix(t, 0).UTC().Format(time.RFC3339)
+}
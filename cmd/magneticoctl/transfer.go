@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/boramalper/magnetico/pkg/blocklist"
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+type exportCommand struct {
+	Format     string `long:"format" description:"Format of the dump, which is a directory of torrents.csv and files.csv for CSV." choice:"jsonl" choice:"csv" default:"jsonl"`
+	Output     string `long:"output" description:"File (or directory, for CSV) to export to, or - for the standard output." default:"-"`
+	InfoDicts  bool   `long:"info-dicts" description:"Export the info dictionaries too, if the database stores them."`
+	Checkpoint string `long:"checkpoint" description:"File to save the progress to, so that an interrupted export resumes where it left off."`
+	BatchSize  uint   `long:"batch-size" description:"Number of torrents read (and checkpointed) at a time." default:"1000"`
+}
+
+type importCommand struct {
+	Format     string `long:"format" description:"Format of the dump." choice:"jsonl" choice:"csv" default:"jsonl"`
+	Checkpoint string `long:"checkpoint" description:"File to save the progress to, so that an interrupted import resumes where it left off."`
+	BatchSize  uint   `long:"batch-size" description:"Number of torrents written (and checkpointed) at a time." default:"1000"`
+	Args       struct {
+		Path string `positional-arg-name:"PATH" description:"File (or directory, for CSV) to import from, or - for the standard input."`
+	} `positional-args:"true" required:"true"`
+}
+
+type migrateCommand struct {
+	To         string `long:"to" description:"URL of the database to migrate the torrents to." required:"true"`
+	InfoDicts  bool   `long:"info-dicts" description:"Migrate the info dictionaries too, if both of the databases store them."`
+	Checkpoint string `long:"checkpoint" description:"File to save the progress to, so that an interrupted migration resumes where it left off."`
+	BatchSize  uint   `long:"batch-size" description:"Number of torrents read and written (and checkpointed) at a time." default:"1000"`
+}
+
+// checkpoint is the progress of an export, import, or migration, which is saved after every batch.
+type checkpoint struct {
+	path string
+
+	// LastID is the ID of the last torrent read from the database (export and migrate).
+	LastID uint64 `json:"lastID"`
+	// NTorrents is the number of torrents exported, imported, or migrated so far.
+	NTorrents uint64 `json:"nTorrents"`
+	// Offsets are the sizes of the files of the dump as of the checkpoint (export), or the offsets
+	// of the files right after the last torrent imported (import).
+	Offsets []int64 `json:"offsets,omitempty"`
+}
+
+// loadCheckpoint loads the checkpoint at @path, which is empty if @path is empty or does not exist
+// yet.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	cp := &checkpoint{path: path}
+	if path == "" {
+		return cp, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "couldn't read checkpoint")
+	}
+	if err = json.Unmarshal(data, cp); err != nil {
+		return nil, errors.Wrap(err, "couldn't parse checkpoint")
+	}
+	if cp.NTorrents > 0 {
+		fmt.Fprintf(os.Stderr, "Resuming from the checkpoint after %d torrents.\n", cp.NTorrents)
+	}
+	return cp, nil
+}
+
+// save saves the checkpoint atomically, so that it is never left half-written.
+func (cp *checkpoint) save() error {
+	if cp.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return errors.Wrap(err, "json.Marshal")
+	}
+	if err = ioutil.WriteFile(cp.path+".tmp", data, 0644); err != nil {
+		return errors.Wrap(err, "couldn't write checkpoint")
+	}
+	return errors.Wrap(os.Rename(cp.path+".tmp", cp.path), "couldn't write checkpoint")
+}
+
+// progress prints the progress to the standard error every few seconds.
+type progress struct {
+	verb  string
+	total uint
+	// resumed is the number of torrents done before the checkpoint, as of started.
+	resumed uint64
+	started time.Time
+	// printed and nPrinted are when the progress is printed last, and the number of torrents then.
+	printed  time.Time
+	nPrinted uint64
+}
+
+// newProgress creates a progress of @total torrents, which is unknown if zero.
+func newProgress(verb string, total uint, resumed uint64) *progress {
+	return &progress{verb: verb, total: total, resumed: resumed, started: time.Now(), nPrinted: resumed}
+}
+
+func (p *progress) update(n uint64, final bool) {
+	// The final progress is printed unless it is already.
+	if final && n == p.nPrinted && !p.printed.IsZero() {
+		return
+	} else if !final && time.Since(p.printed) < 5*time.Second {
+		return
+	}
+	p.printed, p.nPrinted = time.Now(), n
+
+	rate := float64(n-p.resumed) / time.Since(p.started).Seconds()
+	if p.total > 0 {
+		fmt.Fprintf(os.Stderr, "%s %d of ~%d torrents (%.1f%%), %.0f torrents/s\n", p.verb, n, p.total,
+			100*float64(n)/float64(p.total), rate)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s %d torrents, %.0f torrents/s\n", p.verb, n, rate)
+	}
+}
+
+// dump reads the torrents of @database in batches after the checkpoint, and passes them to @f,
+// which is followed by saving the checkpoint.
+func dump(database persistence.Database, cp *checkpoint, batchSize uint, withInfoDicts bool, verb string, f func([]persistence.DumpedTorrent) error) error {
+	if batchSize == 0 {
+		return errors.New("batch size must be positive")
+	}
+
+	// The total is only to estimate the percentage, hence the errors (e.g. of the engines which do
+	// not count their torrents) are ignored.
+	total, _ := database.GetNumberOfTorrents()
+	p := newProgress(verb, total, cp.NTorrents)
+	for {
+		torrents, err := database.DumpTorrents(cp.LastID, batchSize, withInfoDicts)
+		if errors.Cause(err) == persistence.NotImplementedError {
+			return errors.New("the database engine does not support exporting its torrents")
+		} else if err != nil {
+			return err
+		}
+		if len(torrents) == 0 {
+			break
+		}
+
+		if err = f(torrents); err != nil {
+			return err
+		}
+		cp.LastID = torrents[len(torrents)-1].ID
+		cp.NTorrents += uint64(len(torrents))
+		if err = cp.save(); err != nil {
+			return err
+		}
+		p.update(cp.NTorrents, false)
+	}
+	p.update(cp.NTorrents, true)
+	return nil
+}
+
+// importer adds the torrents to a database, except those that are blocked there.
+type importer struct {
+	database persistence.Database
+	blocks   *blocklist.Blocklist
+	// readmes is false if the database does not support readmes.
+	readmes bool
+}
+
+func newImporter(database persistence.Database) (*importer, error) {
+	blocks, err := blocklist.Load(database)
+	if errors.Cause(err) == persistence.NotImplementedError {
+		blocks = nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &importer{database: database, blocks: blocks, readmes: true}, nil
+}
+
+func (im *importer) add(torrents []persistence.DumpedTorrent) error {
+	newTorrents := make([]persistence.NewTorrent, 0, len(torrents))
+	for _, t := range torrents {
+		if im.blocks.Blocks(t.InfoHash, t.InfoHashV2, t.Name) {
+			continue
+		}
+		newTorrents = append(newTorrents, t.NewTorrent)
+	}
+	if err := persistence.AddNewTorrents(im.database, newTorrents); err != nil {
+		return err
+	}
+
+	for _, t := range torrents {
+		if t.Readme == nil || !im.readmes || im.blocks.Blocks(t.InfoHash, t.InfoHashV2, t.Name) {
+			continue
+		}
+		err := im.database.SetReadme(t.InfoHash, *t.Readme)
+		if errors.Cause(err) == persistence.NotImplementedError {
+			im.readmes = false
+		} else if err != nil {
+			return errors.Wrap(err, "SetReadme")
+		}
+	}
+	return nil
+}
+
+func (c *exportCommand) Execute(args []string) error {
+	if c.Output == "-" && (c.Format == "csv" || c.Checkpoint != "") {
+		return errors.New("--output is required for CSV dumps, and to checkpoint")
+	}
+
+	database, err := persistence.MakeDatabase(databaseURL(), nil)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+	return c.export(database)
+}
+
+func (c *exportCommand) export(database persistence.Database) error {
+	cp, err := loadCheckpoint(c.Checkpoint)
+	if err != nil {
+		return err
+	}
+	writer, err := newDumpWriter(c.Format, c.Output, cp.Offsets)
+	if err != nil {
+		return err
+	}
+	err = dump(database, cp, c.BatchSize, c.InfoDicts, "Exported", func(torrents []persistence.DumpedTorrent) error {
+		for i := range torrents {
+			if err := writer.write(&torrents[i]); err != nil {
+				return errors.Wrap(err, "couldn't write dump")
+			}
+		}
+		// The dump is flushed before the checkpoint is saved, so that the checkpoint never refers
+		// to what is not written.
+		offsets, err := writer.flush()
+		cp.Offsets = offsets
+		return err
+	})
+	if closeErr := writer.close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (c *importCommand) Execute(args []string) error {
+	if c.BatchSize == 0 {
+		return errors.New("batch size must be positive")
+	}
+	if c.Args.Path == "-" && (c.Format == "csv" || c.Checkpoint != "") {
+		return errors.New("a path is required for CSV dumps, and to checkpoint")
+	}
+
+	database, err := persistence.MakeDatabase(databaseURL(), nil)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+	return c.importDump(database)
+}
+
+func (c *importCommand) importDump(database persistence.Database) error {
+	cp, err := loadCheckpoint(c.Checkpoint)
+	if err != nil {
+		return err
+	}
+	if cp.NTorrents > 0 && cp.Offsets == nil {
+		return errors.New("the checkpoint has no offsets to resume the import from")
+	}
+	reader, err := newDumpReader(c.Format, c.Args.Path, cp.Offsets)
+	if err != nil {
+		return err
+	}
+	defer reader.close()
+
+	im, err := newImporter(database)
+	if err != nil {
+		return err
+	}
+
+	p := newProgress("Imported", 0, cp.NTorrents)
+	for eof := false; !eof; {
+		batch := make([]persistence.DumpedTorrent, 0, c.BatchSize)
+		for uint(len(batch)) < c.BatchSize {
+			t, err := reader.read()
+			if err == io.EOF {
+				eof = true
+				break
+			} else if err != nil {
+				return errors.Wrapf(err, "couldn't read torrent %d of the dump", cp.NTorrents+uint64(len(batch))+1)
+			}
+			batch = append(batch, *t)
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		if err = im.add(batch); err != nil {
+			return err
+		}
+		cp.NTorrents += uint64(len(batch))
+		cp.Offsets = reader.offsets()
+		if err = cp.save(); err != nil {
+			return err
+		}
+		p.update(cp.NTorrents, false)
+	}
+	p.update(cp.NTorrents, true)
+	return nil
+}
+
+func (c *migrateCommand) Execute(args []string) error {
+	cp, err := loadCheckpoint(c.Checkpoint)
+	if err != nil {
+		return err
+	}
+
+	source, err := persistence.MakeDatabase(databaseURL(), nil)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := persistence.MakeDatabase(c.To, nil)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	im, err := newImporter(target)
+	if err != nil {
+		return err
+	}
+
+	return dump(source, cp, c.BatchSize, c.InfoDicts, "Migrated", im.add)
+}
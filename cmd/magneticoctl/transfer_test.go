@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+// interruptedDatabase fails the @failAt-th call of DumpTorrents and of AddNewTorrent, as if the
+// transfer is interrupted there.
+type interruptedDatabase struct {
+	persistence.Database
+	failAt int
+	dumps  int
+	adds   int
+}
+
+func (db *interruptedDatabase) DumpTorrents(afterID uint64, limit uint, withInfoDicts bool) ([]persistence.DumpedTorrent, error) {
+	db.dumps++
+	if db.dumps == db.failAt {
+		return nil, errors.New("interrupted")
+	}
+	return db.Database.DumpTorrents(afterID, limit, withInfoDicts)
+}
+
+func (db *interruptedDatabase) AddNewTorrent(infoHash []byte, infoHashV2 []byte, name string, files []persistence.File, attributes persistence.TorrentAttributes) error {
+	db.adds++
+	if db.adds == db.failAt {
+		return errors.New("interrupted")
+	}
+	return db.Database.AddNewTorrent(infoHash, infoHashV2, name, files, attributes)
+}
+
+func transferTorrents() []persistence.NewTorrent {
+	torrents := make([]persistence.NewTorrent, 5)
+	for i := range torrents {
+		torrents[i] = persistence.NewTorrent{
+			InfoHash: []byte(fmt.Sprintf("%020d", i)),
+			Name:     fmt.Sprintf("Torrent %d", i),
+			Files: []persistence.File{
+				{Size: 1, Path: fmt.Sprintf("%d/a", i)},
+				{Size: 2, Path: fmt.Sprintf("%d/b", i)},
+			},
+			DiscoveredOn: 1600000000 + int64(i),
+		}
+	}
+	return torrents
+}
+
+func makeTransferDatabase(t *testing.T, torrents []persistence.NewTorrent) persistence.Database {
+	database, err := persistence.MakeDatabase("memory://", nil)
+	if err != nil {
+		t.Fatalf("MakeDatabase: %s", err.Error())
+	}
+	if err = persistence.AddNewTorrents(database, torrents); err != nil {
+		t.Fatalf("AddNewTorrents: %s", err.Error())
+	}
+	return database
+}
+
+// checkTransferred checks that @torrents are exactly the torrents of transferTorrents, in order.
+func checkTransferred(t *testing.T, format string, torrents []persistence.NewTorrent) {
+	expected := transferTorrents()
+	if len(torrents) != len(expected) {
+		t.Fatalf("%s: %d torrents are transferred instead of %d", format, len(torrents), len(expected))
+	}
+	for i := range expected {
+		if torrents[i].Name != expected[i].Name || !reflect.DeepEqual(torrents[i].Files, expected[i].Files) {
+			t.Errorf("%s: torrent %d is transferred as %+v, not %+v", format, i, torrents[i], expected[i])
+		}
+	}
+}
+
+func TestExportResumes(t *testing.T) {
+	for _, format := range []string{"jsonl", "csv"} {
+		dir, err := ioutil.TempDir("", "magneticoctl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		database := &interruptedDatabase{Database: makeTransferDatabase(t, transferTorrents()), failAt: 2}
+		c := &exportCommand{
+			Format:     format,
+			Output:     path.Join(dir, "dump"),
+			Checkpoint: path.Join(dir, "checkpoint"),
+			BatchSize:  2,
+		}
+		if err = c.export(database); err == nil {
+			t.Fatalf("%s: the interrupted export succeeded", format)
+		}
+		if err = c.export(database); err != nil {
+			t.Fatalf("%s: the resumed export failed: %s", format, err.Error())
+		}
+
+		reader, err := newDumpReader(format, c.Output, nil)
+		if err != nil {
+			t.Fatalf("%s: newDumpReader: %s", format, err.Error())
+		}
+		var torrents []persistence.NewTorrent
+		for {
+			torrent, err := reader.read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%s: read: %s", format, err.Error())
+			}
+			torrents = append(torrents, torrent.NewTorrent)
+		}
+		_ = reader.close()
+		checkTransferred(t, format, torrents)
+	}
+}
+
+func TestImportResumes(t *testing.T) {
+	for _, format := range []string{"jsonl", "csv"} {
+		dir, err := ioutil.TempDir("", "magneticoctl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		dumpPath := path.Join(dir, "dump")
+
+		writer, err := newDumpWriter(format, dumpPath, nil)
+		if err != nil {
+			t.Fatalf("%s: newDumpWriter: %s", format, err.Error())
+		}
+		for _, torrent := range transferTorrents() {
+			if err = writer.write(&persistence.DumpedTorrent{NewTorrent: torrent}); err != nil {
+				t.Fatalf("%s: write: %s", format, err.Error())
+			}
+		}
+		if err = writer.close(); err != nil {
+			t.Fatalf("%s: close: %s", format, err.Error())
+		}
+
+		// The interrupted database does not add in batches, hence the third torrent (i.e. the
+		// first of the second batch) fails.
+		database := &interruptedDatabase{Database: makeTransferDatabase(t, nil), failAt: 3}
+		c := &importCommand{
+			Format:     format,
+			Checkpoint: path.Join(dir, "checkpoint"),
+			BatchSize:  2,
+		}
+		c.Args.Path = dumpPath
+		if err = c.importDump(database); err == nil {
+			t.Fatalf("%s: the interrupted import succeeded", format)
+		}
+		cp, err := loadCheckpoint(c.Checkpoint)
+		if err != nil {
+			t.Fatalf("%s: loadCheckpoint: %s", format, err.Error())
+		}
+		if cp.NTorrents != 2 || cp.Offsets == nil {
+			t.Fatalf("%s: the checkpoint is %+v after the first batch", format, *cp)
+		}
+		if err = c.importDump(database); err != nil {
+			t.Fatalf("%s: the resumed import failed: %s", format, err.Error())
+		}
+
+		dumped, err := database.Database.DumpTorrents(0, 100, false)
+		if err != nil {
+			t.Fatalf("%s: DumpTorrents: %s", format, err.Error())
+		}
+		torrents := make([]persistence.NewTorrent, len(dumped))
+		for i := range dumped {
+			torrents[i] = dumped[i].NewTorrent
+		}
+		checkTransferred(t, format, torrents)
+		// Adding an existing torrent is not an error, hence the torrents added twice are counted.
+		if database.adds != len(torrents)+1 {
+			t.Errorf("%s: AddNewTorrent is called %d times instead of %d", format, database.adds, len(torrents)+1)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/boramalper/magnetico/pkg/category"
+	"github.com/boramalper/magnetico/pkg/persistence"
+	"github.com/boramalper/magnetico/pkg/release"
+	"github.com/boramalper/magnetico/pkg/util"
+)
+
+// minBackfillBackoff and maxBackfillBackoff are the bounds of the interval between the attempts to
+// backfill after an error, which is doubled after each failed attempt (as the spool does).
+const (
+	minBackfillBackoff = time.Second
+	maxBackfillBackoff = 5 * time.Minute
+)
+
+// backfill categorises the torrents, and parses the names of the torrents, that were persisted
+// before magneticod did so at ingest; a batch at a time so that it does not hold up the event loop.
+type backfill struct {
+	database  persistence.Database
+	batchSize uint
+
+	categoriesDone bool
+	releasesDone   bool
+
+	// backoff is the interval before retryAt since the last error, and zero if the last attempt
+	// did not fail.
+	backoff time.Duration
+	retryAt time.Time
+}
+
+func newBackfill(database persistence.Database, batchSize uint) *backfill {
+	b := new(backfill)
+	b.database = database
+	b.batchSize = batchSize
+	b.categoriesDone = batchSize == 0
+	b.releasesDone = batchSize == 0
+	return b
+}
+
+// step backfills the next batch of torrents (categories first, then releases), and returns how many
+// of them it did. Nothing is done until it is time to retry after an error.
+func (b *backfill) step() int {
+	if time.Now().Before(b.retryAt) {
+		return 0
+	}
+
+	if !b.categoriesDone {
+		return b.stepCategories()
+	} else if !b.releasesDone {
+		return b.stepReleases()
+	}
+	return 0
+}
+
+func (b *backfill) stepCategories() int {
+	infoHashes, err := b.database.GetUncategorisedTorrents(b.batchSize)
+	if err != nil {
+		b.onError("categories", &b.categoriesDone, errors.Wrap(err, "GetUncategorisedTorrents"))
+		return 0
+	}
+	if len(infoHashes) == 0 {
+		zap.L().Info("Backfilled the categories of all torrents")
+		b.categoriesDone = true
+		return 0
+	}
+
+	for i, infoHash := range infoHashes {
+		files, err := b.database.GetFiles(infoHash)
+		if err != nil {
+			b.onError("categories", &b.categoriesDone, errors.Wrap(err, "GetFiles"))
+			return i
+		}
+
+		c, subCategory := category.Classify(files)
+		if err = b.database.SetCategory(infoHash, c, subCategory); err != nil {
+			b.onError("categories", &b.categoriesDone, errors.Wrap(err, "SetCategory"))
+			return i
+		}
+
+		zap.L().Debug("Backfilled category", util.HexField("infoHash", infoHash),
+			zap.String("category", c), zap.String("subCategory", subCategory))
+	}
+
+	b.backoff = 0
+	return len(infoHashes)
+}
+
+func (b *backfill) stepReleases() int {
+	torrents, err := b.database.GetUnparsedTorrents(b.batchSize)
+	if err != nil {
+		b.onError("releases", &b.releasesDone, errors.Wrap(err, "GetUnparsedTorrents"))
+		return 0
+	}
+	if len(torrents) == 0 {
+		zap.L().Info("Backfilled the releases of all torrents")
+		b.releasesDone = true
+		return 0
+	}
+
+	for i, torrent := range torrents {
+		if err = b.database.SetRelease(torrent.InfoHash, release.Parse(torrent.Name)); err != nil {
+			b.onError("releases", &b.releasesDone, errors.Wrap(err, "SetRelease"))
+			return i
+		}
+
+		zap.L().Debug("Backfilled release", util.HexField("infoHash", torrent.InfoHash))
+	}
+
+	b.backoff = 0
+	return len(torrents)
+}
+
+// onError logs the error of the backfill of @what, which is retried with an exponential backoff (so
+// that an outage of the database does not stop it for good), unless the database engine does not
+// support @what, in which case @done is set.
+func (b *backfill) onError(what string, done *bool, err error) {
+	if errors.Cause(err) == persistence.NotImplementedError {
+		zap.L().Warn("Database engine does not support " + what + ", not backfilling them.")
+		*done = true
+		return
+	}
+
+	if b.backoff *= 2; b.backoff < minBackfillBackoff {
+		b.backoff = minBackfillBackoff
+	} else if b.backoff > maxBackfillBackoff {
+		b.backoff = maxBackfillBackoff
+	}
+	b.retryAt = time.Now().Add(b.backoff)
+	zap.L().Warn("Could not backfill "+what+", retrying later", zap.Duration("backoff", b.backoff), zap.Error(err))
+}
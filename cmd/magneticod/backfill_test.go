@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+func TestBackfillReleases(t *testing.T) {
+	database, err := persistence.MakeDatabase("memory://", nil)
+	if err != nil {
+		t.Fatalf("MakeDatabase: %s", err.Error())
+	}
+	defer database.Close()
+
+	// Nothing is left of these names once the fields are stripped, and the last one is empty.
+	names := []string{"[Group] .mkv", "[Group]", ".mkv", ""}
+	for i, name := range names {
+		files := []persistence.File{{Size: 1, Path: "a"}}
+		if err = database.AddNewTorrent([]byte{byte(i)}, nil, name, files, persistence.TorrentAttributes{}); err != nil {
+			t.Fatalf("AddNewTorrent: %s", err.Error())
+		}
+	}
+
+	b := newBackfill(database, 1)
+	b.categoriesDone = true
+	for i := 0; !b.releasesDone; i++ {
+		if i > len(names) {
+			t.Fatal("Backfill of the releases does not finish")
+		}
+		b.step()
+	}
+
+	for i, name := range names {
+		torrent, err := database.GetTorrent([]byte{byte(i)})
+		if err != nil || torrent == nil || torrent.Release == nil {
+			t.Fatalf("Release of %q is not backfilled: %+v %v", name, torrent, err)
+		}
+		if name != "" && torrent.Release.Title != name {
+			t.Errorf("Title of %q is %q", name, torrent.Release.Title)
+		}
+	}
+}
+
+// unavailableDatabase fails to list the unparsed torrents while unavailable is set.
+type unavailableDatabase struct {
+	persistence.Database
+	unavailable bool
+}
+
+func (db *unavailableDatabase) GetUnparsedTorrents(limit uint) ([]persistence.TorrentMetadata, error) {
+	if db.unavailable {
+		return nil, fmt.Errorf("unavailable")
+	}
+	return db.Database.GetUnparsedTorrents(limit)
+}
+
+func TestBackfillRetry(t *testing.T) {
+	underlying, err := persistence.MakeDatabase("memory://", nil)
+	if err != nil {
+		t.Fatalf("MakeDatabase: %s", err.Error())
+	}
+	defer underlying.Close()
+	files := []persistence.File{{Size: 1, Path: "a"}}
+	if err = underlying.AddNewTorrent([]byte{0}, nil, "Name", files, persistence.TorrentAttributes{}); err != nil {
+		t.Fatalf("AddNewTorrent: %s", err.Error())
+	}
+
+	database := &unavailableDatabase{Database: underlying, unavailable: true}
+	b := newBackfill(database, 1)
+	b.categoriesDone = true
+	for i := 0; i < 2; i++ {
+		b.step()
+		b.retryAt = time.Time{}
+	}
+	if b.releasesDone {
+		t.Fatal("Backfill is given up after an error")
+	}
+	if b.backoff != 2*minBackfillBackoff {
+		t.Errorf("Backoff is not doubled after each error: %s", b.backoff)
+	}
+
+	database.unavailable = false
+	b.step()
+	if b.step(); !b.releasesDone || b.backoff != 0 {
+		t.Errorf("Backfill does not resume once the database is available: %+v", b)
+	}
+}
@@ -0,0 +1,179 @@
+package metadata
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+// Although BEP 3 says that names and paths are UTF-8 encoded, many (older) clients use the
+// codepage of their system instead, and some state it in the `encoding` key.
+
+// charset is a legacy character encoding that is tried when the names or the paths of a torrent are
+// not valid UTF-8 and its `encoding` is unknown (or wrong).
+type charset struct {
+	name     string
+	encoding encoding.Encoding
+	// scripts are the scripts that the non-ASCII characters of a text in this charset are
+	// expected to be in.
+	scripts []*unicode.RangeTable
+}
+
+// charsets are in the order of preference, which matters when a text is just as plausible in more
+// than one of them.
+//
+// Hanja are rarely used in Korean today, so EUC-KR texts are expected to be in Hangul only, so that
+// the texts in GB2312 (a subset of GBK) are not mistaken for them and vice versa.
+var charsets = []charset{
+	{"shift_jis", japanese.ShiftJIS, []*unicode.RangeTable{unicode.Han, unicode.Hiragana, unicode.Katakana}},
+	{"euc-kr", korean.EUCKR, []*unicode.RangeTable{unicode.Hangul}},
+	{"gbk", simplifiedchinese.GBK, []*unicode.RangeTable{unicode.Han}},
+	{"big5", traditionalchinese.Big5, []*unicode.RangeTable{unicode.Han}},
+	{"windows-1251", charmap.Windows1251, []*unicode.RangeTable{unicode.Cyrillic}},
+	{"windows-1252", charmap.Windows1252, []*unicode.RangeTable{unicode.Latin}},
+}
+
+// minPlausibility is the minimum plausibility of a text for its charset to be detected.
+const minPlausibility = 0.5
+
+// decodeNames converts the name and the file paths of a torrent into UTF-8, if they are not
+// already. The charset is the one @declared by the torrent if it works, otherwise the most plausible
+// of the charsets above. The originals are kept in attrs and files, and if no charset works, the
+// invalid bytes are replaced and the torrent is flagged as undecodable.
+func decodeNames(name *string, files []persistence.File, declared string, attrs *persistence.TorrentAttributes) {
+	// All the invalid texts are decoded together using the same charset, since a name and the paths
+	// are (almost) always in the same charset, and more text makes a better guess.
+	var texts []string
+	if !utf8.ValidString(*name) {
+		texts = append(texts, *name)
+	}
+	for _, file := range files {
+		if !utf8.ValidString(file.Path) {
+			texts = append(texts, file.Path)
+		}
+	}
+	if len(texts) == 0 {
+		return
+	}
+
+	cs := detectCharset(strings.Join(texts, "/"), declared)
+	decode := func(s string) string {
+		if cs == nil {
+			return strings.ToValidUTF8(s, string(utf8.RuneError))
+		}
+		decoded, _ := cs.encoding.NewDecoder().String(s)
+		return decoded
+	}
+
+	if cs == nil {
+		attrs.Undecodable = true
+	} else {
+		attrs.Encoding = cs.name
+	}
+	if !utf8.ValidString(*name) {
+		attrs.OriginalName = []byte(*name)
+		*name = decode(*name)
+	}
+	for i := range files {
+		if !utf8.ValidString(files[i].Path) {
+			files[i].OriginalPath = []byte(files[i].Path)
+			files[i].Path = decode(files[i].Path)
+		}
+	}
+}
+
+// detectCharset returns the charset that @s is (most likely) in, or nil if it is not in any of the
+// charsets known.
+func detectCharset(s string, declared string) *charset {
+	if enc, err := htmlindex.Get(declared); err == nil {
+		if _, ok := decodeStrict(enc, s); ok {
+			name, _ := htmlindex.Name(enc)
+			return &charset{name: name, encoding: enc}
+		}
+	}
+
+	var best *charset
+	bestScore := minPlausibility
+	for i := range charsets {
+		decoded, ok := decodeStrict(charsets[i].encoding, s)
+		if !ok {
+			continue
+		}
+		if score := plausibility(decoded, &charsets[i]); score > bestScore {
+			best, bestScore = &charsets[i], score
+		}
+	}
+	return best
+}
+
+// decodeStrict decodes @s, and returns false if @s is not valid in @enc (i.e. if the decoder had to
+// replace any bytes) or contains control characters, which are as good as invalid in names.
+func decodeStrict(enc encoding.Encoding, s string) (string, bool) {
+	decoded, err := enc.NewDecoder().String(s)
+	if err != nil || strings.ContainsRune(decoded, utf8.RuneError) {
+		return "", false
+	}
+	for _, r := range decoded {
+		if unicode.IsControl(r) {
+			return "", false
+		}
+	}
+	return decoded, true
+}
+
+// plausibility returns the ratio of the non-ASCII characters of @s that are in the scripts expected
+// in @cs, minus the ratio of the ones that are mixed with ASCII letters in an unlikely way, such as
+//   * "Cafщ", which is "Café" in windows-1252 decoded as windows-1251 (i.e. cased non-Latin
+//     letters right next to ASCII letters),
+//   * "M鰐ley", which is "Mötley" in windows-1252 decoded as GBK (i.e. double-byte characters
+//     whose second byte is an ASCII letter, right after an ASCII letter).
+//
+// Characters that are common to all scripts (e.g. punctuation) are ignored.
+func plausibility(s string, cs *charset) float64 {
+	var nNonASCII, nExpected, nMixed int
+	prev := ' '
+	for _, r := range s {
+		if r >= utf8.RuneSelf && !unicode.In(r, unicode.Common, unicode.Inherited) {
+			nNonASCII++
+			// Half-width katakana are in the Katakana script, but are rarely used in names and
+			// mostly appear when other charsets are mistaken for Shift_JIS.
+			if unicode.In(r, cs.scripts...) && !(r >= 0xFF61 && r <= 0xFF9F) {
+				nExpected++
+			}
+			if isASCIILetter(prev) && (isCasedNonLatin(r) || hasASCIILetterTrail(cs.encoding, r)) {
+				nMixed++
+			}
+		} else if isASCIILetter(r) && isCasedNonLatin(prev) {
+			nMixed++
+		}
+		prev = r
+	}
+
+	if nNonASCII == 0 {
+		return 1
+	}
+	return float64(nExpected-nMixed) / float64(nNonASCII)
+}
+
+func isASCIILetter(r rune) bool {
+	return r < utf8.RuneSelf && unicode.IsLetter(r)
+}
+
+func isCasedNonLatin(r rune) bool {
+	return (unicode.IsUpper(r) || unicode.IsLower(r)) && !unicode.Is(unicode.Latin, r)
+}
+
+func hasASCIILetterTrail(enc encoding.Encoding, r rune) bool {
+	encoded, err := enc.NewEncoder().String(string(r))
+	return err == nil && len(encoded) == 2 && isASCIILetter(rune(encoded[1]))
+}
@@ -0,0 +1,78 @@
+package metadata
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+var charsetTests = []struct {
+	encoding encoding.Encoding
+	text     string
+	expected string
+}{
+	{japanese.ShiftJIS, "ソードアート・オンライン 第01話", "shift_jis"},
+	{japanese.ShiftJIS, "東京喰種 トーキョーグール", "shift_jis"},
+	{korean.EUCKR, "기생충 2019 한국어", "euc-kr"},
+	{simplifiedchinese.GBK, "让子弹飞 高清版", "gbk"},
+	{simplifiedchinese.GBK, "流浪地球.2019.BD1080P.国语中字", "gbk"},
+	{traditionalchinese.Big5, "臥虎藏龍 繁體中文字幕", "big5"},
+	{charmap.Windows1251, "Война и мир (1966) Бондарчук", "windows-1251"},
+	{charmap.Windows1252, "Café de Flore - Amélie Poulain", "windows-1252"},
+	{charmap.Windows1252, "Mötley Crüe - Dr. Feelgood", "windows-1252"},
+}
+
+func TestDetectCharset(t *testing.T) {
+	for _, test := range charsetTests {
+		encoded, err := test.encoding.NewEncoder().String(test.text)
+		if err != nil {
+			t.Fatalf("Couldn't encode `%s`! %s", test.text, err.Error())
+		}
+
+		cs := detectCharset(encoded, "")
+		if cs == nil {
+			t.Errorf("No charset detected for `%s`", test.text)
+		} else if cs.name != test.expected {
+			t.Errorf("Expected %s for `%s`, got %s", test.expected, test.text, cs.name)
+		}
+	}
+}
+
+func TestDecodeNames(t *testing.T) {
+	encoded, _ := charmap.ISO8859_7.NewEncoder().String("Καλημέρα")
+	name := encoded
+	files := []persistence.File{{Size: 1, Path: encoded + "/a.txt"}, {Size: 1, Path: "b.txt"}}
+	var attrs persistence.TorrentAttributes
+
+	// Greek is not among the charsets that are tried, but it is declared.
+	decodeNames(&name, files, "iso-8859-7", &attrs)
+
+	if name != "Καλημέρα" || files[0].Path != "Καλημέρα/a.txt" || files[1].Path != "b.txt" {
+		t.Errorf("Unexpected name & paths: %s, %v", name, files)
+	}
+	if attrs.Encoding != "iso-8859-7" || attrs.Undecodable {
+		t.Errorf("Unexpected attributes: %+v", attrs)
+	}
+	if !bytes.Equal(attrs.OriginalName, []byte(encoded)) || files[1].OriginalPath != nil {
+		t.Errorf("Unexpected originals: %v, %v", attrs.OriginalName, files)
+	}
+}
+
+func TestDecodeNamesUndecodable(t *testing.T) {
+	name := "a\x81b\x8d"
+	var attrs persistence.TorrentAttributes
+
+	decodeNames(&name, nil, "", &attrs)
+
+	if name != "a�b�" || !attrs.Undecodable || attrs.Encoding != "" {
+		t.Errorf("Unexpected name & attributes: %s, %+v", name, attrs)
+	}
+}
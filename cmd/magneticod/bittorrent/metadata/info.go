@@ -0,0 +1,95 @@
+package metadata
+
+import (
+	"strings"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"go.uber.org/zap"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+// infoExt is the subset of the info dictionary that metainfo.Info lacks.
+type infoExt struct {
+	// See http://bittorrent.org/beps/bep_0047.html
+	Attr string `bencode:"attr"` // single-file torrents
+	// name.utf-8 and path.utf-8 are not in any BEP, but are set by many clients when the original
+	// fields are in a different encoding.
+	NameUTF8 string    `bencode:"name.utf-8"`
+	Files    []fileExt `bencode:"files"`
+	// Encoding is usually a key of the metainfo rather than of the info dictionary, but some
+	// clients put it in the latter too.
+	Encoding string `bencode:"encoding"`
+}
+
+type fileExt struct {
+	Length   int64    `bencode:"length"`
+	Path     []string `bencode:"path"`
+	PathUTF8 []string `bencode:"path.utf-8"`
+	Attr     string   `bencode:"attr"`
+}
+
+// newInfoExt parses the fields of the info dictionary that metainfo.Info lacks. Since these fields
+// are optional, it falls back to metainfo.Info if any of them is malformed, rather than discarding
+// the whole torrent.
+func newInfoExt(metadata []byte, info *metainfo.Info) *infoExt {
+	ext := new(infoExt)
+	err := bencode.Unmarshal(metadata, ext)
+	if err == nil {
+		return ext
+	}
+
+	zap.L().Debug("Ignoring the extended fields of the info dictionary", zap.Error(err))
+	ext = new(infoExt)
+	for _, file := range info.Files {
+		ext.Files = append(ext.Files, fileExt{
+			Length: file.Length,
+			Path:   file.Path,
+		})
+	}
+	return ext
+}
+
+// name returns the name of the torrent, preferring its UTF-8 variant if there is any.
+func (ext *infoExt) name(info *metainfo.Info) string {
+	if ext.NameUTF8 != "" {
+		return ext.NameUTF8
+	}
+	return info.Name
+}
+
+// files returns the files of a v1 torrent, including its padding files (if any).
+func (ext *infoExt) files(info *metainfo.Info) []persistence.File {
+	// If there is only one file, there won't be a Files slice. That's why we need to add it here
+	if len(ext.Files) == 0 {
+		return []persistence.File{{
+			Size:       info.Length,
+			Path:       ext.name(info),
+			Attributes: ext.Attr,
+		}}
+	}
+
+	files := make([]persistence.File, 0, len(ext.Files))
+	for _, file := range ext.Files {
+		path := file.Path
+		if len(file.PathUTF8) > 0 {
+			path = file.PathUTF8
+		}
+		files = append(files, persistence.File{
+			Size:       file.Length,
+			Path:       strings.Join(path, "/"),
+			Attributes: file.Attr,
+		})
+	}
+	return files
+}
+
+// attributes returns the attributes of the torrent that are persisted alongside its name & files.
+func attributes(info *metainfo.Info) persistence.TorrentAttributes {
+	return persistence.TorrentAttributes{
+		PieceLength: info.PieceLength,
+		Private:     info.Private != nil && *info.Private,
+		Source:      info.Source,
+	}
+}
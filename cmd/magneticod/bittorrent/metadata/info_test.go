@@ -0,0 +1,79 @@
+package metadata
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+func TestInfoExt(t *testing.T) {
+	metadata, err := bencode.Marshal(map[string]interface{}{
+		"name":         "\xe7\xe9",
+		"name.utf-8":   "çé",
+		"piece length": 16 * 1024,
+		"pieces":       string(make([]byte, 40)),
+		"private":      1,
+		"source":       "src",
+		"files": []interface{}{
+			map[string]interface{}{"length": 200, "path": []string{"\xe7.txt"}, "path.utf-8": []string{"ç.txt"}, "attr": "x"},
+			map[string]interface{}{"length": 16*1024 - 200, "path": []string{".pad", "16184"}, "attr": "p"},
+			map[string]interface{}{"length": 100, "path": []string{"b.txt"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't marshal info! %s", err.Error())
+	}
+
+	info := new(metainfo.Info)
+	if err = bencode.Unmarshal(metadata, info); err != nil {
+		t.Fatalf("Couldn't unmarshal info! %s", err.Error())
+	}
+	ext := newInfoExt(metadata, info)
+
+	if name := ext.name(info); name != "çé" {
+		t.Errorf("Unexpected name %s", name)
+	}
+
+	expectedFiles := []persistence.File{
+		{Size: 200, Path: "ç.txt", Attributes: "x"},
+		{Size: 16*1024 - 200, Path: ".pad/16184", Attributes: "p"},
+		{Size: 100, Path: "b.txt"},
+	}
+	if files := ext.files(info); !reflect.DeepEqual(files, expectedFiles) {
+		t.Errorf("Unexpected files %v", files)
+	}
+
+	expectedAttributes := persistence.TorrentAttributes{PieceLength: 16 * 1024, Private: true, Source: "src"}
+	if attrs := attributes(info); !reflect.DeepEqual(attrs, expectedAttributes) {
+		t.Errorf("Unexpected attributes %v", attrs)
+	}
+}
+
+func TestInfoExtMalformed(t *testing.T) {
+	metadata, err := bencode.Marshal(map[string]interface{}{
+		"name":         "test",
+		"piece length": 16 * 1024,
+		"pieces":       string(make([]byte, 20)),
+		"files": []interface{}{
+			map[string]interface{}{"length": 100, "path": []string{"a.txt"}, "attr": 1},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't marshal info! %s", err.Error())
+	}
+
+	info := new(metainfo.Info)
+	if err = bencode.Unmarshal(metadata, info); err != nil {
+		t.Fatalf("Couldn't unmarshal info! %s", err.Error())
+	}
+
+	// Malformed extended fields are ignored altogether.
+	expectedFiles := []persistence.File{{Size: 100, Path: "a.txt"}}
+	if files := newInfoExt(metadata, info).files(info); !reflect.DeepEqual(files, expectedFiles) {
+		t.Errorf("Unexpected files %v", files)
+	}
+}
@@ -2,12 +2,12 @@ package metadata
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"math"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/anacrolix/torrent/bencode"
@@ -16,11 +16,20 @@ import (
 
 	"go.uber.org/zap"
 
+	"github.com/boramalper/magnetico/cmd/magneticod/dht/mainline"
 	"github.com/boramalper/magnetico/pkg/persistence"
+	"github.com/boramalper/magnetico/pkg/util"
 )
 
 const MAX_METADATA_SIZE = 10 * 1024 * 1024
 
+// Extension Message IDs we advertise in our extension handshake, hence the IDs that the remote peer
+// uses while sending us the messages of these extensions.
+const (
+	utMetadataID = 1
+	utPexID      = 2
+)
+
 type rootDict struct {
 	M            mDict `bencode:"m"`
 	MetadataSize int   `bencode:"metadata_size"`
@@ -35,31 +44,55 @@ type extDict struct {
 	Piece   int `bencode:"piece"`
 }
 
-type Leech struct {
-	infoHash [20]byte
-	peerAddr *net.TCPAddr
-	ev       LeechEventHandlers
+// pexDict is the payload of a ut_pex message (BEP 11). We are interested only in the IPv4 peers that
+// are added.
+type pexDict struct {
+	Added mainline.CompactPeers `bencode:"added"`
+}
 
-	conn     *net.TCPConn
+type Leech struct {
+	infoHash   [20]byte
+	peerAddr   *net.TCPAddr
+	ev         LeechEventHandlers
+	dialer     *Dialer
+	encryption EncryptionPolicy
+
+	// conn is either a TCP or a uTP connection.
+	conn net.Conn
+	// rw is either conn itself, or the encrypted stream on top of it if MSE is used.
+	rw       io.ReadWriter
 	clientID [20]byte
 
 	ut_metadata                    uint8
 	metadataReceived, metadataSize uint
 	metadata                       []byte
 
+	// readmeMaxSize is the maximum size of the readme to be fetched after the metadata, if non-zero.
+	readmeMaxSize int64
+	// bitfield is the set of the pieces that the remote peer has.
+	bitfield []byte
+
 	connClosed bool
+
+	cancelled bool
+	cancelMx  sync.Mutex
 }
 
 type LeechEventHandlers struct {
 	OnSuccess func(Metadata)        // must be supplied. args: metadata
 	OnError   func([20]byte, error) // must be supplied. args: infohash, error
+	// OnPeers is called whenever the remote peer tells us about other peers of the torrent through
+	// Peer Exchange. Might be nil. args: infohash, peer addresses
+	OnPeers func([20]byte, []net.TCPAddr)
 }
 
-func NewLeech(infoHash [20]byte, peerAddr *net.TCPAddr, clientID []byte, ev LeechEventHandlers) *Leech {
+func NewLeech(infoHash [20]byte, peerAddr *net.TCPAddr, clientID []byte, dialer *Dialer, encryption EncryptionPolicy, ev LeechEventHandlers) *Leech {
 	l := new(Leech)
 	l.infoHash = infoHash
 	l.peerAddr = peerAddr
 	copy(l.clientID[:], clientID)
+	l.dialer = dialer
+	l.encryption = encryption
 	l.ev = ev
 
 	return l
@@ -67,7 +100,7 @@ func NewLeech(infoHash [20]byte, peerAddr *net.TCPAddr, clientID []byte, ev Leec
 
 func (l *Leech) writeAll(b []byte) error {
 	for len(b) != 0 {
-		n, err := l.conn.Write(b)
+		n, err := l.rw.Write(b)
 		if err != nil {
 			return err
 		}
@@ -111,7 +144,12 @@ func (l *Leech) doBtHandshake() error {
 }
 
 func (l *Leech) doExHandshake() error {
-	err := l.writeAll([]byte("\x00\x00\x00\x1a\x14\x00d1:md11:ut_metadatai1eee"))
+	lExHandshake := fmt.Sprintf("d1:md11:ut_metadatai%de6:ut_pexi%deee", utMetadataID, utPexID)
+	err := l.writeAll([]byte(fmt.Sprintf(
+		"%s\x14\x00%s",
+		toBigEndian(uint(2+len(lExHandshake)), 4),
+		lExHandshake,
+	)))
 	if err != nil {
 		return errors.Wrap(err, "writeAll lHandshake")
 	}
@@ -202,7 +240,8 @@ func (l *Leech) readMessage() ([]byte, error) {
 
 // readExMessage returns an *extension* message, sans the first 4 bytes indicating its length.
 //
-// It will IGNORE all non-extension messages!
+// It will IGNORE all non-extension messages, except the ones telling which pieces the remote peer
+// has which are recorded in the meantime.
 func (l *Leech) readExMessage() ([]byte, error) {
 	for {
 		rMessage, err := l.readMessage()
@@ -216,8 +255,12 @@ func (l *Leech) readExMessage() ([]byte, error) {
 		}
 
 		// We are interested only in extension messages, whose first byte is always 20
-		if rMessage[0] == 20 {
+		switch rMessage[0] {
+		case 20:
 			return rMessage, nil
+
+		case msgHave, msgBitfield:
+			l.onHave(rMessage)
 		}
 	}
 }
@@ -225,7 +268,8 @@ func (l *Leech) readExMessage() ([]byte, error) {
 // readUmMessage returns an ut_metadata extension message, sans the first 4 bytes indicating its
 // length.
 //
-// It will IGNORE all non-"ut_metadata extension" messages!
+// It will IGNORE all non-"ut_metadata extension" messages, except ut_pex messages which are
+// processed in the meantime.
 func (l *Leech) readUmMessage() ([]byte, error) {
 	for {
 		rExMessage, err := l.readExMessage()
@@ -233,37 +277,80 @@ func (l *Leech) readUmMessage() ([]byte, error) {
 			return nil, errors.Wrap(err, "readExMessage")
 		}
 
-		if rExMessage[1] == 0x01 {
+		switch rExMessage[1] {
+		case utMetadataID:
 			return rExMessage, nil
+
+		case utPexID:
+			l.onPexMessage(rExMessage[2:])
+		}
+	}
+}
+
+func (l *Leech) onPexMessage(payload []byte) {
+	if l.ev.OnPeers == nil {
+		return
+	}
+
+	rPexDict := new(pexDict)
+	if err := bencode.Unmarshal(payload, rPexDict); err != nil {
+		// Not fatal; metadata can still be fetched from this peer.
+		zap.L().Debug("could not unmarshal ut_pex message", zap.Error(err))
+		return
+	}
+
+	peerAddrs := make([]net.TCPAddr, 0, len(rPexDict.Added))
+	for _, peer := range rPexDict.Added {
+		if peer.Port == 0 {
+			continue
 		}
+		peerAddrs = append(peerAddrs, net.TCPAddr{IP: peer.IP, Port: peer.Port})
+	}
+
+	if len(peerAddrs) > 0 {
+		l.ev.OnPeers(l.infoHash, peerAddrs)
 	}
 }
 
 func (l *Leech) connect(deadline time.Time) error {
 	var err error
 
-	x, err := net.DialTimeout("tcp4", l.peerAddr.String(), 1*time.Second)
+	x, err := l.dialer.Dial(l.peerAddr)
 	if err != nil {
 		return errors.Wrap(err, "dial")
 	}
-	l.conn = x.(*net.TCPConn)
 
-	// > If sec == 0, operating system discards any unsent or unacknowledged data [after Close()
-	// > has been called].
-	err = l.conn.SetLinger(0)
-	if err != nil {
+	// Cancel() might be called concurrently, which sets the deadline of the connection if there is
+	// one already.
+	l.cancelMx.Lock()
+	defer l.cancelMx.Unlock()
+	l.conn = x
+	l.rw = l.conn
+	if l.cancelled {
 		if err := l.conn.Close(); err != nil {
 			zap.L().Panic("couldn't close leech connection!", zap.Error(err))
 		}
-		return errors.Wrap(err, "SetLinger")
+		return fmt.Errorf("leech cancelled")
 	}
 
-	err = l.conn.SetNoDelay(true)
-	if err != nil {
-		if err := l.conn.Close(); err != nil {
-			zap.L().Panic("couldn't close leech connection!", zap.Error(err))
+	if tcpConn, ok := l.conn.(*net.TCPConn); ok {
+		// > If sec == 0, operating system discards any unsent or unacknowledged data [after Close()
+		// > has been called].
+		err = tcpConn.SetLinger(0)
+		if err != nil {
+			if err := l.conn.Close(); err != nil {
+				zap.L().Panic("couldn't close leech connection!", zap.Error(err))
+			}
+			return errors.Wrap(err, "SetLinger")
+		}
+
+		err = tcpConn.SetNoDelay(true)
+		if err != nil {
+			if err := l.conn.Close(); err != nil {
+				zap.L().Panic("couldn't close leech connection!", zap.Error(err))
+			}
+			return errors.Wrap(err, "NODELAY")
 		}
-		return errors.Wrap(err, "NODELAY")
 	}
 
 	err = l.conn.SetDeadline(deadline)
@@ -274,9 +361,23 @@ func (l *Leech) connect(deadline time.Time) error {
 		return errors.Wrap(err, "SetDeadline")
 	}
 
+	l.connClosed = false
 	return nil
 }
 
+// Cancel aborts the leech as soon as possible, in which case OnError is called (unless the leech
+// has already completed). It is safe to call Cancel concurrently with Do.
+func (l *Leech) Cancel() {
+	l.cancelMx.Lock()
+	defer l.cancelMx.Unlock()
+
+	l.cancelled = true
+	if l.conn != nil {
+		// Setting a deadline in the past makes all pending and future I/O fail immediately.
+		_ = l.conn.SetDeadline(time.Now())
+	}
+}
+
 func (l *Leech) closeConn() {
 	if l.connClosed {
 		return
@@ -298,6 +399,24 @@ func (l *Leech) Do(deadline time.Time) {
 	}
 	defer l.closeConn()
 
+	if l.encryption != EncryptionDisable {
+		err = l.doMseHandshake()
+		if err != nil && l.encryption == EncryptionRequire {
+			l.OnError(errors.Wrap(err, "doMseHandshake"))
+			return
+		} else if err != nil {
+			// Peers that do not support MSE drop the connection as soon as they receive garbage
+			// instead of a BitTorrent handshake, so we need to reconnect to fall back to
+			// plaintext.
+			zap.L().Debug("MSE handshake failed, falling back to plaintext", zap.Error(err))
+			l.closeConn()
+			if err = l.connect(deadline); err != nil {
+				l.OnError(errors.Wrap(err, "connect (plaintext fallback)"))
+				return
+			}
+		}
+	}
+
 	err = l.doBtHandshake()
 	if err != nil {
 		l.OnError(errors.Wrap(err, "doBtHandshake"))
@@ -372,13 +491,15 @@ func (l *Leech) Do(deadline time.Time) {
 	}
 
 	// We are done with the transfer, close socket as soon as possible (i.e. NOW) to avoid hitting "too many open files"
-	// error.
-	l.closeConn()
+	// error, unless we are going to fetch the readme too.
+	if l.readmeMaxSize == 0 {
+		l.closeConn()
+	}
 
 	// Verify the checksum
-	sha1Sum := sha1.Sum(l.metadata)
-	if !bytes.Equal(sha1Sum[:], l.infoHash[:]) {
-		l.OnError(fmt.Errorf("infohash mismatch"))
+	infoHash, infoHashV2, infoV2, err := verifyInfoHashes(l.metadata, l.infoHash)
+	if err != nil {
+		l.OnError(errors.Wrap(err, "verifyInfoHashes"))
 		return
 	}
 
@@ -389,28 +510,40 @@ func (l *Leech) Do(deadline time.Time) {
 		l.OnError(errors.Wrap(err, "unmarshal info"))
 		return
 	}
-	err = validateInfo(info)
-	if err != nil {
-		l.OnError(errors.Wrap(err, "validateInfo"))
-		return
-	}
+	ext := newInfoExt(l.metadata, info)
 
 	var files []persistence.File
-	// If there is only one file, there won't be a Files slice. That's why we need to add it here
-	if len(info.Files) == 0 {
-		files = append(files, persistence.File{
-			Size: info.Length,
-			Path: info.Name,
-		})
-	} else {
-		for _, file := range info.Files {
-			files = append(files, persistence.File{
-				Size: file.Length,
-				Path: file.DisplayPath(info),
-			})
+	if infoV2 != nil { // v2 and hybrid torrents
+		if err = validateInfoV2(infoV2); err != nil {
+			l.OnError(errors.Wrap(err, "validateInfoV2"))
+			return
 		}
+		// Hybrid torrents are validated as v1 torrents too, but their files are read from the file
+		// tree since it does not contain any padding files.
+		if len(infoV2.Pieces) > 0 {
+			if err = validateInfo(info); err != nil {
+				l.OnError(errors.Wrap(err, "validateInfo"))
+				return
+			}
+		}
+		files, err = parseFileTree(infoV2.FileTree, nil)
+		if err != nil {
+			l.OnError(errors.Wrap(err, "parseFileTree"))
+			return
+		}
+	} else { // v1 torrents
+		err = validateInfo(info)
+		if err != nil {
+			l.OnError(errors.Wrap(err, "validateInfo"))
+			return
+		}
+
+		files = ext.files(info)
 	}
 
+	name, attrs := ext.name(info), attributes(info)
+	decodeNames(&name, files, ext.Encoding, &attrs)
+
 	var totalSize uint64
 	for _, file := range files {
 		if file.Size < 0 {
@@ -418,15 +551,36 @@ func (l *Leech) Do(deadline time.Time) {
 			return
 		}
 
-		totalSize += uint64(file.Size)
+		if !file.IsPadding() {
+			totalSize += uint64(file.Size)
+		}
+	}
+
+	var readme *persistence.Readme
+	if l.readmeMaxSize > 0 && len(info.Pieces) > 0 {
+		// The files of hybrid torrents are read from the file tree, which lacks the padding files
+		// that the v1 pieces are laid out with.
+		v1Files := files
+		if infoV2 != nil {
+			v1Files = ext.files(info)
+		}
+		readme, err = l.fetchReadme(info, v1Files)
+		if err != nil {
+			zap.L().Debug("Could not fetch readme", util.HexField("infoHash", l.infoHash[:]), zap.Error(err))
+		}
+		l.closeConn()
 	}
 
 	l.ev.OnSuccess(Metadata{
-		InfoHash:     l.infoHash[:],
-		Name:         info.Name,
-		TotalSize:    totalSize,
-		DiscoveredOn: time.Now().Unix(),
-		Files:        files,
+		InfoHash:          infoHash,
+		InfoHashV2:        infoHashV2,
+		Name:              name,
+		TotalSize:         totalSize,
+		DiscoveredOn:      time.Now().Unix(),
+		Files:             files,
+		TorrentAttributes: attrs,
+		Info:              l.metadata,
+		Readme:            readme,
 	})
 }
 
@@ -449,7 +603,7 @@ func validateInfo(info *metainfo.Info) error {
 
 func (l *Leech) readExactly(n uint) ([]byte, error) {
 	b := make([]byte, n)
-	_, err := io.ReadFull(l.conn, b)
+	_, err := io.ReadFull(l.rw, b)
 	return b, err
 }
 
@@ -0,0 +1,62 @@
+package metadata
+
+import (
+	"fmt"
+
+	"github.com/anacrolix/torrent/mse"
+	"github.com/pkg/errors"
+)
+
+// EncryptionPolicy determines whether leeches use BitTorrent Message Stream Encryption (MSE, also
+// known as Protocol Encryption or PE) while talking to the peers.
+//
+// See http://wiki.vuze.com/w/Message_Stream_Encryption
+type EncryptionPolicy uint8
+
+const (
+	// EncryptionPrefer tries MSE first, and falls back to plaintext if the peer does not
+	// support it.
+	EncryptionPrefer EncryptionPolicy = iota
+	// EncryptionRequire refuses to talk to the peers that do not support MSE with RC4.
+	EncryptionRequire
+	// EncryptionDisable never uses MSE, i.e. speaks the plaintext BitTorrent protocol only.
+	EncryptionDisable
+)
+
+func ParseEncryptionPolicy(s string) (EncryptionPolicy, error) {
+	switch s {
+	case "prefer":
+		return EncryptionPrefer, nil
+
+	case "require":
+		return EncryptionRequire, nil
+
+	case "disable":
+		return EncryptionDisable, nil
+
+	default:
+		return EncryptionPrefer, fmt.Errorf("unknown encryption policy: %s", s)
+	}
+}
+
+// doMseHandshake negotiates MSE with the peer, and makes the rest of the communication go through
+// the (possibly) encrypted stream.
+//
+// The infohash of the torrent is used as the shared secret (SKEY), as the spec says.
+func (l *Leech) doMseHandshake() error {
+	cryptoProvides := mse.AllSupportedCrypto
+	if l.encryption == EncryptionRequire {
+		cryptoProvides = mse.CryptoMethodRC4
+	}
+
+	rw, method, err := mse.InitiateHandshake(l.conn, l.infoHash[:], nil, cryptoProvides)
+	if err != nil {
+		return errors.Wrap(err, "InitiateHandshake")
+	}
+	if method&cryptoProvides == 0 {
+		return fmt.Errorf("peer selected an unprovided crypto method: %d", method)
+	}
+
+	l.rw = rw
+	return nil
+}
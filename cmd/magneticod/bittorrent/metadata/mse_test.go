@@ -0,0 +1,42 @@
+package metadata
+
+import (
+	"crypto/sha1"
+	"testing"
+	"time"
+)
+
+var mseTest_instances = []struct {
+	peerMode   testPeerMode
+	encryption EncryptionPolicy
+	success    bool
+}{
+	{testPeerEncrypted, EncryptionRequire, true},
+	{testPeerEncrypted, EncryptionPrefer, true},
+	{testPeerEncrypted, EncryptionDisable, false},
+	{testPeerPlaintext, EncryptionRequire, false},
+	{testPeerPlaintext, EncryptionPrefer, true},
+	{testPeerPlaintext, EncryptionDisable, true},
+}
+
+func TestLeechEncryption(t *testing.T) {
+	metadata := testMetadata(t)
+	dialer := testDialer(t, TransportTCP)
+	defer dialer.Close()
+
+	for i, instance := range mseTest_instances {
+		peer := newTestPeer(t, metadata, instance.peerMode)
+		peerAddr := peer.addr()
+
+		succeeded := make(chan bool, 1)
+		NewLeech(sha1.Sum(metadata), &peerAddr, randomID(), dialer, instance.encryption, LeechEventHandlers{
+			OnSuccess: func(Metadata) { succeeded <- true },
+			OnError:   func([20]byte, error) { succeeded <- false },
+		}).Do(time.Now().Add(5 * time.Second))
+		peer.close()
+
+		if success := <-succeeded; success != instance.success {
+			t.Errorf("Instance #%d: leech success is %t, expected %t", i+1, success, instance.success)
+		}
+	}
+}
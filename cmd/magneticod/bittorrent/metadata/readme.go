@@ -0,0 +1,261 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/pkg/errors"
+	"golang.org/x/text/encoding/charmap"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+// Readmes (and .nfo files) are fetched from the same peer right after the metadata, by downloading
+// the pieces they are in just like any other BitTorrent client would. Since pieces must be
+// downloaded as a whole to be verified, a readme is fetched only if the pieces it spans are small
+// enough, and only from the peers that announce to have all of them.
+//
+// Only v1 pieces are supported (i.e. v1 and hybrid torrents), since the piece hashes of v2 torrents
+// are not in their info dictionaries.
+
+// BitTorrent message IDs (BEP 3) besides the extension messages (BEP 10).
+const (
+	msgChoke      = 0
+	msgUnchoke    = 1
+	msgInterested = 2
+	msgHave       = 4
+	msgBitfield   = 5
+	msgRequest    = 6
+	msgPiece      = 7
+)
+
+// blockSize is the size of the blocks pieces are requested in, which is the maximum most clients
+// allow.
+const blockSize = 16 * 1024
+
+// maxReadmePiecesSize caps the total size of the pieces downloaded to fetch a readme, so that all of
+// its blocks can be requested at once without exceeding the request queues of the peers.
+const maxReadmePiecesSize = 2 * 1024 * 1024
+
+// readmeTimeout is the time allowed to fetch a readme after the metadata is fetched.
+const readmeTimeout = 10 * time.Second
+
+// readmeFile is a readme of a torrent, and where it lies in the torrent.
+type readmeFile struct {
+	path   string
+	offset int64
+	length int64
+}
+
+// isReadme returns whether the file is a readme or an .nfo file, judged by its name.
+func isReadme(path string) bool {
+	name := strings.ToLower(path[strings.LastIndex(path, "/")+1:])
+	return strings.HasSuffix(name, ".nfo") || strings.HasPrefix(name, "readme")
+}
+
+// findReadme returns the first readme of at most @maxSize bytes among the v1 files of a torrent
+// (i.e. in the order they are laid out in the pieces, padding files included), or nil if there is
+// none.
+func findReadme(files []persistence.File, maxSize int64) *readmeFile {
+	var offset int64
+	for _, file := range files {
+		if !file.IsPadding() && 0 < file.Size && file.Size <= maxSize && isReadme(file.Path) {
+			return &readmeFile{path: file.Path, offset: offset, length: file.Size}
+		}
+		offset += file.Size
+	}
+	return nil
+}
+
+// decodeReadme converts the content of a readme into UTF-8. .nfo files are traditionally in CP437
+// (for the sake of their ASCII art) and padded with NUL characters, which are removed since they
+// cannot be stored in text columns by some database engines anyway.
+func decodeReadme(path string, content []byte) string {
+	if strings.HasSuffix(strings.ToLower(path), ".nfo") {
+		// CP437 maps all the 256 bytes, hence decoding never fails.
+		content, _ = charmap.CodePage437.NewDecoder().Bytes(content)
+	}
+	return strings.Replace(strings.ToValidUTF8(string(content), string(utf8.RuneError)), "\x00", "", -1)
+}
+
+// fetchReadme fetches the first readme of the torrent from the peer, if there is any and the peer
+// has it. Since readmes are nice to have, errors are only logged by the caller and the metadata is
+// delivered regardless.
+func (l *Leech) fetchReadme(info *metainfo.Info, files []persistence.File) (*persistence.Readme, error) {
+	readme := findReadme(files, l.readmeMaxSize)
+	if readme == nil {
+		return nil, nil
+	}
+
+	first := int(readme.offset / info.PieceLength)
+	last := int((readme.offset + readme.length - 1) / info.PieceLength)
+	if int64(last-first+1)*info.PieceLength > maxReadmePiecesSize {
+		return nil, fmt.Errorf("pieces of the readme are too big")
+	}
+	for i := first; i <= last; i++ {
+		if !l.hasPiece(i) {
+			return nil, fmt.Errorf("peer does not have the readme")
+		}
+	}
+
+	// Cancel() might be called concurrently, whose deadline must not be overridden.
+	l.cancelMx.Lock()
+	if l.cancelled {
+		l.cancelMx.Unlock()
+		return nil, fmt.Errorf("leech cancelled")
+	}
+	err := l.conn.SetDeadline(time.Now().Add(readmeTimeout))
+	l.cancelMx.Unlock()
+	if err != nil {
+		return nil, errors.Wrap(err, "SetDeadline")
+	}
+
+	pieces, err := l.downloadPieces(info, first, last)
+	if err != nil {
+		return nil, errors.Wrap(err, "downloadPieces")
+	}
+
+	start := readme.offset - int64(first)*info.PieceLength
+	return &persistence.Readme{
+		Path:    readme.path,
+		Content: decodeReadme(readme.path, pieces[start:start+readme.length]),
+	}, nil
+}
+
+// downloadPieces downloads the pieces from @first to @last (inclusive) and verifies them, and
+// returns them concatenated.
+func (l *Leech) downloadPieces(info *metainfo.Info, first int, last int) ([]byte, error) {
+	if err := l.writeMessage(msgInterested, nil); err != nil {
+		return nil, errors.Wrap(err, "writeMessage interested")
+	}
+
+	// Requests sent while choked are discarded by the peers, hence we wait until we are unchoked.
+	for unchoked := false; !unchoked; {
+		rMessage, err := l.readMessage()
+		if err != nil {
+			return nil, errors.Wrap(err, "readMessage")
+		}
+		if len(rMessage) > 0 && rMessage[0] == msgUnchoke {
+			unchoked = true
+		}
+	}
+
+	start := int64(first) * info.PieceLength
+	end := int64(last+1) * info.PieceLength
+	if totalLength := info.TotalLength(); end > totalLength {
+		end = totalLength
+	}
+	buf := make([]byte, end-start)
+
+	nBlocks := (len(buf) + blockSize - 1) / blockSize
+	for block := 0; block < nBlocks; block++ {
+		offset := start + int64(block*blockSize)
+		length := blockSize
+		if block == nBlocks-1 {
+			length = len(buf) - block*blockSize
+		}
+
+		request := make([]byte, 12)
+		binary.BigEndian.PutUint32(request[0:], uint32(offset/info.PieceLength))
+		binary.BigEndian.PutUint32(request[4:], uint32(offset%info.PieceLength))
+		binary.BigEndian.PutUint32(request[8:], uint32(length))
+		if err := l.writeMessage(msgRequest, request); err != nil {
+			return nil, errors.Wrap(err, "writeMessage request")
+		}
+	}
+
+	received := make([]bool, nBlocks)
+	for nReceived := 0; nReceived < nBlocks; {
+		rMessage, err := l.readMessage()
+		if err != nil {
+			return nil, errors.Wrap(err, "readMessage")
+		}
+		if len(rMessage) == 0 {
+			continue // keep-alive
+		}
+
+		switch rMessage[0] {
+		case msgChoke:
+			return nil, fmt.Errorf("peer choked us")
+
+		case msgPiece:
+			if len(rMessage) < 9 {
+				return nil, fmt.Errorf("piece message is too short")
+			}
+			index := int64(binary.BigEndian.Uint32(rMessage[1:]))
+			begin := int64(binary.BigEndian.Uint32(rMessage[5:]))
+			data := rMessage[9:]
+
+			offset := index*info.PieceLength + begin - start
+			block := int(offset / blockSize)
+			if begin >= info.PieceLength || offset < 0 || offset%blockSize != 0 || block >= nBlocks ||
+				offset+int64(len(data)) != int64(min(len(buf), (block+1)*blockSize)) {
+				return nil, fmt.Errorf("unrequested block received")
+			}
+			if !received[block] {
+				copy(buf[offset:], data)
+				received[block] = true
+				nReceived++
+			}
+		}
+	}
+
+	for i := first; i <= last; i++ {
+		pieceStart := int64(i-first) * info.PieceLength
+		pieceEnd := pieceStart + info.PieceLength
+		if pieceEnd > int64(len(buf)) {
+			pieceEnd = int64(len(buf))
+		}
+		sum := sha1.Sum(buf[pieceStart:pieceEnd])
+		if !bytes.Equal(sum[:], info.Piece(i).Hash().Bytes()) {
+			return nil, fmt.Errorf("piece %d is corrupt", i)
+		}
+	}
+
+	return buf, nil
+}
+
+// onHave records the pieces that the peer has as told by the bitfield and the have messages it
+// sends.
+func (l *Leech) onHave(rMessage []byte) {
+	switch rMessage[0] {
+	case msgBitfield:
+		l.bitfield = append([]byte(nil), rMessage[1:]...)
+
+	case msgHave:
+		if len(rMessage) != 5 {
+			return
+		}
+		index := int(binary.BigEndian.Uint32(rMessage[1:]))
+		// Bitfields are not that large since the metadata is limited in size, and so is the number
+		// of pieces.
+		if index >= MAX_METADATA_SIZE/20 {
+			return
+		}
+		if n := index/8 + 1; len(l.bitfield) < n {
+			l.bitfield = append(l.bitfield, make([]byte, n-len(l.bitfield))...)
+		}
+		l.bitfield[index/8] |= 0x80 >> uint(index%8)
+	}
+}
+
+func (l *Leech) hasPiece(index int) bool {
+	return index/8 < len(l.bitfield) && l.bitfield[index/8]&(0x80>>uint(index%8)) != 0
+}
+
+func (l *Leech) writeMessage(id byte, payload []byte) error {
+	return l.writeAll(append(append(toBigEndian(uint(1+len(payload)), 4), id), payload...))
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,135 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+func TestFindReadme(t *testing.T) {
+	files := []persistence.File{
+		{Size: 100, Path: "a/movie.mkv"},
+		{Size: 28, Path: ".pad/28", Attributes: "p"},
+		{Size: 0, Path: "a/README"},
+		{Size: 2000, Path: "a/ReadMe.txt"},
+		{Size: 300, Path: "a/Release.NFO"},
+	}
+
+	readme := findReadme(files, 1000)
+	if readme == nil || *readme != (readmeFile{path: "a/Release.NFO", offset: 2128, length: 300}) {
+		t.Errorf("Unexpected readme %+v", readme)
+	}
+
+	readme = findReadme(files, 2000)
+	if readme == nil || *readme != (readmeFile{path: "a/ReadMe.txt", offset: 128, length: 2000}) {
+		t.Errorf("Unexpected readme %+v", readme)
+	}
+
+	if readme = findReadme(files, 100); readme != nil {
+		t.Errorf("Unexpected readme %+v", readme)
+	}
+}
+
+func TestDecodeReadme(t *testing.T) {
+	if content := decodeReadme("release.nfo", []byte("\xdb\xb2 Release \xb2\xdb\r\n\x00\x00")); content != "█▓ Release ▓█\r\n" {
+		t.Errorf("Unexpected content %q", content)
+	}
+	if content := decodeReadme("readme.txt", []byte("Caf\xe9")); content != "Caf�" {
+		t.Errorf("Unexpected content %q", content)
+	}
+}
+
+// testReadmeTorrent returns the content and the metadata of a torrent whose .nfo file spans two
+// pieces.
+func testReadmeTorrent(t *testing.T) ([]byte, []byte) {
+	const pieceLength = 16 * 1024
+
+	files := []struct {
+		path    string
+		content []byte
+	}{
+		{"a.bin", bytes.Repeat([]byte{'a'}, pieceLength+pieceLength/2)},
+		{"release.nfo", append(bytes.Repeat([]byte{0xdb}, pieceLength), 0, 0)},
+		{"b.bin", bytes.Repeat([]byte{'b'}, 3*pieceLength)},
+	}
+
+	info := metainfo.Info{Name: "test", PieceLength: pieceLength}
+	var content []byte
+	for _, file := range files {
+		info.Files = append(info.Files, metainfo.FileInfo{
+			Length: int64(len(file.content)),
+			Path:   []string{file.path},
+		})
+		content = append(content, file.content...)
+	}
+	for start := 0; start < len(content); start += pieceLength {
+		end := start + pieceLength
+		if end > len(content) {
+			end = len(content)
+		}
+		sum := sha1.Sum(content[start:end])
+		info.Pieces = append(info.Pieces, sum[:]...)
+	}
+
+	metadata, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatalf("Couldn't marshal info! %s", err.Error())
+	}
+	return content, metadata
+}
+
+func fetchMetadataWithReadme(t *testing.T, metadata []byte, content []byte) *Metadata {
+	peer := newTestPeer(t, metadata, testPeerPlaintext)
+	peer.content, peer.pieceLength = content, 16*1024
+	defer peer.close()
+	peerAddr := peer.addr()
+	dialer := testDialer(t, TransportTCP)
+	defer dialer.Close()
+
+	var result *Metadata
+	leech := NewLeech(sha1.Sum(metadata), &peerAddr, randomID(), dialer, EncryptionDisable, LeechEventHandlers{
+		OnSuccess: func(md Metadata) { result = &md },
+		OnError:   func(_ [20]byte, err error) { t.Errorf("Leech error! %s", err.Error()) },
+	})
+	leech.readmeMaxSize = 64 * 1024
+	leech.Do(time.Now().Add(5 * time.Second))
+	return result
+}
+
+func TestLeechReadme(t *testing.T) {
+	content, metadata := testReadmeTorrent(t)
+
+	md := fetchMetadataWithReadme(t, metadata, content)
+	if md == nil {
+		t.FailNow()
+	}
+	if md.Readme == nil {
+		t.Fatalf("Readme is not fetched")
+	}
+	expected := persistence.Readme{Path: "release.nfo", Content: strings.Repeat("█", 16*1024)}
+	if *md.Readme != expected {
+		t.Errorf("Unexpected readme %s (%d bytes)", md.Readme.Path, len(md.Readme.Content))
+	}
+}
+
+// TestLeechReadmeCorrupt tests that the metadata is delivered even if the readme turns out to be
+// corrupt.
+func TestLeechReadmeCorrupt(t *testing.T) {
+	content, metadata := testReadmeTorrent(t)
+	content[len(content)/2] ^= 0xff
+
+	md := fetchMetadataWithReadme(t, metadata, content)
+	if md == nil {
+		t.FailNow()
+	}
+	if md.Readme != nil {
+		t.Errorf("Corrupt readme is fetched")
+	}
+}
@@ -14,23 +14,50 @@ import (
 )
 
 type Metadata struct {
+	// InfoHash is the SHA-1 infohash of v1 and hybrid torrents, and the SHA-256 infohash of v2-only
+	// torrents. Keep in mind that it might be different than the infohash the metadata is fetched
+	// for, which is always 20 bytes long (i.e. truncated for v2 infohashes).
 	InfoHash []byte
+	// InfoHashV2 is the SHA-256 infohash of v2 and hybrid torrents, and nil for v1-only torrents.
+	InfoHashV2 []byte
 	// Name should be thought of "Title" of the torrent. For single-file torrents, it is the name
 	// of the file, and for multi-file torrents, it is the name of the root directory.
 	Name         string
 	TotalSize    uint64
 	DiscoveredOn int64
-	// Files must be populated for both single-file and multi-file torrents!
+	// Files must be populated for both single-file and multi-file torrents! Padding files are
+	// included too, but not counted towards TotalSize.
 	Files []persistence.File
+	persistence.TorrentAttributes
+	// Info is the verified (i.e. matching the infohashes above) bencoded info dictionary, as it is
+	// received from the peer.
+	Info []byte
+	// Readme is nil unless fetching readmes is enabled, and the peer the metadata is fetched from
+	// has one.
+	Readme *persistence.Readme
+}
+
+// Failure is reported when the metadata of a torrent could not be fetched from any of its peers.
+type Failure struct {
+	InfoHash [20]byte
+	// Reason is the error of the last leech.
+	Reason error
 }
 
 type Sink struct {
 	PeerID      []byte
 	deadline    time.Duration
 	maxNLeeches int
-	drain       chan Metadata
+	parallelism int
+	dialer      *Dialer
+	encryption  EncryptionPolicy
+	// readmeMaxSize is the maximum size of the readmes fetched alongside the metadata (0 to
+	// disable).
+	readmeMaxSize int64
+	drain         chan Metadata
+	failures      chan Failure
 
-	incomingInfoHashes   map[[20]byte][]net.TCPAddr
+	incomingInfoHashes   map[[20]byte]*leechGroup
 	incomingInfoHashesMx sync.Mutex
 
 	terminated  bool
@@ -39,6 +66,23 @@ type Sink struct {
 	deleted int
 }
 
+// maxRemainingPeers caps the number of peers learnt through Peer Exchange that are queued to be
+// tried for a single torrent.
+const maxRemainingPeers = 100
+
+// leechGroup is the set of leeches racing each other to fetch the metadata of the same torrent.
+type leechGroup struct {
+	// remainingPeers are the peers yet to be tried.
+	remainingPeers []net.TCPAddr
+	// seenPeers are the peers that are tried or queued to be tried so far, so that the same peer is
+	// not tried twice when learnt through Peer Exchange. Keys are in "host:port" form.
+	seenPeers map[string]struct{}
+	leeches   map[*Leech]struct{}
+	// done is set as soon as one of the leeches succeeds, after which the results of the other
+	// leeches are ignored.
+	done bool
+}
+
 func randomID() []byte {
 	/* > The peer_id is exactly 20 bytes (characters) long.
 	 * >
@@ -73,23 +117,36 @@ func randomDigit() byte {
 	return byte(rand.Intn(max-min) + min)
 }
 
-func NewSink(deadline time.Duration, maxNLeeches int) *Sink {
+// NewSink returns a Sink that fetches the metadata of at most maxNLeeches torrents at once, each
+// from at most parallelism peers concurrently. If readmeMaxSize is non-zero, the first readme (or
+// .nfo file) of each torrent that is not larger than readmeMaxSize bytes is fetched as well.
+func NewSink(deadline time.Duration, maxNLeeches int, parallelism int, dialer *Dialer, encryption EncryptionPolicy, readmeMaxSize int64) *Sink {
 	ms := new(Sink)
 
 	ms.PeerID = randomID()
 	ms.deadline = deadline
 	ms.maxNLeeches = maxNLeeches
+	ms.parallelism = parallelism
+	ms.dialer = dialer
+	ms.encryption = encryption
+	ms.readmeMaxSize = readmeMaxSize
 	ms.drain = make(chan Metadata, 10)
-	ms.incomingInfoHashes = make(map[[20]byte][]net.TCPAddr)
+	ms.failures = make(chan Failure, 100)
+	ms.incomingInfoHashes = make(map[[20]byte]*leechGroup)
 	ms.termination = make(chan interface{})
 
 	go func() {
 		for range time.Tick(deadline) {
 			ms.incomingInfoHashesMx.Lock()
 			l := len(ms.incomingInfoHashes)
+			n := 0
+			for _, group := range ms.incomingInfoHashes {
+				n += len(group.leeches)
+			}
 			ms.incomingInfoHashesMx.Unlock()
 			zap.L().Info("Sink status",
-				zap.Int("activeLeeches", l),
+				zap.Int("activeInfoHashes", l),
+				zap.Int("activeLeeches", n),
 				zap.Int("nDeleted", ms.deleted),
 				zap.Int("drainQueue", len(ms.drain)),
 			)
@@ -118,13 +175,19 @@ func (ms *Sink) Sink(res dht.Result) {
 	if _, exists := ms.incomingInfoHashes[infoHash]; exists {
 		return
 	} else if len(peerAddrs) > 0 {
-		peer := peerAddrs[0]
-		ms.incomingInfoHashes[infoHash] = peerAddrs[1:]
+		group := &leechGroup{
+			remainingPeers: append([]net.TCPAddr(nil), peerAddrs...),
+			seenPeers:      make(map[string]struct{}),
+			leeches:        make(map[*Leech]struct{}),
+		}
+		for _, peer := range peerAddrs {
+			group.seenPeers[peer.String()] = struct{}{}
+		}
+		ms.incomingInfoHashes[infoHash] = group
 
-		go NewLeech(infoHash, &peer, ms.PeerID, LeechEventHandlers{
-			OnSuccess: ms.flush,
-			OnError:   ms.onLeechError,
-		}).Do(time.Now().Add(ms.deadline))
+		for i := 0; i < ms.parallelism && len(group.remainingPeers) > 0; i++ {
+			ms.startLeech(infoHash, group)
+		}
 	}
 
 	zap.L().Debug("Sunk!", zap.Int("leeches", len(ms.incomingInfoHashes)), util.HexField("infoHash", infoHash[:]))
@@ -137,43 +200,125 @@ func (ms *Sink) Drain() <-chan Metadata {
 	return ms.drain
 }
 
+// Failures returns the channel on which the torrents whose metadata could not be fetched from any
+// of their peers are reported. Failures are dropped if the channel is full.
+func (ms *Sink) Failures() <-chan Failure {
+	if ms.terminated {
+		zap.L().Panic("Trying to Failures() an already closed Sink!")
+	}
+	return ms.failures
+}
+
 func (ms *Sink) Terminate() {
 	ms.terminated = true
 	close(ms.termination)
 	close(ms.drain)
+	close(ms.failures)
+}
+
+// startLeech starts a new leech for the next remaining peer of the group.
+//
+// incomingInfoHashesMx must be held by the caller.
+func (ms *Sink) startLeech(infoHash [20]byte, group *leechGroup) {
+	peer := group.remainingPeers[0]
+	group.remainingPeers = group.remainingPeers[1:]
+
+	var leech *Leech
+	leech = NewLeech(infoHash, &peer, ms.PeerID, ms.dialer, ms.encryption, LeechEventHandlers{
+		OnSuccess: func(result Metadata) { ms.flush(leech, result) },
+		OnError:   func(infoHash [20]byte, err error) { ms.onLeechError(leech, infoHash, err) },
+		OnPeers:   ms.onPeers,
+	})
+	leech.readmeMaxSize = ms.readmeMaxSize
+	group.leeches[leech] = struct{}{}
+
+	go leech.Do(time.Now().Add(ms.deadline))
 }
 
-func (ms *Sink) flush(result Metadata) {
+func (ms *Sink) flush(leech *Leech, result Metadata) {
 	if ms.terminated {
 		return
 	}
 
+	infoHash := leech.infoHash
+
+	ms.incomingInfoHashesMx.Lock()
+	group, exists := ms.incomingInfoHashes[infoHash]
+	if !exists || group.done {
+		// Another leech of the group has won the race already.
+		ms.incomingInfoHashesMx.Unlock()
+		return
+	}
+	group.done = true
+	delete(group.leeches, leech)
+	// Cancel the losers.
+	for loser := range group.leeches {
+		loser.Cancel()
+	}
+	ms.incomingInfoHashesMx.Unlock()
+
 	ms.drain <- result
 	// Delete the infoHash from ms.incomingInfoHashes ONLY AFTER once we've flushed the
 	// metadata!
 	ms.incomingInfoHashesMx.Lock()
 	defer ms.incomingInfoHashesMx.Unlock()
 
-	var infoHash [20]byte
-	copy(infoHash[:], result.InfoHash)
 	delete(ms.incomingInfoHashes, infoHash)
 }
 
-func (ms *Sink) onLeechError(infoHash [20]byte, err error) {
+// onPeers queues the peers learnt through Peer Exchange to be tried if the current leeches of the
+// torrent fail.
+func (ms *Sink) onPeers(infoHash [20]byte, peerAddrs []net.TCPAddr) {
+	ms.incomingInfoHashesMx.Lock()
+	defer ms.incomingInfoHashesMx.Unlock()
+
+	group, exists := ms.incomingInfoHashes[infoHash]
+	if !exists || group.done {
+		return
+	}
+
+	n := 0
+	for _, peer := range peerAddrs {
+		if len(group.remainingPeers) >= maxRemainingPeers {
+			break
+		}
+		if _, seen := group.seenPeers[peer.String()]; seen {
+			continue
+		}
+		group.seenPeers[peer.String()] = struct{}{}
+		group.remainingPeers = append(group.remainingPeers, peer)
+		n++
+	}
+
+	zap.L().Debug("Learnt peers through PEX", util.HexField("infoHash", infoHash[:]), zap.Int("n", n))
+}
+
+func (ms *Sink) onLeechError(leech *Leech, infoHash [20]byte, err error) {
 	zap.L().Debug("leech error", util.HexField("infoHash", infoHash[:]), zap.Error(err))
 
 	ms.incomingInfoHashesMx.Lock()
 	defer ms.incomingInfoHashesMx.Unlock()
 
-	if len(ms.incomingInfoHashes[infoHash]) > 0 {
-		peer := ms.incomingInfoHashes[infoHash][0]
-		ms.incomingInfoHashes[infoHash] = ms.incomingInfoHashes[infoHash][1:]
-		go NewLeech(infoHash, &peer, ms.PeerID, LeechEventHandlers{
-			OnSuccess: ms.flush,
-			OnError:   ms.onLeechError,
-		}).Do(time.Now().Add(ms.deadline))
-	} else {
+	group, exists := ms.incomingInfoHashes[infoHash]
+	if !exists || group.done {
+		// Either cancelled, or lost the race.
+		return
+	}
+	delete(group.leeches, leech)
+
+	if len(group.remainingPeers) > 0 {
+		ms.startLeech(infoHash, group)
+	} else if len(group.leeches) == 0 {
 		ms.deleted++
 		delete(ms.incomingInfoHashes, infoHash)
+
+		if ms.terminated {
+			return
+		}
+		select {
+		case ms.failures <- Failure{InfoHash: infoHash, Reason: err}:
+		default:
+			zap.L().Debug("Sink failures ch is full, failure dropped!", util.HexField("infoHash", infoHash[:]))
+		}
 	}
 }
@@ -0,0 +1,328 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/mse"
+	"github.com/anacrolix/utp"
+)
+
+type testResult struct {
+	infoHash  [20]byte
+	peerAddrs []net.TCPAddr
+}
+
+func (tr testResult) InfoHash() [20]byte {
+	return tr.infoHash
+}
+
+func (tr testResult) PeerAddrs() []net.TCPAddr {
+	return tr.peerAddrs
+}
+
+type testPeerMode uint8
+
+const (
+	testPeerPlaintext testPeerMode = iota
+	// testPeerEncrypted peers require MSE with RC4.
+	testPeerEncrypted
+	// testPeerHanging peers accept connections but never respond.
+	testPeerHanging
+	// testPeerRejecting peers reject all metadata requests, after telling about pexPeers through
+	// Peer Exchange.
+	testPeerRejecting
+)
+
+// testPeer is an in-process peer that serves the metadata of a single torrent over BEP 9.
+type testPeer struct {
+	listener net.Listener
+	metadata []byte
+	mode     testPeerMode
+	pexPeers []net.TCPAddr
+	// content, if not nil, is seeded in pieces of pieceLength bytes.
+	content     []byte
+	pieceLength int
+}
+
+func newTestPeer(t *testing.T, metadata []byte, mode testPeerMode) *testPeer {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen! %s", err.Error())
+	}
+
+	p := &testPeer{listener: listener, metadata: metadata, mode: mode}
+	go p.serve()
+	return p
+}
+
+// newTestUTPPeer returns a plaintext testPeer that accepts uTP connections only.
+func newTestUTPPeer(t *testing.T, metadata []byte) *testPeer {
+	socket, err := utp.NewSocket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't create uTP socket! %s", err.Error())
+	}
+
+	p := &testPeer{listener: socket, metadata: metadata, mode: testPeerPlaintext}
+	go p.serve()
+	return p
+}
+
+func (p *testPeer) addr() net.TCPAddr {
+	switch addr := p.listener.Addr().(type) {
+	case *net.TCPAddr:
+		return *addr
+	case *net.UDPAddr:
+		return net.TCPAddr{IP: addr.IP, Port: addr.Port}
+	default:
+		panic("unknown address type")
+	}
+}
+
+func (p *testPeer) close() {
+	_ = p.listener.Close()
+}
+
+func (p *testPeer) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			switch p.mode {
+			case testPeerPlaintext, testPeerRejecting:
+				_ = p.handle(conn)
+
+			case testPeerEncrypted:
+				infoHash := sha1.Sum(p.metadata)
+				rw, _, err := mse.ReceiveHandshake(conn, func(callback func([]byte) bool) {
+					callback(infoHash[:])
+				}, func(provided mse.CryptoMethod) mse.CryptoMethod {
+					return provided & mse.CryptoMethodRC4
+				})
+				if err != nil {
+					return
+				}
+				_ = p.handle(rw)
+
+			case testPeerHanging:
+				_, _ = io.Copy(ioutil.Discard, conn)
+			}
+		}()
+	}
+}
+
+func (p *testPeer) handle(conn io.ReadWriter) error {
+	handshake := make([]byte, 68)
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		return err
+	}
+	// Accept both v1 and (truncated) v2 infohashes.
+	infoHash := sha1.Sum(p.metadata)
+	infoHashV2 := sha256.Sum256(p.metadata)
+	if bytes.Equal(handshake[28:48], infoHashV2[:20]) {
+		copy(infoHash[:], infoHashV2[:20])
+	} else if !bytes.Equal(handshake[28:48], infoHash[:]) {
+		return fmt.Errorf("unknown infohash")
+	}
+	_, err := conn.Write([]byte(fmt.Sprintf(
+		"\x13BitTorrent protocol\x00\x00\x00\x00\x00\x10\x00\x01%s%s", infoHash, "-TP0001-000000000000",
+	)))
+	if err != nil {
+		return err
+	}
+
+	exHandshake, _ := bencode.Marshal(rootDict{M: mDict{UTMetadata: 3}, MetadataSize: len(p.metadata)})
+	if err = writeExMessage(conn, 0, exHandshake); err != nil {
+		return err
+	}
+
+	if p.content != nil {
+		nPieces := (len(p.content) + p.pieceLength - 1) / p.pieceLength
+		bitfield := make([]byte, 1+(nPieces+7)/8)
+		bitfield[0] = msgBitfield
+		for i := 0; i < nPieces; i++ {
+			bitfield[1+i/8] |= 0x80 >> uint(i%8)
+		}
+		if err = writeMessage(conn, bitfield); err != nil {
+			return err
+		}
+	}
+
+	if p.mode == testPeerRejecting {
+		added := make([]byte, 0, 6*len(p.pexPeers))
+		for _, peer := range p.pexPeers {
+			added = append(added, peer.IP.To4()...)
+			added = append(added, byte(peer.Port>>8), byte(peer.Port))
+		}
+		pex, _ := bencode.Marshal(map[string][]byte{"added": added})
+		if err = writeExMessage(conn, utPexID, pex); err != nil {
+			return err
+		}
+	}
+
+	for {
+		lengthB := make([]byte, 4)
+		if _, err := io.ReadFull(conn, lengthB); err != nil {
+			return err
+		}
+		message := make([]byte, binary.BigEndian.Uint32(lengthB))
+		if _, err := io.ReadFull(conn, message); err != nil {
+			return err
+		}
+		if p.content != nil && len(message) > 0 {
+			switch message[0] {
+			case msgInterested:
+				if err := writeMessage(conn, []byte{msgUnchoke}); err != nil {
+					return err
+				}
+				continue
+
+			case msgRequest:
+				index := int(binary.BigEndian.Uint32(message[1:]))
+				begin := int(binary.BigEndian.Uint32(message[5:]))
+				length := int(binary.BigEndian.Uint32(message[9:]))
+				start := index*p.pieceLength + begin
+				piece := append([]byte{msgPiece}, message[1:9]...)
+				if err := writeMessage(conn, append(piece, p.content[start:start+length]...)); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		// Ignore everything but ut_metadata requests (our ut_metadata ID is 3).
+		if len(message) < 2 || message[0] != 20 || message[1] != 3 {
+			continue
+		}
+
+		request := new(extDict)
+		if err := bencode.Unmarshal(message[2:], request); err != nil {
+			return err
+		}
+		start := request.Piece * 16 * 1024
+		end := start + 16*1024
+		if end > len(p.metadata) {
+			end = len(p.metadata)
+		}
+		if p.mode == testPeerRejecting {
+			reject, _ := bencode.Marshal(map[string]int{"msg_type": 2, "piece": request.Piece})
+			if err := writeExMessage(conn, utMetadataID, reject); err != nil {
+				return err
+			}
+			continue
+		}
+
+		response, _ := bencode.Marshal(map[string]int{"msg_type": 1, "piece": request.Piece, "total_size": len(p.metadata)})
+		// The remote peer (i.e. the leech) expects its own ut_metadata ID.
+		if err := writeExMessage(conn, utMetadataID, append(response, p.metadata[start:end]...)); err != nil {
+			return err
+		}
+	}
+}
+
+func writeMessage(w io.Writer, message []byte) error {
+	_, err := w.Write(append(toBigEndian(uint(len(message)), 4), message...))
+	return err
+}
+
+func writeExMessage(w io.Writer, id byte, payload []byte) error {
+	message := make([]byte, 6, 6+len(payload))
+	binary.BigEndian.PutUint32(message, uint32(2+len(payload)))
+	message[4] = 20
+	message[5] = id
+	_, err := w.Write(append(message, payload...))
+	return err
+}
+
+func testDialer(t *testing.T, policy TransportPolicy) *Dialer {
+	dialer, err := NewDialer(policy, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't create dialer! %s", err.Error())
+	}
+	return dialer
+}
+
+func testMetadata(t *testing.T) []byte {
+	info := metainfo.Info{
+		Name:        "test.txt",
+		Length:      100,
+		PieceLength: 16 * 1024,
+		Pieces:      make([]byte, 20),
+	}
+	metadata, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatalf("Couldn't marshal info! %s", err.Error())
+	}
+	return metadata
+}
+
+// TestSinkParallelism tests that a peer that does not respond does not hold back fetching the
+// metadata from another peer.
+func TestSinkParallelism(t *testing.T) {
+	metadata := testMetadata(t)
+
+	hangingPeer := newTestPeer(t, metadata, testPeerHanging)
+	defer hangingPeer.close()
+	goodPeer := newTestPeer(t, metadata, testPeerPlaintext)
+	defer goodPeer.close()
+
+	dialer := testDialer(t, TransportTCP)
+	defer dialer.Close()
+
+	sink := NewSink(10*time.Second, 10, 2, dialer, EncryptionDisable, 0)
+	sink.Sink(testResult{
+		infoHash:  sha1.Sum(metadata),
+		peerAddrs: []net.TCPAddr{hangingPeer.addr(), goodPeer.addr()},
+	})
+
+	select {
+	case md := <-sink.Drain():
+		if md.Name != "test.txt" {
+			t.Errorf("Unexpected name `%s`", md.Name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Metadata is not fetched before the hanging peer's deadline!")
+	}
+}
+
+// TestSinkPex tests that the peers learnt through Peer Exchange are tried when the current peer
+// rejects sending metadata.
+func TestSinkPex(t *testing.T) {
+	metadata := testMetadata(t)
+
+	goodPeer := newTestPeer(t, metadata, testPeerPlaintext)
+	defer goodPeer.close()
+	rejectingPeer := newTestPeer(t, metadata, testPeerRejecting)
+	rejectingPeer.pexPeers = []net.TCPAddr{goodPeer.addr()}
+	defer rejectingPeer.close()
+
+	dialer := testDialer(t, TransportTCP)
+	defer dialer.Close()
+
+	sink := NewSink(5*time.Second, 10, 1, dialer, EncryptionDisable, 0)
+	sink.Sink(testResult{
+		infoHash:  sha1.Sum(metadata),
+		peerAddrs: []net.TCPAddr{rejectingPeer.addr()},
+	})
+
+	select {
+	case <-sink.Drain():
+	case failure := <-sink.Failures():
+		t.Fatalf("Metadata could not be fetched! %s", failure.Reason.Error())
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Metadata is not fetched in time!")
+	}
+}
@@ -0,0 +1,136 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/anacrolix/utp"
+	"github.com/pkg/errors"
+)
+
+// TransportPolicy determines over which transport protocol(s) leeches connect to the peers.
+type TransportPolicy uint8
+
+const (
+	// TransportPreferTCP tries TCP first, and falls back to uTP if the peer cannot be dialled.
+	TransportPreferTCP TransportPolicy = iota
+	// TransportPreferUTP tries uTP first, and falls back to TCP if the peer cannot be dialled.
+	TransportPreferUTP
+	// TransportTCP uses TCP only.
+	TransportTCP
+	// TransportUTP uses uTP (BEP 29) only.
+	TransportUTP
+)
+
+// dialTimeout is the time allowed for each transport to connect to a peer.
+const dialTimeout = 1 * time.Second
+
+func ParseTransportPolicy(s string) (TransportPolicy, error) {
+	switch s {
+	case "prefer-tcp":
+		return TransportPreferTCP, nil
+
+	case "prefer-utp":
+		return TransportPreferUTP, nil
+
+	case "tcp":
+		return TransportTCP, nil
+
+	case "utp":
+		return TransportUTP, nil
+
+	default:
+		return TransportPreferTCP, fmt.Errorf("unknown transport policy: %s", s)
+	}
+}
+
+// Dialer connects leeches to the peers over TCP and/or uTP, as determined by its policy.
+//
+// All uTP connections are multiplexed on a single UDP socket that is separate from the ones used by
+// the indexers.
+type Dialer struct {
+	policy    TransportPolicy
+	utpSocket *utp.Socket
+}
+
+// NewDialer returns a Dialer with the given policy. utpAddr is the local address of the UDP socket
+// used for uTP connections, and is ignored if the policy does not involve uTP.
+func NewDialer(policy TransportPolicy, utpAddr string) (*Dialer, error) {
+	d := new(Dialer)
+	d.policy = policy
+
+	if policy != TransportTCP {
+		var err error
+		d.utpSocket, err = utp.NewSocket("udp4", utpAddr)
+		if err != nil {
+			return nil, errors.Wrap(err, "utp.NewSocket")
+		}
+	}
+
+	return d, nil
+}
+
+// Dial connects to the peer, trying the transports in the order of preference.
+func (d *Dialer) Dial(peerAddr *net.TCPAddr) (net.Conn, error) {
+	switch d.policy {
+	case TransportPreferTCP:
+		conn, err := d.dialTCP(peerAddr)
+		if err == nil {
+			return conn, nil
+		}
+		conn, utpErr := d.dialUTP(peerAddr)
+		if utpErr != nil {
+			return nil, fmt.Errorf("tcp: %s, utp: %s", err.Error(), utpErr.Error())
+		}
+		return conn, nil
+
+	case TransportPreferUTP:
+		conn, err := d.dialUTP(peerAddr)
+		if err == nil {
+			return conn, nil
+		}
+		conn, tcpErr := d.dialTCP(peerAddr)
+		if tcpErr != nil {
+			return nil, fmt.Errorf("utp: %s, tcp: %s", err.Error(), tcpErr.Error())
+		}
+		return conn, nil
+
+	case TransportTCP:
+		return d.dialTCP(peerAddr)
+
+	case TransportUTP:
+		return d.dialUTP(peerAddr)
+
+	default:
+		panic(fmt.Sprintf("unknown transport policy: %d", d.policy))
+	}
+}
+
+func (d *Dialer) dialTCP(peerAddr *net.TCPAddr) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp4", peerAddr.String(), dialTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "dial tcp")
+	}
+	return conn, nil
+}
+
+func (d *Dialer) dialUTP(peerAddr *net.TCPAddr) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	// Peers listen on the same port number for both TCP and uTP.
+	conn, err := d.utpSocket.DialContext(ctx, "udp4", peerAddr.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "dial utp")
+	}
+	return conn, nil
+}
+
+func (d *Dialer) Close() error {
+	if d.utpSocket == nil {
+		return nil
+	}
+	return d.utpSocket.Close()
+}
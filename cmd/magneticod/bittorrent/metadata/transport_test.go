@@ -0,0 +1,49 @@
+package metadata
+
+import (
+	"crypto/sha1"
+	"testing"
+	"time"
+)
+
+var transportTest_instances = []struct {
+	utpPeer   bool
+	transport TransportPolicy
+	success   bool
+}{
+	{true, TransportUTP, true},
+	{true, TransportPreferTCP, true},
+	{true, TransportPreferUTP, true},
+	{true, TransportTCP, false},
+	{false, TransportUTP, false},
+	{false, TransportPreferTCP, true},
+	{false, TransportPreferUTP, true},
+	{false, TransportTCP, true},
+}
+
+func TestLeechTransport(t *testing.T) {
+	metadata := testMetadata(t)
+
+	for i, instance := range transportTest_instances {
+		var peer *testPeer
+		if instance.utpPeer {
+			peer = newTestUTPPeer(t, metadata)
+		} else {
+			peer = newTestPeer(t, metadata, testPeerPlaintext)
+		}
+		peerAddr := peer.addr()
+		dialer := testDialer(t, instance.transport)
+
+		succeeded := make(chan bool, 1)
+		NewLeech(sha1.Sum(metadata), &peerAddr, randomID(), dialer, EncryptionDisable, LeechEventHandlers{
+			OnSuccess: func(Metadata) { succeeded <- true },
+			OnError:   func([20]byte, error) { succeeded <- false },
+		}).Do(time.Now().Add(5 * time.Second))
+		peer.close()
+		_ = dialer.Close()
+
+		if success := <-succeeded; success != instance.success {
+			t.Errorf("Instance #%d: leech success is %t, expected %t", i+1, success, instance.success)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/pkg/errors"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+// BitTorrent v2 (BEP 52) support.
+//
+// In the DHT and in the BitTorrent handshake, v2 torrents are identified by their SHA-256 infohash
+// truncated to 20 bytes, hence we do not know whether an infohash is a v1 or a (truncated) v2 one
+// until we fetch its metadata. Hybrid torrents have both a v1 and a v2 infohash (of the same info
+// dictionary), and might be found by either.
+//
+// See http://bittorrent.org/beps/bep_0052.html
+
+// infoV2 is the subset of the v2 info dictionary that we are interested in.
+type infoV2 struct {
+	MetaVersion int                    `bencode:"meta version"`
+	FileTree    map[string]interface{} `bencode:"file tree"`
+	PieceLength int64                  `bencode:"piece length"`
+	Pieces      []byte                 `bencode:"pieces"` // v1 (i.e. hybrid torrents only)
+}
+
+// verifyInfoHashes checks whether the metadata matches the infohash, and returns the infohashes of
+// the torrent the way they are stored in the database (see persistence.Database.AddNewTorrent),
+// alongside the v2 view of the info dictionary (nil for v1-only torrents).
+func verifyInfoHashes(metadata []byte, infoHash [20]byte) (v1 []byte, v2 []byte, info *infoV2, err error) {
+	sha1Sum := sha1.Sum(metadata)
+	sha256Sum := sha256.Sum256(metadata)
+
+	matchesV1 := bytes.Equal(sha1Sum[:], infoHash[:])
+	matchesV2 := bytes.Equal(sha256Sum[:20], infoHash[:])
+	if !matchesV1 && !matchesV2 {
+		return nil, nil, nil, fmt.Errorf("infohash mismatch")
+	}
+
+	info = new(infoV2)
+	if err = bencode.Unmarshal(metadata, info); err != nil {
+		return nil, nil, nil, errors.Wrap(err, "unmarshal info (v2)")
+	}
+
+	isV2 := info.MetaVersion == 2
+	isV1 := len(info.Pieces) > 0 || !isV2
+
+	switch {
+	case isV1 && !isV2: // v1-only
+		if !matchesV1 {
+			return nil, nil, nil, fmt.Errorf("infohash mismatch (v1 torrent)")
+		}
+		return sha1Sum[:], nil, nil, nil
+
+	case isV1 && isV2: // hybrid
+		return sha1Sum[:], sha256Sum[:], info, nil
+
+	default: // v2-only
+		if !matchesV2 {
+			return nil, nil, nil, fmt.Errorf("infohash mismatch (v2 torrent)")
+		}
+		return sha256Sum[:], sha256Sum[:], info, nil
+	}
+}
+
+func validateInfoV2(info *infoV2) error {
+	// > piece length [...] It must be a power of two and at least 16KiB.
+	if info.PieceLength < 16*1024 || info.PieceLength&(info.PieceLength-1) != 0 {
+		return errors.New("piece length is not a power of two greater than or equal to 16 KiB")
+	}
+	if len(info.FileTree) == 0 {
+		return errors.New("empty file tree")
+	}
+	return nil
+}
+
+// parseFileTree flattens the `file tree` of a v2 info dictionary into a list of files, whose paths
+// are relative to the torrent (just like v1 multi-file torrents), or the name of the file itself
+// for single-file torrents.
+//
+// Unlike the `files` list of v1, `file tree` does not contain any padding files, although its files
+// might have other attributes.
+func parseFileTree(tree map[string]interface{}, path []string) ([]persistence.File, error) {
+	// Dictionary keys are sorted in bencode but Go maps are not.
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var files []persistence.File
+	for _, name := range names {
+		node, ok := tree[name].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("file tree node `%s` is not a dictionary", name)
+		}
+
+		// > A file tree node is a dictionary with an empty string key [...] whose value is a
+		// > dictionary describing the file.
+		if name == "" {
+			if len(path) == 0 {
+				return nil, fmt.Errorf("file without a name in the file tree")
+			}
+			length, ok := node["length"].(int64)
+			if !ok || length < 0 {
+				return nil, fmt.Errorf("invalid length of `%s`", strings.Join(path, "/"))
+			}
+			// > attr: A variable-length string. [...] (BEP 47)
+			attr, _ := node["attr"].(string)
+			files = append(files, persistence.File{
+				Size:       length,
+				Path:       strings.Join(path, "/"),
+				Attributes: attr,
+			})
+			continue
+		}
+
+		subFiles, err := parseFileTree(node, append(path[:len(path):len(path)], name))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, subFiles...)
+	}
+
+	return files, nil
+}
@@ -0,0 +1,129 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+var testFileTree = map[string]interface{}{
+	"b.txt": map[string]interface{}{
+		"": map[string]interface{}{"length": 100, "pieces root": string(make([]byte, 32))},
+	},
+	"a": map[string]interface{}{
+		"c.txt": map[string]interface{}{
+			"": map[string]interface{}{"length": 200, "pieces root": string(make([]byte, 32))},
+		},
+	},
+}
+
+var testFiles = []persistence.File{
+	{Size: 200, Path: "a/c.txt"},
+	{Size: 100, Path: "b.txt"},
+}
+
+func fetchMetadata(t *testing.T, metadata []byte, infoHash [20]byte) *Metadata {
+	peer := newTestPeer(t, metadata, testPeerPlaintext)
+	defer peer.close()
+	peerAddr := peer.addr()
+	dialer := testDialer(t, TransportTCP)
+	defer dialer.Close()
+
+	var result *Metadata
+	NewLeech(infoHash, &peerAddr, randomID(), dialer, EncryptionDisable, LeechEventHandlers{
+		OnSuccess: func(md Metadata) { result = &md },
+		OnError:   func(_ [20]byte, err error) { t.Errorf("Leech error! %s", err.Error()) },
+	}).Do(time.Now().Add(5 * time.Second))
+	return result
+}
+
+func TestLeechV2(t *testing.T) {
+	metadata, err := bencode.Marshal(map[string]interface{}{
+		"name":         "test",
+		"meta version": 2,
+		"piece length": 16 * 1024,
+		"file tree":    testFileTree,
+	})
+	if err != nil {
+		t.Fatalf("Couldn't marshal info! %s", err.Error())
+	}
+	sha256Sum := sha256.Sum256(metadata)
+	var truncated [20]byte
+	copy(truncated[:], sha256Sum[:20])
+
+	md := fetchMetadata(t, metadata, truncated)
+	if md == nil {
+		t.FailNow()
+	}
+	if !bytes.Equal(md.InfoHash, sha256Sum[:]) || !bytes.Equal(md.InfoHashV2, sha256Sum[:]) {
+		t.Errorf("Unexpected infohashes %x, %x", md.InfoHash, md.InfoHashV2)
+	}
+	if !reflect.DeepEqual(md.Files, testFiles) {
+		t.Errorf("Unexpected files %v", md.Files)
+	}
+	if !bytes.Equal(md.Info, metadata) {
+		t.Errorf("Info dictionary does not match the metadata")
+	}
+	if md.TotalSize != 300 {
+		t.Errorf("Unexpected total size %d", md.TotalSize)
+	}
+}
+
+func TestLeechHybrid(t *testing.T) {
+	metadata, err := bencode.Marshal(map[string]interface{}{
+		"name":         "test",
+		"meta version": 2,
+		"piece length": 16 * 1024,
+		"file tree":    testFileTree,
+		// The padding file must not be listed.
+		"files": []interface{}{
+			map[string]interface{}{"length": 200, "path": []string{"a", "c.txt"}},
+			map[string]interface{}{"length": 16*1024 - 200, "path": []string{".pad", "16184"}, "attr": "p"},
+			map[string]interface{}{"length": 100, "path": []string{"b.txt"}},
+		},
+		"pieces": string(make([]byte, 40)),
+	})
+	if err != nil {
+		t.Fatalf("Couldn't marshal info! %s", err.Error())
+	}
+	sha1Sum := sha1.Sum(metadata)
+	sha256Sum := sha256.Sum256(metadata)
+	var truncated [20]byte
+	copy(truncated[:], sha256Sum[:20])
+
+	// Hybrid torrents can be found by either of their infohashes.
+	for _, infoHash := range [][20]byte{sha1Sum, truncated} {
+		md := fetchMetadata(t, metadata, infoHash)
+		if md == nil {
+			t.FailNow()
+		}
+		if !bytes.Equal(md.InfoHash, sha1Sum[:]) || !bytes.Equal(md.InfoHashV2, sha256Sum[:]) {
+			t.Errorf("Unexpected infohashes %x, %x", md.InfoHash, md.InfoHashV2)
+		}
+		if !reflect.DeepEqual(md.Files, testFiles) {
+			t.Errorf("Unexpected files %v", md.Files)
+		}
+	}
+}
+
+func TestVerifyInfoHashesMismatch(t *testing.T) {
+	metadata := testMetadata(t)
+	// A v1 torrent cannot be found by the truncated SHA-256 of its info dictionary.
+	sha256Sum := sha256.Sum256(metadata)
+	var truncated [20]byte
+	copy(truncated[:], sha256Sum[:20])
+
+	if _, _, _, err := verifyInfoHashes(metadata, truncated); err == nil {
+		t.Errorf("err is nil")
+	}
+	if _, _, _, err := verifyInfoHashes(metadata, [20]byte{}); err == nil {
+		t.Errorf("err is nil")
+	}
+}
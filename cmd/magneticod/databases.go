@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+// databases are the default database, and the ones that the content filter rules route torrents
+// to. The latter are opened as soon as the rules are (re)loaded, and are kept open until exit even
+// if the rules routing to them are removed.
+//
+// All the databases are spooled (see persistence.NewSpooled) and batched (see
+// persistence.NewBatched) alike.
+type databases struct {
+	main   persistence.Database
+	routed map[string]persistence.Database
+	logger *zap.Logger
+
+	// noInfoDicts and noReadmes are the URLs of the databases (the empty one being the default
+	// database) whose engines do not support storing info dictionaries and readmes respectively.
+	noInfoDicts map[string]bool
+	noReadmes   map[string]bool
+
+	batchSize     int
+	batchInterval time.Duration
+	// spoolDir is empty if the databases are not spooled.
+	spoolDir string
+}
+
+func newDatabases(logger *zap.Logger, batchSize int, batchInterval time.Duration, spoolDir string) *databases {
+	dbs := new(databases)
+	dbs.routed = make(map[string]persistence.Database)
+	dbs.logger = logger
+	dbs.noInfoDicts = make(map[string]bool)
+	dbs.noReadmes = make(map[string]bool)
+	dbs.batchSize = batchSize
+	dbs.batchInterval = batchInterval
+	dbs.spoolDir = spoolDir
+	return dbs
+}
+
+// openMain opens the default database.
+func (dbs *databases) openMain(url string) (persistence.Database, error) {
+	database, err := persistence.MakeDatabase(url, dbs.logger)
+	if err != nil {
+		return nil, err
+	}
+	if dbs.main, err = dbs.wrap(url, database); err != nil {
+		_ = database.Close()
+		return nil, err
+	}
+	return dbs.main, nil
+}
+
+// open opens the databases at the given URLs, unless they are open already.
+func (dbs *databases) open(urls []string) error {
+	for _, url := range urls {
+		if _, exists := dbs.routed[url]; exists {
+			continue
+		}
+
+		database, err := persistence.MakeDatabase(url, dbs.logger)
+		if err != nil {
+			return errors.Wrapf(err, "MakeDatabase %s", url)
+		}
+		if dbs.routed[url], err = dbs.wrap(url, database); err != nil {
+			_ = database.Close()
+			delete(dbs.routed, url)
+			return errors.Wrapf(err, "wrap %s", url)
+		}
+	}
+	return nil
+}
+
+// wrap spools and batches the database at the given URL, the spool of which is named after the
+// hash of its URL (so that the credentials in the URL are not revealed).
+func (dbs *databases) wrap(url string, database persistence.Database) (persistence.Database, error) {
+	if dbs.spoolDir != "" {
+		if err := os.MkdirAll(dbs.spoolDir, 0755); err != nil {
+			return nil, errors.Wrapf(err, "mkdirAll error for `%s`", dbs.spoolDir)
+		}
+		hash := sha1.Sum([]byte(url))
+		spoolPath := path.Join(dbs.spoolDir, hex.EncodeToString(hash[:8])+".jsonl")
+
+		var err error
+		if database, err = persistence.NewSpooled(database, spoolPath); err != nil {
+			return nil, errors.Wrap(err, "NewSpooled")
+		}
+	}
+
+	return persistence.NewBatched(database, dbs.batchSize, dbs.batchInterval), nil
+}
+
+// get returns the database at the given URL (which must have been opened beforehand), or the
+// default database if url is empty.
+func (dbs *databases) get(url string) persistence.Database {
+	if url == "" {
+		return dbs.main
+	}
+	return dbs.routed[url]
+}
+
+// setInfoDict stores the info dictionary of a torrent in the database at the given URL (see get),
+// unless its engine does not support it, in which case it is not tried again for that database.
+func (dbs *databases) setInfoDict(url string, infoHash []byte, infoDict []byte) error {
+	if dbs.noInfoDicts[url] {
+		return nil
+	}
+	err := dbs.get(url).SetInfoDict(infoHash, infoDict)
+	if errors.Cause(err) == persistence.NotImplementedError {
+		zap.L().Warn("Database engine does not support storing info dictionaries, disabling it.", zap.String("url", url))
+		dbs.noInfoDicts[url] = true
+		return nil
+	}
+	return err
+}
+
+// setReadme stores the readme of a torrent in the database at the given URL (see get), unless its
+// engine does not support it, in which case it is not tried again for that database.
+func (dbs *databases) setReadme(url string, infoHash []byte, readme persistence.Readme) error {
+	if dbs.noReadmes[url] {
+		return nil
+	}
+	err := dbs.get(url).SetReadme(infoHash, readme)
+	if errors.Cause(err) == persistence.NotImplementedError {
+		zap.L().Warn("Database engine does not support storing readmes, ignoring them.", zap.String("url", url))
+		dbs.noReadmes[url] = true
+		return nil
+	}
+	return err
+}
+
+// doesTorrentExist checks all the databases, so that the torrents that are routed to other
+// databases are not fetched again.
+func (dbs *databases) doesTorrentExist(infoHash []byte) (bool, error) {
+	if exists, err := dbs.main.DoesTorrentExist(infoHash); exists || err != nil {
+		return exists, err
+	}
+
+	for url, database := range dbs.routed {
+		if exists, err := database.DoesTorrentExist(infoHash); exists || err != nil {
+			return exists, errors.Wrapf(err, "DoesTorrentExist %s", url)
+		}
+	}
+	return false, nil
+}
+
+func (dbs *databases) close() {
+	if err := dbs.main.Close(); err != nil {
+		zap.L().Error("Could not close database!", zap.Error(err))
+	}
+	for url, database := range dbs.routed {
+		if err := database.Close(); err != nil {
+			zap.L().Error("Could not close database!", zap.String("url", url), zap.Error(err))
+		}
+	}
+}
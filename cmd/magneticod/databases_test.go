@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+// unsupportedDatabase supports storing neither info dictionaries nor readmes.
+type unsupportedDatabase struct {
+	persistence.Database
+	calls int
+}
+
+func (db *unsupportedDatabase) SetInfoDict(infoHash []byte, infoDict []byte) error {
+	db.calls++
+	return persistence.NotImplementedError
+}
+
+func (db *unsupportedDatabase) SetReadme(infoHash []byte, readme persistence.Readme) error {
+	db.calls++
+	return persistence.NotImplementedError
+}
+
+func TestDatabasesUnsupported(t *testing.T) {
+	database, err := persistence.MakeDatabase("memory://", nil)
+	if err != nil {
+		t.Fatalf("MakeDatabase: %s", err.Error())
+	}
+	defer database.Close()
+	infoHash := make([]byte, 20)
+	if err = database.AddNewTorrent(infoHash, nil, "Name", []persistence.File{{Size: 1, Path: "a"}}, persistence.TorrentAttributes{}); err != nil {
+		t.Fatalf("AddNewTorrent: %s", err.Error())
+	}
+	routed := &unsupportedDatabase{Database: database}
+
+	dbs := newDatabases(nil, 0, 0, "")
+	dbs.main = database
+	dbs.routed["routed://"] = routed
+	for i := 0; i < 2; i++ {
+		if err = dbs.setInfoDict("routed://", infoHash, []byte("de")); err != nil {
+			t.Errorf("setInfoDict of the unsupported database: %s", err.Error())
+		}
+		if err = dbs.setReadme("routed://", infoHash, persistence.Readme{Path: "a", Content: "b"}); err != nil {
+			t.Errorf("setReadme of the unsupported database: %s", err.Error())
+		}
+	}
+	if routed.calls != 2 {
+		t.Errorf("Unsupported database is called %d times instead of once for each", routed.calls)
+	}
+
+	// The default database is not affected by the routed one.
+	if err = dbs.setInfoDict("", infoHash, []byte("de")); err != nil {
+		t.Fatalf("setInfoDict: %s", err.Error())
+	}
+	if err = dbs.setReadme("", infoHash, persistence.Readme{Path: "a", Content: "b"}); err != nil {
+		t.Fatalf("setReadme: %s", err.Error())
+	}
+	if infoDict, err := database.GetInfoDict(infoHash); err != nil || string(infoDict) != "de" {
+		t.Errorf("Info dictionary is not stored in the default database: %q %v", infoDict, err)
+	}
+	if readme, err := database.GetReadme(infoHash); err != nil || readme == nil {
+		t.Errorf("Readme is not stored in the default database: %v %v", readme, err)
+	}
+}
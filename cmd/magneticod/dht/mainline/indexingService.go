@@ -1,8 +1,10 @@
 package mainline
 
 import (
+	"bytes"
 	"math/rand"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
@@ -26,7 +28,83 @@ type IndexingService struct {
 	maxNeighbors      uint
 
 	counter          uint16
-	getPeersRequests map[[2]byte][20]byte // GetPeersQuery.`t` -> infohash
+	getPeersRequests map[[2]byte]getPeersRequest // GetPeersQuery.`t` -> request
+	// lookups are the lookups in progress (see LookUp), which are guarded by getPeersRequestsMutex
+	// as well.
+	lookups               map[[20]byte]*lookup
+	getPeersRequestsMutex sync.Mutex
+}
+
+const (
+	// nLookUpNodes is the number of nodes (closest to the infohash known so far) that are queried
+	// when looking up the peers of an infohash.
+	nLookUpNodes = 8
+	// maxLookUpHops is the number of hops after which a lookup gives up if it does not converge.
+	maxLookUpHops = 8
+	// lookUpTimeout is how long a lookup is kept track of, after which the responses to its
+	// queries are no longer followed.
+	lookUpTimeout = time.Minute
+)
+
+// getPeersRequest is a get_peers query that is waiting for its response.
+type getPeersRequest struct {
+	infoHash [20]byte
+	// hop is the hop of the lookup that the query belongs to (starting from 1), and 0 if the query
+	// does not belong to a lookup.
+	hop int
+}
+
+// lookup is an iterative lookup of the peers of an infohash, which follows the nodes returned by
+// the queried nodes as long as they are closer to the infohash than the ones known so far.
+type lookup struct {
+	infoHash [20]byte
+	started  time.Time
+	// closest are the IDs of the nLookUpNodes closest nodes known so far, closest first.
+	closest []string
+	// queried are the addresses of the nodes queried so far.
+	queried map[string]bool
+}
+
+func newLookup(infoHash [20]byte) *lookup {
+	return &lookup{infoHash: infoHash, started: time.Now(), queried: make(map[string]bool)}
+}
+
+// next returns the addresses of @nodes that are to be queried next, i.e. that are not queried yet,
+// and are among the closest nodes known so far. The lookup converges once there are none.
+func (l *lookup) next(nodes CompactNodeInfos) []*net.UDPAddr {
+	// The nodes are sorted so that the farther ones are not queried only to be outdone by the closer
+	// ones that come after them.
+	nodes = append(CompactNodeInfos(nil), nodes...)
+	sort.Slice(nodes, func(i, j int) bool {
+		return bytes.Compare(xor(string(nodes[i].ID), l.infoHash), xor(string(nodes[j].ID), l.infoHash)) < 0
+	})
+
+	var addrs []*net.UDPAddr
+	for i := range nodes {
+		node := &nodes[i]
+		if node.Addr.Port == 0 || l.queried[node.Addr.String()] { // Ignore nodes who "use" port 0.
+			continue
+		}
+
+		// The position of the node among the closest ones, if it is closer than any of them.
+		distance := xor(string(node.ID), l.infoHash)
+		j := sort.Search(len(l.closest), func(j int) bool {
+			return bytes.Compare(distance, xor(l.closest[j], l.infoHash)) < 0
+		})
+		if j == nLookUpNodes {
+			continue
+		}
+		l.closest = append(l.closest, "")
+		copy(l.closest[j+1:], l.closest[j:])
+		l.closest[j] = string(node.ID)
+		if len(l.closest) > nLookUpNodes {
+			l.closest = l.closest[:nLookUpNodes]
+		}
+
+		l.queried[node.Addr.String()] = true
+		addrs = append(addrs, &node.Addr)
+	}
+	return addrs
 }
 
 type IndexingServiceEventHandlers struct {
@@ -62,7 +140,8 @@ func NewIndexingService(laddr string, interval time.Duration, maxNeighbors uint,
 	service.maxNeighbors = maxNeighbors
 	service.eventHandlers = eventHandlers
 
-	service.getPeersRequests = make(map[[2]byte][20]byte)
+	service.getPeersRequests = make(map[[2]byte]getPeersRequest)
+	service.lookups = make(map[[20]byte]*lookup)
 
 	return service
 }
@@ -156,6 +235,49 @@ func (is *IndexingService) findNeighbors() {
 	}
 }
 
+// LookUp looks up the peers of the given infohash iteratively, starting from the nodes closest to
+// it in the routing table, and following the closer nodes returned by the queried ones until the
+// peers are found, no closer nodes are returned, or maxLookUpHops is reached. Peers found are
+// reported through OnResult like any other indexing result.
+func (is *IndexingService) LookUp(infoHash [20]byte) {
+	l := newLookup(infoHash)
+	is.routingTableMutex.RLock()
+	nodes := make(CompactNodeInfos, 0, len(is.routingTable))
+	for nodeID, addr := range is.routingTable {
+		nodes = append(nodes, CompactNodeInfo{ID: []byte(nodeID), Addr: *addr})
+	}
+	is.routingTableMutex.RUnlock()
+
+	is.getPeersRequestsMutex.Lock()
+	// The lookups that are over (or given up on) are forgotten.
+	for other, otherLookup := range is.lookups {
+		if time.Since(otherLookup.started) > lookUpTimeout {
+			delete(is.lookups, other)
+		}
+	}
+	is.lookups[infoHash] = l
+	addrs := l.next(nodes)
+	is.getPeersRequestsMutex.Unlock()
+
+	for _, addr := range addrs {
+		is.sendGetPeersQuery(infoHash, addr, 1)
+	}
+}
+
+// sendGetPeersQuery sends a get_peers query for the given infohash, as the @hop-th hop of its
+// lookup (0 if it is not part of a lookup).
+func (is *IndexingService) sendGetPeersQuery(infoHash [20]byte, addr *net.UDPAddr, hop int) {
+	is.getPeersRequestsMutex.Lock()
+	t := uint16BE(is.counter)
+	is.getPeersRequests[t] = getPeersRequest{infoHash: infoHash, hop: hop}
+	is.counter++
+	is.getPeersRequestsMutex.Unlock()
+
+	msg := NewGetPeersQuery(is.nodeID, infoHash[:])
+	msg.T = t[:]
+	is.protocol.SendMessage(msg, addr)
+}
+
 func (is *IndexingService) onFindNodeResponse(response *Message, addr *net.UDPAddr) {
 	is.routingTableMutex.Lock()
 	defer is.routingTableMutex.Unlock()
@@ -186,9 +308,27 @@ func (is *IndexingService) onGetPeersResponse(msg *Message, addr *net.UDPAddr) {
 	var t [2]byte
 	copy(t[:], msg.T)
 
-	infoHash := is.getPeersRequests[t]
+	is.getPeersRequestsMutex.Lock()
+	request, ok := is.getPeersRequests[t]
 	// We got a response, so free the key!
 	delete(is.getPeersRequests, t)
+	var next []*net.UDPAddr
+	if l := is.lookups[request.infoHash]; ok && request.hop > 0 && l != nil {
+		if len(msg.R.Values) > 0 {
+			delete(is.lookups, request.infoHash)
+		} else if request.hop < maxLookUpHops {
+			next = l.next(msg.R.Nodes)
+		}
+	}
+	is.getPeersRequestsMutex.Unlock()
+	if !ok {
+		return
+	}
+	infoHash := request.infoHash
+
+	for _, addr := range next {
+		is.sendGetPeersQuery(infoHash, addr, request.hop+1)
+	}
 
 	// BEP 51 specifies that
 	//     The new sample_infohashes remote procedure call requests that a remote node return a string of multiple
@@ -223,14 +363,7 @@ func (is *IndexingService) onSampleInfohashesResponse(msg *Message, addr *net.UD
 		var infoHash [20]byte
 		copy(infoHash[:], msg.R.Samples[i:(i+1)*20])
 
-		msg := NewGetPeersQuery(is.nodeID, infoHash[:])
-		t := uint16BE(is.counter)
-		msg.T = t[:]
-
-		is.protocol.SendMessage(msg, addr)
-
-		is.getPeersRequests[t] = infoHash
-		is.counter++
+		is.sendGetPeersQuery(infoHash, addr, 0)
 	}
 
 	// TODO: good idea, but also need to track how long they have been here
@@ -267,6 +400,15 @@ func (is *IndexingService) onSampleInfohashesResponse(msg *Message, addr *net.UD
 	}
 }
 
+// xor returns the XOR distance between a node ID and an infohash.
+func xor(nodeID string, infoHash [20]byte) []byte {
+	distance := make([]byte, 20)
+	for i := 0; i < 20 && i < len(nodeID); i++ {
+		distance[i] = nodeID[i] ^ infoHash[i]
+	}
+	return distance
+}
+
 func uint16BE(v uint16) (b [2]byte) {
 	b[0] = byte(v >> 8)
 	b[1] = byte(v)
@@ -0,0 +1,56 @@
+package mainline
+
+import (
+	"net"
+	"testing"
+)
+
+// lookUpNodes returns the nodes whose distances to the zero infohash are @distances, at the ports
+// of the same numbers.
+func lookUpNodes(distances ...byte) CompactNodeInfos {
+	nodes := make(CompactNodeInfos, len(distances))
+	for i, distance := range distances {
+		id := make([]byte, 20)
+		id[0] = distance
+		nodes[i] = CompactNodeInfo{ID: id, Addr: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(distance)}}
+	}
+	return nodes
+}
+
+func ports(addrs []*net.UDPAddr) []int {
+	ports := make([]int, len(addrs))
+	for i, addr := range addrs {
+		ports[i] = addr.Port
+	}
+	return ports
+}
+
+func TestLookupNext(t *testing.T) {
+	l := newLookup([20]byte{})
+
+	// Only the closest nodes are queried first, regardless of their order.
+	addrs := l.next(lookUpNodes(10, 9, 8, 7, 6, 5, 4, 3, 2, 1))
+	if len(addrs) != nLookUpNodes {
+		t.Fatalf("%d nodes are queried instead of %d: %v", len(addrs), nLookUpNodes, ports(addrs))
+	}
+	for _, addr := range addrs {
+		if addr.Port > nLookUpNodes {
+			t.Errorf("Farther node %d is queried", addr.Port)
+		}
+	}
+
+	// The nodes that are farther than the closest ones, or queried already, are not followed.
+	if addrs = l.next(lookUpNodes(9, 128, 1)); len(addrs) != 0 {
+		t.Errorf("Lookup does not converge: %v", ports(addrs))
+	}
+	// The closer ones are (unless they "use" port 0).
+	closer := lookUpNodes(0, 0)
+	closer[0].ID[19] = 1
+	closer[1].ID[19], closer[1].Addr.Port = 2, 50
+	if addrs = l.next(closer); len(addrs) != 1 || addrs[0].Port != 50 {
+		t.Errorf("Closer node is not followed: %v", ports(addrs))
+	}
+	if len(l.closest) != nLookUpNodes || l.closest[0] != string(closer[1].ID) {
+		t.Errorf("Closest nodes are not updated")
+	}
+}
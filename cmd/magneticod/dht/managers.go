@@ -12,6 +12,9 @@ import (
 type Service interface {
 	Start()
 	Terminate()
+	// LookUp looks up the peers of the given infohash, whose results (if any) are reported as a
+	// Result on the Output() channel of the Manager.
+	LookUp(infoHash [20]byte)
 }
 
 type Result interface {
@@ -51,6 +54,12 @@ func (m *Manager) Output() <-chan Result {
 	return m.output
 }
 
+func (m *Manager) LookUp(infoHash [20]byte) {
+	for _, service := range m.indexingServices {
+		service.LookUp(infoHash)
+	}
+}
+
 func (m *Manager) Terminate() {
 	for _, service := range m.indexingServices {
 		service.Terminate()
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/boramalper/magnetico/cmd/magneticod/bittorrent/metadata"
+	"github.com/boramalper/magnetico/pkg/util"
+)
+
+// droppedTorrents remembers the most recently dropped torrents (by the content filter rules or the
+// blocklist), as they are trawled again and again, so that their metadata are not fetched again
+// only to be dropped once more.
+type droppedTorrents struct {
+	cache *util.InfoHashCache
+}
+
+func newDroppedTorrents(size uint) *droppedTorrents {
+	return &droppedTorrents{cache: util.NewInfoHashCache(int(size))}
+}
+
+func (d *droppedTorrents) add(md *metadata.Metadata) {
+	// v2 torrents are found by their truncated infohashes in the DHT.
+	for _, infoHash := range [][]byte{md.InfoHash, md.InfoHashV2} {
+		if len(infoHash) >= 20 {
+			d.cache.Add(infoHash[:20])
+		}
+	}
+}
+
+func (d *droppedTorrents) contains(infoHash []byte) bool {
+	return d.cache.Contains(infoHash)
+}
+
+// clear forgets all of the dropped torrents, as the content filter rules that dropped them may have
+// changed.
+func (d *droppedTorrents) clear() {
+	d.cache.Clear()
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/boramalper/magnetico/cmd/magneticod/bittorrent/metadata"
+)
+
+func TestDroppedTorrents(t *testing.T) {
+	v1 := bytes.Repeat([]byte{1}, 20)
+	v2 := bytes.Repeat([]byte{2}, 32)
+	d := newDroppedTorrents(10)
+	d.add(&metadata.Metadata{InfoHash: v1})
+	d.add(&metadata.Metadata{InfoHash: v2, InfoHashV2: v2})
+	if !d.contains(v1) || !d.contains(v2[:20]) {
+		t.Errorf("Dropped torrents are not remembered by their (truncated) infohashes")
+	}
+
+	d.clear()
+	if d.contains(v1) || d.contains(v2[:20]) {
+		t.Errorf("Dropped torrents are remembered after clearing")
+	}
+
+	d = newDroppedTorrents(0)
+	d.add(&metadata.Metadata{InfoHash: v1})
+	if d.contains(v1) {
+		t.Errorf("Dropped torrents are remembered when disabled")
+	}
+}
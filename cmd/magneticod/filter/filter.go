@@ -0,0 +1,278 @@
+// Package filter implements the content filter rules that decide what happens to the torrents
+// whose metadata are fetched, before they are persisted.
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/boramalper/magnetico/cmd/magneticod/bittorrent/metadata"
+)
+
+// Action is what happens to a torrent that matches a rule.
+type Action string
+
+const (
+	// Keep persists the torrent in the default database.
+	Keep Action = "keep"
+	// Drop discards the torrent.
+	Drop Action = "drop"
+	// Tag adds a tag to the torrent, and the rest of the rules are evaluated as usual.
+	Tag Action = "tag"
+	// Route persists the torrent in another database.
+	Route Action = "route"
+)
+
+// Rules are evaluated in order for each torrent: the first matching rule whose action is keep,
+// drop, or route decides what happens to the torrent, whereas the matching rules whose action is
+// tag only add their tags. If no rule decides, the default action (keep, unless stated otherwise)
+// is taken.
+//
+// Rules are loaded from JSON files such as:
+//
+//	{
+//	    "default": "keep",
+//	    "rules": [
+//	        {"match": {"extensions": {"deny": ["exe", "msi"]}}, "action": "drop"},
+//	        {"match": {"private": true}, "action": "tag", "tag": "private"},
+//	        {"match": {"name": "(?i)linux"}, "action": "route", "database": "sqlite3:///linux.sqlite3"}
+//	    ]
+//	}
+type Rules struct {
+	Default Action  `json:"default"`
+	Rules   []*Rule `json:"rules"`
+}
+
+type Rule struct {
+	// Name is used only in the logs.
+	Name   string `json:"name"`
+	Match  Match  `json:"match"`
+	Action Action `json:"action"`
+	// Tag is the tag added by the tag action.
+	Tag string `json:"tag"`
+	// Database is the URL of the database that the route action persists the torrents in.
+	Database string `json:"database"`
+}
+
+// Match is the set of the conditions that a torrent must satisfy (all of them) to match a rule.
+// Conditions that are omitted are always satisfied. Padding files are ignored by all conditions.
+type Match struct {
+	// Name is a regular expression (in RE2 syntax) that the name of the torrent must match.
+	Name       string      `json:"name"`
+	Extensions *Extensions `json:"extensions"`
+	// Size is the range of the total size of the torrent in bytes.
+	Size *Range `json:"size"`
+	// NFiles is the range of the number of files of the torrent.
+	NFiles  *Range `json:"nFiles"`
+	Private *bool  `json:"private"`
+
+	name *regexp.Regexp
+}
+
+// Extensions are case-insensitive lists of file extensions, with or without the leading dot.
+type Extensions struct {
+	// Allow is satisfied if all the files of the torrent have one of these extensions.
+	Allow []string `json:"allow"`
+	// Deny is satisfied if any of the files of the torrent has one of these extensions.
+	Deny []string `json:"deny"`
+}
+
+// Range is inclusive, and either of its bounds might be omitted.
+type Range struct {
+	Min *uint64 `json:"min"`
+	Max *uint64 `json:"max"`
+}
+
+// Verdict is the outcome of the rules for a torrent.
+type Verdict struct {
+	Drop bool
+	// Database is the URL of the database that the torrent is routed to, or empty for the default
+	// database.
+	Database string
+	Tags     []string
+}
+
+// Load reads the rules from the JSON file at @path, and validates them.
+func Load(path string) (*Rules, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "ReadFile")
+	}
+
+	rules := new(Rules)
+	if err = json.Unmarshal(data, rules); err != nil {
+		return nil, errors.Wrap(err, "Unmarshal")
+	}
+
+	if err = rules.compile(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func (rs *Rules) compile() error {
+	switch rs.Default {
+	case "":
+		rs.Default = Keep
+	case Keep, Drop:
+	default:
+		return fmt.Errorf("default action must be either `keep` or `drop`, not `%s`", rs.Default)
+	}
+
+	for i, rule := range rs.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i+1)
+		}
+
+		switch rule.Action {
+		case Keep, Drop:
+		case Tag:
+			// Tags are persisted comma-separated.
+			if rule.Tag == "" || strings.Contains(rule.Tag, ",") {
+				return fmt.Errorf("rule %s: tag must be non-empty and without commas", rule.Name)
+			}
+		case Route:
+			if rule.Database == "" {
+				return fmt.Errorf("rule %s: route action requires a database", rule.Name)
+			}
+		default:
+			return fmt.Errorf("rule %s: unknown action `%s`", rule.Name, rule.Action)
+		}
+
+		if rule.Match.Name != "" {
+			var err error
+			if rule.Match.name, err = regexp.Compile(rule.Match.Name); err != nil {
+				return errors.Wrapf(err, "rule %s: name", rule.Name)
+			}
+		}
+
+		if ext := rule.Match.Extensions; ext != nil {
+			normaliseExtensions(ext.Allow)
+			normaliseExtensions(ext.Deny)
+		}
+	}
+
+	return nil
+}
+
+// Databases returns the URLs of all the databases that the torrents might be routed to.
+func (rs *Rules) Databases() []string {
+	if rs == nil {
+		return nil
+	}
+
+	var urls []string
+	for _, rule := range rs.Rules {
+		if rule.Action == Route {
+			urls = append(urls, rule.Database)
+		}
+	}
+	return urls
+}
+
+// Apply evaluates the rules for the torrent. Nil rules keep all torrents.
+func (rs *Rules) Apply(md *metadata.Metadata) Verdict {
+	var verdict Verdict
+	if rs == nil {
+		return verdict
+	}
+
+	for _, rule := range rs.Rules {
+		if !rule.Match.matches(md) {
+			continue
+		}
+
+		switch rule.Action {
+		case Keep:
+			return verdict
+
+		case Drop:
+			verdict.Drop = true
+			return verdict
+
+		case Tag:
+			verdict.Tags = append(verdict.Tags, rule.Tag)
+
+		case Route:
+			verdict.Database = rule.Database
+			return verdict
+		}
+	}
+
+	verdict.Drop = rs.Default == Drop
+	return verdict
+}
+
+func (m *Match) matches(md *metadata.Metadata) bool {
+	if m.name != nil && !m.name.MatchString(md.Name) {
+		return false
+	}
+
+	if m.Size != nil && !m.Size.contains(md.TotalSize) {
+		return false
+	}
+
+	if m.Private != nil && *m.Private != md.Private {
+		return false
+	}
+
+	var nFiles uint64
+	allAllowed, anyDenied := true, false
+	for _, file := range md.Files {
+		if file.IsPadding() {
+			continue
+		}
+		nFiles++
+
+		if m.Extensions != nil {
+			ext := extension(file.Path)
+			allAllowed = allAllowed && contains(m.Extensions.Allow, ext)
+			anyDenied = anyDenied || contains(m.Extensions.Deny, ext)
+		}
+	}
+
+	if m.NFiles != nil && !m.NFiles.contains(nFiles) {
+		return false
+	}
+
+	if m.Extensions != nil {
+		if len(m.Extensions.Allow) > 0 && !allAllowed {
+			return false
+		}
+		if len(m.Extensions.Deny) > 0 && !anyDenied {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *Range) contains(x uint64) bool {
+	return (r.Min == nil || *r.Min <= x) && (r.Max == nil || x <= *r.Max)
+}
+
+func extension(filePath string) string {
+	return strings.ToLower(strings.TrimPrefix(path.Ext(filePath), "."))
+}
+
+func normaliseExtensions(exts []string) {
+	for i := range exts {
+		exts[i] = strings.ToLower(strings.TrimPrefix(exts[i], "."))
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
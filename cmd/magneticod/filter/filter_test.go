@@ -0,0 +1,105 @@
+package filter
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/boramalper/magnetico/cmd/magneticod/bittorrent/metadata"
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+const testRules = `{
+	"default": "drop",
+	"rules": [
+		{"match": {"extensions": {"deny": [".EXE"]}}, "action": "drop"},
+		{"match": {"private": true}, "action": "tag", "tag": "private"},
+		{"match": {"name": "(?i)\\blinux\\b"}, "action": "route", "database": "sqlite3:///linux.sqlite3"},
+		{"match": {"extensions": {"allow": ["mkv", "nfo"]}, "size": {"min": 1000}, "nFiles": {"max": 2}}, "action": "keep"}
+	]
+}`
+
+func loadTestRules(t *testing.T, rules string) (*Rules, error) {
+	f, err := ioutil.TempFile("", "magneticod-rules-")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary file! %s", err.Error())
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.WriteString(rules); err != nil {
+		t.Fatalf("Couldn't write temporary file! %s", err.Error())
+	}
+	_ = f.Close()
+
+	return Load(f.Name())
+}
+
+func TestApply(t *testing.T) {
+	rules, err := loadTestRules(t, testRules)
+	if err != nil {
+		t.Fatalf("Couldn't load rules! %s", err.Error())
+	}
+
+	testCases := []struct {
+		name     string
+		files    []persistence.File
+		private  bool
+		expected Verdict
+	}{
+		{"Movie", []persistence.File{{Size: 2000, Path: "movie.mkv"}, {Size: 10, Path: "movie.nfo"}}, false,
+			Verdict{}},
+		{"Movie", []persistence.File{{Size: 2000, Path: "movie.mkv"}, {Size: 10, Path: "setup.exe"}}, true,
+			Verdict{Drop: true}},
+		// Padding files are ignored.
+		{"Movie", []persistence.File{{Size: 2000, Path: "movie.MKV"}, {Size: 10, Path: ".pad/10", Attributes: "p"}}, true,
+			Verdict{Tags: []string{"private"}}},
+		{"Movie", []persistence.File{{Size: 999, Path: "movie.mkv"}}, false,
+			Verdict{Drop: true}},
+		{"Movie", []persistence.File{{Size: 1000, Path: "1.mkv"}, {Size: 1000, Path: "2.mkv"}, {Size: 1000, Path: "3.mkv"}}, false,
+			Verdict{Drop: true}},
+		{"Arch Linux 2020.10.01", []persistence.File{{Size: 1000, Path: "archlinux.iso"}}, true,
+			Verdict{Database: "sqlite3:///linux.sqlite3", Tags: []string{"private"}}},
+		{"Linuxes", []persistence.File{{Size: 1000, Path: "linuxes.iso"}}, false,
+			Verdict{Drop: true}},
+	}
+
+	for i, tc := range testCases {
+		md := metadata.Metadata{Name: tc.name, Files: tc.files}
+		for _, file := range tc.files {
+			if !file.IsPadding() {
+				md.TotalSize += uint64(file.Size)
+			}
+		}
+		md.Private = tc.private
+
+		if verdict := rules.Apply(&md); !reflect.DeepEqual(verdict, tc.expected) {
+			t.Errorf("Case #%d: expected %+v, got %+v", i, tc.expected, verdict)
+		}
+	}
+
+	if databases := rules.Databases(); !reflect.DeepEqual(databases, []string{"sqlite3:///linux.sqlite3"}) {
+		t.Errorf("Unexpected databases %v", databases)
+	}
+}
+
+func TestApplyNil(t *testing.T) {
+	var rules *Rules
+	if verdict := rules.Apply(&metadata.Metadata{Name: "test"}); !reflect.DeepEqual(verdict, Verdict{}) {
+		t.Errorf("Nil rules did not keep the torrent: %+v", verdict)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for _, rules := range []string{
+		`{"default": "route"}`,
+		`{"rules": [{"action": "burn"}]}`,
+		`{"rules": [{"action": "tag", "tag": "a,b"}]}`,
+		`{"rules": [{"action": "route"}]}`,
+		`{"rules": [{"match": {"name": "("}, "action": "drop"}]}`,
+		`{"rules": [`,
+	} {
+		if _, err := loadTestRules(t, rules); err == nil {
+			t.Errorf("Invalid rules are loaded: %s", rules)
+		}
+	}
+}
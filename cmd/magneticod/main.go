@@ -5,6 +5,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
@@ -18,19 +19,42 @@ import (
 
 	"github.com/boramalper/magnetico/cmd/magneticod/bittorrent/metadata"
 	"github.com/boramalper/magnetico/cmd/magneticod/dht"
+	"github.com/boramalper/magnetico/cmd/magneticod/filter"
 
+	"github.com/boramalper/magnetico/pkg/blocklist"
+	"github.com/boramalper/magnetico/pkg/category"
 	"github.com/boramalper/magnetico/pkg/persistence"
+	"github.com/boramalper/magnetico/pkg/release"
+	"github.com/boramalper/magnetico/pkg/spam"
 	"github.com/boramalper/magnetico/pkg/util"
 )
 
 type opFlags struct {
-	DatabaseURL string
+	DatabaseURL   string
+	BatchSize     int
+	BatchInterval time.Duration
+	SpoolDir      string
 
 	IndexerAddrs        []string
 	IndexerInterval     time.Duration
 	IndexerMaxNeighbors uint
 
-	LeechMaxN int
+	LeechMaxN        int
+	LeechParallelism int
+	LeechEncryption  metadata.EncryptionPolicy
+	LeechTransport   metadata.TransportPolicy
+	LeechUTPAddr     string
+
+	RetryMaxAttempts uint
+	RetryInterval    time.Duration
+
+	StoreInfoDicts bool
+	ReadmeMaxSize  int64
+
+	FilterRules   string
+	DropCacheSize uint
+
+	BackfillBatchSize uint
 
 	Verbosity int
 	Profile   string
@@ -92,13 +116,54 @@ func main() {
 	interruptChan := make(chan os.Signal, 1)
 	signal.Notify(interruptChan, os.Interrupt)
 
-	database, err := persistence.MakeDatabase(opFlags.DatabaseURL, logger)
+	// Torrents are added in batches (if the database engine supports it) which are flushed
+	// asynchronously, so that the event loop need not wait for a transaction per torrent, and are
+	// spooled to the disk while the database is unavailable.
+	dbs := newDatabases(logger, opFlags.BatchSize, opFlags.BatchInterval, opFlags.SpoolDir)
+	database, err := dbs.openMain(opFlags.DatabaseURL)
 	if err != nil {
 		logger.Fatal("Could not open the database", zap.String("url", opFlags.DatabaseURL), zap.Error(err))
 	}
 
+	// The blocklist (of the default database) is managed by magneticow and magneticoctl, hence
+	// reloaded every minute.
+	blocks, err := blocklist.Load(database)
+	if errors.Cause(err) == persistence.NotImplementedError {
+		zap.L().Warn("Database engine does not support the blocklist, disabling it.")
+	} else if err != nil {
+		logger.Fatal("Could not load the blocklist", zap.Error(err))
+	}
+	blocklistTicker := time.NewTicker(time.Minute)
+	defer blocklistTicker.Stop()
+
+	// Content filter rules are reloaded on SIGHUP.
+	var rules *filter.Rules
+	if opFlags.FilterRules != "" {
+		if rules, err = filter.Load(opFlags.FilterRules); err != nil {
+			logger.Fatal("Could not load the content filter rules", zap.Error(err))
+		}
+		if err = dbs.open(rules.Databases()); err != nil {
+			logger.Fatal("Could not open the databases of the content filter rules", zap.Error(err))
+		}
+	}
+	dropped := newDroppedTorrents(opFlags.DropCacheSize)
+	sighupChan := make(chan os.Signal, 1)
+	signal.Notify(sighupChan, syscall.SIGHUP)
+
 	trawlingManager := dht.NewManager(opFlags.IndexerAddrs, opFlags.IndexerInterval, opFlags.IndexerMaxNeighbors)
-	metadataSink := metadata.NewSink(5*time.Second, opFlags.LeechMaxN)
+	dialer, err := metadata.NewDialer(opFlags.LeechTransport, opFlags.LeechUTPAddr)
+	if err != nil {
+		logger.Fatal("Could not create the leech dialer", zap.Error(err))
+	}
+	defer dialer.Close()
+	metadataSink := metadata.NewSink(5*time.Second, opFlags.LeechMaxN, opFlags.LeechParallelism, dialer, opFlags.LeechEncryption, opFlags.ReadmeMaxSize)
+	retries := newRetryQueue(database, opFlags.RetryMaxAttempts, opFlags.RetryInterval)
+	retryTicker := time.NewTicker(30 * time.Second)
+	defer retryTicker.Stop()
+	// Only the default database is backfilled, as the routed ones are opened after the fact.
+	backfills := newBackfill(database, opFlags.BackfillBatchSize)
+	backfillTicker := time.NewTicker(time.Second)
+	defer backfillTicker.Stop()
 
 	// The Event Loop
 	for stopped := false; !stopped; {
@@ -107,40 +172,138 @@ func main() {
 			infoHash := result.InfoHash()
 
 			zap.L().Debug("Trawled!", util.HexField("infoHash", infoHash[:]))
-			exists, err := database.DoesTorrentExist(infoHash[:])
+			if blocks.BlocksInfoHash(infoHash[:]) {
+				zap.L().Debug("Blocked!", util.HexField("infoHash", infoHash[:]))
+				continue
+			}
+			if dropped.contains(infoHash[:]) {
+				zap.L().Debug("Dropped already!", util.HexField("infoHash", infoHash[:]))
+				continue
+			}
+			// The torrent is trawled again sooner or later, hence not worth stopping for.
+			exists, err := dbs.doesTorrentExist(infoHash[:])
 			if err != nil {
-				zap.L().Fatal("Could not check whether torrent exists!", zap.Error(err))
+				zap.L().Error("Could not check whether torrent exists!",
+					util.HexField("infoHash", infoHash[:]), zap.Error(err))
 			} else if !exists {
 				metadataSink.Sink(result)
 			}
 
 		case md := <-metadataSink.Drain():
-			if err := database.AddNewTorrent(md.InfoHash, md.Name, md.Files); err != nil {
-				zap.L().Fatal("Could not add new torrent to the database",
+			if blocks.Blocks(md.InfoHash, md.InfoHashV2, md.Name) {
+				zap.L().Debug("Blocked!", zap.String("name", md.Name), util.HexField("infoHash", md.InfoHash))
+				dropped.add(&md)
+				continue
+			}
+			verdict := rules.Apply(&md)
+			if verdict.Drop {
+				zap.L().Debug("Dropped!", zap.String("name", md.Name), util.HexField("infoHash", md.InfoHash))
+				dropped.add(&md)
+				continue
+			}
+			md.Tags = verdict.Tags
+			md.Category, md.SubCategory = category.Classify(md.Files)
+			r := release.Parse(md.Name)
+			md.Release = &r
+			md.SpamScore, md.QualityFlags = spam.Assess(md.Name, md.Files)
+			database := dbs.get(verdict.Database)
+
+			// Unless `--no-spool` is supplied, only the errors of the spool itself end up here, and the
+			// errors of the batches are logged by the batched database rather than here. Either way
+			// the torrent is dropped rather than stopping for it, as it is trawled again anyway.
+			if err := database.AddNewTorrent(md.InfoHash, md.InfoHashV2, md.Name, md.Files, md.TorrentAttributes); err != nil {
+				zap.L().Error("Could not add new torrent to the database, dropping it",
 					util.HexField("infohash", md.InfoHash), zap.Error(err))
+				continue
+			}
+			if opFlags.StoreInfoDicts {
+				if err := dbs.setInfoDict(verdict.Database, md.InfoHash, md.Info); err != nil {
+					zap.L().Error("Could not store the info dictionary",
+						util.HexField("infohash", md.InfoHash), zap.Error(err))
+				}
+			}
+			if md.Readme != nil {
+				// Readmes are nice to have, hence not worth stopping for.
+				if err := dbs.setReadme(verdict.Database, md.InfoHash, *md.Readme); err != nil {
+					zap.L().Error("Could not store the readme",
+						util.HexField("infohash", md.InfoHash), zap.Error(err))
+				}
 			}
 			zap.L().Info("Fetched!", zap.String("name", md.Name), util.HexField("infoHash", md.InfoHash))
 
+		case failure := <-metadataSink.Failures():
+			retries.onFailure(failure)
+
+		case <-retryTicker.C:
+			for _, infoHash := range retries.due(100) {
+				trawlingManager.LookUp(infoHash)
+			}
+
+		case <-blocklistTicker.C:
+			if blocks == nil {
+				continue
+			}
+			if err := blocks.Reload(); err != nil {
+				zap.L().Error("Could not reload the blocklist, keeping the old one", zap.Error(err))
+			}
+
+		case <-backfillTicker.C:
+			backfills.step()
+
+		case <-sighupChan:
+			if opFlags.FilterRules == "" {
+				zap.L().Warn("Ignoring SIGHUP since no content filter rules are supplied")
+				continue
+			}
+			newRules, err := filter.Load(opFlags.FilterRules)
+			if err == nil {
+				err = dbs.open(newRules.Databases())
+			}
+			if err != nil {
+				zap.L().Error("Could not reload the content filter rules, keeping the old ones", zap.Error(err))
+				continue
+			}
+			rules = newRules
+			dropped.clear()
+			zap.L().Info("Reloaded the content filter rules")
+
 		case <-interruptChan:
 			trawlingManager.Terminate()
 			stopped = true
 		}
 	}
 
-	if err = database.Close(); err != nil {
-		zap.L().Error("Could not close database!", zap.Error(err))
-	}
+	dbs.close()
 }
 
 func parseFlags() (*opFlags, error) {
 	var cmdF struct {
-		DatabaseURL string `long:"database" description:"URL of the database."`
+		DatabaseURL   string `long:"database" description:"URL of the database."`
+		BatchSize     uint   `long:"batch-size" description:"Maximum number of torrents added to the database in a single transaction (0 or 1 to add them one by one)." default:"100"`
+		BatchInterval uint   `long:"batch-interval" description:"Maximum time torrents wait to be added to the database in integer milliseconds." default:"1000"`
+		SpoolDir      string `long:"spool-dir" description:"Directory of the spools of the torrents that cannot be added while the database is unavailable."`
+		NoSpool       bool   `long:"no-spool" description:"Drop the torrents if the database is unavailable instead of spooling them."`
 
 		IndexerAddrs        []string `long:"indexer-addr" description:"Address(es) to be used by indexing DHT nodes." default:"0.0.0.0:0"`
 		IndexerInterval     uint     `long:"indexer-interval" description:"Indexing interval in integer seconds." default:"1"`
 		IndexerMaxNeighbors uint     `long:"indexer-max-neighbors" description:"Maximum number of neighbors of an indexer." default:"1000"`
 
-		LeechMaxN uint `long:"leech-max-n" description:"Maximum number of leeches." default:"50"`
+		LeechMaxN        uint   `long:"leech-max-n" description:"Maximum number of torrents whose metadata are fetched at once." default:"50"`
+		LeechParallelism uint   `long:"leech-parallelism" description:"Maximum number of peers the metadata of a torrent is fetched from concurrently." default:"3"`
+		LeechEncryption  string `long:"leech-encryption" description:"Whether to use Message Stream Encryption while fetching metadata." choice:"prefer" choice:"require" choice:"disable" default:"prefer"`
+		LeechTransport   string `long:"leech-transport" description:"Transport protocol(s) to connect to the peers over while fetching metadata." choice:"prefer-tcp" choice:"prefer-utp" choice:"tcp" choice:"utp" default:"prefer-tcp"`
+		LeechUTPAddr     string `long:"leech-utp-addr" description:"Address of the UDP socket to be used for uTP connections." default:"0.0.0.0:0"`
+
+		RetryMaxAttempts uint `long:"retry-max-attempts" description:"Maximum number of times a failed metadata fetch is retried (0 to disable)." default:"5"`
+		RetryInterval    uint `long:"retry-interval" description:"Initial interval between retries of a failed metadata fetch in integer seconds, doubled after each attempt." default:"300"`
+
+		StoreInfoDicts bool `long:"store-info-dicts" description:"Store the info dictionaries of the torrents as well, so that .torrent files can be served."`
+		ReadmeMaxSize  uint `long:"readme-max-size" description:"Maximum size of the readme/.nfo files fetched alongside the metadata in bytes (0 to disable)." default:"0"`
+
+		FilterRules   string `long:"filter-rules" description:"Path of the JSON file of the content filter rules (reloaded on SIGHUP)."`
+		DropCacheSize uint   `long:"drop-cache-size" description:"Number of the most recently dropped (or blocked) torrents whose metadata are not fetched again (0 to disable)." default:"100000"`
+
+		BackfillBatchSize uint `long:"backfill-batch-size" description:"Number of existing torrents to categorise (or whose names to parse) every second until all are (0 to disable)." default:"100"`
 
 		Verbose []bool `short:"v" long:"verbose" description:"Increases verbosity."`
 		Profile string `long:"profile" description:"Enable profiling." choice:"cpu" choice:"memory"`
@@ -166,6 +329,20 @@ func parseFlags() (*opFlags, error) {
 		opF.DatabaseURL = cmdF.DatabaseURL
 	}
 
+	opF.BatchSize = int(cmdF.BatchSize)
+	opF.BatchInterval = time.Duration(cmdF.BatchInterval) * time.Millisecond
+	if opF.BatchSize > 1 && opF.BatchInterval <= 0 {
+		return nil, errors.New("batch-interval must be positive")
+	}
+
+	if cmdF.NoSpool {
+		opF.SpoolDir = ""
+	} else if cmdF.SpoolDir == "" {
+		opF.SpoolDir = appdirs.UserDataDir("magneticod", "", "", false) + "/spool"
+	} else {
+		opF.SpoolDir = cmdF.SpoolDir
+	}
+
 	if err = checkAddrs(cmdF.IndexerAddrs); err != nil {
 		zap.S().Fatalf("Of argument (list) `trawler-ml-addr`", zap.Error(err))
 	} else {
@@ -176,13 +353,39 @@ func parseFlags() (*opFlags, error) {
 	opF.IndexerMaxNeighbors = cmdF.IndexerMaxNeighbors
 
 	opF.LeechMaxN = int(cmdF.LeechMaxN)
-	if opF.LeechMaxN > 1000 {
+	opF.LeechParallelism = int(cmdF.LeechParallelism)
+	if opF.LeechParallelism < 1 {
+		opF.LeechParallelism = 1
+	}
+	if opF.LeechEncryption, err = metadata.ParseEncryptionPolicy(cmdF.LeechEncryption); err != nil {
+		return nil, err
+	}
+	if opF.LeechTransport, err = metadata.ParseTransportPolicy(cmdF.LeechTransport); err != nil {
+		return nil, err
+	}
+	if err = checkAddrs([]string{cmdF.LeechUTPAddr}); err != nil {
+		return nil, errors.Wrap(err, "leech-utp-addr")
+	}
+	opF.LeechUTPAddr = cmdF.LeechUTPAddr
+	if opF.LeechMaxN*opF.LeechParallelism > 1000 {
 		zap.S().Warnf(
 			"Beware that on many systems max # of file descriptors per process is limited to 1024. " +
-				"Setting maximum number of leeches greater than 1k might cause \"too many open files\" errors!",
+				"Setting maximum number of leeches (i.e. leech-max-n times leech-parallelism) greater than 1k " +
+				"might cause \"too many open files\" errors!",
 		)
 	}
 
+	opF.RetryMaxAttempts = cmdF.RetryMaxAttempts
+	opF.RetryInterval = time.Duration(cmdF.RetryInterval) * time.Second
+
+	opF.StoreInfoDicts = cmdF.StoreInfoDicts
+	opF.ReadmeMaxSize = int64(cmdF.ReadmeMaxSize)
+
+	opF.FilterRules = cmdF.FilterRules
+	opF.DropCacheSize = cmdF.DropCacheSize
+
+	opF.BackfillBatchSize = cmdF.BackfillBatchSize
+
 	opF.Verbosity = len(cmdF.Verbose)
 
 	opF.Profile = cmdF.Profile
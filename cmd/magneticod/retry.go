@@ -0,0 +1,114 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/boramalper/magnetico/cmd/magneticod/bittorrent/metadata"
+	"github.com/boramalper/magnetico/pkg/persistence"
+	"github.com/boramalper/magnetico/pkg/util"
+)
+
+// maxBackoff caps the time between two attempts of the same failed fetch.
+const maxBackoff = 24 * time.Hour
+
+// retryQueue keeps track of the torrents whose metadata could not be fetched from any of their
+// peers, and schedules them to be looked up again with exponential backoff.
+//
+// The queue itself lives in the database so that it survives restarts.
+type retryQueue struct {
+	database    persistence.Database
+	maxAttempts uint
+	interval    time.Duration
+
+	disabled bool
+}
+
+func newRetryQueue(database persistence.Database, maxAttempts uint, interval time.Duration) *retryQueue {
+	rq := new(retryQueue)
+	rq.database = database
+	rq.maxAttempts = maxAttempts
+	rq.interval = interval
+	rq.disabled = maxAttempts == 0
+	return rq
+}
+
+// onFailure enqueues a failed fetch to be retried.
+func (rq *retryQueue) onFailure(failure metadata.Failure) {
+	if rq.disabled {
+		return
+	}
+
+	nextAttemptOn := time.Now().Add(backoff(rq.interval, 0)).Unix()
+	err := rq.database.AddFailedFetch(failure.InfoHash[:], failure.Reason.Error(), nextAttemptOn)
+	if err != nil {
+		rq.onError(errors.Wrap(err, "AddFailedFetch"))
+		return
+	}
+
+	zap.L().Debug("Enqueued failed fetch to be retried", util.HexField("infoHash", failure.InfoHash[:]))
+}
+
+// due returns the infohashes that are due to be retried, and counts them as attempted.
+func (rq *retryQueue) due(limit uint) [][20]byte {
+	if rq.disabled {
+		return nil
+	}
+
+	now := time.Now()
+	failedFetches, err := rq.database.GetDueFailedFetches(now.Unix(), limit)
+	if err != nil {
+		rq.onError(errors.Wrap(err, "GetDueFailedFetches"))
+		return nil
+	}
+
+	infoHashes := make([][20]byte, 0, len(failedFetches))
+	for _, ff := range failedFetches {
+		nAttempts := ff.NAttempts + 1
+
+		var nextAttemptOn *int64
+		if nAttempts < rq.maxAttempts {
+			nextAttemptOn = new(int64)
+			*nextAttemptOn = now.Add(backoff(rq.interval, nAttempts)).Unix()
+		} else {
+			zap.L().Debug("Abandoning failed fetch after its last attempt",
+				util.HexField("infoHash", ff.InfoHash), zap.String("reason", ff.Reason))
+		}
+
+		if err := rq.database.UpdateFailedFetch(ff.InfoHash, nAttempts, nextAttemptOn); err != nil {
+			rq.onError(errors.Wrap(err, "UpdateFailedFetch"))
+			return nil
+		}
+
+		var infoHash [20]byte
+		copy(infoHash[:], ff.InfoHash)
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	return infoHashes
+}
+
+func (rq *retryQueue) onError(err error) {
+	if errors.Cause(err) == persistence.NotImplementedError {
+		zap.L().Warn("Database engine does not support the retry queue, disabling it.")
+		rq.disabled = true
+		return
+	}
+
+	zap.L().Error("Retry queue error", zap.Error(err))
+}
+
+// backoff returns how long to wait before the next attempt of a failed fetch that has been
+// attempted nAttempts times so far.
+func backoff(interval time.Duration, nAttempts uint) time.Duration {
+	d := interval
+	for i := uint(0); i < nAttempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		return maxBackoff
+	}
+	return d
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/boramalper/magnetico/cmd/magneticod/bittorrent/metadata"
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+func TestBackoff(t *testing.T) {
+	instances := []struct {
+		nAttempts uint
+		expected  time.Duration
+	}{
+		{0, 5 * time.Minute},
+		{1, 10 * time.Minute},
+		{2, 20 * time.Minute},
+		{4, 80 * time.Minute},
+		{10, maxBackoff},
+		{1000, maxBackoff},
+	}
+
+	for _, instance := range instances {
+		if returned := backoff(5*time.Minute, instance.nAttempts); returned != instance.expected {
+			t.Errorf("backoff after %d attempts is %s, expected %s", instance.nAttempts, returned, instance.expected)
+		}
+	}
+}
+
+func TestRetryQueue(t *testing.T) {
+	database, err := persistence.MakeDatabase("memory://", nil)
+	if err != nil {
+		t.Fatalf("MakeDatabase: %s", err.Error())
+	}
+	defer database.Close()
+
+	// The interval is zero so that the failed fetches are due right away.
+	rq := newRetryQueue(database, 2, 0)
+	failure := metadata.Failure{InfoHash: [20]byte{1}, Reason: fmt.Errorf("no peers")}
+	rq.onFailure(failure)
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		if infoHashes := rq.due(10); len(infoHashes) != 1 || infoHashes[0] != failure.InfoHash {
+			t.Fatalf("Failed fetch is not due for attempt %d: %v", attempt, infoHashes)
+		}
+	}
+	// The failed fetch is abandoned after its last attempt.
+	if infoHashes := rq.due(10); len(infoHashes) != 0 {
+		t.Errorf("Failed fetch is due after its last attempt: %v", infoHashes)
+	}
+	stats, err := database.GetStatistics("2020", 1)
+	if err != nil {
+		t.Fatalf("GetStatistics: %s", err.Error())
+	}
+	if stats.RetryQueue == nil || stats.RetryQueue.NAbandoned != 1 || stats.RetryQueue.NPending != 0 {
+		t.Errorf("Failed fetch is not abandoned: %+v", stats.RetryQueue)
+	}
+}
+
+// noRetryQueueDatabase does not support the retry queue.
+type noRetryQueueDatabase struct {
+	persistence.Database
+	calls int
+}
+
+func (db *noRetryQueueDatabase) AddFailedFetch(infoHash []byte, reason string, nextAttemptOn int64) error {
+	db.calls++
+	return persistence.NotImplementedError
+}
+
+func (db *noRetryQueueDatabase) GetDueFailedFetches(now int64, limit uint) ([]persistence.FailedFetch, error) {
+	db.calls++
+	return nil, persistence.NotImplementedError
+}
+
+func TestRetryQueueDisabled(t *testing.T) {
+	database := new(noRetryQueueDatabase)
+	rq := newRetryQueue(database, 5, 0)
+	failure := metadata.Failure{InfoHash: [20]byte{1}, Reason: fmt.Errorf("no peers")}
+	rq.onFailure(failure)
+	rq.onFailure(failure)
+	if infoHashes := rq.due(10); infoHashes != nil || database.calls != 1 {
+		t.Errorf("Retry queue is not disabled although the database does not support it: %v %d calls", infoHashes, database.calls)
+	}
+
+	// Nothing is enqueued if the failed fetches are not to be retried at all.
+	rq = newRetryQueue(database, 0, 0)
+	rq.onFailure(failure)
+	if infoHashes := rq.due(10); infoHashes != nil || database.calls != 1 {
+		t.Errorf("Retry queue is not disabled by zero attempts: %v %d calls", infoHashes, database.calls)
+	}
+}
@@ -1,60 +1,22 @@
 package main
 
 import (
-	"bytes"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net/http"
-	"os"
 	"strconv"
-	"strings"
 	"time"
 
-	"github.com/anacrolix/torrent"
-	"github.com/anacrolix/torrent/storage"
+	"github.com/anacrolix/torrent/bencode"
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
-	"golang.org/x/text/encoding/charmap"
 
+	"github.com/boramalper/magnetico/pkg/category"
 	"github.com/boramalper/magnetico/pkg/persistence"
 )
 
-type ApiReadmeHandler struct {
-	client  *torrent.Client
-	tempdir string
-}
-
-func NewApiReadmeHandler() (*ApiReadmeHandler, error) {
-	h := new(ApiReadmeHandler)
-	var err error
-
-	h.tempdir, err = ioutil.TempDir("", "magneticod_")
-	if err != nil {
-		return nil, err
-	}
-
-	config := torrent.NewDefaultClientConfig()
-	config.ListenPort = 0
-	config.DefaultStorage = storage.NewFileByInfoHash(h.tempdir)
-
-	h.client, err = torrent.NewClient(config)
-	if err != nil {
-		_ = os.RemoveAll(h.tempdir)
-		return nil, err
-	}
-
-	return h, nil
-}
-
-func (h *ApiReadmeHandler) Close() {
-	h.client.Close()
-	_ = os.RemoveAll(h.tempdir)
-}
-
-func (h *ApiReadmeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func apiReadme(w http.ResponseWriter, r *http.Request) {
 	infohashHex := mux.Vars(r)["infohash"]
 
 	infohash, err := hex.DecodeString(infohashHex)
@@ -63,99 +25,18 @@ func (h *ApiReadmeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	files, err := database.GetFiles(infohash)
+	readme, err := database.GetReadme(infohash)
 	if err != nil {
-		zap.L().Error("GetFiles error", zap.Error(err))
+		zap.L().Error("GetReadme error", zap.Error(err))
 		respondError(w, http.StatusInternalServerError, "Internal Server Error")
-	}
-
-	ok := false
-	for _, file := range files {
-		if strings.HasSuffix(file.Path, ".nfo") {
-			ok = true
-			break
-		} else if strings.Contains(file.Path, "read") {
-			ok = true
-			break
-		}
-	}
-
-	if !ok {
-		w.WriteHeader(http.StatusNotFound)
 		return
-	}
-
-	zap.L().Warn("README")
-
-	t, err := h.client.AddMagnet("magnet:?xt=urn:btih:" + infohashHex)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	defer t.Drop()
-
-	zap.L().Warn("WAITING FOR INFO")
-
-	select {
-	case <-t.GotInfo():
-
-	case <-time.After(30 * time.Second):
-		respondError(w, http.StatusInternalServerError, "Timeout")
-		return
-	}
-
-	zap.L().Warn("GOT INFO!")
-
-	t.CancelPieces(0, t.NumPieces())
-
-	var file *torrent.File
-	for _, file = range t.Files() {
-		filePath := file.Path()
-		if strings.HasSuffix(filePath, ".nfo") {
-			break
-		} else if strings.Contains(filePath, "read") {
-			break
-		}
-	}
-
-	if file == nil {
-		w.WriteHeader(http.StatusNotFound)
+	} else if readme == nil {
+		respondError(w, http.StatusNotFound, "Not Found")
 		return
 	}
 
-	// Cancel if the file is larger than 50 KiB
-	if file.Length() > 50*1024 {
-		w.WriteHeader(http.StatusRequestEntityTooLarge)
-		return
-	}
-
-	file.Download()
-
-	reader := file.NewReader()
-	// BEWARE:
-	//     ioutil.ReadAll(reader)
-	// returns some adjancent garbage too, for reasons unknown...
-	content := make([]byte, file.Length())
-	_, err = io.ReadFull(reader, content)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer reader.Close()
-
-	if strings.HasSuffix(file.Path(), ".nfo") {
-		content, err = charmap.CodePage437.NewDecoder().Bytes(content)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-	}
-
-	// Because .nfo files are right padded with \x00'es.
-	content = bytes.TrimRight(content, "\x00")
-
 	w.Header().Set("Content-Type", "text/plain;charset=UTF-8")
-	_, _ = w.Write(content)
+	_, _ = w.Write([]byte(readme.Content))
 }
 
 func apiTorrents(w http.ResponseWriter, r *http.Request) {
@@ -175,6 +56,21 @@ func apiTorrents(w http.ResponseWriter, r *http.Request) {
 		LastOrderedValue *float64 `schema:"lastOrderedValue"`
 		LastID           *uint64  `schema:"lastID"`
 		Limit            *uint    `schema:"limit"`
+		ShowFlagged      bool     `schema:"showFlagged"`
+		Private          *bool    `schema:"private"`
+		Category         string   `schema:"category"`
+		SubCategory      string   `schema:"subCategory"`
+		// Fields of the releases parsed from the names of the torrents.
+		Title      string `schema:"title"`
+		Year       int    `schema:"year"`
+		Season     int    `schema:"season"`
+		Episode    int    `schema:"episode"`
+		Resolution string `schema:"resolution"`
+		Source     string `schema:"source"`
+		Codec      string `schema:"codec"`
+		Audio      string `schema:"audio"`
+		Language   string `schema:"language"`
+		Group      string `schema:"group"`
 	}
 	if err := decoder.Decode(&tq, r.URL.Query()); err != nil {
 		respondError(w, 400, "error while parsing the URL: %s", err.Error())
@@ -220,8 +116,35 @@ func apiTorrents(w http.ResponseWriter, r *http.Request) {
 		*tq.Limit = 20
 	}
 
-	torrents, err := database.QueryTorrents(
-		*tq.Query, *tq.Epoch, orderBy,
+	if tq.Category != "" && !category.IsValid(tq.Category) {
+		respondError(w, 400, "unknown category `%s`", tq.Category)
+		return
+	} else if tq.Category == "" && tq.SubCategory != "" {
+		respondError(w, 400, "`subCategory` requires `category`")
+		return
+	}
+	filter := persistence.QueryFilter{
+		// The torrents flagged as likely fakes are hidden unless asked otherwise.
+		ExcludeFlagged: !tq.ShowFlagged,
+		Private:        tq.Private,
+		Category:       tq.Category,
+		SubCategory:    tq.SubCategory,
+		Release: persistence.Release{
+			Title:      tq.Title,
+			Year:       tq.Year,
+			Season:     tq.Season,
+			Episode:    tq.Episode,
+			Resolution: tq.Resolution,
+			Source:     tq.Source,
+			Codec:      tq.Codec,
+			Audio:      tq.Audio,
+			Language:   tq.Language,
+			Group:      tq.Group,
+		},
+	}
+
+	torrents, err := queryUnblocked(
+		*tq.Query, filter, *tq.Epoch, orderBy,
 		*tq.Ascending, *tq.Limit, tq.LastOrderedValue, tq.LastID)
 	if err != nil {
 		respondError(w, 400, "query error: %s", err.Error())
@@ -282,6 +205,90 @@ func apiFilelist(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// InfoDictSummary is the info dictionary of a torrent as exposed by the API.
+type InfoDictSummary struct {
+	Name        string `json:"name"`
+	PieceLength int64  `json:"pieceLength"`
+	// NPieces is the number of pieces of v1 and hybrid torrents, and zero for v2-only torrents.
+	NPieces     int    `json:"nPieces"`
+	Private     bool   `json:"private"`
+	Source      string `json:"source,omitempty"`
+	MetaVersion int64  `json:"metaVersion"`
+	// Size is the size of the bencoded info dictionary in bytes.
+	Size int `json:"size"`
+	// Other contains the rest of the fields whose values are either strings or integers (e.g.
+	// `name.utf-8`, `x_cross_seed`, and so on).
+	Other map[string]interface{} `json:"other"`
+}
+
+func apiInfoDict(w http.ResponseWriter, r *http.Request) {
+	infohashHex := mux.Vars(r)["infohash"]
+
+	infohash, err := hex.DecodeString(infohashHex)
+	if err != nil {
+		respondError(w, 400, "couldn't decode infohash: %s", err.Error())
+		return
+	}
+
+	infoDict, err := database.GetInfoDict(infohash)
+	if err != nil {
+		respondError(w, 500, "couldn't get info dictionary: %s", err.Error())
+		return
+	} else if infoDict == nil {
+		respondError(w, 404, "not found")
+		return
+	}
+
+	summary, err := summariseInfoDict(infoDict)
+	if err != nil {
+		respondError(w, 500, "couldn't parse info dictionary: %s", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err = json.NewEncoder(w).Encode(summary); err != nil {
+		zap.L().Warn("JSON encode error", zap.Error(err))
+	}
+}
+
+func summariseInfoDict(infoDict []byte) (*InfoDictSummary, error) {
+	var fields map[string]interface{}
+	if err := bencode.Unmarshal(infoDict, &fields); err != nil {
+		return nil, err
+	}
+
+	summary := &InfoDictSummary{
+		MetaVersion: 1,
+		Size:        len(infoDict),
+		Other:       make(map[string]interface{}),
+	}
+	for key, value := range fields {
+		switch key {
+		case "name":
+			summary.Name, _ = value.(string)
+		case "piece length":
+			summary.PieceLength, _ = value.(int64)
+		case "pieces":
+			pieces, _ := value.(string)
+			summary.NPieces = len(pieces) / 20
+		case "private":
+			private, _ := value.(int64)
+			summary.Private = private == 1
+		case "source":
+			summary.Source, _ = value.(string)
+		case "meta version":
+			summary.MetaVersion, _ = value.(int64)
+		default:
+			switch value.(type) {
+			case string, int64:
+				summary.Other[key] = value
+			}
+		}
+	}
+
+	return summary, nil
+}
+
 func apiStatistics(w http.ResponseWriter, r *http.Request) {
 	from := r.URL.Query().Get("from")
 
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/boramalper/magnetico/pkg/blocklist"
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+// setupAPI sets up the API (and the web interface) against an in-memory database with two torrents,
+// the second of which is a hybrid one, and returns its router.
+func setupAPI(t *testing.T) http.Handler {
+	var err error
+	if database, err = persistence.MakeDatabase("memory://", nil); err != nil {
+		t.Fatalf("MakeDatabase: %s", err.Error())
+	}
+	err = persistence.AddNewTorrents(database, []persistence.NewTorrent{
+		{
+			InfoHash:     make([]byte, 20),
+			Name:         "Ubuntu 20.04 Desktop amd64",
+			Files:        []persistence.File{{Size: 100, Path: "ubuntu.iso"}, {Size: 1, Path: "README.txt"}},
+			Attributes:   persistence.TorrentAttributes{Category: "software"},
+			DiscoveredOn: 1000,
+		},
+		{
+			InfoHash:     []byte("01234567890123456789"),
+			InfoHashV2:   []byte("01234567890123456789012345678901"),
+			Name:         "Debian 10 netinst",
+			Files:        []persistence.File{{Size: 50, Path: "debian.iso"}},
+			Attributes:   persistence.TorrentAttributes{Private: true, QualityFlags: []string{"keyword-stuffing"}},
+			DiscoveredOn: 2000,
+		},
+	})
+	if err != nil {
+		t.Fatalf("AddNewTorrents: %s", err.Error())
+	}
+	if blocks, err = blocklist.Load(database); err != nil {
+		t.Fatalf("blocklist.Load: %s", err.Error())
+	}
+
+	// Authentication is disabled, as if `--no-auth` were supplied.
+	return newRouter()
+}
+
+// get requests @target of @router, and decodes the response into @v (unless nil).
+func get(t *testing.T, router http.Handler, target string, v interface{}) int {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+	if v != nil && recorder.Code == http.StatusOK {
+		if err := json.Unmarshal(recorder.Body.Bytes(), v); err != nil {
+			t.Errorf("Invalid response of %s: %s", target, err.Error())
+		}
+	}
+	return recorder.Code
+}
+
+func TestAPITorrents(t *testing.T) {
+	router := setupAPI(t)
+	defer database.Close()
+
+	for _, c := range []struct {
+		target   string
+		status   int
+		expected []string
+	}{
+		{"/api/v0.1/torrents?query=ubuntu", http.StatusOK, []string{"Ubuntu 20.04 Desktop amd64"}},
+		// The flagged torrents are hidden unless asked otherwise.
+		{"/api/v0.1/torrents", http.StatusOK, []string{"Ubuntu 20.04 Desktop amd64"}},
+		{"/api/v0.1/torrents?showFlagged=true&orderBy=TOTAL_SIZE&ascending=false", http.StatusOK,
+			[]string{"Ubuntu 20.04 Desktop amd64", "Debian 10 netinst"}},
+		{"/api/v0.1/torrents?showFlagged=true&lastOrderedValue=1000&lastID=1", http.StatusOK,
+			[]string{"Debian 10 netinst"}},
+		{"/api/v0.1/torrents?showFlagged=true&epoch=1500", http.StatusOK, []string{"Ubuntu 20.04 Desktop amd64"}},
+		{"/api/v0.1/torrents?category=software&query=debian", http.StatusOK, []string{}},
+		{"/api/v0.1/torrents?showFlagged=true&private=true", http.StatusOK, []string{"Debian 10 netinst"}},
+		{"/api/v0.1/torrents?showFlagged=true&private=false", http.StatusOK, []string{"Ubuntu 20.04 Desktop amd64"}},
+		{"/api/v0.1/torrents?private=maybe", http.StatusBadRequest, nil},
+		{"/api/v0.1/torrents?lastID=1", http.StatusBadRequest, nil},
+		{"/api/v0.1/torrents?orderBy=RELEVANCE", http.StatusBadRequest, nil},
+		{"/api/v0.1/torrents?category=nonexistent", http.StatusBadRequest, nil},
+	} {
+		var torrents []struct {
+			Name string `json:"name"`
+		}
+		if status := get(t, router, c.target, &torrents); status != c.status {
+			t.Errorf("%s: expected %d, got %d", c.target, c.status, status)
+			continue
+		}
+		if c.expected == nil {
+			continue
+		}
+		names := make([]string, len(torrents))
+		for i, torrent := range torrents {
+			names[i] = torrent.Name
+		}
+		if len(names) != len(c.expected) {
+			t.Errorf("%s: expected %q, got %q", c.target, c.expected, names)
+			continue
+		}
+		for i := range names {
+			if names[i] != c.expected[i] {
+				t.Errorf("%s: expected %q, got %q", c.target, c.expected, names)
+				break
+			}
+		}
+	}
+}
+
+func TestAPITorrent(t *testing.T) {
+	router := setupAPI(t)
+	defer database.Close()
+
+	ubuntu := "/api/v0.1/torrents/" + hex.EncodeToString(make([]byte, 20))
+	var torrent struct {
+		Name   string `json:"name"`
+		Size   uint64 `json:"size"`
+		NFiles uint   `json:"nFiles"`
+	}
+	if status := get(t, router, ubuntu, &torrent); status != http.StatusOK || torrent.Name != "Ubuntu 20.04 Desktop amd64" ||
+		torrent.Size != 101 || torrent.NFiles != 2 {
+		t.Errorf("Wrong torrent: %d %+v", status, torrent)
+	}
+	// Hybrid torrents are found by their v2 infohashes too.
+	debian := "/api/v0.1/torrents/" + hex.EncodeToString([]byte("01234567890123456789012345678901"))
+	if status := get(t, router, debian, &torrent); status != http.StatusOK || torrent.Name != "Debian 10 netinst" {
+		t.Errorf("Wrong torrent by v2 infohash: %d %+v", status, torrent)
+	}
+	if status := get(t, router, "/api/v0.1/torrents/"+hex.EncodeToString([]byte("99999999999999999999")), nil); status != http.StatusNotFound {
+		t.Errorf("Missing torrent: expected 404, got %d", status)
+	}
+
+	var files []persistence.File
+	if status := get(t, router, ubuntu+"/filelist", &files); status != http.StatusOK || len(files) != 2 {
+		t.Errorf("Wrong files: %d %v", status, files)
+	}
+
+	if status := get(t, router, ubuntu+"/readme", nil); status != http.StatusNotFound {
+		t.Errorf("Missing readme: expected 404, got %d", status)
+	}
+	if err := database.SetReadme(make([]byte, 20), persistence.Readme{Path: "README.txt", Content: "Hello"}); err != nil {
+		t.Fatalf("SetReadme: %s", err.Error())
+	}
+	if status := get(t, router, ubuntu+"/readme", nil); status != http.StatusOK {
+		t.Errorf("Readme: expected 200, got %d", status)
+	}
+
+	// The torrents whose names are blocked are hidden.
+	_, err := blocks.Block(persistence.Block{NamePattern: "(?i)ubuntu", Reason: "Notice", AddedBy: "admin"})
+	if err != nil {
+		t.Fatalf("Block: %s", err.Error())
+	}
+	if status := get(t, router, ubuntu, nil); status != http.StatusNotFound {
+		t.Errorf("Blocked torrent: expected 404, got %d", status)
+	}
+	if status := get(t, router, "/torrents/"+hex.EncodeToString(make([]byte, 20)), nil); status != http.StatusNotFound {
+		t.Errorf("Page of the blocked torrent: expected 404, got %d", status)
+	}
+	var torrents []interface{}
+	if status := get(t, router, "/api/v0.1/torrents?query=ubuntu", &torrents); status != http.StatusOK || len(torrents) != 0 {
+		t.Errorf("Blocked torrents are listed: %d %v", status, torrents)
+	}
+	// The pages are filled with the torrents after the blocked ones.
+	var page []struct {
+		Name string `json:"name"`
+	}
+	if status := get(t, router, "/api/v0.1/torrents?showFlagged=true&limit=1", &page); status != http.StatusOK ||
+		len(page) != 1 || page[0].Name != "Debian 10 netinst" {
+		t.Errorf("Page is not filled after the blocked torrent: %d %v", status, page)
+	}
+}
+
+func TestTorrentFile(t *testing.T) {
+	router := setupAPI(t)
+	defer database.Close()
+
+	ubuntu := make([]byte, 20)
+	if status := get(t, router, "/torrents/"+hex.EncodeToString(ubuntu)+".torrent", nil); status != http.StatusNotFound {
+		t.Errorf("Missing info dictionary: expected 404, got %d", status)
+	}
+	if err := database.SetInfoDict(ubuntu, []byte("d6:lengthi100e4:name10:ubuntu.iso12:piece lengthi16384e6:pieces20:01234567890123456789e")); err != nil {
+		t.Fatalf("SetInfoDict: %s", err.Error())
+	}
+	if status := get(t, router, "/torrents/"+hex.EncodeToString(ubuntu)+".torrent", nil); status != http.StatusOK {
+		t.Errorf(".torrent file: expected 200, got %d", status)
+	}
+
+	// The piece layers of v2-only torrents are not stored, hence their .torrent files are not served.
+	debian := []byte("01234567890123456789")
+	if err := database.SetInfoDict(debian, []byte("d12:meta versioni2e4:name10:debian.iso12:piece lengthi16384ee")); err != nil {
+		t.Fatalf("SetInfoDict: %s", err.Error())
+	}
+	if status := get(t, router, "/torrents/"+hex.EncodeToString(debian)+".torrent", nil); status != http.StatusNotImplemented {
+		t.Errorf(".torrent file of a v2-only torrent: expected 501, got %d", status)
+	}
+}
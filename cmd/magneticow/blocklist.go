@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/boramalper/magnetico/pkg/blocklist"
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+// blocks is nil if the database engine does not support the blocklist.
+var blocks *blocklist.Blocklist
+
+// reloadBlocklist reloads the blocklist periodically, since it might be changed by magneticoctl
+// as well.
+func reloadBlocklist(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := blocks.Reload(); err != nil {
+			zap.L().Error("Could not reload the blocklist, keeping the old one", zap.Error(err))
+		}
+	}
+}
+
+// unlessBlocked wraps a handler of a torrent (identified by the `infohash` variable of its route)
+// so that the blocked torrents are not found.
+func unlessBlocked(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if blocks == nil {
+			handler(w, r)
+			return
+		}
+
+		infohash, err := hex.DecodeString(mux.Vars(r)["infohash"])
+		if err != nil {
+			respondError(w, 400, "couldn't decode infohash: %s", err.Error())
+			return
+		}
+
+		// The torrent is needed for its name, as well as its other infohash (if any).
+		torrent, err := database.GetTorrent(infohash)
+		if err != nil {
+			respondError(w, 500, "couldn't get torrent: %s", err.Error())
+			return
+		}
+		if (torrent == nil && blocks.BlocksInfoHash(infohash)) ||
+			(torrent != nil && blocks.Blocks(torrent.InfoHash, torrent.InfoHashV2, torrent.Name)) {
+			respondError(w, 404, "not found")
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// queryUnblocked is database.QueryTorrents, except that the blocked torrents are skipped, and the
+// torrents after them are queried until the page is full (or there are none left), so that a page
+// shorter than @limit still marks the end of the results.
+func queryUnblocked(
+	query string,
+	filter persistence.QueryFilter,
+	epoch int64,
+	orderBy persistence.OrderingCriteria,
+	ascending bool,
+	limit uint,
+	lastOrderedValue *float64,
+	lastID *uint64,
+) ([]persistence.TorrentMetadata, error) {
+	torrents := make([]persistence.TorrentMetadata, 0, limit)
+	for {
+		pageSize := limit - uint(len(torrents))
+		page, err := database.QueryTorrents(query, filter, epoch, orderBy, ascending, pageSize, lastOrderedValue, lastID)
+		if err != nil {
+			return nil, err
+		}
+		if uint(len(page)) < pageSize || len(page) == 0 || blocks == nil {
+			return append(torrents, blocks.Filter(page)...), nil
+		}
+
+		// The page is filtered in place, hence its last torrent is copied beforehand.
+		last := page[len(page)-1]
+		torrents = append(torrents, blocks.Filter(page)...)
+		value, ok := orderedValue(last, orderBy)
+		if uint(len(torrents)) == limit || !ok {
+			return torrents, nil
+		}
+		lastOrderedValue, lastID = &value, &last.ID
+	}
+}
+
+// orderedValue returns the value of @torrent that the torrents are ordered by (i.e. which the next
+// page is queried after), or false if it is not known.
+func orderedValue(torrent persistence.TorrentMetadata, orderBy persistence.OrderingCriteria) (float64, bool) {
+	switch orderBy {
+	case persistence.ByRelevance:
+		return torrent.Relevance, true
+	case persistence.ByTotalSize:
+		return float64(torrent.Size), true
+	case persistence.ByDiscoveredOn:
+		return float64(torrent.DiscoveredOn), true
+	case persistence.ByNFiles:
+		return float64(torrent.NFiles), true
+	default:
+		return 0, false
+	}
+}
+
+// AdminAuth wraps a handler requiring HTTP basic auth of an admin (see `--admin`) for it. Admin
+// handlers are forbidden altogether if `--no-auth` is supplied.
+func AdminAuth(handler http.HandlerFunc, realm string) http.HandlerFunc {
+	return BasicAuth(func(w http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		if opts.Credentials == nil || !opts.Admins[username] {
+			respondError(w, 403, "Forbidden.\n")
+			return
+		}
+
+		if blocks == nil {
+			respondError(w, 501, "database engine does not support the blocklist")
+			return
+		}
+
+		handler(w, r)
+	}, realm)
+}
+
+func apiAdminBlocklist(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		blockList, err := database.GetBlocks()
+		if err != nil {
+			respondError(w, 500, "couldn't get blocklist: %s", err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err = json.NewEncoder(w).Encode(blockList); err != nil {
+			zap.L().Warn("JSON encode error", zap.Error(err))
+		}
+
+	case http.MethodPost:
+		var req struct {
+			InfoHash    string `json:"infoHash"`
+			NamePattern string `json:"namePattern"`
+			Reason      string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, 400, "couldn't decode request: %s", err.Error())
+			return
+		}
+
+		block := persistence.Block{NamePattern: req.NamePattern, Reason: req.Reason}
+		block.AddedBy, _, _ = r.BasicAuth()
+		if req.InfoHash != "" {
+			var err error
+			if block.InfoHash, err = hex.DecodeString(req.InfoHash); err != nil {
+				respondError(w, 400, "couldn't decode infohash: %s", err.Error())
+				return
+			}
+		}
+		if err := blocklist.Validate(block); err != nil {
+			respondError(w, 400, "invalid block: %s", err.Error())
+			return
+		}
+
+		id, err := blocks.Block(block)
+		if err != nil {
+			respondError(w, 500, "couldn't block: %s", err.Error())
+			return
+		}
+		zap.L().Info("Blocked", zap.Uint64("id", id), zap.String("by", block.AddedBy))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(201)
+		_ = json.NewEncoder(w).Encode(struct {
+			ID uint64 `json:"id"`
+		}{id})
+
+	default:
+		respondError(w, 405, "method not allowed")
+	}
+}
+
+func apiAdminUnblock(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, 400, "couldn't parse id: %s", err.Error())
+		return
+	}
+
+	actor, _, _ := r.BasicAuth()
+	if err = blocks.Unblock(id, actor, r.URL.Query().Get("reason")); err != nil {
+		respondError(w, 400, "couldn't unblock: %s", err.Error())
+		return
+	}
+	zap.L().Info("Unblocked", zap.Uint64("id", id), zap.String("by", actor))
+
+	w.WriteHeader(204)
+}
+
+func apiAdminDeleteTorrent(w http.ResponseWriter, r *http.Request) {
+	infohash, err := hex.DecodeString(mux.Vars(r)["infohash"])
+	if err != nil {
+		respondError(w, 400, "couldn't decode infohash: %s", err.Error())
+		return
+	}
+
+	actor, _, _ := r.BasicAuth()
+	if err = blocks.Delete(infohash, actor, r.URL.Query().Get("reason")); err != nil {
+		respondError(w, 400, "couldn't delete torrent: %s", err.Error())
+		return
+	}
+	zap.L().Info("Deleted", zap.String("infohash", mux.Vars(r)["infohash"]), zap.String("by", actor))
+
+	w.WriteHeader(204)
+}
+
+func apiAdminAudit(w http.ResponseWriter, r *http.Request) {
+	limit := uint64(100)
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.ParseUint(l, 10, 32); err != nil {
+			respondError(w, 400, "couldn't parse limit: %s", err.Error())
+			return
+		}
+	}
+
+	entries, err := database.GetAuditLog(uint(limit))
+	if err != nil {
+		respondError(w, 500, "couldn't get audit log: %s", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err = json.NewEncoder(w).Encode(entries); err != nil {
+		zap.L().Warn("JSON encode error", zap.Error(err))
+	}
+}
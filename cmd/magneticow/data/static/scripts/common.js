@@ -12,6 +12,17 @@ function encodeQueryData(data) {
 }
 
 
+// Returns the magnet link of a torrent. v2-only torrents (whose infoHash is their v2 infohash) are
+// identified by their multihash (BEP 52), and hybrid torrents by both of their infohashes.
+function magnetURI(infoHash, infoHashV2, name) {
+    let xts = [];
+    if (!infoHashV2 || infoHash !== infoHashV2)
+        xts.push("xt=urn:btih:" + infoHash);
+    if (infoHashV2)
+        xts.push("xt=urn:btmh:1220" + infoHashV2);  // 0x12 = sha2-256, 0x20 = 32 bytes
+    return "magnet:?" + xts.join("&") + "&dn=" + encodeURIComponent(name);
+}
+
 // Source: https://stackoverflow.com/q/10420352/4466589
 function fileSize(fileSizeInBytes) {
     let i = -1;
@@ -18,9 +18,23 @@ window.onload = function () {
         document.querySelector("main").innerHTML = Mustache.render(template, {
             name: x.name,
             infoHash: x.infoHash,
+            magnet: magnetURI(x.infoHash, x.infoHashV2, x.name),
             sizeHumanised: fileSize(x.size),
             discoveredOnHumanised: humaniseDate(x.discoveredOn),
             nFiles: x.nFiles,
+            // Piece length is unknown for the torrents that are discovered by older versions.
+            pieceLengthHumanised: x.pieceLength ? fileSize(x.pieceLength) : null,
+            private: x.private,
+            source: x.source,
+            category: x.category,
+            qualityFlags: x.qualityFlags && x.qualityFlags.join(", "),
+            spamScore: x.spamScore,
+            subCategory: x.subCategory,
+            release: x.release && Object.assign({
+                titleEncoded: encodeURIComponent(x.release.title),
+                details: [x.release.resolution, x.release.source, x.release.codec, x.release.audio, x.release.language]
+                    .filter(Boolean).join(" "),
+            }, x.release),
         });
 
         fetch("/api/v0.1/torrents/" + infoHash + "/filelist").then(x => x.json()).then(x => {
@@ -42,6 +56,13 @@ window.onload = function () {
             }
         });
 
+        // Info dictionaries are stored only if magneticod is told to do so.
+        myFetch("/api/v0.1/torrents/" + infoHash + "/info")
+            .then(() => {
+                document.getElementById("torrent-file").hidden = false;
+            })
+            .catch(() => {});
+
         myFetch("/api/v0.1/torrents/" + infoHash + "/readme")
             .then(response => {
                 return response.text();
@@ -52,7 +73,12 @@ window.onload = function () {
             })
             .catch(err => {
                 const readme = document.getElementById("readme");
-                readme.innerText = err;
+                // Readmes are fetched only if magneticod is told to do so.
+                if (err.response && err.response.status === 404) {
+                    readme.innerText = "No readme.";
+                } else {
+                    readme.innerText = err;
+                }
             });
     });
 };
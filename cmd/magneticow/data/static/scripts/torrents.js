@@ -1,8 +1,15 @@
 "use strict";
 
 const query = (new URL(location)).searchParams.get("query")
+    , category = (new URL(location)).searchParams.get("category") || null
+    , showFlagged = (new URL(location)).searchParams.get("showFlagged") === "true" || null
     , epoch = Math.floor(Date.now() / 1000)
 ;
+// Fields of the releases that the torrents are filtered by (e.g. `/torrents?title=...&resolution=1080p`).
+const releaseFilter = {};
+for (let key of ["title", "year", "season", "episode", "resolution", "source", "codec", "audio", "language", "group"]) {
+    releaseFilter[key] = (new URL(location)).searchParams.get(key) || null;
+}
 let orderBy, ascending;  // use `setOrderBy()` to modify orderBy
 let lastOrderedValue, lastID;
 
@@ -26,9 +33,20 @@ window.onload = function() {
         setOrderBy("DISCOVERED_ON");
     }
 
-    if (query) {
+    if (releaseFilter.title) {
+        title.textContent = releaseFilter.title + " - magneticow";
+    }
+    if (category) {
+        title.textContent = "[" + category + "] " + title.textContent;
+        document.getElementsByTagName("select")[0].value = category;
+    }
+    if (showFlagged) {
+        document.querySelector("input[name=showFlagged]").checked = true;
+    }
+
+    if (query || category) {
         const feedAnchor = document.getElementById("feed-anchor");
-        feedAnchor.setAttribute("href", "/feed?query=" + encodeURIComponent(query));
+        feedAnchor.setAttribute("href", "/feed?" + encodeQueryData({query: query || null, category: category}));
     }
 
     load();
@@ -69,14 +87,16 @@ function load() {
 
     const ul       = document.querySelector("main ul");
     const template = document.getElementById("item-template").innerHTML;
-    const reqURL   = "/api/v0.1/torrents?" + encodeQueryData({
+    const reqURL   = "/api/v0.1/torrents?" + encodeQueryData(Object.assign({
         query           : query,
+        category        : category,
+        showFlagged     : showFlagged,
         epoch           : epoch,
         lastID          : lastID,
         lastOrderedValue: lastOrderedValue,
         orderBy         : orderBy,
         ascending       : ascending
-    });
+    }, releaseFilter));
 
     console.log("reqURL", reqURL);
 
@@ -103,8 +123,10 @@ function load() {
         lastOrderedValue = orderedValue(last);
 
         for (let t of torrents) {
+            t.magnet = magnetURI(t.infoHash, t.infoHashV2, t.name);
             t.size = fileSize(t.size);
             t.discoveredOn = humaniseDate(t.discoveredOn);
+            t.qualityFlags = t.qualityFlags && t.qualityFlags.join(", ");
 
             ul.innerHTML += Mustache.render(template, t);
         }
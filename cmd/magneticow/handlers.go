@@ -1,12 +1,16 @@
 package main
 
 import (
+	"encoding/hex"
+	"mime"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 
+	"github.com/boramalper/magnetico/pkg/category"
 	"github.com/boramalper/magnetico/pkg/persistence"
 )
 
@@ -41,6 +45,46 @@ func torrentsInfohashHandler(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(data)
 }
 
+// torrentFileHandler serves the .torrent file of a torrent, if its info dictionary is stored.
+//
+// The .torrent files of v2-only torrents are not served (501), since they require the piece layers,
+// which are not part of the info dictionary and hence never fetched.
+func torrentFileHandler(w http.ResponseWriter, r *http.Request) {
+	infohash, err := hex.DecodeString(mux.Vars(r)["infohash"])
+	if err != nil {
+		respondError(w, 400, "couldn't decode infohash: %s", err.Error())
+		return
+	}
+
+	infoDict, err := database.GetInfoDict(infohash)
+	if err != nil {
+		handlerError(errors.Wrap(err, "GetInfoDict"), w)
+		return
+	} else if infoDict == nil {
+		respondError(w, 404, "not found")
+		return
+	}
+
+	summary, err := summariseInfoDict(infoDict)
+	if err != nil {
+		handlerError(errors.Wrap(err, "summariseInfoDict"), w)
+		return
+	} else if summary.MetaVersion == 2 && summary.NPieces == 0 {
+		respondError(w, 501, "the .torrent files of v2-only torrents are not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-bittorrent")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": summary.Name + ".torrent",
+	}))
+	// A metainfo file with nothing but the info dictionary is still valid for trackerless (i.e.
+	// DHT) torrents, which all of ours are.
+	_, _ = w.Write([]byte("d4:info"))
+	_, _ = w.Write(infoDict)
+	_, _ = w.Write([]byte("e"))
+}
+
 func statisticsHandler(w http.ResponseWriter, r *http.Request) {
 	data := mustAsset("templates/statistics.html")
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -61,14 +105,24 @@ func feedHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	filter := persistence.QueryFilter{Category: r.URL.Query().Get("category"), ExcludeFlagged: true}
+	if filter.Category != "" && !category.IsValid(filter.Category) {
+		respondError(w, 400, "unknown category!")
+		return
+	}
+
 	if query == "" {
 		title = "Most recent torrents - magneticow"
 	} else {
 		title = "`" + query + "` - magneticow"
 	}
+	if filter.Category != "" {
+		title = "[" + filter.Category + "] " + title
+	}
 
-	torrents, err := database.QueryTorrents(
+	torrents, err := queryUnblocked(
 		query,
+		filter,
 		time.Now().Unix(),
 		persistence.ByDiscoveredOn,
 		false,
@@ -27,6 +27,7 @@ import (
 	"go.uber.org/zap/zapcore"
 	"golang.org/x/crypto/bcrypt"
 
+	"github.com/boramalper/magnetico/pkg/blocklist"
 	"github.com/boramalper/magnetico/pkg/persistence"
 )
 
@@ -47,7 +48,9 @@ var opts struct {
 	CredentialsRWMutex sync.RWMutex
 	// CredentialsPath is nil when no-auth is supplied.
 	CredentialsPath string
-	Verbosity       int
+	// Admins are the usernames (of the credentials) that are allowed to manage the blocklist.
+	Admins    map[string]bool
+	Verbosity int
 }
 
 func main() {
@@ -102,37 +105,7 @@ func main() {
 		}
 	}()
 
-	apiReadmeHandler, err := NewApiReadmeHandler()
-	if err != nil {
-		zap.L().Fatal("Could not initialise readme handler", zap.Error(err))
-	}
-	defer apiReadmeHandler.Close()
-
-	router := mux.NewRouter()
-	router.HandleFunc("/",
-		BasicAuth(rootHandler, "magneticow"))
-
-	router.HandleFunc("/api/v0.1/statistics",
-		BasicAuth(apiStatistics, "magneticow"))
-	router.HandleFunc("/api/v0.1/torrents",
-		BasicAuth(apiTorrents, "magneticow"))
-	router.HandleFunc("/api/v0.1/torrents/{infohash:[a-f0-9]{40}}",
-		BasicAuth(apiTorrent, "magneticow"))
-	router.HandleFunc("/api/v0.1/torrents/{infohash:[a-f0-9]{40}}/filelist",
-		BasicAuth(apiFilelist, "magneticow"))
-	router.Handle("/api/v0.1/torrents/{infohash:[a-f0-9]{40}}/readme",
-		apiReadmeHandler)
-
-	router.HandleFunc("/feed",
-		BasicAuth(feedHandler, "magneticow"))
-	router.PathPrefix("/static").HandlerFunc(
-		BasicAuth(staticHandler, "magneticow"))
-	router.HandleFunc("/statistics",
-		BasicAuth(statisticsHandler, "magneticow"))
-	router.HandleFunc("/torrents",
-		BasicAuth(torrentsHandler, "magneticow"))
-	router.HandleFunc("/torrents/{infohash:[a-f0-9]{40}}",
-		BasicAuth(torrentsInfohashHandler, "magneticow"))
+	router := newRouter()
 
 	templateFunctions := template.FuncMap{
 		"add": func(augend int, addends int) int {
@@ -147,6 +120,10 @@ func main() {
 			return hex.EncodeToString(bytes)
 		},
 
+		"magnet": func(t persistence.TorrentMetadata) template.URL {
+			return template.URL(magnetURI(t.InfoHash, t.InfoHashV2, t.Name))
+		},
+
 		"unixTimeToYearMonthDay": func(s int64) string {
 			tm := time.Unix(s, 0)
 			// > Format and Parse use example-based layouts. Usually you’ll use a constant from time
@@ -179,11 +156,21 @@ func main() {
 	templates["feed"] = template.Must(template.New("feed").Funcs(templateFunctions).Parse(string(mustAsset("templates/feed.xml"))))
 	templates["homepage"] = template.Must(template.New("homepage").Funcs(templateFunctions).Parse(string(mustAsset("templates/homepage.html"))))
 
+	var err error
 	database, err = persistence.MakeDatabase(opts.Database, logger)
 	if err != nil {
 		zap.L().Fatal("could not access to database", zap.Error(err))
 	}
 
+	blocks, err = blocklist.Load(database)
+	if errors.Cause(err) == persistence.NotImplementedError {
+		zap.L().Warn("Database engine does not support the blocklist, disabling it.")
+	} else if err != nil {
+		zap.L().Fatal("could not load the blocklist", zap.Error(err))
+	} else {
+		go reloadBlocklist(time.Minute)
+	}
+
 	decoder.IgnoreUnknownKeys(false)
 	decoder.ZeroEmpty(true)
 
@@ -211,10 +198,11 @@ func mustAsset(name string) []byte {
 
 func parseFlags() error {
 	var cmdFlags struct {
-		Addr     string `short:"a" long:"addr"        description:"Address (host:port) to serve on"  default:":8080"`
-		Database string `short:"d" long:"database"    description:"URL of the (magneticod) database"`
-		Cred     string `short:"c" long:"credentials" description:"Path to the credentials file"`
-		NoAuth   bool   `          long:"no-auth"     description:"Disables authorisation"`
+		Addr     string   `short:"a" long:"addr"        description:"Address (host:port) to serve on"  default:":8080"`
+		Database string   `short:"d" long:"database"    description:"URL of the (magneticod) database"`
+		Cred     string   `short:"c" long:"credentials" description:"Path to the credentials file"`
+		NoAuth   bool     `          long:"no-auth"     description:"Disables authorisation"`
+		Admins   []string `          long:"admin"       description:"Username (of the credentials) allowed to manage the blocklist (can be supplied multiple times)"`
 
 		Verbose []bool `short:"v" long:"verbose" description:"Increases verbosity."`
 	}
@@ -257,6 +245,14 @@ func parseFlags() error {
 		}
 	}
 
+	if len(cmdFlags.Admins) > 0 && cmdFlags.NoAuth {
+		return fmt.Errorf("`admin` and `no-auth` cannot be supplied together")
+	}
+	opts.Admins = make(map[string]bool)
+	for _, admin := range cmdFlags.Admins {
+		opts.Admins[admin] = true
+	}
+
 	opts.Verbosity = len(cmdFlags.Verbose)
 
 	return nil
@@ -305,6 +301,50 @@ func loadCred(cred string) error {
 	return nil
 }
 
+// newRouter returns the router of the web interface and of the API.
+func newRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/",
+		BasicAuth(rootHandler, "magneticow"))
+
+	router.HandleFunc("/api/v0.1/statistics",
+		BasicAuth(apiStatistics, "magneticow"))
+	router.HandleFunc("/api/v0.1/torrents",
+		BasicAuth(apiTorrents, "magneticow"))
+	router.HandleFunc("/api/v0.1/torrents/{infohash:(?:[a-f0-9]{40}|[a-f0-9]{64})}",
+		BasicAuth(unlessBlocked(apiTorrent), "magneticow"))
+	router.HandleFunc("/api/v0.1/torrents/{infohash:(?:[a-f0-9]{40}|[a-f0-9]{64})}/filelist",
+		BasicAuth(unlessBlocked(apiFilelist), "magneticow"))
+	router.HandleFunc("/api/v0.1/torrents/{infohash:(?:[a-f0-9]{40}|[a-f0-9]{64})}/info",
+		BasicAuth(unlessBlocked(apiInfoDict), "magneticow"))
+	router.HandleFunc("/api/v0.1/torrents/{infohash:(?:[a-f0-9]{40}|[a-f0-9]{64})}/readme",
+		BasicAuth(unlessBlocked(apiReadme), "magneticow"))
+
+	router.HandleFunc("/api/v0.1/admin/blocklist",
+		AdminAuth(apiAdminBlocklist, "magneticow")).Methods("GET", "POST")
+	router.HandleFunc("/api/v0.1/admin/blocklist/{id:[0-9]+}",
+		AdminAuth(apiAdminUnblock, "magneticow")).Methods("DELETE")
+	router.HandleFunc("/api/v0.1/admin/torrents/{infohash:(?:[a-f0-9]{40}|[a-f0-9]{64})}",
+		AdminAuth(apiAdminDeleteTorrent, "magneticow")).Methods("DELETE")
+	router.HandleFunc("/api/v0.1/admin/audit",
+		AdminAuth(apiAdminAudit, "magneticow")).Methods("GET")
+
+	router.HandleFunc("/feed",
+		BasicAuth(feedHandler, "magneticow"))
+	router.PathPrefix("/static").HandlerFunc(
+		BasicAuth(staticHandler, "magneticow"))
+	router.HandleFunc("/statistics",
+		BasicAuth(statisticsHandler, "magneticow"))
+	router.HandleFunc("/torrents",
+		BasicAuth(torrentsHandler, "magneticow"))
+	router.HandleFunc("/torrents/{infohash:(?:[a-f0-9]{40}|[a-f0-9]{64})}",
+		BasicAuth(unlessBlocked(torrentsInfohashHandler), "magneticow"))
+	router.HandleFunc("/torrents/{infohash:(?:[a-f0-9]{40}|[a-f0-9]{64})}.torrent",
+		BasicAuth(unlessBlocked(torrentFileHandler), "magneticow"))
+
+	return router
+}
+
 // BasicAuth wraps a handler requiring HTTP basic auth for it using the given
 // username and password and the specified realm, which shouldn't contain quotes.
 //
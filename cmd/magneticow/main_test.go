@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 )
 
@@ -113,3 +115,40 @@ func TestSchemaRequired(t *testing.T) {
 		t.Error("err is nil")
 	}
 }
+
+func TestMagnetURI(t *testing.T) {
+	v1 := bytes.Repeat([]byte{0xab}, 20)
+	v2 := bytes.Repeat([]byte{0xcd}, 32)
+
+	for _, c := range []struct {
+		infoHash, infoHashV2 []byte
+		expected             string
+	}{
+		{v1, nil, "magnet:?xt=urn:btih:" + strings.Repeat("ab", 20) + "&dn=a+b"},
+		{v2, v2, "magnet:?xt=urn:btmh:1220" + strings.Repeat("cd", 32) + "&dn=a+b"},
+		{v1, v2, "magnet:?xt=urn:btih:" + strings.Repeat("ab", 20) +
+			"&xt=urn:btmh:1220" + strings.Repeat("cd", 32) + "&dn=a+b"},
+	} {
+		if actual := magnetURI(c.infoHash, c.infoHashV2, "a b"); actual != c.expected {
+			t.Errorf("expected %s, got %s", c.expected, actual)
+		}
+	}
+}
+
+func TestSummariseInfoDict(t *testing.T) {
+	infoDict := []byte("d6:lengthi100e4:name8:test.txt12:piece lengthi16384e6:pieces40:" +
+		strings.Repeat("x", 40) + "7:privatei1e6:source3:abce")
+
+	summary, err := summariseInfoDict(infoDict)
+	if err != nil {
+		t.Fatalf("summariseInfoDict error: %s", err.Error())
+	}
+
+	if summary.Name != "test.txt" || summary.PieceLength != 16384 || summary.NPieces != 2 ||
+		!summary.Private || summary.Source != "abc" || summary.MetaVersion != 1 {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+	if summary.Other["length"] != int64(100) {
+		t.Errorf("length is not in other fields: %+v", summary.Other)
+	}
+}
@@ -1,8 +1,30 @@
 package main
 
-import "net/http"
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+)
 
 func handlerError(err error, w http.ResponseWriter) {
 	w.WriteHeader(http.StatusInternalServerError)
 	_, _ = w.Write([]byte(err.Error()))
 }
+
+// magnetURI returns the magnet link of a torrent (see also magnetURI in common.js).
+//
+// v2-only torrents (whose infoHash is their v2 infohash) are identified by their multihash as per
+// BEP 52, and hybrid torrents by both of their infohashes.
+func magnetURI(infoHash []byte, infoHashV2 []byte, name string) string {
+	var xts []string
+	if infoHashV2 == nil || !bytes.Equal(infoHash, infoHashV2) {
+		xts = append(xts, "xt=urn:btih:"+hex.EncodeToString(infoHash))
+	}
+	if infoHashV2 != nil {
+		// 0x12 = sha2-256, 0x20 = 32 bytes
+		xts = append(xts, "xt=urn:btmh:1220"+hex.EncodeToString(infoHashV2))
+	}
+	return "magnet:?" + strings.Join(xts, "&") + "&dn=" + url.QueryEscape(name)
+}
@@ -8,8 +8,10 @@ require (
 	github.com/anacrolix/missinggo v1.2.1
 	github.com/anacrolix/missinggo/v2 v2.4.0 // indirect
 	github.com/anacrolix/torrent v1.14.0
+	github.com/anacrolix/utp v0.0.0-20180219060659-9e0e1d1d0572
 	github.com/chzyer/readline v0.0.0-20180603132655-2972be24d48e // indirect
 	github.com/dustin/go-humanize v1.0.0
+	github.com/go-sql-driver/mysql v1.5.0
 	github.com/google/pprof v0.0.0-20190515194954-54271f7e092f // indirect
 	github.com/gorilla/mux v1.7.4
 	github.com/gorilla/schema v1.1.0
@@ -17,6 +19,7 @@ require (
 	github.com/jackc/pgx/v4 v4.9.2
 	github.com/jessevdk/go-flags v1.4.0
 	github.com/kevinburke/go-bindata v3.16.0+incompatible // indirect
+	github.com/klauspost/compress v1.11.13
 	github.com/libp2p/go-sockaddr v0.0.1
 	github.com/mattn/go-sqlite3 v2.0.3+incompatible
 	github.com/pkg/errors v0.9.1
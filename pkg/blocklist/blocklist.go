@@ -0,0 +1,242 @@
+// Package blocklist enforces and manages the blocklist of the torrents (e.g. due to takedown
+// notices) that is persisted in the database, and records who changed it, and why, in the audit
+// log.
+package blocklist
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+// Actions of the audit log entries.
+const (
+	ActionBlock   = "block"
+	ActionUnblock = "unblock"
+	ActionDelete  = "delete"
+)
+
+// Blocklist is an in-memory copy of the blocklist of a database, which is safe for concurrent use.
+// Nil blocklists block nothing.
+type Blocklist struct {
+	database persistence.Database
+
+	mutex sync.RWMutex
+	// infoHashes are keyed by both the infohashes and the truncated (to 20 bytes) v2 infohashes,
+	// the latter of which are what v2 torrents are found by in the DHT.
+	infoHashes map[string]bool
+	patterns   []*regexp.Regexp
+}
+
+// Load loads the blocklist of the database.
+func Load(database persistence.Database) (*Blocklist, error) {
+	bl := new(Blocklist)
+	bl.database = database
+	if err := bl.Reload(); err != nil {
+		return nil, err
+	}
+	return bl, nil
+}
+
+// Reload reloads the blocklist from the database, which might have been changed by another process
+// since. The old blocklist is kept on error.
+func (bl *Blocklist) Reload() error {
+	blocks, err := bl.database.GetBlocks()
+	if err != nil {
+		return errors.Wrap(err, "GetBlocks")
+	}
+
+	infoHashes := make(map[string]bool)
+	var patterns []*regexp.Regexp
+	for _, block := range blocks {
+		if block.InfoHash != nil {
+			infoHashes[string(block.InfoHash)] = true
+			infoHashes[string(truncate(block.InfoHash))] = true
+			continue
+		}
+
+		re, err := regexp.Compile(block.NamePattern)
+		if err != nil {
+			return errors.Wrapf(err, "block %d", block.ID)
+		}
+		patterns = append(patterns, re)
+	}
+
+	bl.mutex.Lock()
+	bl.infoHashes, bl.patterns = infoHashes, patterns
+	bl.mutex.Unlock()
+
+	return nil
+}
+
+// BlocksInfoHash returns true if the infohash (either v1, v2, or truncated v2) is blocked. It is
+// meant for the torrents whose names are not known yet (e.g. before leeching), hence the name
+// patterns should be checked by Blocks as soon as they are.
+func (bl *Blocklist) BlocksInfoHash(infoHash []byte) bool {
+	if bl == nil {
+		return false
+	}
+
+	bl.mutex.RLock()
+	defer bl.mutex.RUnlock()
+	return bl.infoHashes[string(infoHash)]
+}
+
+// Blocks returns true if either of the infohashes (@infoHashV2 might be nil), or the name of the
+// torrent is blocked.
+func (bl *Blocklist) Blocks(infoHash []byte, infoHashV2 []byte, name string) bool {
+	if bl == nil {
+		return false
+	}
+
+	bl.mutex.RLock()
+	defer bl.mutex.RUnlock()
+
+	if bl.infoHashes[string(infoHash)] || (infoHashV2 != nil && bl.infoHashes[string(infoHashV2)]) {
+		return true
+	}
+	for _, re := range bl.patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter removes the blocked torrents from @torrents, in place.
+func (bl *Blocklist) Filter(torrents []persistence.TorrentMetadata) []persistence.TorrentMetadata {
+	filtered := torrents[:0]
+	for _, t := range torrents {
+		if !bl.Blocks(t.InfoHash, t.InfoHashV2, t.Name) {
+			filtered = append(filtered, t)
+		}
+	}
+	return filtered
+}
+
+// Block adds @block to the blocklist of the database, on behalf of @block.AddedBy. The torrent of
+// an infohash that is blocked is taken down as well (i.e. deleted, see Delete), whereas the torrents
+// whose names match a pattern are only suppressed, so that they are restored if unblocked. The
+// block, the takedown, and their audit entries are written in a single transaction if the database
+// engine can (see persistence.AddBlockAndDelete).
+//
+// The blocklist in memory is reloaded as well.
+func (bl *Blocklist) Block(block persistence.Block) (uint64, error) {
+	if err := Validate(block); err != nil {
+		return 0, err
+	}
+
+	entries := []persistence.AuditEntry{{
+		Action:      ActionBlock,
+		InfoHash:    block.InfoHash,
+		NamePattern: block.NamePattern,
+		Actor:       block.AddedBy,
+		Reason:      block.Reason,
+	}}
+	if block.InfoHash != nil {
+		entries = append(entries, persistence.AuditEntry{
+			Action:   ActionDelete,
+			InfoHash: block.InfoHash,
+			Actor:    block.AddedBy,
+			Reason:   block.Reason,
+		})
+	}
+	id, err := persistence.AddBlockAndDelete(bl.database, block, entries)
+	if err != nil {
+		return id, errors.Wrap(err, "AddBlockAndDelete")
+	}
+
+	return id, bl.Reload()
+}
+
+// Unblock removes the block of the given ID from the blocklist of the database on behalf of
+// @actor, and reloads the blocklist in memory.
+func (bl *Blocklist) Unblock(id uint64, actor string, reason string) error {
+	if actor == "" || reason == "" {
+		return fmt.Errorf("actor and reason must be non-empty")
+	}
+
+	var block *persistence.Block
+	blocks, err := bl.database.GetBlocks()
+	if err != nil {
+		return errors.Wrap(err, "GetBlocks")
+	}
+	for i := range blocks {
+		if blocks[i].ID == id {
+			block = &blocks[i]
+		}
+	}
+	if block == nil {
+		return fmt.Errorf("no such block: %d", id)
+	}
+
+	if err = bl.database.RemoveBlock(id); err != nil {
+		return errors.Wrap(err, "RemoveBlock")
+	}
+	err = bl.database.AddAuditEntry(persistence.AuditEntry{
+		Action:      ActionUnblock,
+		InfoHash:    block.InfoHash,
+		NamePattern: block.NamePattern,
+		Actor:       actor,
+		Reason:      reason,
+	})
+	if err != nil {
+		return errors.Wrap(err, "AddAuditEntry")
+	}
+
+	return bl.Reload()
+}
+
+// Delete deletes the torrent of the given infohash from the database on behalf of @actor. Beware
+// that the torrent might be discovered again unless it is blocked too.
+func (bl *Blocklist) Delete(infoHash []byte, actor string, reason string) error {
+	if actor == "" || reason == "" {
+		return fmt.Errorf("actor and reason must be non-empty")
+	}
+
+	if err := bl.database.DeleteTorrent(infoHash); err != nil {
+		return errors.Wrap(err, "DeleteTorrent")
+	}
+	err := bl.database.AddAuditEntry(persistence.AuditEntry{
+		Action:   ActionDelete,
+		InfoHash: infoHash,
+		Actor:    actor,
+		Reason:   reason,
+	})
+	if err != nil {
+		return errors.Wrap(err, "AddAuditEntry")
+	}
+
+	return nil
+}
+
+// Validate checks that the block has either a (v1 or v2) infohash or a valid name pattern, and
+// that its reason and who adds it are known.
+func Validate(block persistence.Block) error {
+	if (block.InfoHash == nil) == (block.NamePattern == "") {
+		return fmt.Errorf("either an infohash or a name pattern must be supplied")
+	}
+	if block.InfoHash != nil && len(block.InfoHash) != 20 && len(block.InfoHash) != 32 {
+		return fmt.Errorf("infohash must be either 20 or 32 bytes long")
+	}
+	if block.NamePattern != "" {
+		if _, err := regexp.Compile(block.NamePattern); err != nil {
+			return errors.Wrap(err, "name pattern")
+		}
+	}
+	if block.Reason == "" || block.AddedBy == "" {
+		return fmt.Errorf("reason and who adds the block must be non-empty")
+	}
+	return nil
+}
+
+func truncate(infoHash []byte) []byte {
+	if len(infoHash) > 20 {
+		return infoHash[:20]
+	}
+	return infoHash
+}
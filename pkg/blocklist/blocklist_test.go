@@ -0,0 +1,83 @@
+package blocklist
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+// blocksDatabase implements only GetBlocks of persistence.Database.
+type blocksDatabase struct {
+	persistence.Database
+	blocks []persistence.Block
+}
+
+func (db *blocksDatabase) GetBlocks() ([]persistence.Block, error) {
+	return db.blocks, nil
+}
+
+func TestBlocks(t *testing.T) {
+	v1 := bytes.Repeat([]byte{1}, 20)
+	v2 := bytes.Repeat([]byte{2}, 32)
+	bl, err := Load(&blocksDatabase{blocks: []persistence.Block{
+		{ID: 1, InfoHash: v1},
+		{ID: 2, InfoHash: v2},
+		{ID: 3, NamePattern: `(?i)\bforbidden\b`},
+	}})
+	if err != nil {
+		t.Fatalf("Couldn't load the blocklist! %s", err.Error())
+	}
+
+	testCases := []struct {
+		infoHash   []byte
+		infoHashV2 []byte
+		name       string
+		expected   bool
+	}{
+		{v1, nil, "a", true},
+		{bytes.Repeat([]byte{3}, 20), v2, "a", true},
+		{bytes.Repeat([]byte{3}, 20), nil, "The Forbidden Movie", true},
+		{bytes.Repeat([]byte{3}, 20), nil, "Unforbidden", false},
+		{bytes.Repeat([]byte{3}, 20), bytes.Repeat([]byte{4}, 32), "a", false},
+	}
+	for i, tc := range testCases {
+		if blocked := bl.Blocks(tc.infoHash, tc.infoHashV2, tc.name); blocked != tc.expected {
+			t.Errorf("Case #%d: expected %t, got %t", i, tc.expected, blocked)
+		}
+	}
+
+	// v2 torrents are found by their truncated infohashes in the DHT.
+	if !bl.BlocksInfoHash(v2[:20]) {
+		t.Error("Truncated v2 infohash is not blocked")
+	}
+
+	torrents := bl.Filter([]persistence.TorrentMetadata{{InfoHash: v1, Name: "a"}, {InfoHash: bytes.Repeat([]byte{3}, 20), Name: "b"}})
+	if len(torrents) != 1 || torrents[0].Name != "b" {
+		t.Errorf("Unexpected filtered torrents %+v", torrents)
+	}
+
+	var nilBlocklist *Blocklist
+	if nilBlocklist.Blocks(v1, nil, "forbidden") || nilBlocklist.BlocksInfoHash(v1) {
+		t.Error("Nil blocklist blocks")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for i, block := range []persistence.Block{
+		{Reason: "r", AddedBy: "a"},
+		{InfoHash: make([]byte, 20), NamePattern: "x", Reason: "r", AddedBy: "a"},
+		{InfoHash: make([]byte, 21), Reason: "r", AddedBy: "a"},
+		{NamePattern: "(", Reason: "r", AddedBy: "a"},
+		{NamePattern: "x", AddedBy: "a"},
+		{NamePattern: "x", Reason: "r"},
+	} {
+		if Validate(block) == nil {
+			t.Errorf("Case #%d: invalid block is valid", i)
+		}
+	}
+
+	if err := Validate(persistence.Block{InfoHash: make([]byte, 32), Reason: "r", AddedBy: "a"}); err != nil {
+		t.Errorf("Valid block is invalid: %s", err.Error())
+	}
+}
@@ -0,0 +1,145 @@
+// Package category classifies torrents by their content, judged by the extensions and the sizes of
+// their files.
+package category
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+const (
+	Video    = "video"
+	Audio    = "audio"
+	Software = "software"
+	EBook    = "e-book"
+	Image    = "image"
+	Archive  = "archive"
+	Game     = "game"
+	Other    = "other"
+)
+
+// All are all the categories, in the order they are listed to the users.
+var All = []string{Video, Audio, Software, EBook, Image, Archive, Game, Other}
+
+func IsValid(category string) bool {
+	for _, c := range All {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+type class struct {
+	category    string
+	subCategory string
+}
+
+var extensions = map[string]class{
+	"3gp": {Video, ""}, "avi": {Video, ""}, "flv": {Video, ""}, "m4v": {Video, ""}, "mkv": {Video, ""},
+	"mov": {Video, ""}, "mp4": {Video, ""}, "mpeg": {Video, ""}, "mpg": {Video, ""}, "ogv": {Video, ""},
+	"rmvb": {Video, ""}, "ts": {Video, ""}, "webm": {Video, ""}, "wmv": {Video, ""},
+	"vob": {Video, "dvd"}, "m2ts": {Video, "blu-ray"},
+
+	"aac": {Audio, "lossy"}, "m4a": {Audio, "lossy"}, "mp3": {Audio, "lossy"}, "mpc": {Audio, "lossy"},
+	"ogg": {Audio, "lossy"}, "opus": {Audio, "lossy"}, "wma": {Audio, "lossy"},
+	"aiff": {Audio, "lossless"}, "alac": {Audio, "lossless"}, "ape": {Audio, "lossless"},
+	"dff": {Audio, "lossless"}, "dsf": {Audio, "lossless"}, "flac": {Audio, "lossless"},
+	"wav": {Audio, "lossless"}, "wv": {Audio, "lossless"},
+	"m4b": {Audio, "audiobook"},
+
+	"exe": {Software, "windows"}, "msi": {Software, "windows"},
+	"dmg": {Software, "macos"}, "pkg": {Software, "macos"},
+	"appimage": {Software, "linux"}, "deb": {Software, "linux"}, "rpm": {Software, "linux"},
+	"apk": {Software, "android"}, "ipa": {Software, "ios"},
+	"img": {Software, "disc-image"}, "iso": {Software, "disc-image"},
+
+	"azw": {EBook, ""}, "azw3": {EBook, ""}, "djvu": {EBook, ""}, "epub": {EBook, ""}, "fb2": {EBook, ""},
+	"mobi": {EBook, ""}, "pdf": {EBook, ""},
+	"cb7": {EBook, "comic"}, "cbr": {EBook, "comic"}, "cbz": {EBook, "comic"},
+
+	"bmp": {Image, ""}, "gif": {Image, ""}, "heic": {Image, ""}, "jpeg": {Image, ""}, "jpg": {Image, ""},
+	"png": {Image, ""}, "tif": {Image, ""}, "tiff": {Image, ""}, "webp": {Image, ""},
+	"arw": {Image, "raw"}, "cr2": {Image, "raw"}, "dng": {Image, "raw"}, "nef": {Image, "raw"},
+	"raf": {Image, "raw"},
+
+	"7z": {Archive, ""}, "bz2": {Archive, ""}, "gz": {Archive, ""}, "rar": {Archive, ""}, "tar": {Archive, ""},
+	"tgz": {Archive, ""}, "xz": {Archive, ""}, "zip": {Archive, ""}, "zst": {Archive, ""},
+
+	"nes": {Game, "nes"}, "sfc": {Game, "snes"}, "smc": {Game, "snes"},
+	"gb": {Game, "game-boy"}, "gbc": {Game, "game-boy"}, "gba": {Game, "game-boy-advance"},
+	"n64": {Game, "nintendo-64"}, "v64": {Game, "nintendo-64"}, "z64": {Game, "nintendo-64"},
+	"nds": {Game, "nintendo-ds"}, "3ds": {Game, "nintendo-3ds"}, "cia": {Game, "nintendo-3ds"},
+	"gcm": {Game, "gamecube"}, "rvz": {Game, "wii"}, "wbfs": {Game, "wii"},
+	"nsp": {Game, "nintendo-switch"}, "xci": {Game, "nintendo-switch"},
+	"cso": {Game, "psp"}, "pbp": {Game, "psp"},
+}
+
+// splitArchive matches the extensions of the volumes of split archives (e.g. `.r00` and `.001`).
+var splitArchive = regexp.MustCompile(`^(r\d{2}|\d{3})$`)
+
+// dominance is the minimum share of the total size that the files of a category must have for the
+// torrent to be classified into that category, since torrents with mixed content are better off
+// in Other than in a wrong category.
+const dominance = 0.5
+
+// Classify returns the category and the sub-category (which might be empty) of a torrent with the
+// given files, which is the one whose files make up (at least half of) the most of the total size.
+// Padding files are ignored.
+func Classify(files []persistence.File) (category string, subCategory string) {
+	var total int64
+	sizes := make(map[string]int64)
+	subSizes := make(map[class]int64)
+	for _, file := range files {
+		if file.IsPadding() {
+			continue
+		}
+		total += file.Size
+
+		c, ok := classOf(file.Path)
+		if !ok {
+			continue
+		}
+		sizes[c.category] += file.Size
+		subSizes[c] += file.Size
+	}
+
+	// Ties are broken by the order of the categories in All.
+	category = Other
+	var max int64
+	for _, c := range All {
+		if sizes[c] > max {
+			category, max = c, sizes[c]
+		}
+	}
+	if max == 0 || float64(max) < dominance*float64(total) {
+		return Other, ""
+	}
+
+	max = 0
+	for c, size := range subSizes {
+		if c.category == category && c.subCategory != "" && (size > max || size == max && c.subCategory < subCategory) {
+			subCategory, max = c.subCategory, size
+		}
+	}
+	// The sub-category is likewise for the majority of the category.
+	if float64(max) < dominance*float64(sizes[category]) {
+		subCategory = ""
+	}
+
+	return category, subCategory
+}
+
+func classOf(filePath string) (class, bool) {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(filePath), "."))
+	if c, ok := extensions[ext]; ok {
+		return c, true
+	}
+	if splitArchive.MatchString(ext) {
+		return class{Archive, ""}, true
+	}
+	return class{}, false
+}
@@ -0,0 +1,42 @@
+package category
+
+import (
+	"testing"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+func TestClassify(t *testing.T) {
+	testCases := []struct {
+		files       []persistence.File
+		category    string
+		subCategory string
+	}{
+		{[]persistence.File{{Size: 4 << 30, Path: "Movie/Movie.mkv"}, {Size: 2 << 10, Path: "Movie/Movie.nfo"}, {Size: 50 << 10, Path: "Movie/poster.jpg"}},
+			Video, ""},
+		{[]persistence.File{{Size: 30 << 20, Path: "01.flac"}, {Size: 32 << 20, Path: "02.flac"}, {Size: 5 << 20, Path: "cover.JPG"}, {Size: 4 << 20, Path: "bonus.mp3"}},
+			Audio, "lossless"},
+		{[]persistence.File{{Size: 100 << 20, Path: "setup.exe"}, {Size: 1 << 10, Path: "readme.txt"}},
+			Software, "windows"},
+		{[]persistence.File{{Size: 50 << 20, Path: "a.r00"}, {Size: 50 << 20, Path: "a.r01"}, {Size: 10 << 20, Path: "a.rar"}},
+			Archive, ""},
+		{[]persistence.File{{Size: 32 << 20, Path: "game.gba"}},
+			Game, "game-boy-advance"},
+		{[]persistence.File{{Size: 3 << 20, Path: "book.epub"}, {Size: 5 << 20, Path: "book.pdf"}, {Size: 40 << 20, Path: "vol1.cbz"}},
+			EBook, "comic"},
+		// No category makes up at least half of the total size.
+		{[]persistence.File{{Size: 40 << 20, Path: "a.mp4"}, {Size: 30 << 20, Path: "b.zip"}, {Size: 30 << 20, Path: "c.bin"}},
+			Other, ""},
+		// Padding files are ignored.
+		{[]persistence.File{{Size: 10 << 20, Path: "photo.png"}, {Size: 30 << 20, Path: ".pad/1", Attributes: "p"}},
+			Image, ""},
+		{nil, Other, ""},
+	}
+
+	for i, tc := range testCases {
+		category, subCategory := Classify(tc.files)
+		if category != tc.category || subCategory != tc.subCategory {
+			t.Errorf("Case #%d: expected %s/%s, got %s/%s", i, tc.category, tc.subCategory, category, subCategory)
+		}
+	}
+}
@@ -0,0 +1,481 @@
+package persistence
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// NewTorrent is a torrent to be added by AddNewTorrents (see Database.AddNewTorrent), together with
+// its bencoded info dictionary if it is to be stored (see Database.SetInfoDict).
+type NewTorrent struct {
+	InfoHash   []byte            `json:"infoHash"`
+	InfoHashV2 []byte            `json:"infoHashV2,omitempty"`
+	Name       string            `json:"name"`
+	Files      []File            `json:"files"`
+	Attributes TorrentAttributes `json:"attributes"`
+	InfoDict   []byte            `json:"infoDict,omitempty"`
+	// DiscoveredOn is zero for the torrents that are discovered now, and is set for the ones that
+	// are imported from another database.
+	DiscoveredOn int64 `json:"discoveredOn,omitempty"`
+}
+
+// discoveredOn returns when the torrent is discovered, which is now unless set otherwise.
+func (t *NewTorrent) discoveredOn() int64 {
+	if t.DiscoveredOn != 0 {
+		return t.DiscoveredOn
+	}
+	return time.Now().Unix()
+}
+
+// totalSize is the total size of the files of the torrent, excluding the padding files.
+func (t *NewTorrent) totalSize() uint64 {
+	var totalSize uint64 = 0
+	for _, file := range t.Files {
+		if !file.IsPadding() {
+			totalSize += uint64(file.Size)
+		}
+	}
+	return totalSize
+}
+
+// isUTF8 returns whether the name and the paths of the torrent are UTF-8 compliant, which the
+// engines other than SQLite require, logging the reason if they are not.
+func (t *NewTorrent) isUTF8() bool {
+	if !utf8.ValidString(t.Name) {
+		zap.L().Warn(
+			"Ignoring a torrent whose name is not UTF-8 compliant.",
+			zap.ByteString("infoHash", t.InfoHash),
+			zap.Binary("name", []byte(t.Name)),
+		)
+		return false
+	}
+
+	for _, file := range t.Files {
+		if !utf8.ValidString(file.Path) {
+			zap.L().Warn(
+				"Ignoring a torrent with a file whose path is not UTF-8 compliant.",
+				zap.ByteString("infoHash", t.InfoHash),
+				zap.Binary("path", []byte(file.Path)),
+			)
+			return false
+		}
+	}
+
+	return true
+}
+
+// batchAdder is implemented by the database engines that can add many torrents at once, in a
+// single transaction. As in AddNewTorrent, the torrents that exist already are ignored.
+type batchAdder interface {
+	AddNewTorrents(torrents []NewTorrent) error
+}
+
+// AddNewTorrents adds the torrents to @database at once if its engine can, and one by one
+// otherwise, in which case their info dictionaries are not stored if the engine cannot store them.
+func AddNewTorrents(database Database, torrents []NewTorrent) error {
+	if adder, ok := database.(batchAdder); ok {
+		return adder.AddNewTorrents(torrents)
+	}
+
+	for _, t := range torrents {
+		if err := database.AddNewTorrent(t.InfoHash, t.InfoHashV2, t.Name, t.Files, t.Attributes); err != nil {
+			return errors.Wrap(err, "AddNewTorrent")
+		}
+		if t.InfoDict == nil {
+			continue
+		}
+		if err := database.SetInfoDict(t.InfoHash, t.InfoDict); err != nil && errors.Cause(err) != NotImplementedError {
+			return errors.Wrap(err, "SetInfoDict")
+		}
+	}
+	return nil
+}
+
+// maxPendingBatches is how many batches might be pending before AddNewTorrent waits for them to
+// be flushed, so that the pending torrents do not pile up indefinitely if the database cannot keep
+// up.
+const maxPendingBatches = 4
+
+// maxBatchAttempts is how many times a batch is attempted before its torrents are added one by one,
+// so that a torrent which cannot be added (e.g. as it violates a constraint) does not block the
+// rest forever.
+const maxBatchAttempts = 3
+
+// batched is a write-behind database which adds the torrents to the underlying database
+// asynchronously, in batches, so that AddNewTorrent need not wait for a transaction per torrent.
+//
+// The pending torrents are accounted for by DoesTorrentExist, and their info dictionaries and
+// readmes are flushed together with them. All the other methods are passed through.
+type batched struct {
+	Database
+
+	size     int
+	interval time.Duration
+
+	mutex sync.Mutex
+	// flushed is broadcast (with mutex) after every flush.
+	flushed *sync.Cond
+	pending []*batchedTorrent
+	// torrents are the pending torrents and the ones being flushed, by all their infohashes
+	// (including the truncated v2 infohash).
+	torrents map[string]*batchedTorrent
+	// err is the error of the last flush if it failed, which is returned by Close.
+	err     error
+	closed  bool
+	metrics BatchMetrics
+
+	full    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type batchedTorrent struct {
+	NewTorrent
+	readme   *Readme
+	flushing bool
+	// attempts is the number of the failed attempts to flush the torrent.
+	attempts int
+}
+
+// BatchMetrics are the metrics of the flushes of a batched database since it is opened.
+type BatchMetrics struct {
+	NFlushes  uint64 `json:"nFlushes"`
+	NTorrents uint64 `json:"nTorrents"` // flushed successfully
+	NFailures uint64 `json:"nFailures"`
+	// NDropped is the number of the torrents that cannot be added even one by one, although the
+	// underlying database is available, which are dropped.
+	NDropped uint64 `json:"nDropped"`
+	// LastError is the error of the last flush if it failed.
+	LastError   string        `json:"lastError,omitempty"`
+	MeanLatency time.Duration `json:"meanLatency"`
+	MaxLatency  time.Duration `json:"maxLatency"`
+	LastLatency time.Duration `json:"lastLatency"`
+}
+
+// NewBatched returns a database that adds the torrents to @database in batches of (at most) @size
+// torrents, each in a single transaction, flushed every @interval at the latest and on Close.
+//
+// A batch that fails is retried on the next flush (together with the torrents pending meanwhile),
+// and after maxBatchAttempts its torrents are added one by one, dropping the ones that cannot be
+// added although the underlying database is available. The errors of the flushes are logged and
+// reported by Metrics, rather than returned by AddNewTorrent, which always queues the torrent
+// (waiting for the pending torrents to be flushed if there are too many). Close returns the error of
+// the final flush, if any, in which case the pending torrents are lost.
+//
+// @database itself is returned if @size is less than 2, or if its engine cannot add many torrents
+// at once.
+func NewBatched(database Database, size int, interval time.Duration) Database {
+	if size < 2 {
+		return database
+	}
+	if _, ok := database.(batchAdder); !ok {
+		zap.L().Warn("Database engine does not support batched writes, writing torrents one by one.")
+		return database
+	}
+
+	b := &batched{
+		Database: database,
+		size:     size,
+		interval: interval,
+		torrents: make(map[string]*batchedTorrent),
+		full:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	b.flushed = sync.NewCond(&b.mutex)
+	go b.run()
+	return b
+}
+
+func (b *batched) run() {
+	defer close(b.stopped)
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.full:
+		case <-b.done:
+			b.flush()
+			return
+		}
+		b.flush()
+	}
+}
+
+// flush flushes the pending torrents, batch by batch, until there are none left or a batch fails,
+// in which case the (rest of the) batch is put back in front of the pending torrents to be retried
+// on the next flush.
+func (b *batched) flush() {
+	for {
+		b.mutex.Lock()
+		n := len(b.pending)
+		if n == 0 {
+			b.mutex.Unlock()
+			return
+		}
+		if n > b.size {
+			n = b.size
+		}
+		batch := b.pending[:n:n]
+		b.pending = append([]*batchedTorrent(nil), b.pending[n:]...)
+		for _, t := range batch {
+			t.flushing = true
+		}
+		b.mutex.Unlock()
+
+		start := time.Now()
+		err := b.add(batch)
+		latency := time.Since(start)
+
+		// rest are the torrents to be retried.
+		var rest, dropped []*batchedTorrent
+		if err != nil {
+			rest = batch
+			for _, t := range batch {
+				t.attempts++
+			}
+			// The first torrent is the one that has been pending the longest.
+			if batch[0].attempts >= maxBatchAttempts {
+				rest, dropped = b.addOneByOne(batch, err)
+			}
+		}
+
+		b.mutex.Lock()
+		// The torrents before the rest are either added or dropped.
+		for _, t := range batch[:len(batch)-len(rest)] {
+			b.unindex(t)
+		}
+		for _, t := range rest {
+			t.flushing = false
+		}
+		b.pending = append(rest, b.pending...)
+		b.metrics.NFlushes++
+		b.metrics.MeanLatency += (latency - b.metrics.MeanLatency) / time.Duration(b.metrics.NFlushes)
+		if latency > b.metrics.MaxLatency {
+			b.metrics.MaxLatency = latency
+		}
+		b.metrics.LastLatency = latency
+		b.metrics.NTorrents += uint64(len(batch) - len(rest) - len(dropped))
+		b.metrics.NDropped += uint64(len(dropped))
+		if err != nil {
+			b.metrics.NFailures++
+			b.metrics.LastError = err.Error()
+		}
+		if len(rest) > 0 {
+			b.err = errors.Wrap(err, "flush")
+		} else {
+			b.err = nil
+		}
+		b.flushed.Broadcast()
+		b.mutex.Unlock()
+
+		if len(rest) > 0 {
+			zap.L().Error("Could not flush a batch of torrents", zap.Int("n", n), zap.Error(err))
+			return
+		}
+		zap.L().Debug("Flushed a batch of torrents", zap.Int("n", n), zap.Duration("latency", latency))
+		if latency > b.interval {
+			zap.L().Warn("Flushing a batch of torrents takes longer than the batch interval",
+				zap.Int("n", n), zap.Duration("latency", latency), zap.Duration("interval", b.interval))
+		}
+	}
+}
+
+// addOneByOne adds the torrents of a batch that failed with @err one by one (like
+// spooled.addOneByOne), and returns the torrents that are left to be retried as the underlying
+// database is unavailable, and the ones that are dropped as they cannot be added although it is
+// available.
+func (b *batched) addOneByOne(batch []*batchedTorrent, err error) (rest []*batchedTorrent, dropped []*batchedTorrent) {
+	for i, t := range batch {
+		if _, pingErr := b.Database.DoesTorrentExist(t.InfoHash); pingErr != nil {
+			return batch[i:], dropped
+		}
+		if err = b.add(batch[i : i+1]); err == nil {
+			continue
+		}
+		if _, pingErr := b.Database.DoesTorrentExist(t.InfoHash); pingErr != nil {
+			return batch[i:], dropped
+		}
+
+		zap.L().Error("Dropping a torrent that cannot be added",
+			zap.Binary("infoHash", t.InfoHash), zap.String("name", t.Name), zap.Error(err))
+		dropped = append(dropped, t)
+	}
+	return nil, dropped
+}
+
+func (b *batched) add(batch []*batchedTorrent) error {
+	torrents := make([]NewTorrent, len(batch))
+	for i, t := range batch {
+		torrents[i] = t.NewTorrent
+	}
+	if err := b.Database.(batchAdder).AddNewTorrents(torrents); err != nil {
+		return errors.Wrap(err, "AddNewTorrents")
+	}
+
+	// Readmes are nice to have, hence not worth failing the batch for (just like in magneticod).
+	for _, t := range batch {
+		if t.readme == nil {
+			continue
+		}
+		if err := b.Database.SetReadme(t.InfoHash, *t.readme); err != nil {
+			zap.L().Error("Could not store the readme", zap.Binary("infoHash", t.InfoHash), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+func (b *batched) index(t *batchedTorrent) {
+	b.torrents[string(t.InfoHash)] = t
+	if t.InfoHashV2 != nil {
+		b.torrents[string(t.InfoHashV2)] = t
+		b.torrents[string(t.InfoHashV2[:20])] = t
+	}
+}
+
+func (b *batched) unindex(t *batchedTorrent) {
+	delete(b.torrents, string(t.InfoHash))
+	if t.InfoHashV2 != nil {
+		delete(b.torrents, string(t.InfoHashV2))
+		delete(b.torrents, string(t.InfoHashV2[:20]))
+	}
+}
+
+// pendingTorrent returns the pending torrent of the given InfoHash (either v1 or v2), after waiting
+// for it to be flushed if it is being flushed, or nil if there is none. mutex must be held.
+func (b *batched) pendingTorrent(infoHash []byte) *batchedTorrent {
+	for {
+		t := b.torrents[string(infoHash)]
+		if t == nil || !t.flushing {
+			return t
+		}
+		b.flushed.Wait()
+	}
+}
+
+// Metrics returns the metrics of the flushes.
+func (b *batched) Metrics() BatchMetrics {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.metrics
+}
+
+func (b *batched) DoesTorrentExist(infoHash []byte) (bool, error) {
+	b.mutex.Lock()
+	_, exists := b.torrents[string(infoHash)]
+	b.mutex.Unlock()
+	if exists {
+		return true, nil
+	}
+
+	return b.Database.DoesTorrentExist(infoHash)
+}
+
+func (b *batched) AddNewTorrent(infoHash []byte, infoHashV2 []byte, name string, files []File, attributes TorrentAttributes) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for !b.closed && len(b.pending) >= maxPendingBatches*b.size {
+		b.flushed.Wait()
+	}
+	if b.closed {
+		return fmt.Errorf("database is closed")
+	}
+
+	// The torrent exists already (see sqlite3Database.AddNewTorrent for how).
+	if _, exists := b.torrents[string(infoHash)]; exists {
+		return nil
+	}
+
+	t := &batchedTorrent{NewTorrent: NewTorrent{
+		InfoHash:   infoHash,
+		InfoHashV2: infoHashV2,
+		Name:       name,
+		Files:      files,
+		Attributes: attributes,
+	}}
+	b.pending = append(b.pending, t)
+	b.index(t)
+
+	if len(b.pending) >= b.size {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+func (b *batched) SetInfoDict(infoHash []byte, infoDict []byte) error {
+	b.mutex.Lock()
+	if t := b.pendingTorrent(infoHash); t != nil {
+		t.InfoDict = infoDict
+		b.mutex.Unlock()
+		return nil
+	}
+	b.mutex.Unlock()
+
+	return b.Database.SetInfoDict(infoHash, infoDict)
+}
+
+func (b *batched) SetReadme(infoHash []byte, readme Readme) error {
+	b.mutex.Lock()
+	if t := b.pendingTorrent(infoHash); t != nil {
+		t.readme = &readme
+		b.mutex.Unlock()
+		return nil
+	}
+	b.mutex.Unlock()
+
+	return b.Database.SetReadme(infoHash, readme)
+}
+
+// DeleteTorrent deletes the torrent from the pending torrents as well, so that it is not added
+// after the fact.
+func (b *batched) DeleteTorrent(infoHash []byte) error {
+	b.mutex.Lock()
+	if t := b.pendingTorrent(infoHash); t != nil {
+		for i := range b.pending {
+			if b.pending[i] == t {
+				b.pending = append(b.pending[:i], b.pending[i+1:]...)
+				break
+			}
+		}
+		b.unindex(t)
+	}
+	b.mutex.Unlock()
+
+	return b.Database.DeleteTorrent(infoHash)
+}
+
+// Close flushes the pending torrents (logging the metrics of the flushes) before closing the
+// underlying database, and returns the error of the final flush if any.
+func (b *batched) Close() error {
+	b.mutex.Lock()
+	b.closed = true
+	b.flushed.Broadcast()
+	b.mutex.Unlock()
+
+	close(b.done)
+	<-b.stopped
+
+	b.mutex.Lock()
+	err, nPending := b.err, len(b.pending)
+	b.mutex.Unlock()
+	zap.L().Info("Closing batched database", zap.Any("metrics", b.Metrics()), zap.Int("nLost", nPending))
+
+	if closeErr := b.Database.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
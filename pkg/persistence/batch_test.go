@@ -0,0 +1,196 @@
+package persistence
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchDatabase implements only the methods of Database that the tests of batched call.
+type batchDatabase struct {
+	Database
+	mutex sync.Mutex
+	// err is returned by all the methods, as if the database is unavailable.
+	err error
+	// rejected is the name of the torrent that cannot be added, as if it violates a constraint.
+	rejected  string
+	batches   [][]NewTorrent
+	infoDicts int
+	closed    bool
+}
+
+func (db *batchDatabase) DoesTorrentExist(infoHash []byte) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return false, db.err
+}
+
+func (db *batchDatabase) AddNewTorrents(torrents []NewTorrent) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.err != nil {
+		return db.err
+	}
+	for _, t := range torrents {
+		if t.Name == db.rejected {
+			return fmt.Errorf("constraint violated")
+		}
+	}
+	db.batches = append(db.batches, torrents)
+	for _, t := range torrents {
+		if t.InfoDict != nil {
+			db.infoDicts++
+		}
+	}
+	return nil
+}
+
+func (db *batchDatabase) Close() error {
+	db.closed = true
+	return nil
+}
+
+func TestBatched(t *testing.T) {
+	underlying := new(batchDatabase)
+	// The interval is long enough for the batches to be flushed only when they are full.
+	b := NewBatched(underlying, 2, time.Hour)
+
+	_ = b.AddNewTorrent([]byte("a"), nil, "a", nil, TorrentAttributes{})
+	if exists, _ := b.DoesTorrentExist([]byte("a")); !exists {
+		t.Error("Pending torrent does not exist")
+	}
+	_ = b.SetInfoDict([]byte("a"), []byte("d"))
+	_ = b.AddNewTorrent([]byte("b"), nil, "b", nil, TorrentAttributes{})
+	_ = b.AddNewTorrent([]byte("c"), nil, "c", nil, TorrentAttributes{})
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %s", err.Error())
+	}
+	if !underlying.closed {
+		t.Error("Underlying database is not closed")
+	}
+	if len(underlying.batches) != 2 || len(underlying.batches[0]) != 2 || len(underlying.batches[1]) != 1 {
+		t.Errorf("Torrents are not flushed in batches of 2 (and on Close): %v", underlying.batches)
+	}
+	if underlying.infoDicts != 1 {
+		t.Errorf("Info dictionary of the pending torrent is not flushed with it")
+	}
+	if metrics := b.(*batched).Metrics(); metrics.NFlushes != 2 || metrics.NTorrents != 3 {
+		t.Errorf("Wrong metrics: %+v", metrics)
+	}
+}
+
+// names returns the names of the torrents added to the database, in order.
+func (db *batchDatabase) names() string {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	var names string
+	for _, batch := range db.batches {
+		for _, torrent := range batch {
+			names += torrent.Name
+		}
+	}
+	return names
+}
+
+func TestBatchedError(t *testing.T) {
+	underlying := &batchDatabase{err: fmt.Errorf("unavailable")}
+	b := NewBatched(underlying, 2, time.Millisecond)
+
+	_ = b.AddNewTorrent([]byte("a"), nil, "a", nil, TorrentAttributes{})
+	// The torrents are not dropped however many times the batch fails, as the database is
+	// unavailable.
+	for i := 0; i < 100 && b.(*batched).Metrics().NFailures <= maxBatchAttempts; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := b.AddNewTorrent([]byte("b"), nil, "b", nil, TorrentAttributes{}); err != nil {
+		t.Errorf("Error of the flush is returned by the subsequent write: %s", err.Error())
+	}
+	if exists, _ := b.DoesTorrentExist([]byte("a")); !exists {
+		t.Error("Torrent of the failed batch is not pending anymore")
+	}
+	if metrics := b.(*batched).Metrics(); metrics.LastError == "" || metrics.NDropped != 0 {
+		t.Errorf("Wrong metrics of the failed flushes: %+v", metrics)
+	}
+
+	underlying.mutex.Lock()
+	underlying.err = nil
+	underlying.mutex.Unlock()
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %s", err.Error())
+	}
+	if names := underlying.names(); names != "ab" {
+		t.Errorf("Failed batch is not retried: %q", names)
+	}
+}
+
+func TestBatchedRejected(t *testing.T) {
+	underlying := &batchDatabase{rejected: "b"}
+	b := NewBatched(underlying, 3, time.Millisecond)
+
+	_ = b.AddNewTorrent([]byte("a"), nil, "a", nil, TorrentAttributes{})
+	_ = b.AddNewTorrent([]byte("b"), nil, "b", nil, TorrentAttributes{})
+	_ = b.AddNewTorrent([]byte("c"), nil, "c", nil, TorrentAttributes{})
+	for i := 0; i < 100 && b.(*batched).Metrics().NDropped == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_ = b.AddNewTorrent([]byte("d"), nil, "d", nil, TorrentAttributes{})
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %s", err.Error())
+	}
+
+	if names := underlying.names(); names != "acd" {
+		t.Errorf("Rejected torrent blocks the rest: %q", names)
+	}
+	if metrics := b.(*batched).Metrics(); metrics.NDropped != 1 || metrics.NTorrents != 3 || metrics.NFailures != maxBatchAttempts {
+		t.Errorf("Wrong metrics: %+v", metrics)
+	}
+}
+
+func TestBatchedFull(t *testing.T) {
+	underlying := &batchDatabase{err: fmt.Errorf("unavailable")}
+	b := NewBatched(underlying, 2, time.Millisecond)
+
+	for i := 0; i < maxPendingBatches*2; i++ {
+		_ = b.AddNewTorrent([]byte{byte(i)}, nil, "a", nil, TorrentAttributes{})
+	}
+	// The pending torrents do not pile up even though the flushes fail.
+	added := make(chan error)
+	go func() {
+		added <- b.AddNewTorrent([]byte("last"), nil, "b", nil, TorrentAttributes{})
+	}()
+	select {
+	case <-added:
+		t.Fatal("Torrent is queued although too many torrents are pending")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	underlying.mutex.Lock()
+	underlying.err = nil
+	underlying.mutex.Unlock()
+	select {
+	case err := <-added:
+		if err != nil {
+			t.Errorf("AddNewTorrent: %s", err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Torrent is not queued once the pending torrents are flushed")
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %s", err.Error())
+	}
+	if names := underlying.names(); len(names) != maxPendingBatches*2+1 {
+		t.Errorf("Not all of the torrents are added: %q", names)
+	}
+}
+
+func TestBatchedCloseError(t *testing.T) {
+	underlying := &batchDatabase{err: fmt.Errorf("unavailable")}
+	b := NewBatched(underlying, 2, time.Hour)
+
+	_ = b.AddNewTorrent([]byte("a"), nil, "a", nil, TorrentAttributes{})
+	if err := b.Close(); err == nil {
+		t.Error("Error of the final flush is not returned by Close")
+	}
+}
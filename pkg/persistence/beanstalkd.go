@@ -52,11 +52,14 @@ func (s *beanstalkd) DoesTorrentExist(infoHash []byte) (bool, error) {
 	return false, nil
 }
 
-func (s *beanstalkd) AddNewTorrent(infoHash []byte, name string, files []File) error {
+func (s *beanstalkd) AddNewTorrent(infoHash []byte, infoHashV2 []byte, name string, files []File, attributes TorrentAttributes) error {
 	payloadJson, err := json.Marshal(SimpleTorrentSummary{
-		InfoHash: hex.EncodeToString(infoHash),
-		Name:     name,
-		Files:    files,
+		InfoHash:   hex.EncodeToString(infoHash),
+		InfoHashV2: hex.EncodeToString(infoHashV2),
+		Name:       name,
+		Files:      files,
+
+		TorrentAttributes: attributes,
 	})
 
 	if err != nil {
@@ -85,6 +88,7 @@ func (s *beanstalkd) GetNumberOfTorrents() (uint, error) {
 
 func (s *beanstalkd) QueryTorrents(
 	query string,
+	filter QueryFilter,
 	epoch int64,
 	orderBy OrderingCriteria,
 	ascending bool,
@@ -106,3 +110,75 @@ func (s *beanstalkd) GetFiles(infoHash []byte) ([]File, error) {
 func (s *beanstalkd) GetStatistics(from string, n uint) (*Statistics, error) {
 	return nil, NotImplementedError
 }
+
+func (s *beanstalkd) DeleteTorrent(infoHash []byte) error {
+	return NotImplementedError
+}
+
+func (s *beanstalkd) AddBlock(block Block) (uint64, error) {
+	return 0, NotImplementedError
+}
+
+func (s *beanstalkd) RemoveBlock(id uint64) error {
+	return NotImplementedError
+}
+
+func (s *beanstalkd) GetBlocks() ([]Block, error) {
+	return nil, NotImplementedError
+}
+
+func (s *beanstalkd) AddAuditEntry(entry AuditEntry) error {
+	return NotImplementedError
+}
+
+func (s *beanstalkd) GetAuditLog(limit uint) ([]AuditEntry, error) {
+	return nil, NotImplementedError
+}
+
+func (s *beanstalkd) GetUnparsedTorrents(limit uint) ([]TorrentMetadata, error) {
+	return nil, NotImplementedError
+}
+
+func (s *beanstalkd) SetRelease(infoHash []byte, release Release) error {
+	return NotImplementedError
+}
+
+func (s *beanstalkd) GetUncategorisedTorrents(limit uint) ([][]byte, error) {
+	return nil, NotImplementedError
+}
+
+func (s *beanstalkd) SetCategory(infoHash []byte, category string, subCategory string) error {
+	return NotImplementedError
+}
+
+func (s *beanstalkd) SetInfoDict(infoHash []byte, infoDict []byte) error {
+	return NotImplementedError
+}
+
+func (s *beanstalkd) GetInfoDict(infoHash []byte) ([]byte, error) {
+	return nil, NotImplementedError
+}
+
+func (s *beanstalkd) SetReadme(infoHash []byte, readme Readme) error {
+	return NotImplementedError
+}
+
+func (s *beanstalkd) GetReadme(infoHash []byte) (*Readme, error) {
+	return nil, NotImplementedError
+}
+
+func (s *beanstalkd) AddFailedFetch(infoHash []byte, reason string, nextAttemptOn int64) error {
+	return NotImplementedError
+}
+
+func (s *beanstalkd) GetDueFailedFetches(now int64, limit uint) ([]FailedFetch, error) {
+	return nil, NotImplementedError
+}
+
+func (s *beanstalkd) UpdateFailedFetch(infoHash []byte, nAttempts uint, nextAttemptOn *int64) error {
+	return NotImplementedError
+}
+
+func (s *beanstalkd) DumpTorrents(afterID uint64, limit uint, withInfoDicts bool) ([]DumpedTorrent, error) {
+	return nil, NotImplementedError
+}
@@ -0,0 +1,41 @@
+package persistence
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// compress and decompress are used by the engines to store the (rather large) BLOBs such as the
+// info dictionaries.
+//
+// Beware that the bulk of an info dictionary is its `pieces`, which are SHA-1 hashes hence
+// incompressible; yet the file lists of multi-file torrents usually compress very well.
+
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, errors.Wrap(err, "zlib.Writer.Write")
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.Wrap(err, "zlib.Writer.Close")
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "zlib.NewReader")
+	}
+	defer r.Close()
+
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "ioutil.ReadAll")
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,134 @@
+package persistence
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// DumpedTorrent is a torrent with all that is persisted of it, as returned by DumpTorrents, which
+// can be added to another database by AddNewTorrents (and SetReadme).
+type DumpedTorrent struct {
+	ID uint64
+	NewTorrent
+	// Readme is nil if the torrent has no readme.
+	Readme *Readme
+}
+
+// sqlDumpTorrents implements DumpTorrents for the SQL engines, whose schemas are alike. @rebind
+// converts the `?` placeholders of a query to the ones of the engine.
+func sqlDumpTorrents(conn *sql.DB, rebind func(string) string, afterID uint64, limit uint, withInfoDicts bool) ([]DumpedTorrent, error) {
+	infoDict := "NULL"
+	if withInfoDicts {
+		infoDict = "info_dict"
+	}
+
+	rows, err := conn.Query(rebind(`
+		SELECT
+			id,
+			info_hash,
+			info_hash_v2,
+			name,
+			discovered_on,
+			piece_length,
+			private,
+			source,
+			encoding,
+			original_name,
+			undecodable,
+			tags,
+			category,
+			sub_category,
+			spam_score,
+			quality_flags,
+			`+infoDict+`,
+			`+releaseColumns+`
+		FROM torrents
+		WHERE id > ?
+		ORDER BY id
+		LIMIT ?;`), afterID, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "Query (torrents)")
+	}
+	defer rows.Close()
+
+	torrents := make([]DumpedTorrent, 0, limit)
+	// indices are the indices of the torrents by their IDs.
+	indices := make(map[uint64]int)
+	for rows.Next() {
+		var t DumpedTorrent
+		var pieceLength, spamScore sql.NullInt64
+		var source, encoding, tags, category, subCategory, qualityFlags sql.NullString
+		var compressed []byte
+		var release nullRelease
+		err = rows.Scan(append([]interface{}{&t.ID, &t.InfoHash, &t.InfoHashV2, &t.Name, &t.DiscoveredOn,
+			&pieceLength, &t.Attributes.Private, &source, &encoding, &t.Attributes.OriginalName,
+			&t.Attributes.Undecodable, &tags, &category, &subCategory, &spamScore, &qualityFlags,
+			&compressed}, release.destinations()...)...)
+		if err != nil {
+			return nil, errors.Wrap(err, "rows.Scan (torrents)")
+		}
+
+		t.Attributes.PieceLength, t.Attributes.Source = pieceLength.Int64, source.String
+		t.Attributes.Encoding, t.Attributes.Tags = encoding.String, splitTags(tags.String)
+		t.Attributes.Category, t.Attributes.SubCategory = category.String, subCategory.String
+		t.Attributes.SpamScore, t.Attributes.QualityFlags = int(spamScore.Int64), splitTags(qualityFlags.String)
+		t.Attributes.Release = release.release()
+		if compressed != nil {
+			if t.InfoDict, err = decompress(compressed); err != nil {
+				return nil, errors.Wrap(err, "decompress")
+			}
+		}
+
+		indices[t.ID] = len(torrents)
+		torrents = append(torrents, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "rows.Err (torrents)")
+	}
+	if len(torrents) == 0 {
+		return torrents, nil
+	}
+
+	// The files of the torrents are queried by the range of their IDs, which makes use of the
+	// index on torrent_id. The padding files are included as well, since AddNewTorrents needs them.
+	fileRows, err := conn.Query(rebind(`
+		SELECT torrent_id, size, path, attributes, original_path, content
+		FROM files
+		WHERE torrent_id > ? AND torrent_id <= ?
+		ORDER BY torrent_id, id;`), afterID, torrents[len(torrents)-1].ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Query (files)")
+	}
+	defer fileRows.Close()
+
+	for fileRows.Next() {
+		var torrentID uint64
+		var file File
+		var attributes, content sql.NullString
+		if err = fileRows.Scan(&torrentID, &file.Size, &file.Path, &attributes, &file.OriginalPath, &content); err != nil {
+			return nil, errors.Wrap(err, "rows.Scan (files)")
+		}
+		file.Attributes = attributes.String
+
+		i, ok := indices[torrentID]
+		if !ok {
+			continue
+		}
+		torrents[i].Files = append(torrents[i].Files, file)
+		// Only the readmes have contents.
+		if content.Valid {
+			torrents[i].Readme = &Readme{Path: file.Path, Content: content.String}
+		}
+	}
+	if err = fileRows.Err(); err != nil {
+		return nil, errors.Wrap(err, "rows.Err (files)")
+	}
+
+	return torrents, nil
+}
+
+// sqlIdentity is the @rebind of sqlDumpTorrents for the engines whose placeholders are `?`.
+func sqlIdentity(query string) string {
+	return query
+}
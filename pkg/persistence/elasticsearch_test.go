@@ -0,0 +1,321 @@
+package persistence
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// esStub implements (the subset used of) the REST API of Elasticsearch, storing the documents of a
+// single index in memory.
+type esStub struct {
+	t     *testing.T
+	mutex sync.Mutex
+	index string
+	// created is whether the index is created.
+	created  bool
+	template esObject
+	// mapping is the mapping put after the index is created.
+	mapping esObject
+	docs    map[string]esObject
+	// searches are the bodies of the search requests, in order.
+	searches []esObject
+}
+
+// matches returns whether @doc matches @query, whose `bool.should` terms are evaluated only.
+func (s *esStub) matches(doc esObject, query esObject) bool {
+	if query == nil {
+		return true
+	}
+	should, ok := query["bool"].(esObject)["should"].([]interface{})
+	if !ok {
+		return true
+	}
+	for _, clause := range should {
+		for field, value := range clause.(esObject)["term"].(esObject) {
+			if doc[field] == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *esStub) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var body esObject
+	if r.Body != nil && r.URL.Path != "/_bulk" {
+		_ = json.NewDecoder(r.Body).Decode(&body)
+	}
+	query, _ := body["query"].(esObject)
+	reply := func(v interface{}) {
+		rw.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(rw).Encode(v)
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/"+s.index)
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/_index_template/"):
+		s.template = body
+		reply(esObject{"acknowledged": true})
+
+	case r.URL.Path == "/"+s.index && r.Method == http.MethodHead:
+		if !s.created {
+			rw.WriteHeader(http.StatusNotFound)
+		}
+
+	case r.URL.Path == "/"+s.index && r.Method == http.MethodPut:
+		s.created = true
+		reply(esObject{"acknowledged": true})
+
+	case path == "/_mapping" && r.Method == http.MethodPut:
+		s.mapping = body
+		reply(esObject{"acknowledged": true})
+
+	case r.URL.Path == "/_bulk":
+		if r.Header.Get("Content-Type") != "application/x-ndjson" {
+			s.t.Errorf("Wrong content type of _bulk: %s", r.Header.Get("Content-Type"))
+		}
+		var items []esObject
+		hasErrors := false
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action, doc esObject
+			_ = json.Unmarshal(scanner.Bytes(), &action)
+			scanner.Scan()
+			_ = json.Unmarshal(scanner.Bytes(), &doc)
+			id := action["create"].(esObject)["_id"].(string)
+			if _, exists := s.docs[id]; exists {
+				hasErrors = true
+				items = append(items, esObject{"create": esObject{"_id": id, "status": 409}})
+			} else {
+				s.docs[id] = doc
+				items = append(items, esObject{"create": esObject{"_id": id, "status": 201}})
+			}
+		}
+		reply(esObject{"errors": hasErrors, "items": items})
+
+	case path == "/_count":
+		count := 0
+		for _, doc := range s.docs {
+			if s.matches(doc, query) {
+				count++
+			}
+		}
+		reply(esObject{"count": count})
+
+	case path == "/_search":
+		s.searches = append(s.searches, body)
+		var hits []esObject
+		for id, doc := range s.docs {
+			if s.matches(doc, query) {
+				hits = append(hits, esObject{"_id": id, "_score": 2.5, "_source": doc})
+			}
+		}
+		sort.Slice(hits, func(i, j int) bool {
+			return hits[i]["_source"].(esObject)["id"].(float64) < hits[j]["_source"].(esObject)["id"].(float64)
+		})
+		reply(esObject{"hits": esObject{"hits": hits}})
+
+	case strings.HasPrefix(path, "/_doc/"):
+		id := strings.TrimPrefix(path, "/_doc/")
+		if doc, exists := s.docs[id]; exists {
+			reply(esObject{"_id": id, "found": true, "_source": doc})
+		} else {
+			rw.WriteHeader(http.StatusNotFound)
+			reply(esObject{"_id": id, "found": false})
+		}
+
+	case strings.HasPrefix(path, "/_update/"):
+		doc := s.docs[strings.TrimPrefix(path, "/_update/")]
+		for field, value := range body["doc"].(esObject) {
+			doc[field] = value
+		}
+		reply(esObject{"result": "updated"})
+
+	case path == "/_delete_by_query":
+		for id, doc := range s.docs {
+			if s.matches(doc, query) {
+				delete(s.docs, id)
+			}
+		}
+		reply(esObject{"deleted": 1})
+
+	default:
+		s.t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		rw.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestElasticsearch(t *testing.T) {
+	stub := &esStub{t: t, index: "torrents", docs: make(map[string]esObject)}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	db, err := MakeDatabase(strings.Replace(server.URL, "http://", "elasticsearch://", 1)+"/torrents", nil)
+	if err != nil {
+		t.Fatalf("MakeDatabase: %s", err.Error())
+	}
+	defer db.Close()
+	if !stub.created || stub.template["index_patterns"].([]interface{})[0] != "torrents" {
+		t.Errorf("Index is not set up: %v %v", stub.created, stub.template)
+	}
+
+	err = AddNewTorrents(db, []NewTorrent{
+		{
+			InfoHash: []byte{0x01},
+			Name:     "ubuntu desktop",
+			Files: []File{
+				{Size: 100, Path: "ubuntu.iso"},
+				{Size: 10, Path: ".pad/10", Attributes: "p"},
+				{Size: 1, Path: "README.txt"},
+			},
+			Attributes:   TorrentAttributes{Category: "software", Release: &Release{Title: "Ubuntu"}},
+			DiscoveredOn: 1000,
+		},
+		{InfoHash: []byte{0x02}, InfoHashV2: make([]byte, 32), Name: "debian", Files: []File{{Size: 1, Path: "a"}},
+			DiscoveredOn: 2000},
+	})
+	if err != nil {
+		t.Fatalf("AddNewTorrents: %s", err.Error())
+	}
+	// The torrents that exist already are ignored.
+	if err = db.AddNewTorrent([]byte{0x01}, nil, "ubuntu", nil, TorrentAttributes{}); err != nil {
+		t.Errorf("Existing torrent is an error: %s", err.Error())
+	}
+	if doc := stub.docs["01"]; doc["size"] != 101.0 || doc["nFiles"] != 2.0 || doc["category"] != "software" {
+		t.Errorf("Wrong document: %v", doc)
+	}
+
+	if exists, err := db.DoesTorrentExist([]byte{0x01}); !exists || err != nil {
+		t.Errorf("Torrent does not exist: %v %v", exists, err)
+	}
+	if exists, err := db.DoesTorrentExist(make([]byte, 20)); !exists || err != nil {
+		t.Errorf("Torrent does not exist by its truncated v2 infohash: %v %v", exists, err)
+	}
+	if n, err := db.GetNumberOfTorrents(); n != 2 || err != nil {
+		t.Errorf("Wrong number of torrents: %d %v", n, err)
+	}
+
+	lastOrderedValue, lastID := -3.0, uint64(42)
+	torrents, err := db.QueryTorrents(
+		"ubuntu", QueryFilter{Category: "software", ExcludeFlagged: true, Private: new(bool)}, 1500,
+		ByRelevance, true, 10, &lastOrderedValue, &lastID,
+	)
+	if err != nil {
+		t.Fatalf("QueryTorrents: %s", err.Error())
+	}
+	if len(torrents) != 2 || torrents[0].Name != "ubuntu desktop" || torrents[0].Relevance != -2.5 ||
+		torrents[0].Size != 101 || torrents[0].ID != esID([]byte{0x01}) {
+		t.Errorf("Wrong torrents: %+v", torrents)
+	}
+	search := stub.searches[len(stub.searches)-1]
+	expected := esObject{
+		"sort":         []interface{}{esObject{"_score": "desc"}, esObject{"infoHash": "asc"}},
+		"search_after": []interface{}{3.0, "00000000000157ff" + strings.Repeat("f", 48)},
+		"track_scores": true,
+		"query": esObject{"bool": esObject{
+			"must": esObject{"simple_query_string": esObject{
+				"query": "ubuntu", "fields": []interface{}{"name"}, "default_operator": "and",
+			}},
+			"filter": []interface{}{
+				esObject{"range": esObject{"discoveredOn": esObject{"lte": 1500.0}}},
+				esObject{"term": esObject{"category": "software"}},
+				esObject{"term": esObject{"private": false}},
+			},
+			"must_not": esObject{"exists": esObject{"field": "qualityFlags"}},
+		}},
+	}
+	for key, value := range expected {
+		if !reflect.DeepEqual(search[key], value) {
+			t.Errorf("Wrong %s of the search: %v", key, search[key])
+		}
+	}
+
+	if _, err = db.QueryTorrents("", QueryFilter{}, 0, ByRelevance, true, 10, nil, nil); err == nil {
+		t.Error("Ordering by relevance with an empty query is not an error")
+	}
+	if _, err = db.QueryTorrents("", QueryFilter{}, 0, ByTotalSize, false, 10, nil, nil); err != nil {
+		t.Fatalf("QueryTorrents: %s", err.Error())
+	}
+	search = stub.searches[len(stub.searches)-1]
+	if !reflect.DeepEqual(search["sort"], []interface{}{esObject{"size": "desc"}, esObject{"infoHash": "desc"}}) {
+		t.Errorf("Wrong sort of the search: %v", search["sort"])
+	}
+
+	torrent, err := db.GetTorrent([]byte{0x01})
+	if err != nil || torrent == nil || torrent.Release.Title != "Ubuntu" {
+		t.Errorf("GetTorrent: %+v %v", torrent, err)
+	}
+	if torrent, err = db.GetTorrent(make([]byte, 32)); err != nil || torrent == nil || torrent.Name != "debian" {
+		t.Errorf("GetTorrent by v2 infohash: %+v %v", torrent, err)
+	}
+	if torrent, err = db.GetTorrent([]byte{0x03}); err != nil || torrent != nil {
+		t.Errorf("GetTorrent of a missing torrent: %+v %v", torrent, err)
+	}
+	files, err := db.GetFiles([]byte{0x01})
+	if err != nil || len(files) != 2 || files[1].Path != "README.txt" {
+		t.Errorf("GetFiles: %v %v", files, err)
+	}
+
+	if err = db.SetReadme([]byte{0x01}, Readme{Path: "README.txt", Content: "Hello"}); err != nil {
+		t.Errorf("SetReadme: %s", err.Error())
+	}
+	if err = db.SetReadme([]byte{0x01}, Readme{Path: "missing.txt"}); err == nil {
+		t.Error("Readme of a missing file is not an error")
+	}
+	if err = db.SetReadme([]byte{0x03}, Readme{Path: "README.txt"}); err == nil {
+		t.Error("Readme of a missing torrent is not an error")
+	}
+	if readme, err := db.GetReadme([]byte{0x01}); err != nil || readme == nil || readme.Content != "Hello" {
+		t.Errorf("GetReadme: %v %v", readme, err)
+	}
+
+	if err = db.DeleteTorrent([]byte{0x01}); err != nil {
+		t.Errorf("DeleteTorrent: %s", err.Error())
+	}
+	if exists, _ := db.DoesTorrentExist([]byte{0x01}); exists {
+		t.Error("Deleted torrent exists")
+	}
+
+	// The fields added since the index is created are indexed from now on.
+	reopened, err := MakeDatabase(strings.Replace(server.URL, "http://", "elasticsearch://", 1)+"/torrents", nil)
+	if err != nil {
+		t.Fatalf("MakeDatabase: %s", err.Error())
+	}
+	defer reopened.Close()
+	if _, ok := stub.mapping["properties"].(esObject)["private"]; !ok {
+		t.Errorf("Mapping of the existing index is not put: %v", stub.mapping)
+	}
+}
+
+func TestESInfoHashAfter(t *testing.T) {
+	infoHash, _ := hex.DecodeString("0123456789abcdef0123456789abcdef01234567")
+	// Shares its first 53 bits, hence its ID, with infoHash.
+	colliding, _ := hex.DecodeString("0123456789abc8000000000000000000000000ff")
+	id := esID(infoHash)
+	if esID(colliding) != id {
+		t.Fatal("IDs do not collide")
+	}
+
+	for _, h := range []string{hex.EncodeToString(infoHash), hex.EncodeToString(colliding)} {
+		if after := esInfoHashAfter(id, true); h >= after {
+			t.Errorf("%s is not skipped ascending (after %s)", h, after)
+		}
+		if after := esInfoHashAfter(id, false); h <= after {
+			t.Errorf("%s is not skipped descending (after %s)", h, after)
+		}
+	}
+	if next := "0123456789abd0"; next <= esInfoHashAfter(id, true) {
+		t.Errorf("Next ID is skipped ascending")
+	}
+}
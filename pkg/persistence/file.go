@@ -0,0 +1,668 @@
+package persistence
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// fileSink is a write-only engine that appends the torrents to a file, as JSON Lines, CSV, or the
+// output of a template, and rotates it by size and/or by time. The rotated files are compressed in
+// the background.
+type fileSink struct {
+	path           string
+	format         string
+	fields         []fileField
+	template       *template.Template
+	rotateSize     uint64
+	rotateInterval time.Duration
+	// compression is the extension of the compressed files (`gz` or `zst`), or empty.
+	compression string
+	// rename is os.Rename, except in the tests.
+	rename func(oldpath, newpath string) error
+
+	mutex sync.Mutex
+	// file is nil if it could not be (re)opened, in which case it is opened again before the next
+	// torrent is written, or if the engine is closed.
+	file   *os.File
+	closed bool
+	size   uint64
+	// hasTorrents is false if the current file is empty, or has only its CSV header, and started is
+	// when its first torrent is written otherwise.
+	hasTorrents bool
+	started     time.Time
+
+	compressing sync.WaitGroup
+	done        chan struct{}
+	stopped     chan struct{}
+}
+
+// fileRecord is a torrent as written by the file engine, whose fields are what the templates refer
+// to (e.g. `{{.InfoHash}}`).
+type fileRecord struct {
+	InfoHash   string
+	InfoHashV2 string
+	Name       string
+	// DiscoveredOn is in Unix time.
+	DiscoveredOn int64
+	// Size and NFiles exclude the padding files.
+	Size   uint64
+	NFiles int
+	Files  []File
+	TorrentAttributes
+}
+
+// fileField is a field of the JSON Lines and CSV formats, in which the empty values of the
+// omitEmpty fields are omitted and empty respectively.
+type fileField struct {
+	name      string
+	omitEmpty bool
+	value     func(r *fileRecord) interface{}
+}
+
+// fileFields are all the fields, in the default order.
+var fileFields = []fileField{
+	{"infoHash", false, func(r *fileRecord) interface{} { return r.InfoHash }},
+	{"infoHashV2", true, func(r *fileRecord) interface{} { return r.InfoHashV2 }},
+	{"name", false, func(r *fileRecord) interface{} { return r.Name }},
+	{"discoveredOn", false, func(r *fileRecord) interface{} { return r.DiscoveredOn }},
+	{"size", false, func(r *fileRecord) interface{} { return r.Size }},
+	{"nFiles", false, func(r *fileRecord) interface{} { return r.NFiles }},
+	{"files", false, func(r *fileRecord) interface{} { return r.Files }},
+	{"pieceLength", false, func(r *fileRecord) interface{} { return r.PieceLength }},
+	{"private", false, func(r *fileRecord) interface{} { return r.Private }},
+	{"source", true, func(r *fileRecord) interface{} { return r.Source }},
+	{"encoding", true, func(r *fileRecord) interface{} { return r.Encoding }},
+	{"originalName", true, func(r *fileRecord) interface{} { return r.OriginalName }},
+	{"undecodable", true, func(r *fileRecord) interface{} { return r.Undecodable }},
+	{"tags", true, func(r *fileRecord) interface{} { return r.Tags }},
+	{"category", true, func(r *fileRecord) interface{} { return r.Category }},
+	{"subCategory", true, func(r *fileRecord) interface{} { return r.SubCategory }},
+	{"release", true, func(r *fileRecord) interface{} { return r.Release }},
+	{"spamScore", false, func(r *fileRecord) interface{} { return r.SpamScore }},
+	{"qualityFlags", true, func(r *fileRecord) interface{} { return r.QualityFlags }},
+}
+
+// fileTemplateFuncs are the functions that the templates can use besides the predefined ones:
+// `json` encodes a value to JSON, and `time` converts a Unix time (e.g. `.DiscoveredOn`) to a
+// time.Time in UTC, so that it can be formatted (e.g. `{{(time .DiscoveredOn).Format "2006-01-02"}}`).
+var fileTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"time": func(t int64) time.Time {
+		return time.Unix(t, 0).UTC()
+	},
+}
+
+// makeFileDatabase opens the file of a URL such as
+// `file:///path/to/torrents.jsonl?format=csv&fields=infoHash,name,size&rotate-size=100MB&rotate-interval=24h&compress=zstd`
+// whose parameters are all optional:
+//
+// `format` is `jsonl` (the default), `csv`, or `template`, in which case `template` is the path of
+// a Go text/template that is executed for each torrent (see fileRecord). `fields` are the
+// comma-separated fields of the JSON Lines and CSV formats (see fileFields), all of them by
+// default. `rotate-size` (in bytes, or such as `100MB`) and `rotate-interval` (such as `24h`, in
+// which case the files are rotated at midnight UTC) are when to rotate the file, and `compress` is
+// `gzip` or `zstd`.
+func makeFileDatabase(url_ *url.URL) (Database, error) {
+	if url_.Path == "" {
+		return nil, fmt.Errorf("path is not supplied")
+	}
+
+	query := url_.Query()
+	s := &fileSink{
+		path:    url_.Path,
+		format:  query.Get("format"),
+		rename:  os.Rename,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	switch s.format {
+	case "":
+		s.format = "jsonl"
+	case "jsonl", "csv":
+	case "template":
+		if query.Get("template") == "" {
+			return nil, fmt.Errorf("template is not supplied")
+		}
+		text, err := ioutil.ReadFile(query.Get("template"))
+		if err != nil {
+			return nil, errors.Wrap(err, "ioutil.ReadFile")
+		}
+		if s.template, err = template.New("file").Funcs(fileTemplateFuncs).Parse(string(text)); err != nil {
+			return nil, errors.Wrap(err, "template.Parse")
+		}
+	default:
+		return nil, fmt.Errorf("unknown format: `%s`", s.format)
+	}
+
+	s.fields = fileFields
+	if query.Get("fields") != "" {
+		s.fields = nil
+		for _, name := range strings.Split(query.Get("fields"), ",") {
+			field, ok := findFileField(strings.TrimSpace(name))
+			if !ok {
+				return nil, fmt.Errorf("unknown field: `%s`", name)
+			}
+			s.fields = append(s.fields, field)
+		}
+	}
+
+	var err error
+	if rotateSize := query.Get("rotate-size"); rotateSize != "" {
+		if s.rotateSize, err = humanize.ParseBytes(rotateSize); err != nil {
+			return nil, errors.Wrap(err, "rotate-size")
+		}
+	}
+	if rotateInterval := query.Get("rotate-interval"); rotateInterval != "" {
+		if s.rotateInterval, err = time.ParseDuration(rotateInterval); err != nil {
+			return nil, errors.Wrap(err, "rotate-interval")
+		}
+		if s.rotateInterval < time.Second {
+			return nil, fmt.Errorf("rotate-interval must be at least a second")
+		}
+	}
+
+	switch query.Get("compress") {
+	case "", "none":
+	case "gzip":
+		s.compression = "gz"
+	case "zstd":
+		s.compression = "zst"
+	default:
+		return nil, fmt.Errorf("unknown compression: `%s`", query.Get("compress"))
+	}
+
+	if err = s.open(); err != nil {
+		return nil, err
+	}
+
+	zap.L().Info("File opened",
+		zap.String("path", s.path),
+		zap.String("format", s.format),
+		zap.Uint64("rotateSize", s.rotateSize),
+		zap.Duration("rotateInterval", s.rotateInterval),
+		zap.String("compression", s.compression),
+	)
+
+	go s.run()
+	return s, nil
+}
+
+func findFileField(name string) (fileField, bool) {
+	for _, field := range fileFields {
+		if field.name == name {
+			return field, true
+		}
+	}
+	return fileField{}, false
+}
+
+// open opens the file to append to it, which is started anew (with a CSV header) if it is empty.
+func (s *fileSink) open() error {
+	if err := os.MkdirAll(path.Dir(s.path), 0755); err != nil {
+		return errors.Wrap(err, "os.MkdirAll")
+	}
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "os.OpenFile")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrap(err, "file.Stat")
+	}
+
+	s.file, s.size = file, uint64(info.Size())
+	// The file of a previous run is rotated as if it is started when it is written last.
+	s.hasTorrents, s.started = s.size > 0, info.ModTime()
+	if s.size == 0 && s.format == "csv" {
+		header := make([]string, len(s.fields))
+		for i, field := range s.fields {
+			header[i] = field.name
+		}
+		return s.write(csvLine(header))
+	}
+	return nil
+}
+
+func (s *fileSink) write(data []byte) error {
+	n, err := s.file.Write(data)
+	s.size += uint64(n)
+	return errors.Wrap(err, "file.Write")
+}
+
+// isDue returns whether the file is due to be rotated before @n more bytes are written to it.
+func (s *fileSink) isDue(n int) bool {
+	if !s.hasTorrents {
+		return false
+	}
+	if s.rotateSize > 0 && s.size+uint64(n) > s.rotateSize {
+		return true
+	}
+	return s.rotateInterval > 0 && !time.Now().Truncate(s.rotateInterval).Equal(s.started.Truncate(s.rotateInterval))
+}
+
+// rotate closes the file, renames it after when it is started, and opens a new one. If the file
+// cannot be renamed, it is opened again to be appended to (and rotated later).
+func (s *fileSink) rotate() error {
+	if err := s.close(); err != nil {
+		return err
+	}
+
+	started := s.started.UTC()
+	if s.rotateInterval > 0 {
+		started = started.Truncate(s.rotateInterval)
+	}
+	ext := path.Ext(s.path)
+	stem := strings.TrimSuffix(s.path, ext) + "." + started.Format("20060102T150405Z")
+	rotated := stem + ext
+	for i := 1; fileExists(rotated) || fileExists(rotated+"."+s.compression); i++ {
+		rotated = stem + "-" + strconv.Itoa(i) + ext
+	}
+	if err := s.rename(s.path, rotated); err != nil {
+		// The file is still started when it was, rather than when it is written last.
+		started := s.started
+		if openErr := s.open(); openErr != nil {
+			zap.L().Error("Could not reopen the file!", zap.String("path", s.path), zap.Error(openErr))
+		} else {
+			s.started = started
+		}
+		return errors.Wrap(err, "os.Rename")
+	}
+	zap.L().Info("File rotated", zap.String("path", rotated))
+
+	if s.compression != "" {
+		s.compressing.Add(1)
+		go func() {
+			defer s.compressing.Done()
+			if err := s.compress(rotated); err != nil {
+				zap.L().Error("Could not compress the rotated file!", zap.String("path", rotated), zap.Error(err))
+			}
+		}()
+	}
+
+	return s.open()
+}
+
+// compress compresses the file at @path, which is replaced by the compressed file once it is
+// written completely.
+func (s *fileSink) compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "os.Open")
+	}
+	defer src.Close()
+
+	tmpPath := path + "." + s.compression + ".tmp"
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return errors.Wrap(err, "os.Create")
+	}
+	defer os.Remove(tmpPath)
+	defer dst.Close()
+
+	var writer io.WriteCloser
+	if s.compression == "gz" {
+		writer = gzip.NewWriter(dst)
+	} else if writer, err = zstd.NewWriter(dst); err != nil {
+		return errors.Wrap(err, "zstd.NewWriter")
+	}
+	if _, err = io.Copy(writer, src); err != nil {
+		return errors.Wrap(err, "io.Copy")
+	}
+	if err = writer.Close(); err != nil {
+		return errors.Wrap(err, "writer.Close")
+	}
+	if err = dst.Sync(); err != nil {
+		return errors.Wrap(err, "file.Sync")
+	}
+	if err = os.Rename(tmpPath, path+"."+s.compression); err != nil {
+		return errors.Wrap(err, "os.Rename")
+	}
+	return errors.Wrap(os.Remove(path), "os.Remove")
+}
+
+// run rotates the file at the end of every interval even if no torrents are written then, so that
+// the file of a day (say) is complete by the end of it.
+func (s *fileSink) run() {
+	defer close(s.stopped)
+	if s.rotateInterval == 0 {
+		<-s.done
+		return
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mutex.Lock()
+			if err := s.reopen(); err != nil {
+				zap.L().Error("Could not reopen the file!", zap.String("path", s.path), zap.Error(err))
+			} else if s.isDue(0) {
+				if err := s.rotate(); err != nil {
+					zap.L().Error("Could not rotate the file!", zap.String("path", s.path), zap.Error(err))
+				}
+			}
+			s.mutex.Unlock()
+
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// reopen opens the file again if it could not be (re)opened before, e.g. when it is rotated.
+func (s *fileSink) reopen() error {
+	if s.file != nil {
+		return nil
+	}
+	return s.open()
+}
+
+// close flushes the file to the disk and closes it.
+func (s *fileSink) close() error {
+	file := s.file
+	s.file = nil
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return errors.Wrap(err, "file.Sync")
+	}
+	return errors.Wrap(file.Close(), "file.Close")
+}
+
+// formatTorrent formats a torrent as a line of the file.
+func (s *fileSink) formatTorrent(t *NewTorrent) ([]byte, error) {
+	r := &fileRecord{
+		InfoHash:          hex.EncodeToString(t.InfoHash),
+		InfoHashV2:        hex.EncodeToString(t.InfoHashV2),
+		Name:              t.Name,
+		DiscoveredOn:      t.discoveredOn(),
+		Size:              t.totalSize(),
+		Files:             t.Files,
+		TorrentAttributes: t.Attributes,
+	}
+	for _, file := range t.Files {
+		if !file.IsPadding() {
+			r.NFiles++
+		}
+	}
+
+	switch s.format {
+	case "template":
+		var buffer bytes.Buffer
+		if err := s.template.Execute(&buffer, r); err != nil {
+			return nil, errors.Wrap(err, "template.Execute")
+		}
+		if buffer.Len() > 0 && buffer.Bytes()[buffer.Len()-1] != '\n' {
+			buffer.WriteByte('\n')
+		}
+		return buffer.Bytes(), nil
+
+	case "csv":
+		values := make([]string, len(s.fields))
+		for i, field := range s.fields {
+			var err error
+			if values[i], err = csvValue(field.value(r)); err != nil {
+				return nil, errors.Wrapf(err, "field %s", field.name)
+			}
+		}
+		return csvLine(values), nil
+
+	default:
+		var buffer bytes.Buffer
+		buffer.WriteByte('{')
+		for _, field := range s.fields {
+			value := field.value(r)
+			if field.omitEmpty && isEmpty(value) {
+				continue
+			}
+			data, err := json.Marshal(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "field %s", field.name)
+			}
+			if buffer.Len() > 1 {
+				buffer.WriteByte(',')
+			}
+			buffer.WriteString(strconv.Quote(field.name))
+			buffer.WriteByte(':')
+			buffer.Write(data)
+		}
+		buffer.WriteString("}\n")
+		return buffer.Bytes(), nil
+	}
+}
+
+// csvValue formats a value of a CSV field, in which the lists are comma-separated, the binary
+// values are base64-encoded (like in JSON), and the files and the release are JSON.
+func csvValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case []string:
+		return strings.Join(v, ","), nil
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v), nil
+	case *Release:
+		if v == nil {
+			return "", nil
+		}
+	case int, int64, uint64, bool:
+		return fmt.Sprint(v), nil
+	}
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+func csvLine(values []string) []byte {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	_ = writer.Write(values)
+	writer.Flush()
+	return buffer.Bytes()
+}
+
+func isEmpty(value interface{}) bool {
+	v := reflect.ValueOf(value)
+	return v.IsZero() || v.Kind() == reflect.Slice && v.Len() == 0
+}
+
+func (s *fileSink) Engine() databaseEngine {
+	return FileSink
+}
+
+func (s *fileSink) DoesTorrentExist(infoHash []byte) (bool, error) {
+	// Like stdout, the file is never read back.
+	return false, nil
+}
+
+func (s *fileSink) AddNewTorrent(infoHash []byte, infoHashV2 []byte, name string, files []File, attributes TorrentAttributes) error {
+	return s.AddNewTorrents([]NewTorrent{{
+		InfoHash:   infoHash,
+		InfoHashV2: infoHashV2,
+		Name:       name,
+		Files:      files,
+		Attributes: attributes,
+	}})
+}
+
+func (s *fileSink) AddNewTorrents(torrents []NewTorrent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return fmt.Errorf("file is closed")
+	} else if err := s.reopen(); err != nil {
+		return errors.Wrap(err, "reopen")
+	}
+
+	for i := range torrents {
+		// Like in the SQL engines, the torrents whose total size is zero are ignored.
+		if torrents[i].totalSize() == 0 {
+			continue
+		}
+		line, err := s.formatTorrent(&torrents[i])
+		if err != nil {
+			return err
+		}
+		if s.isDue(len(line)) {
+			if err = s.rotate(); err != nil {
+				return errors.Wrap(err, "rotate")
+			}
+		}
+		if !s.hasTorrents {
+			s.hasTorrents, s.started = true, time.Now()
+		}
+		if err = s.write(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileSink) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mutex.Unlock()
+
+	close(s.done)
+	<-s.stopped
+
+	s.mutex.Lock()
+	var err error
+	if s.file != nil {
+		err = s.close()
+	}
+	s.mutex.Unlock()
+
+	s.compressing.Wait()
+	return err
+}
+
+func (s *fileSink) GetNumberOfTorrents() (uint, error) {
+	return 0, NotImplementedError
+}
+
+func (s *fileSink) QueryTorrents(
+	query string,
+	filter QueryFilter,
+	epoch int64,
+	orderBy OrderingCriteria,
+	ascending bool,
+	limit uint,
+	lastOrderedValue *float64,
+	lastID *uint64,
+) ([]TorrentMetadata, error) {
+	return nil, NotImplementedError
+}
+
+func (s *fileSink) GetTorrent(infoHash []byte) (*TorrentMetadata, error) {
+	return nil, NotImplementedError
+}
+
+func (s *fileSink) GetFiles(infoHash []byte) ([]File, error) {
+	return nil, NotImplementedError
+}
+
+func (s *fileSink) GetStatistics(from string, n uint) (*Statistics, error) {
+	return nil, NotImplementedError
+}
+
+func (s *fileSink) DeleteTorrent(infoHash []byte) error {
+	return NotImplementedError
+}
+
+func (s *fileSink) AddBlock(block Block) (uint64, error) {
+	return 0, NotImplementedError
+}
+
+func (s *fileSink) RemoveBlock(id uint64) error {
+	return NotImplementedError
+}
+
+func (s *fileSink) GetBlocks() ([]Block, error) {
+	return nil, NotImplementedError
+}
+
+func (s *fileSink) AddAuditEntry(entry AuditEntry) error {
+	return NotImplementedError
+}
+
+func (s *fileSink) GetAuditLog(limit uint) ([]AuditEntry, error) {
+	return nil, NotImplementedError
+}
+
+func (s *fileSink) GetUnparsedTorrents(limit uint) ([]TorrentMetadata, error) {
+	return nil, NotImplementedError
+}
+
+func (s *fileSink) SetRelease(infoHash []byte, release Release) error {
+	return NotImplementedError
+}
+
+func (s *fileSink) GetUncategorisedTorrents(limit uint) ([][]byte, error) {
+	return nil, NotImplementedError
+}
+
+func (s *fileSink) SetCategory(infoHash []byte, category string, subCategory string) error {
+	return NotImplementedError
+}
+
+func (s *fileSink) SetInfoDict(infoHash []byte, infoDict []byte) error {
+	return NotImplementedError
+}
+
+func (s *fileSink) GetInfoDict(infoHash []byte) ([]byte, error) {
+	return nil, NotImplementedError
+}
+
+func (s *fileSink) SetReadme(infoHash []byte, readme Readme) error {
+	return NotImplementedError
+}
+
+func (s *fileSink) GetReadme(infoHash []byte) (*Readme, error) {
+	return nil, NotImplementedError
+}
+
+func (s *fileSink) AddFailedFetch(infoHash []byte, reason string, nextAttemptOn int64) error {
+	return NotImplementedError
+}
+
+func (s *fileSink) GetDueFailedFetches(now int64, limit uint) ([]FailedFetch, error) {
+	return nil, NotImplementedError
+}
+
+func (s *fileSink) UpdateFailedFetch(infoHash []byte, nAttempts uint, nextAttemptOn *int64) error {
+	return NotImplementedError
+}
+
+func (s *fileSink) DumpTorrents(afterID uint64, limit uint, withInfoDicts bool) ([]DumpedTorrent, error) {
+	return nil, NotImplementedError
+}
@@ -0,0 +1,149 @@
+package persistence
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnetico")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Every torrent is rotated to a file of its own, since the header and a line exceed 32 bytes.
+	u := &url.URL{
+		Scheme:   "file",
+		Path:     path.Join(dir, "torrents.csv"),
+		RawQuery: "format=csv&fields=infoHash,name,size,tags&rotate-size=32&compress=gzip",
+	}
+	db, err := MakeDatabase(u.String(), nil)
+	if err != nil {
+		t.Fatalf("MakeDatabase: %s", err.Error())
+	}
+	files := []File{{Size: 10, Path: "a"}, {Size: 6, Path: "pad", Attributes: "p"}}
+	_ = db.AddNewTorrent([]byte{0x01}, nil, "first", files, TorrentAttributes{Tags: []string{"a", "b"}})
+	_ = db.AddNewTorrent([]byte{0x02}, nil, "second", files, TorrentAttributes{})
+	if err = db.Close(); err != nil {
+		t.Fatalf("Close: %s", err.Error())
+	}
+
+	current, err := ioutil.ReadFile(u.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(current) != "infoHash,name,size,tags\n02,second,10,\n" {
+		t.Errorf("Wrong current file: %q", current)
+	}
+
+	rotated, _ := filepath.Glob(path.Join(dir, "torrents.*.csv.gz"))
+	if len(rotated) != 1 {
+		t.Fatalf("Rotated files are not compressed: %v", rotated)
+	}
+	file, err := os.Open(rotated[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(reader); string(data) != "infoHash,name,size,tags\n01,first,10,\"a,b\"\n" {
+		t.Errorf("Wrong rotated file: %q", data)
+	}
+	if leftovers, _ := filepath.Glob(path.Join(dir, "torrents.*.csv")); len(leftovers) != 0 {
+		t.Errorf("Rotated files are not removed once compressed: %v", leftovers)
+	}
+}
+
+func TestFileSinkTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnetico")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	templatePath := path.Join(dir, "torrent.tmpl")
+	err = ioutil.WriteFile(templatePath, []byte(`{{.Name}} {{(time .DiscoveredOn).Format "2006-01-02"}} {{json .Tags}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &url.URL{
+		Scheme:   "file",
+		Path:     path.Join(dir, "torrents.txt"),
+		RawQuery: url.Values{"format": {"template"}, "template": {templatePath}}.Encode(),
+	}
+	db, err := MakeDatabase(u.String(), nil)
+	if err != nil {
+		t.Fatalf("MakeDatabase: %s", err.Error())
+	}
+	err = AddNewTorrents(db, []NewTorrent{{InfoHash: []byte{0x01}, Name: "name", Files: []File{{Size: 1, Path: "a"}}, DiscoveredOn: 86400,
+		Attributes: TorrentAttributes{Tags: []string{"tag"}}}})
+	if err != nil {
+		t.Fatalf("AddNewTorrents: %s", err.Error())
+	}
+	_ = db.Close()
+
+	if data, _ := ioutil.ReadFile(u.Path); strings.TrimSpace(string(data)) != `name 1970-01-02 ["tag"]` {
+		t.Errorf("Wrong output of the template: %q", data)
+	}
+}
+
+// TestFileSinkFailedRotation tests that the file is appended to (and rotated later) if it cannot
+// be renamed when it is rotated.
+func TestFileSinkFailedRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnetico")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u := &url.URL{Scheme: "file", Path: path.Join(dir, "torrents.csv"), RawQuery: "format=csv&fields=name&rotate-size=16"}
+	db, err := MakeDatabase(u.String(), nil)
+	if err != nil {
+		t.Fatalf("MakeDatabase: %s", err.Error())
+	}
+	s := db.(*fileSink)
+	s.rename = func(oldpath, newpath string) error { return fmt.Errorf("rename failed") }
+
+	files := []File{{Size: 1, Path: "a"}}
+	if err = db.AddNewTorrent([]byte{0x01}, nil, "first", files, TorrentAttributes{}); err != nil {
+		t.Fatalf("AddNewTorrent: %s", err.Error())
+	}
+	if err = db.AddNewTorrent([]byte{0x02}, nil, "second", files, TorrentAttributes{}); err == nil {
+		t.Error("Failed rotation is not an error")
+	}
+	s.rename = os.Rename
+	if err = db.AddNewTorrent([]byte{0x02}, nil, "second", files, TorrentAttributes{}); err != nil {
+		t.Fatalf("AddNewTorrent after a failed rotation: %s", err.Error())
+	}
+	if err = db.Close(); err != nil {
+		t.Fatalf("Close: %s", err.Error())
+	}
+	if err = db.Close(); err != nil {
+		t.Errorf("Closing twice is an error: %s", err.Error())
+	}
+	if err = db.AddNewTorrent([]byte{0x03}, nil, "third", files, TorrentAttributes{}); err == nil {
+		t.Error("Adding to a closed file is not an error")
+	}
+
+	if current, _ := ioutil.ReadFile(u.Path); string(current) != "name\nsecond\n" {
+		t.Errorf("Wrong current file: %q", current)
+	}
+	rotated, _ := filepath.Glob(path.Join(dir, "torrents.*.csv"))
+	if len(rotated) != 1 {
+		t.Fatalf("File is not rotated: %v", rotated)
+	}
+	if data, _ := ioutil.ReadFile(rotated[0]); string(data) != "name\nfirst\n" {
+		t.Errorf("Wrong rotated file: %q", data)
+	}
+}
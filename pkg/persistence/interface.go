@@ -1,11 +1,13 @@
 package persistence
 
 import (
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
 	"net/url"
+	"strings"
 
 	"go.uber.org/zap"
 )
@@ -14,8 +16,16 @@ var NotImplementedError = errors.New("Function not implemented")
 
 type Database interface {
 	Engine() databaseEngine
+	// DoesTorrentExist accepts v1 infohashes, v2 infohashes, and truncated (to 20 bytes) v2
+	// infohashes as found in the DHT.
 	DoesTorrentExist(infoHash []byte) (bool, error)
-	AddNewTorrent(infoHash []byte, name string, files []File) error
+	// AddNewTorrent adds a new torrent to the database. @infoHash is the SHA-1 infohash of v1 and
+	// hybrid torrents, or the SHA-256 infohash of v2-only torrents. @infoHashV2 is the SHA-256
+	// infohash of v2 and hybrid torrents, and nil for v1-only torrents.
+	//
+	// @files must include the padding files (if any) as well, which are then hidden from the file
+	// lists, the file counts, and the total size of the torrent.
+	AddNewTorrent(infoHash []byte, infoHashV2 []byte, name string, files []File, attributes TorrentAttributes) error
 	Close() error
 
 	// GetNumberOfTorrents returns the number of torrents saved in the database. Might be an
@@ -24,12 +34,14 @@ type Database interface {
 	// QueryTorrents returns @pageSize amount of torrents,
 	// * that are discovered before @discoveredOnBefore
 	// * that match the @query if it's not empty, else all torrents
+	// * that pass the @filter
 	// * ordered by the @orderBy in ascending order if @ascending is true, else in descending order
 	// after skipping (@page * @pageSize) torrents that also fits the criteria above.
 	//
 	// On error, returns (nil, error), otherwise a non-nil slice of TorrentMetadata and nil.
 	QueryTorrents(
 		query string,
+		filter QueryFilter,
 		epoch int64,
 		orderBy OrderingCriteria,
 		ascending bool,
@@ -37,11 +49,75 @@ type Database interface {
 		lastOrderedValue *float64,
 		lastID *uint64,
 	) ([]TorrentMetadata, error)
-	// GetTorrents returns the TorrentExtMetadata for the torrent of the given InfoHash. Will return
-	// nil, nil if the torrent does not exist in the database.
+	// GetTorrents returns the TorrentExtMetadata for the torrent of the given InfoHash (either v1 or
+	// v2). Will return nil, nil if the torrent does not exist in the database.
 	GetTorrent(infoHash []byte) (*TorrentMetadata, error)
+	// GetFiles returns the files of the torrent of the given InfoHash (either v1 or v2).
 	GetFiles(infoHash []byte) ([]File, error)
+	// GetUnparsedTorrents returns at most @limit torrents that are added without a release (i.e.
+	// before release parsing is introduced), of which only the InfoHash and the Name are set.
+	GetUnparsedTorrents(limit uint) ([]TorrentMetadata, error)
+	// SetRelease sets the release parsed from the name of the torrent of the given InfoHash (either
+	// v1 or v2).
+	SetRelease(infoHash []byte, release Release) error
+	// GetUncategorisedTorrents returns the InfoHashes of at most @limit torrents that are added
+	// without a category (i.e. before categorisation is introduced).
+	GetUncategorisedTorrents(limit uint) ([][]byte, error)
+	// SetCategory sets the category and the sub-category (which might be empty) of the torrent of
+	// the given InfoHash (either v1 or v2).
+	SetCategory(infoHash []byte, category string, subCategory string) error
 	GetStatistics(from string, n uint) (*Statistics, error)
+
+	// SetInfoDict stores the (verified) bencoded info dictionary of the torrent of the given
+	// InfoHash (either v1 or v2), which must have been added by AddNewTorrent beforehand.
+	// Info dictionaries are compressed by the engines that support them.
+	SetInfoDict(infoHash []byte, infoDict []byte) error
+	// GetInfoDict returns the bencoded info dictionary of the torrent of the given InfoHash (either
+	// v1 or v2). Will return nil, nil if the torrent does not exist in the database, or if its info
+	// dictionary is not stored.
+	GetInfoDict(infoHash []byte) ([]byte, error)
+
+	// SetReadme marks the file of the torrent of the given InfoHash (either v1 or v2) at
+	// @readme.Path as its readme, and stores its content. A torrent has at most one readme, hence
+	// the previous one (if any) is replaced.
+	SetReadme(infoHash []byte, readme Readme) error
+	// GetReadme returns the readme of the torrent of the given InfoHash (either v1 or v2). Will
+	// return nil, nil if the torrent does not exist in the database, or if it has no readme.
+	GetReadme(infoHash []byte) (*Readme, error)
+
+	// DeleteTorrent deletes the torrent of the given InfoHash (either v1 or v2) together with its
+	// files. Deleting a torrent that does not exist is not an error.
+	DeleteTorrent(infoHash []byte) error
+
+	// AddBlock adds @block (whose ID and AddedOn are ignored) to the blocklist, and returns its ID.
+	AddBlock(block Block) (uint64, error)
+	// RemoveBlock removes the block of the given ID from the blocklist.
+	RemoveBlock(id uint64) error
+	// GetBlocks returns the whole blocklist, oldest first.
+	GetBlocks() ([]Block, error)
+	// AddAuditEntry appends @entry (whose ID and PerformedOn are ignored) to the audit log.
+	AddAuditEntry(entry AuditEntry) error
+	// GetAuditLog returns at most @limit entries of the audit log, newest first.
+	GetAuditLog(limit uint) ([]AuditEntry, error)
+
+	// AddFailedFetch records that the metadata of the torrent with the given InfoHash could not be
+	// fetched from any of its peers. If the torrent is already in the retry queue, only its reason
+	// is updated; otherwise it is enqueued to be retried on @nextAttemptOn.
+	AddFailedFetch(infoHash []byte, reason string, nextAttemptOn int64) error
+	// GetDueFailedFetches returns at most @limit failed fetches whose next attempt is due on or
+	// before @now, oldest first. Abandoned fetches are never returned.
+	GetDueFailedFetches(now int64, limit uint) ([]FailedFetch, error)
+	// UpdateFailedFetch sets the number of attempts made and the time of the next attempt of a
+	// failed fetch. A nil @nextAttemptOn marks the fetch as abandoned.
+	//
+	// Failed fetches are removed from the retry queue by AddNewTorrent once their metadata is
+	// fetched successfully.
+	UpdateFailedFetch(infoHash []byte, nAttempts uint, nextAttemptOn *int64) error
+
+	// DumpTorrents returns at most @limit torrents whose IDs are greater than @afterID ordered by
+	// their IDs, with their files (including the padding files), readmes, and (if @withInfoDicts)
+	// info dictionaries, so that whole databases can be streamed by paging through them.
+	DumpTorrents(afterID uint64, limit uint, withInfoDicts bool) ([]DumpedTorrent, error)
 }
 
 type OrderingCriteria uint8
@@ -58,6 +134,67 @@ const (
 
 // TODO: search `swtich (orderBy)` and see if all cases are covered all the time
 
+// QueryFilter narrows down the torrents returned by QueryTorrents. Its zero value passes all the
+// torrents.
+type QueryFilter struct {
+	// Category and SubCategory are ignored if empty (see pkg/category).
+	Category    string
+	SubCategory string
+	// Release is matched field by field, ignoring its empty (or zero) fields. Titles are matched
+	// case-insensitively.
+	Release Release
+	// ExcludeFlagged excludes the torrents with quality flags (see pkg/spam).
+	ExcludeFlagged bool
+	// Private is ignored if nil, and otherwise passes only the private torrents if true, and only
+	// the public ones if false.
+	Private *bool
+}
+
+// conditions returns the SQL expressions (with `?` placeholders for the values, in order) that
+// the torrents must satisfy to pass the filter, in the dialect of the given @engine.
+func (f QueryFilter) conditions(engine databaseEngine) (expressions []string, values []interface{}) {
+	// Titles are matched case-insensitively, which the columns of SQLite (COLLATE NOCASE) and MySQL
+	// (utf8mb4_unicode_ci) do by themselves. PostgreSQL has no
+	// case-insensitive collation that is readily available, hence its titles are compared by their
+	// lowercase (see its v8 -> v9 migration).
+	title := "release_title = ?"
+	if engine == Postgres {
+		title = "lower(release_title) = lower(?)"
+	}
+
+	for _, c := range []struct {
+		expression string
+		value      interface{}
+		empty      bool
+	}{
+		{"category = ?", f.Category, f.Category == ""},
+		{"sub_category = ?", f.SubCategory, f.SubCategory == ""},
+		{title, f.Release.Title, f.Release.Title == ""},
+		{"release_year = ?", f.Release.Year, f.Release.Year == 0},
+		{"release_season = ?", f.Release.Season, f.Release.Season == 0},
+		{"release_episode = ?", f.Release.Episode, f.Release.Episode == 0},
+		{"release_resolution = ?", f.Release.Resolution, f.Release.Resolution == ""},
+		{"release_source = ?", f.Release.Source, f.Release.Source == ""},
+		{"release_codec = ?", f.Release.Codec, f.Release.Codec == ""},
+		{"release_audio = ?", f.Release.Audio, f.Release.Audio == ""},
+		{"release_language = ?", f.Release.Language, f.Release.Language == ""},
+		{"release_group = ?", f.Release.Group, f.Release.Group == ""},
+	} {
+		if !c.empty {
+			expressions = append(expressions, c.expression)
+			values = append(values, c.value)
+		}
+	}
+	if f.ExcludeFlagged {
+		expressions = append(expressions, "quality_flags IS NULL")
+	}
+	if f.Private != nil {
+		expressions = append(expressions, "private = ?")
+		values = append(values, *f.Private)
+	}
+	return
+}
+
 type databaseEngine uint8
 
 const (
@@ -65,6 +202,12 @@ const (
 	Postgres
 	Beanstalkd
 	Stdout
+	MySQL
+	Multi
+	FileSink
+	Webhook
+	Elasticsearch
+	Memory
 )
 
 type Statistics struct {
@@ -75,37 +218,294 @@ type Statistics struct {
 	// All these slices below have the exact length equal to the Period.
 	//NDiscovered []uint64  `json:"nDiscovered"`
 
+	// RetryQueue is nil if the database engine does not keep a retry queue.
+	RetryQueue *RetryQueueStatistics `json:"retryQueue,omitempty"`
+}
+
+// RetryQueueStatistics is a snapshot of the retry queue at the time statistics are gathered, hence
+// it is not broken down by time unlike the other fields of Statistics.
+type RetryQueueStatistics struct {
+	NPending   uint64 `json:"nPending"`
+	NAbandoned uint64 `json:"nAbandoned"`
 }
 
 type File struct {
 	Size int64  `json:"size"`
 	Path string `json:"path"`
+	// Attributes are the BEP 47 attributes of the file, each of which is a character:
+	//   * `p` for padding files,
+	//   * `h` for hidden files,
+	//   * `x` for executable files,
+	//   * `l` for symbolic links.
+	Attributes string `json:"attributes,omitempty"`
+	// OriginalPath is the path as found in the info dictionary if it is not UTF-8 (see
+	// TorrentAttributes.Encoding), and nil otherwise.
+	OriginalPath []byte `json:"originalPath,omitempty"`
+}
+
+// IsPadding returns true if the file is a padding file, which is not a part of the content of the
+// torrent but exists solely to align the other files to the piece boundaries.
+func (f File) IsPadding() bool {
+	return strings.ContainsRune(f.Attributes, 'p')
+}
+
+// TorrentAttributes are the attributes of a torrent (i.e. the fields of its info dictionary)
+// besides its name and files.
+type TorrentAttributes struct {
+	PieceLength int64  `json:"pieceLength"`
+	Private     bool   `json:"private"`
+	Source      string `json:"source,omitempty"`
+
+	// Encoding is the charset that the name and/or the paths of the torrent are decoded from if
+	// they are not UTF-8, and empty otherwise.
+	Encoding string `json:"encoding,omitempty"`
+	// OriginalName is the name as found in the info dictionary if it is not UTF-8, and nil
+	// otherwise.
+	OriginalName []byte `json:"originalName,omitempty"`
+	// Undecodable is true if the name and/or the paths of the torrent are neither UTF-8 nor in any
+	// charset known, in which case their invalid bytes are replaced by U+FFFD.
+	Undecodable bool `json:"undecodable,omitempty"`
+
+	// Tags are added by the content filter rules of magneticod, and are persisted comma-separated
+	// (hence cannot contain commas).
+	Tags []string `json:"tags,omitempty"`
+
+	// Category and SubCategory (which might be empty) are the classification of the content of
+	// the torrent (see pkg/category).
+	Category    string `json:"category,omitempty"`
+	SubCategory string `json:"subCategory,omitempty"`
+
+	// Release is parsed from the name of the torrent (see pkg/release).
+	Release *Release `json:"release,omitempty"`
+
+	// SpamScore (from 0 to 100) and QualityFlags are how likely the torrent is to be a fake, spam,
+	// or bait for malware, and why (see pkg/spam). Flags are persisted comma-separated like tags.
+	SpamScore    int      `json:"spamScore"`
+	QualityFlags []string `json:"qualityFlags,omitempty"`
+}
+
+// splitTags splits the tags of a torrent as they are persisted.
+func splitTags(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// Release is the structured metadata parsed from the name of a torrent, whose fields are empty (or
+// zero) unless they are found in the name.
+type Release struct {
+	Title   string `json:"title"`
+	Year    int    `json:"year,omitempty"`
+	Season  int    `json:"season,omitempty"`
+	Episode int    `json:"episode,omitempty"`
+	// Resolution is such as `1080p`.
+	Resolution string `json:"resolution,omitempty"`
+	// Source is such as `BluRay` or `WEB-DL`.
+	Source string `json:"source,omitempty"`
+	// Codec is such as `H.264`.
+	Codec string `json:"codec,omitempty"`
+	// Audio is such as `DTS-HD MA`.
+	Audio string `json:"audio,omitempty"`
+	// Language is an ISO 639-1 code, or `multi`.
+	Language string `json:"language,omitempty"`
+	Group    string `json:"group,omitempty"`
+}
+
+// releaseColumns are the columns of the torrents table that a Release is persisted in, in the
+// order of the values of releaseValues and of the destinations of nullRelease.
+const releaseColumns = `release_title, release_year, release_season, release_episode, release_resolution,
+	release_source, release_codec, release_audio, release_language, release_group`
+
+// releaseValues returns the values of the release columns, which are NULL for the empty fields (and
+// for all of them if @r is nil), except for the title: since the torrents whose titles are NULL are
+// the ones not parsed yet (see GetUnparsedTorrents), the title is NULL only if @r is nil.
+func releaseValues(r *Release) []interface{} {
+	title := sql.NullString{Valid: r != nil}
+	if r == nil {
+		r = new(Release)
+	}
+	title.String = r.Title
+	str := func(s string) sql.NullString { return sql.NullString{String: s, Valid: s != ""} }
+	num := func(i int) sql.NullInt64 { return sql.NullInt64{Int64: int64(i), Valid: i != 0} }
+	return []interface{}{title, num(r.Year), num(r.Season), num(r.Episode), str(r.Resolution),
+		str(r.Source), str(r.Codec), str(r.Audio), str(r.Language), str(r.Group)}
+}
+
+// nullRelease is scanned from the release columns.
+type nullRelease struct {
+	title, resolution, source, codec, audio, language, group sql.NullString
+	year, season, episode                                    sql.NullInt64
+}
+
+func (nr *nullRelease) destinations() []interface{} {
+	return []interface{}{&nr.title, &nr.year, &nr.season, &nr.episode, &nr.resolution,
+		&nr.source, &nr.codec, &nr.audio, &nr.language, &nr.group}
+}
+
+// release returns nil for the torrents that are not parsed yet, whose titles are NULL.
+func (nr *nullRelease) release() *Release {
+	if !nr.title.Valid {
+		return nil
+	}
+	return &Release{
+		Title:      nr.title.String,
+		Year:       int(nr.year.Int64),
+		Season:     int(nr.season.Int64),
+		Episode:    int(nr.episode.Int64),
+		Resolution: nr.resolution.String,
+		Source:     nr.source.String,
+		Codec:      nr.codec.String,
+		Audio:      nr.audio.String,
+		Language:   nr.language.String,
+		Group:      nr.group.String,
+	}
+}
+
+// Readme is a readme (or an .nfo) file of a torrent, whose content is fetched from the swarm.
+type Readme struct {
+	Path string `json:"path"`
+	// Content is always in UTF-8.
+	Content string `json:"content"`
+}
+
+// Block is an entry of the blocklist, which blocks either the torrent of an InfoHash (either v1 or
+// v2), or the torrents whose names match a NamePattern (a regular expression in RE2 syntax).
+type Block struct {
+	ID          uint64 `json:"id"`
+	InfoHash    []byte `json:"infoHash"` // marshalled differently
+	NamePattern string `json:"namePattern,omitempty"`
+	Reason      string `json:"reason"`
+	AddedBy     string `json:"addedBy"`
+	AddedOn     int64  `json:"addedOn"`
+}
+
+func (b *Block) MarshalJSON() ([]byte, error) {
+	type Alias Block
+	return json.Marshal(&struct {
+		InfoHash string `json:"infoHash,omitempty"`
+		*Alias
+	}{
+		InfoHash: hex.EncodeToString(b.InfoHash),
+		Alias:    (*Alias)(b),
+	})
+}
+
+// AuditEntry records who did what (e.g. blocking or deleting a torrent) and why.
+type AuditEntry struct {
+	ID     uint64 `json:"id"`
+	Action string `json:"action"`
+	// InfoHash and NamePattern are the subject of the action, either of which might be empty.
+	InfoHash    []byte `json:"infoHash"` // marshalled differently
+	NamePattern string `json:"namePattern,omitempty"`
+	Actor       string `json:"actor"`
+	Reason      string `json:"reason"`
+	PerformedOn int64  `json:"performedOn"`
+}
+
+func (ae *AuditEntry) MarshalJSON() ([]byte, error) {
+	type Alias AuditEntry
+	return json.Marshal(&struct {
+		InfoHash string `json:"infoHash,omitempty"`
+		*Alias
+	}{
+		InfoHash: hex.EncodeToString(ae.InfoHash),
+		Alias:    (*Alias)(ae),
+	})
+}
+
+// blockAdder is implemented by the database engines that can add a block together with its audit
+// entries, and delete the torrent it blocks, in a single transaction (see AddBlockAndDelete).
+type blockAdder interface {
+	AddBlockAndDelete(block Block, entries []AuditEntry) (uint64, error)
+}
+
+// AddBlockAndDelete adds @block to the blocklist of @database, deletes the torrent of its InfoHash
+// (unless nil), and appends @entries to the audit log; at once if its engine can, so that neither
+// is done without the others, and one after the other otherwise. Returns the ID of the block.
+func AddBlockAndDelete(database Database, block Block, entries []AuditEntry) (uint64, error) {
+	if adder, ok := database.(blockAdder); ok {
+		return adder.AddBlockAndDelete(block, entries)
+	}
+
+	id, err := database.AddBlock(block)
+	if err != nil {
+		return 0, errors.Wrap(err, "AddBlock")
+	}
+	if block.InfoHash != nil {
+		if err = database.DeleteTorrent(block.InfoHash); err != nil {
+			return id, errors.Wrap(err, "DeleteTorrent")
+		}
+	}
+	for _, entry := range entries {
+		if err = database.AddAuditEntry(entry); err != nil {
+			return id, errors.Wrap(err, "AddAuditEntry")
+		}
+	}
+	return id, nil
+}
+
+// sqlExecer is either a *sql.DB or a *sql.Tx, so that the same statements can be executed either
+// on their own or in a transaction.
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type FailedFetch struct {
+	InfoHash      []byte `json:"infoHash"`
+	Reason        string `json:"reason"`
+	NAttempts     uint   `json:"nAttempts"`
+	LastFailedOn  int64  `json:"lastFailedOn"`
+	NextAttemptOn *int64 `json:"nextAttemptOn"` // nil if abandoned
 }
 
 type TorrentMetadata struct {
-	ID           uint64  `json:"id"`
-	InfoHash     []byte  `json:"infoHash"` // marshalled differently
+	ID       uint64 `json:"id"`
+	InfoHash []byte `json:"infoHash"` // marshalled differently
+	// InfoHashV2 is the SHA-256 infohash of v2 and hybrid torrents, nil for v1-only torrents.
+	InfoHashV2   []byte  `json:"infoHashV2"` // marshalled differently
 	Name         string  `json:"name"`
 	Size         uint64  `json:"size"`
 	DiscoveredOn int64   `json:"discoveredOn"`
 	NFiles       uint    `json:"nFiles"`
 	Relevance    float64 `json:"relevance"`
+	// PieceLength is zero for the torrents that are added before it is persisted.
+	PieceLength int64  `json:"pieceLength"`
+	Private     bool   `json:"private"`
+	Source      string `json:"source,omitempty"`
+	// Tags are returned by GetTorrent only.
+	Tags []string `json:"tags,omitempty"`
+	// Category is empty for the torrents that are added before categorisation is introduced, and
+	// not backfilled yet.
+	Category    string `json:"category,omitempty"`
+	SubCategory string `json:"subCategory,omitempty"`
+	// Release is likewise nil until the name of the torrent is parsed.
+	Release *Release `json:"release,omitempty"`
+	// SpamScore and QualityFlags are zero for the torrents that are added before they are
+	// assessed.
+	SpamScore    int      `json:"spamScore"`
+	QualityFlags []string `json:"qualityFlags,omitempty"`
 }
 
 type SimpleTorrentSummary struct {
-	InfoHash string `json:"infoHash"`
-	Name     string `json:"name"`
-	Files    []File `json:"files"`
+	InfoHash   string `json:"infoHash"`
+	InfoHashV2 string `json:"infoHashV2,omitempty"`
+	Name       string `json:"name"`
+	Files      []File `json:"files"`
+	TorrentAttributes
 }
 
 func (tm *TorrentMetadata) MarshalJSON() ([]byte, error) {
 	type Alias TorrentMetadata
 	return json.Marshal(&struct {
-		InfoHash string `json:"infoHash"`
+		InfoHash   string `json:"infoHash"`
+		InfoHashV2 string `json:"infoHashV2,omitempty"`
 		*Alias
 	}{
-		InfoHash: hex.EncodeToString(tm.InfoHash),
-		Alias:    (*Alias)(tm),
+		InfoHash:   hex.EncodeToString(tm.InfoHash),
+		InfoHashV2: hex.EncodeToString(tm.InfoHashV2),
+		Alias:      (*Alias)(tm),
 	})
 }
 
@@ -133,7 +533,22 @@ func MakeDatabase(rawURL string, logger *zap.Logger) (Database, error) {
 		return makeBeanstalkDatabase(url_)
 
 	case "mysql":
-		return nil, fmt.Errorf("mysql is not yet supported")
+		return makeMySQLDatabase(url_)
+
+	case "multi":
+		return makeMultiDatabase(url_)
+
+	case "file":
+		return makeFileDatabase(url_)
+
+	case "http", "https":
+		return makeWebhookDatabase(url_)
+
+	case "elasticsearch", "opensearch":
+		return makeElasticsearchDatabase(url_)
+
+	case "memory":
+		return makeMemoryDatabase(url_)
 
 	default:
 		return nil, fmt.Errorf("unknown URI scheme: `%s`", url_.Scheme)
@@ -0,0 +1,755 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// memory is an engine that keeps everything in memory, and hence loses it when closed. It supports
+// all of the operations so that the tests (e.g. of magneticow) do not need a database file, and so
+// that magneticod can be run ephemerally (e.g. to try it out, or together with `multi`).
+//
+// It behaves like the SQLite engine, except that the names are searched by their words (see
+// memoryTerms) rather than by the query syntax of FTS5.
+type memory struct {
+	mutex sync.RWMutex
+
+	// torrents are ordered by their IDs, which are never reused.
+	torrents []*memoryTorrent
+	lastID   uint64
+	// byInfoHash are the torrents by their infohashes, both v1 and v2.
+	byInfoHash map[string]*memoryTorrent
+	// byTruncatedInfoHash are the v2 torrents by their truncated (to 20 bytes) infohashes.
+	byTruncatedInfoHash map[string]*memoryTorrent
+	// index is the inverted index of the names, from their terms to the IDs of the torrents.
+	index map[string]map[uint64]struct{}
+	// nTerms is the total number of the terms in the names, for the average length of the names.
+	nTerms int
+
+	blocks        []Block
+	lastBlockID   uint64
+	auditLog      []AuditEntry
+	failedFetches map[string]*FailedFetch
+}
+
+// memoryTorrent is a torrent with the frequencies of the terms of its name.
+type memoryTorrent struct {
+	DumpedTorrent
+	terms  map[string]int
+	nTerms int
+}
+
+func makeMemoryDatabase(url_ *url.URL) (Database, error) {
+	return &memory{
+		byInfoHash:          make(map[string]*memoryTorrent),
+		byTruncatedInfoHash: make(map[string]*memoryTorrent),
+		index:               make(map[string]map[uint64]struct{}),
+		failedFetches:       make(map[string]*FailedFetch),
+	}, nil
+}
+
+// memoryTerms splits @s into its terms, which are the lowercase runs of letters and numbers, like
+// the `unicode61` tokenizer of SQLite (without the removal of diacritics and stemming).
+func memoryTerms(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// find returns the torrent of the given InfoHash (either v1 or v2), or nil if it does not exist.
+func (db *memory) find(infoHash []byte) *memoryTorrent {
+	return db.byInfoHash[string(infoHash)]
+}
+
+func (db *memory) Engine() databaseEngine {
+	return Memory
+}
+
+func (db *memory) DoesTorrentExist(infoHash []byte) (bool, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.exists(infoHash), nil
+}
+
+// exists is DoesTorrentExist without locking.
+func (db *memory) exists(infoHash []byte) bool {
+	// A 20 bytes long infohash might as well be a truncated v2 infohash.
+	return db.byInfoHash[string(infoHash)] != nil || db.byTruncatedInfoHash[string(infoHash)] != nil
+}
+
+func (db *memory) AddNewTorrent(infoHash []byte, infoHashV2 []byte, name string, files []File, attributes TorrentAttributes) error {
+	return db.AddNewTorrents([]NewTorrent{{
+		InfoHash:   infoHash,
+		InfoHashV2: infoHashV2,
+		Name:       name,
+		Files:      files,
+		Attributes: attributes,
+	}})
+}
+
+func (db *memory) AddNewTorrents(torrents []NewTorrent) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for _, nt := range torrents {
+		// Like in SQLite, the torrents whose total size is zero are ignored.
+		if nt.totalSize() == 0 || db.exists(nt.InfoHash) {
+			continue
+		}
+
+		db.lastID++
+		t := &memoryTorrent{DumpedTorrent: DumpedTorrent{ID: db.lastID, NewTorrent: nt}, terms: make(map[string]int)}
+		// The torrent is copied lest the caller modifies it afterwards.
+		t.InfoHash = append([]byte(nil), nt.InfoHash...)
+		t.InfoHashV2 = append([]byte(nil), nt.InfoHashV2...)
+		t.Files = append([]File(nil), nt.Files...)
+		t.InfoDict = append([]byte(nil), nt.InfoDict...)
+		t.DiscoveredOn = nt.discoveredOn()
+		t.Attributes.Tags = append([]string(nil), nt.Attributes.Tags...)
+		t.Attributes.QualityFlags = append([]string(nil), nt.Attributes.QualityFlags...)
+		if nt.Attributes.Release != nil {
+			release := *nt.Attributes.Release
+			t.Attributes.Release = &release
+		}
+		if len(nt.InfoHashV2) == 0 {
+			t.InfoHashV2 = nil
+		}
+		if len(nt.InfoDict) == 0 {
+			t.InfoDict = nil
+		}
+
+		db.torrents = append(db.torrents, t)
+		db.byInfoHash[string(t.InfoHash)] = t
+		if t.InfoHashV2 != nil {
+			db.byInfoHash[string(t.InfoHashV2)] = t
+			db.byTruncatedInfoHash[string(t.InfoHashV2[:20])] = t
+		}
+		for _, term := range memoryTerms(t.Name) {
+			if t.terms[term] == 0 {
+				if db.index[term] == nil {
+					db.index[term] = make(map[uint64]struct{})
+				}
+				db.index[term][t.ID] = struct{}{}
+			}
+			t.terms[term]++
+			t.nTerms++
+		}
+		db.nTerms += t.nTerms
+
+		// The torrent might have been in the retry queue, which is keyed by the infohashes found
+		// in the DHT, which are truncated for v2 torrents.
+		delete(db.failedFetches, string(t.InfoHash))
+		if t.InfoHashV2 != nil {
+			delete(db.failedFetches, string(t.InfoHashV2[:20]))
+		}
+	}
+
+	return nil
+}
+
+func (db *memory) Close() error {
+	return nil
+}
+
+func (db *memory) GetNumberOfTorrents() (uint, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return uint(len(db.torrents)), nil
+}
+
+// QueryTorrents matches the torrents whose names contain all the terms of @query, and ranks them by
+// BM25 with the same parameters as SQLite. Relevance is negated so that, like in SQLite (see bm25),
+// the lower it is the more relevant the torrent is.
+func (db *memory) QueryTorrents(
+	query string,
+	filter QueryFilter,
+	epoch int64,
+	orderBy OrderingCriteria,
+	ascending bool,
+	limit uint,
+	lastOrderedValue *float64,
+	lastID *uint64,
+) ([]TorrentMetadata, error) {
+	if query == "" && orderBy == ByRelevance {
+		return nil, fmt.Errorf("torrents cannot be ordered by relevance when the query is empty")
+	}
+	if (lastOrderedValue == nil) != (lastID == nil) {
+		return nil, fmt.Errorf("lastOrderedValue and lastID should be supplied together, if supplied")
+	}
+	switch orderBy {
+	case ByRelevance, ByTotalSize, ByDiscoveredOn, ByNFiles:
+	default:
+		return nil, fmt.Errorf("torrents cannot be ordered by %v", orderBy)
+	}
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	candidates := db.torrents
+	var terms []string
+	if query != "" {
+		terms = memoryTerms(query)
+		candidates = db.match(terms)
+	}
+
+	type result struct {
+		*memoryTorrent
+		relevance float64
+		value     float64
+	}
+	var results []result
+	for _, t := range candidates {
+		if t.DiscoveredOn > epoch || !filter.matches(&t.Attributes) {
+			continue
+		}
+
+		r := result{memoryTorrent: t}
+		if query != "" {
+			r.relevance = db.bm25(t, terms)
+		}
+		switch orderBy {
+		case ByRelevance:
+			r.value = r.relevance
+		case ByTotalSize:
+			r.value = float64(t.totalSize())
+		case ByDiscoveredOn:
+			r.value = float64(t.DiscoveredOn)
+		case ByNFiles:
+			r.value = float64(t.nFiles())
+		}
+		results = append(results, r)
+	}
+
+	// before returns whether the torrent with @value and @id comes before the one with @otherValue
+	// and @otherID in the order.
+	before := func(value float64, id uint64, otherValue float64, otherID uint64) bool {
+		if value != otherValue {
+			return (value < otherValue) == ascending
+		} else if id != otherID {
+			return (id < otherID) == ascending
+		}
+		return false
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return before(results[i].value, results[i].ID, results[j].value, results[j].ID)
+	})
+
+	torrents := make([]TorrentMetadata, 0)
+	for _, r := range results {
+		if uint(len(torrents)) == limit {
+			break
+		}
+		if lastID != nil && !before(*lastOrderedValue, *lastID, r.value, r.ID) {
+			continue
+		}
+
+		tm := r.metadata()
+		// Tags are returned by GetTorrent only.
+		tm.Tags = nil
+		tm.Relevance = r.relevance
+		torrents = append(torrents, *tm)
+	}
+
+	return torrents, nil
+}
+
+// match returns the torrents whose names contain all of the @terms, ordered by their IDs.
+func (db *memory) match(terms []string) []*memoryTorrent {
+	if len(terms) == 0 {
+		return nil
+	}
+
+	// The IDs of the rarest term are checked against the others.
+	rarest := db.index[terms[0]]
+	for _, term := range terms[1:] {
+		if len(db.index[term]) < len(rarest) {
+			rarest = db.index[term]
+		}
+	}
+
+	var matches []*memoryTorrent
+	for _, t := range db.torrents {
+		if _, ok := rarest[t.ID]; !ok {
+			continue
+		}
+		matched := true
+		for _, term := range terms {
+			matched = matched && t.terms[term] > 0
+		}
+		if matched {
+			matches = append(matches, t)
+		}
+	}
+	return matches
+}
+
+// bm25 returns the negated BM25 score of @t for @terms, like the bm25 function of FTS5 does.
+// See https://www.sqlite.org/fts5.html#the_bm25_function
+func (db *memory) bm25(t *memoryTorrent, terms []string) float64 {
+	const k1, b = 1.2, 0.75
+	n := float64(len(db.torrents))
+	averageLength := float64(db.nTerms) / n
+
+	score := 0.0
+	for _, term := range terms {
+		nMatches := float64(len(db.index[term]))
+		idf := math.Log((n - nMatches + 0.5) / (nMatches + 0.5))
+		if idf <= 0 {
+			idf = 1e-6
+		}
+		frequency := float64(t.terms[term])
+		score += idf * frequency * (k1 + 1) / (frequency + k1*(1-b+b*float64(t.nTerms)/averageLength))
+	}
+	return -score
+}
+
+// matches returns whether the torrent with @attributes passes the filter, like its conditions do in
+// SQL.
+func (f QueryFilter) matches(attributes *TorrentAttributes) bool {
+	if f.Category != "" && attributes.Category != f.Category {
+		return false
+	}
+	if f.SubCategory != "" && attributes.SubCategory != f.SubCategory {
+		return false
+	}
+	if f.ExcludeFlagged && len(attributes.QualityFlags) > 0 {
+		return false
+	}
+	if f.Private != nil && attributes.Private != *f.Private {
+		return false
+	}
+
+	if f.Release == (Release{}) {
+		return true
+	}
+	r := attributes.Release
+	if r == nil {
+		return false
+	}
+	for _, c := range []struct {
+		expected, actual string
+	}{
+		{f.Release.Resolution, r.Resolution},
+		{f.Release.Source, r.Source},
+		{f.Release.Codec, r.Codec},
+		{f.Release.Audio, r.Audio},
+		{f.Release.Language, r.Language},
+		{f.Release.Group, r.Group},
+	} {
+		if c.expected != "" && c.expected != c.actual {
+			return false
+		}
+	}
+	for _, c := range []struct {
+		expected, actual int
+	}{
+		{f.Release.Year, r.Year},
+		{f.Release.Season, r.Season},
+		{f.Release.Episode, r.Episode},
+	} {
+		if c.expected != 0 && c.expected != c.actual {
+			return false
+		}
+	}
+	return f.Release.Title == "" || strings.EqualFold(f.Release.Title, r.Title)
+}
+
+// nFiles is the number of the files of the torrent, excluding the padding files.
+func (t *memoryTorrent) nFiles() uint {
+	var n uint
+	for _, file := range t.Files {
+		if !file.IsPadding() {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *memoryTorrent) metadata() *TorrentMetadata {
+	tm := &TorrentMetadata{
+		ID:           t.ID,
+		InfoHash:     t.InfoHash,
+		InfoHashV2:   t.InfoHashV2,
+		Name:         t.Name,
+		Size:         t.totalSize(),
+		DiscoveredOn: t.DiscoveredOn,
+		NFiles:       t.nFiles(),
+		PieceLength:  t.Attributes.PieceLength,
+		Private:      t.Attributes.Private,
+		Source:       t.Attributes.Source,
+		Tags:         append([]string(nil), t.Attributes.Tags...),
+		Category:     t.Attributes.Category,
+		SubCategory:  t.Attributes.SubCategory,
+		SpamScore:    t.Attributes.SpamScore,
+		QualityFlags: append([]string(nil), t.Attributes.QualityFlags...),
+	}
+	if t.Attributes.Release != nil {
+		release := *t.Attributes.Release
+		tm.Release = &release
+	}
+	return tm
+}
+
+func (db *memory) GetTorrent(infoHash []byte) (*TorrentMetadata, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	t := db.find(infoHash)
+	if t == nil {
+		return nil, nil
+	}
+	return t.metadata(), nil
+}
+
+func (db *memory) GetFiles(infoHash []byte) ([]File, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	t := db.find(infoHash)
+	if t == nil {
+		return nil, nil
+	}
+
+	var files []File
+	for _, file := range t.Files {
+		if !file.IsPadding() {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+func (db *memory) GetStatistics(from string, n uint) (*Statistics, error) {
+	fromTime, gran, err := ParseISO8601(from)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing ISO8601 error")
+	}
+
+	var toTime time.Time
+	var format func(t time.Time) string
+	formatted := func(layout string) func(t time.Time) string {
+		return func(t time.Time) string { return t.Format(layout) }
+	}
+
+	switch gran {
+	case Year:
+		toTime = fromTime.AddDate(int(n), 0, 0)
+		format = formatted("2006")
+	case Month:
+		toTime = fromTime.AddDate(0, int(n), 0)
+		format = formatted("2006-01")
+	case Week:
+		// Weeks are numbered as in ISO 8601, like in PostgreSQL.
+		toTime = fromTime.AddDate(0, 0, int(n)*7)
+		format = func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%04d-W%02d", year, week)
+		}
+	case Day:
+		toTime = fromTime.AddDate(0, 0, int(n))
+		format = formatted("2006-01-02")
+	case Hour:
+		toTime = fromTime.Add(time.Duration(n) * time.Hour)
+		format = formatted("2006-01-02T15")
+	}
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	stats := NewStatistics()
+	for _, t := range db.torrents {
+		if t.DiscoveredOn < fromTime.Unix() || t.DiscoveredOn > toTime.Unix() {
+			continue
+		}
+		// Like in SQL, the torrents without any files (but the padding files) are not counted.
+		nFiles := t.nFiles()
+		if nFiles == 0 {
+			continue
+		}
+
+		dT := format(time.Unix(t.DiscoveredOn, 0).UTC())
+		stats.NDiscovered[dT]++
+		stats.NFiles[dT] += uint64(nFiles)
+		stats.TotalSize[dT] += t.totalSize()
+	}
+
+	stats.RetryQueue = new(RetryQueueStatistics)
+	for _, ff := range db.failedFetches {
+		if ff.NextAttemptOn != nil {
+			stats.RetryQueue.NPending++
+		} else {
+			stats.RetryQueue.NAbandoned++
+		}
+	}
+
+	return stats, nil
+}
+
+func (db *memory) GetUnparsedTorrents(limit uint) ([]TorrentMetadata, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	var torrents []TorrentMetadata
+	for _, t := range db.torrents {
+		if uint(len(torrents)) == limit {
+			break
+		}
+		if t.Attributes.Release == nil {
+			torrents = append(torrents, TorrentMetadata{InfoHash: t.InfoHash, Name: t.Name})
+		}
+	}
+	return torrents, nil
+}
+
+func (db *memory) SetRelease(infoHash []byte, release Release) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if t := db.find(infoHash); t != nil {
+		t.Attributes.Release = &release
+	}
+	return nil
+}
+
+func (db *memory) GetUncategorisedTorrents(limit uint) ([][]byte, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	var infoHashes [][]byte
+	for _, t := range db.torrents {
+		if uint(len(infoHashes)) == limit {
+			break
+		}
+		if t.Attributes.Category == "" {
+			infoHashes = append(infoHashes, t.InfoHash)
+		}
+	}
+	return infoHashes, nil
+}
+
+func (db *memory) SetCategory(infoHash []byte, category string, subCategory string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if t := db.find(infoHash); t != nil {
+		t.Attributes.Category, t.Attributes.SubCategory = category, subCategory
+	}
+	return nil
+}
+
+func (db *memory) SetInfoDict(infoHash []byte, infoDict []byte) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if t := db.find(infoHash); t != nil {
+		t.InfoDict = append([]byte(nil), infoDict...)
+	}
+	return nil
+}
+
+func (db *memory) GetInfoDict(infoHash []byte) ([]byte, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	t := db.find(infoHash)
+	if t == nil {
+		return nil, nil
+	}
+	return t.InfoDict, nil
+}
+
+func (db *memory) SetReadme(infoHash []byte, readme Readme) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	t := db.find(infoHash)
+	if t == nil {
+		return fmt.Errorf("no such torrent")
+	}
+
+	for _, file := range t.Files {
+		if file.Path == readme.Path {
+			t.Readme = &readme
+			return nil
+		}
+	}
+	return fmt.Errorf("no such file: %s", readme.Path)
+}
+
+func (db *memory) GetReadme(infoHash []byte) (*Readme, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	t := db.find(infoHash)
+	if t == nil || t.Readme == nil {
+		return nil, nil
+	}
+	readme := *t.Readme
+	return &readme, nil
+}
+
+func (db *memory) DeleteTorrent(infoHash []byte) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	t := db.find(infoHash)
+	if t == nil {
+		return nil
+	}
+
+	i := sort.Search(len(db.torrents), func(i int) bool { return db.torrents[i].ID >= t.ID })
+	db.torrents = append(db.torrents[:i], db.torrents[i+1:]...)
+	delete(db.byInfoHash, string(t.InfoHash))
+	if t.InfoHashV2 != nil {
+		delete(db.byInfoHash, string(t.InfoHashV2))
+		delete(db.byTruncatedInfoHash, string(t.InfoHashV2[:20]))
+	}
+	for term := range t.terms {
+		delete(db.index[term], t.ID)
+		if len(db.index[term]) == 0 {
+			delete(db.index, term)
+		}
+	}
+	db.nTerms -= t.nTerms
+
+	return nil
+}
+
+func (db *memory) AddBlock(block Block) (uint64, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.lastBlockID++
+	block.ID, block.AddedOn = db.lastBlockID, time.Now().Unix()
+	block.InfoHash = append([]byte(nil), block.InfoHash...)
+	db.blocks = append(db.blocks, block)
+
+	return block.ID, nil
+}
+
+func (db *memory) RemoveBlock(id uint64) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for i, block := range db.blocks {
+		if block.ID == id {
+			db.blocks = append(db.blocks[:i], db.blocks[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no such block: %d", id)
+}
+
+func (db *memory) GetBlocks() ([]Block, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return append(make([]Block, 0, len(db.blocks)), db.blocks...), nil
+}
+
+func (db *memory) AddAuditEntry(entry AuditEntry) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	entry.ID, entry.PerformedOn = uint64(len(db.auditLog)+1), time.Now().Unix()
+	entry.InfoHash = append([]byte(nil), entry.InfoHash...)
+	db.auditLog = append(db.auditLog, entry)
+
+	return nil
+}
+
+func (db *memory) GetAuditLog(limit uint) ([]AuditEntry, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	entries := make([]AuditEntry, 0)
+	for i := len(db.auditLog) - 1; i >= 0 && uint(len(entries)) < limit; i-- {
+		entries = append(entries, db.auditLog[i])
+	}
+	return entries, nil
+}
+
+func (db *memory) AddFailedFetch(infoHash []byte, reason string, nextAttemptOn int64) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	ff := db.failedFetches[string(infoHash)]
+	if ff == nil {
+		ff = &FailedFetch{InfoHash: append([]byte(nil), infoHash...), NextAttemptOn: &nextAttemptOn}
+		db.failedFetches[string(infoHash)] = ff
+	}
+	ff.Reason, ff.LastFailedOn = reason, time.Now().Unix()
+
+	return nil
+}
+
+func (db *memory) GetDueFailedFetches(now int64, limit uint) ([]FailedFetch, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	failedFetches := make([]FailedFetch, 0)
+	for _, ff := range db.failedFetches {
+		if ff.NextAttemptOn != nil && *ff.NextAttemptOn <= now {
+			failedFetches = append(failedFetches, *ff)
+		}
+	}
+	sort.Slice(failedFetches, func(i, j int) bool {
+		a, b := failedFetches[i], failedFetches[j]
+		if *a.NextAttemptOn != *b.NextAttemptOn {
+			return *a.NextAttemptOn < *b.NextAttemptOn
+		}
+		return bytes.Compare(a.InfoHash, b.InfoHash) < 0
+	})
+
+	if uint(len(failedFetches)) > limit {
+		failedFetches = failedFetches[:limit]
+	}
+	return failedFetches, nil
+}
+
+func (db *memory) UpdateFailedFetch(infoHash []byte, nAttempts uint, nextAttemptOn *int64) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if ff := db.failedFetches[string(infoHash)]; ff != nil {
+		ff.NAttempts = nAttempts
+		if nextAttemptOn != nil {
+			next := *nextAttemptOn
+			nextAttemptOn = &next
+		}
+		ff.NextAttemptOn = nextAttemptOn
+	}
+	return nil
+}
+
+func (db *memory) DumpTorrents(afterID uint64, limit uint, withInfoDicts bool) ([]DumpedTorrent, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	i := sort.Search(len(db.torrents), func(i int) bool { return db.torrents[i].ID > afterID })
+	torrents := make([]DumpedTorrent, 0)
+	for ; i < len(db.torrents) && uint(len(torrents)) < limit; i++ {
+		t := db.torrents[i].DumpedTorrent
+		t.Files = append([]File(nil), t.Files...)
+		if t.Readme != nil {
+			readme := *t.Readme
+			t.Readme = &readme
+		}
+		if !withInfoDicts {
+			t.InfoDict = nil
+		}
+		torrents = append(torrents, t)
+	}
+	return torrents, nil
+}
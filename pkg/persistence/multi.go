@@ -0,0 +1,326 @@
+package persistence
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// multi is a composite database that writes to (i.e. tees) several databases, its backends, and
+// reads from one of them, its primary.
+//
+// The writes fail if they fail in any of the required backends, and are only counted (see Metrics)
+// if they fail in the best-effort ones. The primary is always required.
+type multi struct {
+	// backends[0] is the primary.
+	backends []*multiBackend
+
+	// done and stopped are nil until all the backends are opened.
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// multiStatusInterval is how often the metrics of the backends are logged.
+const multiStatusInterval = time.Minute
+
+type multiBackend struct {
+	// Atomic counters come first so that they are 64-bit aligned on 32-bit platforms as well.
+	// https://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	nWrites   uint64
+	nFailures uint64
+
+	database   Database
+	url        string // redacted
+	bestEffort bool
+
+	lastErrorMutex sync.Mutex
+	lastError      string
+}
+
+// BackendMetrics are the metrics of a backend of a `multi://` database since it is opened.
+type BackendMetrics struct {
+	// URL is redacted (i.e. its password is replaced by `xxxxx`).
+	URL        string `json:"url"`
+	Primary    bool   `json:"primary"`
+	BestEffort bool   `json:"bestEffort"`
+	NWrites    uint64 `json:"nWrites"`
+	NFailures  uint64 `json:"nFailures"`
+	// LastError is the error of the last failed write, if any.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// makeMultiDatabase opens the backends given by the query of a URL such as
+// `multi://?primary=sqlite3%3A%2F%2F...&url=postgres%3A%2F%2F...&best-effort=beanstalk%3A%2F%2F...`
+// whose values are the URL-encoded URLs of the backends. `url`s are required and `best-effort`s are
+// not, whereas `primary` is the primary (which is required) and, if not supplied, the first `url`
+// is.
+func makeMultiDatabase(url_ *url.URL) (Database, error) {
+	query := url_.Query()
+	urls, bestEffortURLs := query["url"], query["best-effort"]
+	if primary := query.Get("primary"); primary != "" {
+		urls = append([]string{primary}, urls...)
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("neither primary nor any (required) url is supplied")
+	}
+
+	m := new(multi)
+	for i, rawURL := range append(urls, bestEffortURLs...) {
+		backend := &multiBackend{url: rawURL, bestEffort: i >= len(urls)}
+		if u, err := url.Parse(rawURL); err == nil && u.User != nil {
+			backend.url = u.Redacted()
+		}
+
+		var err error
+		if backend.database, err = MakeDatabase(rawURL, nil); err != nil {
+			_ = m.Close()
+			return nil, errors.Wrapf(err, "MakeDatabase %s", backend.url)
+		}
+		m.backends = append(m.backends, backend)
+	}
+
+	m.done = make(chan struct{})
+	m.stopped = make(chan struct{})
+	go m.run()
+	return m, nil
+}
+
+// run logs the metrics of the backends every multiStatusInterval, so that the failures of the
+// best-effort ones are noticed before the database is closed.
+func (m *multi) run() {
+	defer close(m.stopped)
+
+	ticker := time.NewTicker(multiStatusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			for _, metrics := range m.Metrics() {
+				zap.L().Info("Backend status", zap.Any("metrics", metrics))
+			}
+		}
+	}
+}
+
+func (m *multi) primary() Database {
+	return m.backends[0].database
+}
+
+// write performs @op (named @name) on every backend. Unsupported operations are tolerated in all
+// backends but the primary.
+func (m *multi) write(name string, op func(database Database) error) error {
+	var firstErr error
+	for i, backend := range m.backends {
+		atomic.AddUint64(&backend.nWrites, 1)
+		err := op(backend.database)
+		if err == nil || (i != 0 && errors.Cause(err) == NotImplementedError) {
+			continue
+		}
+
+		nFailures := atomic.AddUint64(&backend.nFailures, 1)
+		backend.lastErrorMutex.Lock()
+		backend.lastError = err.Error()
+		backend.lastErrorMutex.Unlock()
+
+		if backend.bestEffort {
+			zap.L().Error("Could not write to a best-effort backend",
+				zap.String("url", backend.url),
+				zap.String("operation", name),
+				zap.Uint64("nFailures", nFailures),
+				zap.Error(err),
+			)
+		} else if firstErr == nil {
+			// The primary is returned as it is, so that NotImplementedError can be told apart.
+			if i == 0 {
+				firstErr = err
+			} else {
+				firstErr = errors.Wrapf(err, "%s %s", name, backend.url)
+			}
+		}
+	}
+	return firstErr
+}
+
+// Metrics returns the metrics of the backends, primary first.
+func (m *multi) Metrics() []BackendMetrics {
+	metrics := make([]BackendMetrics, len(m.backends))
+	for i, backend := range m.backends {
+		backend.lastErrorMutex.Lock()
+		metrics[i] = BackendMetrics{
+			URL:        backend.url,
+			Primary:    i == 0,
+			BestEffort: backend.bestEffort,
+			NWrites:    atomic.LoadUint64(&backend.nWrites),
+			NFailures:  atomic.LoadUint64(&backend.nFailures),
+			LastError:  backend.lastError,
+		}
+		backend.lastErrorMutex.Unlock()
+	}
+	return metrics
+}
+
+func (m *multi) Engine() databaseEngine {
+	return Multi
+}
+
+func (m *multi) DoesTorrentExist(infoHash []byte) (bool, error) {
+	return m.primary().DoesTorrentExist(infoHash)
+}
+
+func (m *multi) AddNewTorrent(infoHash []byte, infoHashV2 []byte, name string, files []File, attributes TorrentAttributes) error {
+	return m.write("AddNewTorrent", func(database Database) error {
+		return database.AddNewTorrent(infoHash, infoHashV2, name, files, attributes)
+	})
+}
+
+// AddNewTorrents adds the torrents to each backend at once if it can, and one by one otherwise, so
+// that a multi database can be batched (see NewBatched) as well.
+func (m *multi) AddNewTorrents(torrents []NewTorrent) error {
+	return m.write("AddNewTorrents", func(database Database) error {
+		return AddNewTorrents(database, torrents)
+	})
+}
+
+// Close closes all the backends (logging their metrics), and returns the first error, if any.
+func (m *multi) Close() error {
+	if m.done != nil {
+		close(m.done)
+		<-m.stopped
+	}
+
+	var firstErr error
+	for _, metrics := range m.Metrics() {
+		zap.L().Info("Closing backend", zap.Any("metrics", metrics))
+	}
+	for _, backend := range m.backends {
+		if err := backend.database.Close(); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "Close %s", backend.url)
+		}
+	}
+	return firstErr
+}
+
+func (m *multi) GetNumberOfTorrents() (uint, error) {
+	return m.primary().GetNumberOfTorrents()
+}
+
+func (m *multi) QueryTorrents(
+	query string,
+	filter QueryFilter,
+	epoch int64,
+	orderBy OrderingCriteria,
+	ascending bool,
+	limit uint,
+	lastOrderedValue *float64,
+	lastID *uint64,
+) ([]TorrentMetadata, error) {
+	return m.primary().QueryTorrents(query, filter, epoch, orderBy, ascending, limit, lastOrderedValue, lastID)
+}
+
+func (m *multi) GetTorrent(infoHash []byte) (*TorrentMetadata, error) {
+	return m.primary().GetTorrent(infoHash)
+}
+
+func (m *multi) GetFiles(infoHash []byte) ([]File, error) {
+	return m.primary().GetFiles(infoHash)
+}
+
+func (m *multi) GetUnparsedTorrents(limit uint) ([]TorrentMetadata, error) {
+	return m.primary().GetUnparsedTorrents(limit)
+}
+
+func (m *multi) SetRelease(infoHash []byte, release Release) error {
+	return m.write("SetRelease", func(database Database) error {
+		return database.SetRelease(infoHash, release)
+	})
+}
+
+func (m *multi) GetUncategorisedTorrents(limit uint) ([][]byte, error) {
+	return m.primary().GetUncategorisedTorrents(limit)
+}
+
+func (m *multi) SetCategory(infoHash []byte, category string, subCategory string) error {
+	return m.write("SetCategory", func(database Database) error {
+		return database.SetCategory(infoHash, category, subCategory)
+	})
+}
+
+func (m *multi) GetStatistics(from string, n uint) (*Statistics, error) {
+	return m.primary().GetStatistics(from, n)
+}
+
+func (m *multi) SetInfoDict(infoHash []byte, infoDict []byte) error {
+	return m.write("SetInfoDict", func(database Database) error {
+		return database.SetInfoDict(infoHash, infoDict)
+	})
+}
+
+func (m *multi) GetInfoDict(infoHash []byte) ([]byte, error) {
+	return m.primary().GetInfoDict(infoHash)
+}
+
+func (m *multi) SetReadme(infoHash []byte, readme Readme) error {
+	return m.write("SetReadme", func(database Database) error {
+		return database.SetReadme(infoHash, readme)
+	})
+}
+
+func (m *multi) GetReadme(infoHash []byte) (*Readme, error) {
+	return m.primary().GetReadme(infoHash)
+}
+
+// DeleteTorrent deletes the torrent from all the backends, so that the takedowns are complete.
+func (m *multi) DeleteTorrent(infoHash []byte) error {
+	return m.write("DeleteTorrent", func(database Database) error {
+		return database.DeleteTorrent(infoHash)
+	})
+}
+
+// The blocklist and the audit log are of the primary only, since the IDs of the blocks differ
+// from backend to backend.
+
+func (m *multi) AddBlock(block Block) (uint64, error) {
+	return m.primary().AddBlock(block)
+}
+
+func (m *multi) RemoveBlock(id uint64) error {
+	return m.primary().RemoveBlock(id)
+}
+
+func (m *multi) GetBlocks() ([]Block, error) {
+	return m.primary().GetBlocks()
+}
+
+func (m *multi) AddAuditEntry(entry AuditEntry) error {
+	return m.primary().AddAuditEntry(entry)
+}
+
+func (m *multi) GetAuditLog(limit uint) ([]AuditEntry, error) {
+	return m.primary().GetAuditLog(limit)
+}
+
+// The retry queue is of the primary only as well, which is where the torrents are looked up.
+
+func (m *multi) AddFailedFetch(infoHash []byte, reason string, nextAttemptOn int64) error {
+	return m.primary().AddFailedFetch(infoHash, reason, nextAttemptOn)
+}
+
+func (m *multi) GetDueFailedFetches(now int64, limit uint) ([]FailedFetch, error) {
+	return m.primary().GetDueFailedFetches(now, limit)
+}
+
+func (m *multi) UpdateFailedFetch(infoHash []byte, nAttempts uint, nextAttemptOn *int64) error {
+	return m.primary().UpdateFailedFetch(infoHash, nAttempts, nextAttemptOn)
+}
+
+func (m *multi) DumpTorrents(afterID uint64, limit uint, withInfoDicts bool) ([]DumpedTorrent, error) {
+	return m.primary().DumpTorrents(afterID, limit, withInfoDicts)
+}
@@ -0,0 +1,73 @@
+package persistence
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// teeDatabase implements only the methods of Database that the tests of multi call.
+type teeDatabase struct {
+	Database
+	err      error
+	torrents []string
+	exists   bool
+}
+
+func (db *teeDatabase) DoesTorrentExist(infoHash []byte) (bool, error) {
+	return db.exists, nil
+}
+
+func (db *teeDatabase) AddNewTorrent(infoHash []byte, infoHashV2 []byte, name string, files []File, attributes TorrentAttributes) error {
+	if db.err != nil {
+		return db.err
+	}
+	db.torrents = append(db.torrents, name)
+	return nil
+}
+
+func (db *teeDatabase) SetInfoDict(infoHash []byte, infoDict []byte) error {
+	return NotImplementedError
+}
+
+func TestMulti(t *testing.T) {
+	primary, required, bestEffort := &teeDatabase{exists: true}, new(teeDatabase), new(teeDatabase)
+	m := &multi{backends: []*multiBackend{
+		{database: primary, url: "primary://"},
+		{database: required, url: "required://"},
+		{database: bestEffort, url: "best-effort://", bestEffort: true},
+	}}
+
+	if exists, _ := m.DoesTorrentExist(nil); !exists {
+		t.Error("DoesTorrentExist is not answered by the primary")
+	}
+
+	bestEffort.err = fmt.Errorf("unavailable")
+	if err := m.AddNewTorrent(nil, nil, "a", nil, TorrentAttributes{}); err != nil {
+		t.Errorf("Failure of a best-effort backend is not tolerated: %s", err.Error())
+	}
+	required.err = fmt.Errorf("unavailable")
+	if err := m.AddNewTorrent(nil, nil, "b", nil, TorrentAttributes{}); err == nil {
+		t.Error("Failure of a required backend is tolerated")
+	}
+	if len(primary.torrents) != 2 || len(required.torrents) != 1 || len(bestEffort.torrents) != 0 {
+		t.Errorf("Unexpected torrents %v %v %v", primary.torrents, required.torrents, bestEffort.torrents)
+	}
+
+	// Unsupported operations are tolerated in all backends but the primary.
+	if err := m.SetInfoDict(nil, nil); errors.Cause(err) != NotImplementedError {
+		t.Errorf("Expected NotImplementedError of the primary, got %v", err)
+	}
+
+	metrics := m.Metrics()
+	for i, expected := range []BackendMetrics{
+		{URL: "primary://", Primary: true, NWrites: 3, NFailures: 1, LastError: NotImplementedError.Error()},
+		{URL: "required://", NWrites: 3, NFailures: 1, LastError: "unavailable"},
+		{URL: "best-effort://", BestEffort: true, NWrites: 3, NFailures: 2, LastError: "unavailable"},
+	} {
+		if metrics[i] != expected {
+			t.Errorf("Backend #%d: expected %+v, got %+v", i, expected, metrics[i])
+		}
+	}
+}
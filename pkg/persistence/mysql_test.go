@@ -0,0 +1,90 @@
+package persistence
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMyBooleanQuery(t *testing.T) {
+	testCases := []struct {
+		query    string
+		expected string
+	}{
+		{"", ""},
+		{"king bad", "+king +bad"},
+		{"The Godf*", "The +Godf*"},
+		{`"king bad" -windows`, `+"king bad" -windows`},
+		{`"unterminated phrase`, `+"unterminated phrase"`},
+		{"The.Movie.2020.1080p.WEB-DL", "The +Movie +2020 +1080p +WEB DL"},
+		{"ubuntu (desktop server)", "+ubuntu (desktop server)"},
+		{"  >arch  ~linux ", ">arch ~linux"},
+	}
+
+	for i, tc := range testCases {
+		if actual := myBooleanQuery(tc.query); actual != tc.expected {
+			t.Errorf("Case #%d: expected %q, got %q", i, tc.expected, actual)
+		}
+	}
+}
+
+// openTestMySQL opens the database at MAGNETICO_TEST_MYSQL (see conformanceEngines), whose tables
+// are truncated, or skips the test if it is not set.
+func openTestMySQL(t *testing.T) Database {
+	rawURL := os.Getenv("MAGNETICO_TEST_MYSQL")
+	if rawURL == "" {
+		t.Skip("MAGNETICO_TEST_MYSQL is not set")
+	}
+	db := openConformanceDatabase(t, rawURL)
+
+	// The foreign keys are checked for each connection, hence a single one is used throughout.
+	ctx := context.Background()
+	conn, err := db.(*mysqlDatabase).conn.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Conn: %s", err.Error())
+	}
+	defer conn.Close()
+	for _, statement := range []string{
+		"SET FOREIGN_KEY_CHECKS = 0;",
+		"TRUNCATE files;",
+		"TRUNCATE torrents;",
+		"TRUNCATE blocklist;",
+		"TRUNCATE audit_log;",
+		"TRUNCATE failed_fetches;",
+		"SET FOREIGN_KEY_CHECKS = 1;",
+	} {
+		if _, err = conn.ExecContext(ctx, statement); err != nil {
+			t.Fatalf("%s: %s", statement, err.Error())
+		}
+	}
+	return db
+}
+
+// TestMySQLQueryTorrents tests the queries that are particular to MySQL, which are matched in the
+// boolean mode of its full-text search (see myBooleanQuery).
+func TestMySQLQueryTorrents(t *testing.T) {
+	db := openTestMySQL(t)
+	defer db.Close()
+	addConformanceTorrents(t, db)
+
+	now := int64(conformanceBase + 365*86400)
+	for _, c := range []struct {
+		query    string
+		expected []string
+	}{
+		{"ubun*", []string{"Ubuntu 20.04 Desktop amd64", "Ubuntu 20.04 Server amd64"}},
+		{"ubuntu -server", []string{"Ubuntu 20.04 Desktop amd64"}},
+		{`"desktop amd64"`, []string{"Ubuntu 20.04 Desktop amd64"}},
+		{`"amd64 desktop"`, []string{}},
+		// Stopwords (e.g. `the`) are not required, lest nothing is matched.
+		{"the netinst", []string{"Debian 10 netinst"}},
+	} {
+		torrents, err := db.QueryTorrents(c.query, QueryFilter{}, now, ByDiscoveredOn, true, 10, nil, nil)
+		if err != nil {
+			t.Errorf("QueryTorrents(%q): %s", c.query, err.Error())
+		} else if actual := names(torrents); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("QueryTorrents(%q): expected %q, got %q", c.query, c.expected, actual)
+		}
+	}
+}
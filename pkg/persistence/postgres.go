@@ -1,19 +1,34 @@
 package persistence
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
 	"time"
 	"unicode/utf8"
 
-	_ "github.com/jackc/pgx/v4"
-	_ "github.com/jackc/pgx/v4/stdlib"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
+// pgNotPadding is the condition on the `files` table to exclude the padding files (see BEP 47).
+const pgNotPadding = "(f.attributes IS NULL OR position('p' in f.attributes) = 0)"
+
+// pgNameVector is the document of the full-text search of the names of the torrents. Punctuation
+// is replaced by spaces beforehand, for the names such as `The.Movie.2020` are tokenised as a
+// whole otherwise. It must be the same expression as the one of idx_torrents_name_tsvector.
+const pgNameVector = `to_tsvector('simple'::regconfig, regexp_replace(t.name, '[^[:alnum:]]+', ' ', 'g'))`
+
+// likeEscaper escapes the wildcards of the (I)LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
 type postgresDatabase struct {
 	conn   *sql.DB
 	schema string
@@ -62,7 +77,12 @@ func (db *postgresDatabase) Engine() databaseEngine {
 }
 
 func (db *postgresDatabase) DoesTorrentExist(infoHash []byte) (bool, error) {
-	rows, err := db.conn.Query("SELECT 1 FROM torrents WHERE info_hash = $1;", infoHash)
+	// A 20 bytes long infohash might as well be a truncated v2 infohash, hence the second
+	// condition.
+	rows, err := db.conn.Query(
+		"SELECT 1 FROM torrents WHERE info_hash = $1 OR substring(info_hash_v2 from 1 for 20) = $1;",
+		infoHash,
+	)
 	if err != nil {
 		return false, err
 	}
@@ -76,7 +96,7 @@ func (db *postgresDatabase) DoesTorrentExist(infoHash []byte) (bool, error) {
 	return exists, nil
 }
 
-func (db *postgresDatabase) AddNewTorrent(infoHash []byte, name string, files []File) error {
+func (db *postgresDatabase) AddNewTorrent(infoHash []byte, infoHashV2 []byte, name string, files []File, attributes TorrentAttributes) error {
 	if !utf8.ValidString(name) {
 		zap.L().Warn(
 			"Ignoring a torrent whose name is not UTF-8 compliant.",
@@ -99,7 +119,9 @@ func (db *postgresDatabase) AddNewTorrent(infoHash []byte, name string, files []
 
 	var totalSize uint64 = 0
 	for _, file := range files {
-		totalSize += uint64(file.Size)
+		if !file.IsPadding() {
+			totalSize += uint64(file.Size)
+		}
 	}
 
 	// This is a workaround for a bug: the database will not accept total_size to be zero.
@@ -112,17 +134,41 @@ func (db *postgresDatabase) AddNewTorrent(infoHash []byte, name string, files []
 		return err
 	}
 
+	// Unlike the name, the source is not worth ignoring the whole torrent for.
+	if !utf8.ValidString(attributes.Source) {
+		attributes.Source = ""
+	}
+
 	var lastInsertId int64
 
 	err = tx.QueryRow(`
 		INSERT INTO torrents (
 			info_hash,
+			info_hash_v2,
 			name,
 			total_size,
-			discovered_on
-		) VALUES ($1, $2, $3, $4)
+			discovered_on,
+			piece_length,
+			private,
+			source,
+			encoding,
+			original_name,
+			undecodable,
+			tags,
+			category,
+			sub_category,
+			spam_score,
+			quality_flags,
+			`+releaseColumns+`
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NULLIF($9, ''), $10, $11, NULLIF($12, ''), NULLIF($13, ''), NULLIF($14, ''),
+			$15, NULLIF($16, ''), $17, $18, $19, $20, $21, $22, $23, $24, $25, $26)
 		RETURNING id;
-	`, infoHash, name, totalSize, time.Now().Unix()).Scan(&lastInsertId)
+	`, append([]interface{}{infoHash, infoHashV2, name, totalSize, time.Now().Unix(),
+		attributes.PieceLength, attributes.Private, attributes.Source,
+		attributes.Encoding, attributes.OriginalName, attributes.Undecodable,
+		strings.Join(attributes.Tags, ","), attributes.Category, attributes.SubCategory,
+		attributes.SpamScore, strings.Join(attributes.QualityFlags, ",")},
+		releaseValues(attributes.Release)...)...).Scan(&lastInsertId)
 	if err != nil {
 		return errors.Wrap(err, "tx.QueryRow (INSERT INTO torrents)")
 	}
@@ -138,14 +184,24 @@ func (db *postgresDatabase) AddNewTorrent(infoHash []byte, name string, files []
 			return nil
 		}
 
-		_, err = tx.Exec("INSERT INTO files (torrent_id, size, path) VALUES ($1, $2, $3);",
-			lastInsertId, file.Size, file.Path,
+		_, err = tx.Exec("INSERT INTO files (torrent_id, size, path, attributes, original_path) VALUES ($1, $2, $3, NULLIF($4, ''), $5);",
+			lastInsertId, file.Size, file.Path, file.Attributes, file.OriginalPath,
 		)
 		if err != nil {
 			return errors.Wrap(err, "tx.Exec (INSERT INTO files)")
 		}
 	}
 
+	// The torrent might have been in the retry queue, in which case it is no longer needed there.
+	// Retry queue is keyed by the infohashes found in the DHT, which are truncated for v2 torrents.
+	_, err = tx.Exec(
+		"DELETE FROM failed_fetches WHERE info_hash = $1 OR info_hash = substring($2::bytea from 1 for 20);",
+		infoHash, infoHashV2,
+	)
+	if err != nil {
+		return errors.Wrap(err, "tx.Exec (DELETE FROM failed_fetches)")
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		return errors.Wrap(err, "tx.Commit")
@@ -154,6 +210,186 @@ func (db *postgresDatabase) AddNewTorrent(infoHash []byte, name string, files []
 	return nil
 }
 
+// AddNewTorrents adds the torrents using COPY, which is not available through database/sql, hence
+// the underlying pgx connection is used for the whole transaction.
+func (db *postgresDatabase) AddNewTorrents(torrents []NewTorrent) error {
+	ctx := context.Background()
+	conn, err := db.conn.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "conn.Conn")
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		return pgAddNewTorrents(ctx, driverConn.(*stdlib.Conn).Conn(), torrents)
+	})
+}
+
+func pgAddNewTorrents(ctx context.Context, conn *pgx.Conn, torrents []NewTorrent) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return errors.Wrap(err, "conn.Begin")
+	}
+	// See AddNewTorrent for why the transaction is rollback'ed.
+	defer tx.Rollback(ctx)
+
+	infoHashes := make([][]byte, len(torrents))
+	for i, t := range torrents {
+		infoHashes[i] = t.InfoHash
+	}
+	// A 20 bytes long infohash might as well be a truncated v2 infohash (see DoesTorrentExist).
+	rows, err := tx.Query(ctx, `
+		SELECT info_hash, substring(info_hash_v2 from 1 for 20)
+		FROM torrents
+		WHERE info_hash = ANY($1) OR substring(info_hash_v2 from 1 for 20) = ANY($1);
+	`, infoHashes)
+	if err != nil {
+		return errors.Wrap(err, "tx.Query (SELECT FROM torrents)")
+	}
+	exist := make(map[string]bool)
+	for rows.Next() {
+		var infoHash, truncatedInfoHashV2 []byte
+		if err = rows.Scan(&infoHash, &truncatedInfoHashV2); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "rows.Scan")
+		}
+		exist[string(infoHash)] = true
+		if truncatedInfoHashV2 != nil {
+			exist[string(truncatedInfoHashV2)] = true
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "rows.Err")
+	}
+
+	var newTorrents []*NewTorrent
+	for i := range torrents {
+		t := &torrents[i]
+		if !t.isUTF8() || exist[string(t.InfoHash)] {
+			continue
+		}
+		// This is a workaround for a bug: the database will not accept total_size to be zero.
+		if t.totalSize() == 0 {
+			zap.L().Debug("Ignoring a torrent whose total size is zero.")
+			continue
+		}
+		// The torrents of the same batch are checked against each other as well.
+		exist[string(t.InfoHash)] = true
+		newTorrents = append(newTorrents, t)
+	}
+	if len(newTorrents) == 0 {
+		return nil
+	}
+
+	// The IDs of the torrents are allocated beforehand so that the files can refer to them.
+	ids := make([]int64, 0, len(newTorrents))
+	rows, err = tx.Query(ctx, "SELECT nextval('seq_torrents_id') FROM generate_series(1, $1);", len(newTorrents))
+	if err != nil {
+		return errors.Wrap(err, "tx.Query (SELECT nextval)")
+	}
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "rows.Scan")
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "rows.Err")
+	}
+
+	// COPY does not evaluate expressions, hence NULLIF is done here.
+	nullIfEmpty := func(s string) interface{} {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+
+	var torrentRows, fileRows [][]interface{}
+	var retriedInfoHashes [][]byte
+	for i, t := range newTorrents {
+		var infoDict []byte
+		if t.InfoDict != nil {
+			if infoDict, err = compress(t.InfoDict); err != nil {
+				return errors.Wrap(err, "compress")
+			}
+		}
+
+		// Unlike the name, the source is not worth ignoring the whole torrent for.
+		attributes := t.Attributes
+		if !utf8.ValidString(attributes.Source) {
+			attributes.Source = ""
+		}
+
+		torrentRows = append(torrentRows, append([]interface{}{ids[i], t.InfoHash, t.InfoHashV2, t.Name,
+			t.totalSize(), t.discoveredOn(), attributes.PieceLength, attributes.Private,
+			nullIfEmpty(attributes.Source), nullIfEmpty(attributes.Encoding), attributes.OriginalName,
+			attributes.Undecodable, nullIfEmpty(strings.Join(attributes.Tags, ",")),
+			nullIfEmpty(attributes.Category), nullIfEmpty(attributes.SubCategory), attributes.SpamScore,
+			nullIfEmpty(strings.Join(attributes.QualityFlags, ",")), infoDict},
+			releaseValues(attributes.Release)...))
+
+		for _, file := range t.Files {
+			fileRows = append(fileRows, []interface{}{ids[i], file.Size, file.Path,
+				nullIfEmpty(file.Attributes), file.OriginalPath})
+		}
+
+		// Retry queue is keyed by the infohashes found in the DHT, which are truncated for v2
+		// torrents.
+		retriedInfoHashes = append(retriedInfoHashes, t.InfoHash)
+		if t.InfoHashV2 != nil {
+			retriedInfoHashes = append(retriedInfoHashes, t.InfoHashV2[:20])
+		}
+	}
+
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"torrents"}, append([]string{
+		"id",
+		"info_hash",
+		"info_hash_v2",
+		"name",
+		"total_size",
+		"discovered_on",
+		"piece_length",
+		"private",
+		"source",
+		"encoding",
+		"original_name",
+		"undecodable",
+		"tags",
+		"category",
+		"sub_category",
+		"spam_score",
+		"quality_flags",
+		"info_dict",
+	}, strings.Split(strings.Join(strings.Fields(releaseColumns), ""), ",")...), pgx.CopyFromRows(torrentRows))
+	if err != nil {
+		return errors.Wrap(err, "tx.CopyFrom (torrents)")
+	}
+
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"files"},
+		[]string{"torrent_id", "size", "path", "attributes", "original_path"}, pgx.CopyFromRows(fileRows))
+	if err != nil {
+		return errors.Wrap(err, "tx.CopyFrom (files)")
+	}
+
+	// The torrents might have been in the retry queue, in which case they are no longer needed
+	// there.
+	_, err = tx.Exec(ctx, "DELETE FROM failed_fetches WHERE info_hash = ANY($1);", retriedInfoHashes)
+	if err != nil {
+		return errors.Wrap(err, "tx.Exec (DELETE FROM failed_fetches)")
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return errors.Wrap(err, "tx.Commit")
+	}
+
+	return nil
+}
+
 func (db *postgresDatabase) Close() error {
 	return db.conn.Close()
 }
@@ -190,6 +426,7 @@ func (db *postgresDatabase) GetNumberOfTorrents() (uint, error) {
 
 func (db *postgresDatabase) QueryTorrents(
 	query string,
+	filter QueryFilter,
 	epoch int64,
 	orderBy OrderingCriteria,
 	ascending bool,
@@ -197,19 +434,217 @@ func (db *postgresDatabase) QueryTorrents(
 	lastOrderedValue *float64,
 	lastID *uint64,
 ) ([]TorrentMetadata, error) {
-	return nil, NotImplementedError
+	if query == "" && orderBy == ByRelevance {
+		return nil, fmt.Errorf("torrents cannot be ordered by relevance when the query is empty")
+	}
+	if (lastOrderedValue == nil) != (lastID == nil) {
+		return nil, fmt.Errorf("lastOrderedValue and lastID should be supplied together, if supplied")
+	}
+	orderOn, err := pgOrderOn(orderBy)
+	if err != nil {
+		return nil, err
+	}
+
+	doJoin := query != ""
+	firstPage := lastID == nil
+	conditions, conditionValues := filter.conditions(Postgres)
+
+	// The torrents are matched either by the words of their names (using the full-text search),
+	// or by the query as a substring of their names (using the trigram index) so that the partial
+	// words are matched as well.
+	//
+	// Relevance is negated so that, like in SQLite (see bm25), the lower it is the more relevant
+	// the torrent is, and hence the clients need not care about the database engine.
+	//
+	// The query is wrapped so that the keyset pagination can refer to the columns by their names
+	// (e.g. n_files), which PostgreSQL does not allow in the WHERE clause of the same query.
+	//
+	// executeTemplate is used to prepare the SQL query, WITH PLACEHOLDERS FOR USER INPUT.
+	sqlQuery := pgPlaceholders(executeTemplate(`
+		SELECT *
+		FROM (
+			SELECT t.id
+				 , t.info_hash
+				 , t.info_hash_v2
+				 , t.name
+				 , t.total_size
+				 , t.discovered_on
+				 , (SELECT COUNT(*) FROM files f WHERE f.torrent_id = t.id AND `+pgNotPadding+`) AS n_files
+				 , t.piece_length
+				 , t.private
+				 , t.source
+				 , t.category
+				 , t.sub_category
+				 , COALESCE(t.spam_score, 0) AS spam_score
+				 , t.quality_flags
+				 , `+releaseColumns+`
+		{{ if .DoJoin }}
+				 , -(ts_rank_cd(`+pgNameVector+`, q) + word_similarity(?, t.name)) AS rank
+		{{ else }}
+				 , 0::float8 AS rank
+		{{ end }}
+			FROM torrents t
+		{{ if .DoJoin }}
+			   , websearch_to_tsquery('simple', ?) AS q
+		{{ end }}
+			WHERE     t.discovered_on <= ?
+		{{ if .DoJoin }}
+				  AND (`+pgNameVector+` @@ q OR t.name ILIKE ?)
+		{{ end }}
+		{{ range .Conditions }}
+				  AND {{ . }}
+		{{ end }}
+		) AS t
+	{{ if not .FirstPage }}
+		WHERE ( {{.OrderOn}}, id ) {{GTEorLTE .Ascending}} (?, ?)
+	{{ end }}
+		ORDER BY {{.OrderOn}} {{AscOrDesc .Ascending}}, id {{AscOrDesc .Ascending}}
+		LIMIT ?;
+	`, struct {
+		DoJoin     bool
+		FirstPage  bool
+		OrderOn    string
+		Ascending  bool
+		Conditions []string
+	}{
+		DoJoin:     doJoin,
+		FirstPage:  firstPage,
+		OrderOn:    orderOn,
+		Ascending:  ascending,
+		Conditions: conditions,
+	}, template.FuncMap{
+		"GTEorLTE": func(ascending bool) string {
+			if ascending {
+				return ">"
+			} else {
+				return "<"
+			}
+		},
+		"AscOrDesc": func(ascending bool) string {
+			if ascending {
+				return "ASC"
+			} else {
+				return "DESC"
+			}
+		},
+	}))
+
+	// Prepare query
+	queryArgs := make([]interface{}, 0)
+	if doJoin {
+		queryArgs = append(queryArgs, query, query)
+	}
+	queryArgs = append(queryArgs, epoch)
+	if doJoin {
+		queryArgs = append(queryArgs, "%"+likeEscaper.Replace(query)+"%")
+	}
+	queryArgs = append(queryArgs, conditionValues...)
+	if !firstPage {
+		queryArgs = append(queryArgs, *lastOrderedValue, *lastID)
+	}
+	queryArgs = append(queryArgs, limit)
+
+	rows, err := db.conn.Query(sqlQuery, queryArgs...)
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+	defer db.closeRows(rows)
+
+	torrents := make([]TorrentMetadata, 0)
+	for rows.Next() {
+		var torrent TorrentMetadata
+		var pieceLength sql.NullInt64
+		var source, category, subCategory, qualityFlags sql.NullString
+		var release nullRelease
+		dest := []interface{}{
+			&torrent.ID,
+			&torrent.InfoHash,
+			&torrent.InfoHashV2,
+			&torrent.Name,
+			&torrent.Size,
+			&torrent.DiscoveredOn,
+			&torrent.NFiles,
+			&pieceLength,
+			&torrent.Private,
+			&source,
+			&category,
+			&subCategory,
+			&torrent.SpamScore,
+			&qualityFlags,
+		}
+		dest = append(dest, release.destinations()...)
+		if err = rows.Scan(append(dest, &torrent.Relevance)...); err != nil {
+			return nil, err
+		}
+		torrent.PieceLength, torrent.Source = pieceLength.Int64, source.String
+		torrent.Category, torrent.SubCategory = category.String, subCategory.String
+		torrent.QualityFlags = splitTags(qualityFlags.String)
+		torrent.Release = release.release()
+		torrents = append(torrents, torrent)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return torrents, nil
+}
+
+func pgOrderOn(orderBy OrderingCriteria) (string, error) {
+	switch orderBy {
+	case ByRelevance:
+		return "rank", nil
+
+	case ByTotalSize:
+		return "total_size", nil
+
+	case ByDiscoveredOn:
+		return "discovered_on", nil
+
+	case ByNFiles:
+		return "n_files", nil
+
+	default:
+		return "", fmt.Errorf("torrents cannot be ordered by %v", orderBy)
+	}
+}
+
+// pgPlaceholders replaces the `?` placeholders of the query with the numbered placeholders of
+// PostgreSQL (i.e. `$1`, `$2`, ...) in order, so that the conditions of QueryFilter (and the
+// templates) can be shared with SQLite. The query must not contain any other question marks.
+func pgPlaceholders(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
 }
 
 func (db *postgresDatabase) GetTorrent(infoHash []byte) (*TorrentMetadata, error) {
 	rows, err := db.conn.Query(`
 		SELECT
 			t.info_hash,
+			t.info_hash_v2,
 			t.name,
 			t.total_size,
 			t.discovered_on,
-			(SELECT COUNT(*) FROM files f WHERE f.torrent_id = t.id) AS n_files
+			(SELECT COUNT(*) FROM files f WHERE f.torrent_id = t.id AND `+pgNotPadding+`) AS n_files,
+			t.piece_length,
+			t.private,
+			t.source,
+			t.tags,
+			t.category,
+			t.sub_category,
+			COALESCE(t.spam_score, 0),
+			t.quality_flags,
+			`+releaseColumns+`
 		FROM torrents t
-		WHERE t.info_hash = $1;`,
+		WHERE t.info_hash = $1 OR t.info_hash_v2 = $1;`,
 		infoHash,
 	)
 	defer db.closeRows(rows)
@@ -222,9 +657,19 @@ func (db *postgresDatabase) GetTorrent(infoHash []byte) (*TorrentMetadata, error
 	}
 
 	var tm TorrentMetadata
-	if err = rows.Scan(&tm.InfoHash, &tm.Name, &tm.Size, &tm.DiscoveredOn, &tm.NFiles); err != nil {
+	var pieceLength sql.NullInt64
+	var source, tags, category, subCategory, qualityFlags sql.NullString
+	var release nullRelease
+	err = rows.Scan(append([]interface{}{&tm.InfoHash, &tm.InfoHashV2, &tm.Name, &tm.Size, &tm.DiscoveredOn,
+		&tm.NFiles, &pieceLength, &tm.Private, &source, &tags, &category, &subCategory, &tm.SpamScore,
+		&qualityFlags}, release.destinations()...)...)
+	if err != nil {
 		return nil, err
 	}
+	tm.PieceLength, tm.Source, tm.Tags = pieceLength.Int64, source.String, splitTags(tags.String)
+	tm.Category, tm.SubCategory = category.String, subCategory.String
+	tm.QualityFlags = splitTags(qualityFlags.String)
+	tm.Release = release.release()
 
 	return &tm, nil
 }
@@ -233,8 +678,9 @@ func (db *postgresDatabase) GetFiles(infoHash []byte) ([]File, error) {
 	rows, err := db.conn.Query(`
 		SELECT
        		f.size,
-       		f.path 
-		FROM files f, torrents t WHERE f.torrent_id = t.id AND t.info_hash = $1;`,
+       		f.path,
+       		COALESCE(f.attributes, '')
+		FROM files f, torrents t WHERE f.torrent_id = t.id AND (t.info_hash = $1 OR t.info_hash_v2 = $1) AND `+pgNotPadding+`;`,
 		infoHash,
 	)
 	defer db.closeRows(rows)
@@ -245,7 +691,7 @@ func (db *postgresDatabase) GetFiles(infoHash []byte) ([]File, error) {
 	var files []File
 	for rows.Next() {
 		var file File
-		if err = rows.Scan(&file.Size, &file.Path); err != nil {
+		if err = rows.Scan(&file.Size, &file.Path, &file.Attributes); err != nil {
 			return nil, err
 		}
 		files = append(files, file)
@@ -254,8 +700,437 @@ func (db *postgresDatabase) GetFiles(infoHash []byte) ([]File, error) {
 	return files, nil
 }
 
+func (db *postgresDatabase) GetUnparsedTorrents(limit uint) ([]TorrentMetadata, error) {
+	rows, err := db.conn.Query("SELECT info_hash, name FROM torrents WHERE release_title IS NULL LIMIT $1;", limit)
+	defer db.closeRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var torrents []TorrentMetadata
+	for rows.Next() {
+		var torrent TorrentMetadata
+		if err = rows.Scan(&torrent.InfoHash, &torrent.Name); err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, torrent)
+	}
+
+	return torrents, nil
+}
+
+func (db *postgresDatabase) SetRelease(infoHash []byte, release Release) error {
+	_, err := db.conn.Exec(`
+		UPDATE torrents
+		SET (`+releaseColumns+`) = ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		WHERE info_hash = $11 OR info_hash_v2 = $11;`,
+		append(releaseValues(&release), infoHash)...,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Exec (UPDATE torrents)")
+	}
+
+	return nil
+}
+
+func (db *postgresDatabase) GetUncategorisedTorrents(limit uint) ([][]byte, error) {
+	rows, err := db.conn.Query("SELECT info_hash FROM torrents WHERE category IS NULL LIMIT $1;", limit)
+	defer db.closeRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var infoHashes [][]byte
+	for rows.Next() {
+		var infoHash []byte
+		if err = rows.Scan(&infoHash); err != nil {
+			return nil, err
+		}
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	return infoHashes, nil
+}
+
+func (db *postgresDatabase) SetCategory(infoHash []byte, category string, subCategory string) error {
+	_, err := db.conn.Exec(
+		"UPDATE torrents SET category = $1, sub_category = NULLIF($2, '') WHERE info_hash = $3 OR info_hash_v2 = $3;",
+		category, subCategory, infoHash,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Exec (UPDATE torrents)")
+	}
+
+	return nil
+}
+
 func (db *postgresDatabase) GetStatistics(from string, n uint) (*Statistics, error) {
-	return nil, NotImplementedError
+	fromTime, gran, err := ParseISO8601(from)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing ISO8601 error")
+	}
+
+	var toTime time.Time
+	var timef string // time format: https://www.postgresql.org/docs/current/functions-formatting.html
+
+	switch gran {
+	case Year:
+		toTime = fromTime.AddDate(int(n), 0, 0)
+		timef = "YYYY"
+	case Month:
+		toTime = fromTime.AddDate(0, int(n), 0)
+		timef = "YYYY-MM"
+	case Week:
+		// Unlike SQLite, PostgreSQL supports the ISO 8601 week numbering.
+		toTime = fromTime.AddDate(0, 0, int(n)*7)
+		timef = `IYYY-"W"IW`
+	case Day:
+		toTime = fromTime.AddDate(0, 0, int(n))
+		timef = "YYYY-MM-DD"
+	case Hour:
+		toTime = fromTime.Add(time.Duration(n) * time.Hour)
+		timef = `YYYY-MM-DD"T"HH24`
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT to_char(to_timestamp(t.discovered_on) AT TIME ZONE 'UTC', $1) AS dT
+		     , sum(f.size)::BIGINT AS tS
+		     , count(DISTINCT t.id) AS nD
+		     , count(DISTINCT f.id) AS nF
+		FROM torrents t, files f
+		WHERE     t.id = f.torrent_id
+		      AND `+pgNotPadding+`
+		      AND t.discovered_on >= $2
+		      AND t.discovered_on <= $3
+		GROUP BY dT;`,
+		timef, fromTime.Unix(), toTime.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer db.closeRows(rows)
+
+	stats := NewStatistics()
+
+	for rows.Next() {
+		var dT string
+		var tS, nD, nF uint64
+		if err := rows.Scan(&dT, &tS, &nD, &nF); err != nil {
+			return nil, err
+		}
+		stats.NDiscovered[dT] = nD
+		stats.TotalSize[dT] = tS
+		stats.NFiles[dT] = nF
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stats.RetryQueue = new(RetryQueueStatistics)
+	err = db.conn.QueryRow(`
+		SELECT count(next_attempt_on)
+		     , count(*) - count(next_attempt_on)
+		FROM failed_fetches;
+	`).Scan(&stats.RetryQueue.NPending, &stats.RetryQueue.NAbandoned)
+	if err != nil {
+		return nil, errors.Wrap(err, "QueryRow (failed_fetches)")
+	}
+
+	return stats, nil
+}
+
+func (db *postgresDatabase) SetInfoDict(infoHash []byte, infoDict []byte) error {
+	compressed, err := compress(infoDict)
+	if err != nil {
+		return errors.Wrap(err, "compress")
+	}
+
+	_, err = db.conn.Exec(
+		"UPDATE torrents SET info_dict = $1 WHERE info_hash = $2 OR info_hash_v2 = $2;",
+		compressed, infoHash,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Exec (UPDATE torrents)")
+	}
+
+	return nil
+}
+
+func (db *postgresDatabase) GetInfoDict(infoHash []byte) ([]byte, error) {
+	var compressed []byte
+	err := db.conn.QueryRow(
+		"SELECT info_dict FROM torrents WHERE info_hash = $1 OR info_hash_v2 = $1;",
+		infoHash,
+	).Scan(&compressed)
+	if err == sql.ErrNoRows || (err == nil && compressed == nil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "QueryRow (torrents)")
+	}
+
+	return decompress(compressed)
+}
+
+func (db *postgresDatabase) SetReadme(infoHash []byte, readme Readme) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return errors.Wrap(err, "conn.Begin")
+	}
+	defer tx.Rollback()
+
+	var torrentID int64
+	err = tx.QueryRow(
+		"SELECT id FROM torrents WHERE info_hash = $1 OR info_hash_v2 = $1;",
+		infoHash,
+	).Scan(&torrentID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no such torrent")
+	} else if err != nil {
+		return errors.Wrap(err, "tx.QueryRow (SELECT id FROM torrents)")
+	}
+
+	// See sqlite3.go for the details.
+	_, err = tx.Exec(
+		"UPDATE files SET is_readme = FALSE, content = NULL WHERE torrent_id = $1 AND is_readme;",
+		torrentID,
+	)
+	if err != nil {
+		return errors.Wrap(err, "tx.Exec (UPDATE files, unmark)")
+	}
+
+	res, err := tx.Exec(`
+		UPDATE files SET is_readme = TRUE, content = $1
+		WHERE id = (SELECT id FROM files WHERE torrent_id = $2 AND path = $3 ORDER BY id LIMIT 1);`,
+		readme.Content, torrentID, readme.Path,
+	)
+	if err != nil {
+		return errors.Wrap(err, "tx.Exec (UPDATE files, mark)")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "RowsAffected")
+	} else if n == 0 {
+		return fmt.Errorf("no such file: %s", readme.Path)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.Wrap(err, "tx.Commit")
+	}
+
+	return nil
+}
+
+func (db *postgresDatabase) GetReadme(infoHash []byte) (*Readme, error) {
+	readme := new(Readme)
+	err := db.conn.QueryRow(`
+		SELECT f.path, f.content
+		FROM files f, torrents t
+		WHERE f.torrent_id = t.id AND (t.info_hash = $1 OR t.info_hash_v2 = $1) AND f.is_readme;`,
+		infoHash,
+	).Scan(&readme.Path, &readme.Content)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "QueryRow (files)")
+	}
+
+	return readme, nil
+}
+
+func (db *postgresDatabase) DeleteTorrent(infoHash []byte) error {
+	return db.deleteTorrent(db.conn, infoHash)
+}
+
+func (db *postgresDatabase) deleteTorrent(execer sqlExecer, infoHash []byte) error {
+	// Files are deleted by the foreign key, which is always enforced by PostgreSQL.
+	_, err := execer.Exec("DELETE FROM torrents WHERE info_hash = $1 OR info_hash_v2 = $1;", infoHash)
+	if err != nil {
+		return errors.Wrap(err, "Exec (DELETE FROM torrents)")
+	}
+
+	return nil
+}
+
+// AddBlockAndDelete adds the block, deletes its torrent, and appends the audit entries in a single
+// transaction (see persistence.AddBlockAndDelete).
+func (db *postgresDatabase) AddBlockAndDelete(block Block, entries []AuditEntry) (uint64, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "conn.Begin")
+	}
+	defer tx.Rollback()
+
+	id, err := db.addBlock(tx, block)
+	if err != nil {
+		return 0, err
+	}
+	if block.InfoHash != nil {
+		if err = db.deleteTorrent(tx, block.InfoHash); err != nil {
+			return 0, err
+		}
+	}
+	for _, entry := range entries {
+		if err = db.addAuditEntry(tx, entry); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "tx.Commit")
+	}
+
+	return id, nil
+}
+
+func (db *postgresDatabase) AddBlock(block Block) (uint64, error) {
+	return db.addBlock(db.conn, block)
+}
+
+func (db *postgresDatabase) addBlock(execer sqlExecer, block Block) (uint64, error) {
+	var id uint64
+	err := execer.QueryRow(`
+		INSERT INTO blocklist (info_hash, name_pattern, reason, added_by, added_on)
+		VALUES ($1, NULLIF($2, ''), $3, $4, $5)
+		RETURNING id;
+	`, block.InfoHash, block.NamePattern, block.Reason, block.AddedBy, time.Now().Unix()).Scan(&id)
+	if err != nil {
+		return 0, errors.Wrap(err, "QueryRow (INSERT INTO blocklist)")
+	}
+
+	return id, nil
+}
+
+func (db *postgresDatabase) RemoveBlock(id uint64) error {
+	res, err := db.conn.Exec("DELETE FROM blocklist WHERE id = $1;", id)
+	if err != nil {
+		return errors.Wrap(err, "Exec (DELETE FROM blocklist)")
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "sql.Result.RowsAffected")
+	} else if n == 0 {
+		return fmt.Errorf("no such block: %d", id)
+	}
+
+	return nil
+}
+
+func (db *postgresDatabase) GetBlocks() ([]Block, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, info_hash, COALESCE(name_pattern, ''), reason, added_by, added_on
+		FROM blocklist
+		ORDER BY id ASC;`)
+	defer db.closeRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]Block, 0)
+	for rows.Next() {
+		var b Block
+		if err = rows.Scan(&b.ID, &b.InfoHash, &b.NamePattern, &b.Reason, &b.AddedBy, &b.AddedOn); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+
+	return blocks, nil
+}
+
+func (db *postgresDatabase) AddAuditEntry(entry AuditEntry) error {
+	return db.addAuditEntry(db.conn, entry)
+}
+
+func (db *postgresDatabase) addAuditEntry(execer sqlExecer, entry AuditEntry) error {
+	_, err := execer.Exec(`
+		INSERT INTO audit_log (action, info_hash, name_pattern, actor, reason, performed_on)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6);
+	`, entry.Action, entry.InfoHash, entry.NamePattern, entry.Actor, entry.Reason, time.Now().Unix())
+	if err != nil {
+		return errors.Wrap(err, "Exec (INSERT INTO audit_log)")
+	}
+
+	return nil
+}
+
+func (db *postgresDatabase) GetAuditLog(limit uint) ([]AuditEntry, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, action, info_hash, COALESCE(name_pattern, ''), actor, reason, performed_on
+		FROM audit_log
+		ORDER BY id DESC
+		LIMIT $1;`,
+		limit,
+	)
+	defer db.closeRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		var ae AuditEntry
+		if err = rows.Scan(&ae.ID, &ae.Action, &ae.InfoHash, &ae.NamePattern, &ae.Actor, &ae.Reason, &ae.PerformedOn); err != nil {
+			return nil, err
+		}
+		entries = append(entries, ae)
+	}
+
+	return entries, nil
+}
+
+func (db *postgresDatabase) AddFailedFetch(infoHash []byte, reason string, nextAttemptOn int64) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO failed_fetches (info_hash, reason, last_failed_on, next_attempt_on)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (info_hash) DO UPDATE SET
+			reason         = excluded.reason,
+			last_failed_on = excluded.last_failed_on;
+	`, infoHash, reason, time.Now().Unix(), nextAttemptOn)
+	if err != nil {
+		return errors.Wrap(err, "Exec (INSERT INTO failed_fetches)")
+	}
+
+	return nil
+}
+
+func (db *postgresDatabase) GetDueFailedFetches(now int64, limit uint) ([]FailedFetch, error) {
+	rows, err := db.conn.Query(`
+		SELECT info_hash, reason, n_attempts, last_failed_on, next_attempt_on
+		FROM failed_fetches
+		WHERE next_attempt_on <= $1
+		ORDER BY next_attempt_on ASC
+		LIMIT $2;`,
+		now, limit,
+	)
+	defer db.closeRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	failedFetches := make([]FailedFetch, 0)
+	for rows.Next() {
+		var ff FailedFetch
+		if err = rows.Scan(&ff.InfoHash, &ff.Reason, &ff.NAttempts, &ff.LastFailedOn, &ff.NextAttemptOn); err != nil {
+			return nil, err
+		}
+		failedFetches = append(failedFetches, ff)
+	}
+
+	return failedFetches, nil
+}
+
+func (db *postgresDatabase) UpdateFailedFetch(infoHash []byte, nAttempts uint, nextAttemptOn *int64) error {
+	_, err := db.conn.Exec(
+		"UPDATE failed_fetches SET n_attempts = $1, next_attempt_on = $2 WHERE info_hash = $3;",
+		nAttempts, nextAttemptOn, infoHash,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Exec (UPDATE failed_fetches)")
+	}
+
+	return nil
+}
+
+func (db *postgresDatabase) DumpTorrents(afterID uint64, limit uint, withInfoDicts bool) ([]DumpedTorrent, error) {
+	return sqlDumpTorrents(db.conn, pgPlaceholders, afterID, limit, withInfoDicts)
 }
 
 func (db *postgresDatabase) setupDatabase() error {
@@ -349,16 +1224,259 @@ func (db *postgresDatabase) setupDatabase() error {
 	// https://stackoverflow.com/questions/36295883/golang-postgres-commit-unknown-command-error/36866993#36866993
 	db.closeRows(rows)
 
-	// Uncomment for future migrations:
-	//switch schemaVersion {
-	//case 0: // FROZEN.
-	//	zap.L().Warn("Updating (fake) database schema from 0 to 1...")
-	//	_, err = tx.Exec(`INSERT INTO migrations (schema_version) VALUES (1);`)
-	//	if err != nil {
-	//		return errors.Wrap(err, "sql.Tx.Exec (v0 -> v1)")
-	//	}
-	//	//fallthrough
-	//}
+	switch schemaVersion {
+	case 0:
+		// Upgrade from schema version 0 to 1
+		// Changes:
+		//   * Created `failed_fetches` table, which is the retry queue of the torrents whose
+		//     metadata could not be fetched from any of their peers. `next_attempt_on` is NULL for
+		//     the fetches that are abandoned after too many attempts.
+		zap.L().Warn("Updating database schema from 0 to 1... (this might take a while)")
+		_, err = tx.Exec(`
+			CREATE TABLE failed_fetches (
+				info_hash        bytea PRIMARY KEY,
+				reason           TEXT NOT NULL,
+				n_attempts       INTEGER NOT NULL DEFAULT 0 CHECK (n_attempts >= 0),
+				last_failed_on   BIGINT NOT NULL CHECK (last_failed_on > 0),
+				next_attempt_on  BIGINT DEFAULT NULL
+			);
+
+			CREATE INDEX idx_failed_fetches_next_attempt_on ON failed_fetches (next_attempt_on);
+
+			INSERT INTO migrations (schema_version) VALUES (1);
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v0 -> v1)")
+		}
+		fallthrough
+
+	case 1:
+		// Upgrade from schema version 1 to 2
+		// Changes:
+		//   * Added `info_hash_v2` column to the `torrents` table for BitTorrent v2 (BEP 52) and
+		//     hybrid torrents. See sqlite3.go (v4 -> v5) for the semantics of the columns.
+		zap.L().Warn("Updating database schema from 1 to 2... (this might take a while)")
+		_, err = tx.Exec(`
+			ALTER TABLE torrents ADD COLUMN info_hash_v2 bytea UNIQUE CHECK (info_hash_v2 IS NULL OR length(info_hash_v2) = 32) DEFAULT NULL;
+			CREATE INDEX idx_torrents_info_hash_v2_truncated ON torrents (substring(info_hash_v2 from 1 for 20));
+
+			INSERT INTO migrations (schema_version) VALUES (2);
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v1 -> v2)")
+		}
+		fallthrough
+
+	case 2:
+		// Upgrade from schema version 2 to 3
+		// Changes:
+		//   * Added `info_dict` column to the `torrents` table, which is the zlib-compressed
+		//     bencoded info dictionary of the torrent (if stored).
+		//
+		//     Its storage is set to EXTERNAL so that PostgreSQL does not try to compress it again.
+		zap.L().Warn("Updating database schema from 2 to 3... (this might take a while)")
+		_, err = tx.Exec(`
+			ALTER TABLE torrents ADD COLUMN info_dict bytea DEFAULT NULL;
+			ALTER TABLE torrents ALTER COLUMN info_dict SET STORAGE EXTERNAL;
+
+			INSERT INTO migrations (schema_version) VALUES (3);
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v2 -> v3)")
+		}
+		fallthrough
+
+	case 3:
+		// Upgrade from schema version 3 to 4
+		// Changes:
+		//   * Added `piece_length`, `private`, and `source` columns to the `torrents` table, and
+		//     `attributes` column to the `files` table. See sqlite3.go (v6 -> v7) for details.
+		zap.L().Warn("Updating database schema from 3 to 4... (this might take a while)")
+		_, err = tx.Exec(`
+			ALTER TABLE torrents ADD COLUMN piece_length BIGINT CHECK (piece_length IS NULL OR piece_length >= 0) DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN private      BOOLEAN NOT NULL DEFAULT FALSE;
+			ALTER TABLE torrents ADD COLUMN source       TEXT DEFAULT NULL;
+
+			ALTER TABLE files ADD COLUMN attributes TEXT DEFAULT NULL;
+
+			INSERT INTO migrations (schema_version) VALUES (4);
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v3 -> v4)")
+		}
+		fallthrough
+
+	case 4:
+		// Upgrade from schema version 4 to 5
+		// Changes:
+		//   * Added `encoding`, `original_name`, and `undecodable` columns to the `torrents` table,
+		//     and `original_path` column to the `files` table. See sqlite3.go (v7 -> v8) for
+		//     details.
+		zap.L().Warn("Updating database schema from 4 to 5... (this might take a while)")
+		_, err = tx.Exec(`
+			ALTER TABLE torrents ADD COLUMN encoding      TEXT DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN original_name bytea DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN undecodable   BOOLEAN NOT NULL DEFAULT FALSE;
+
+			ALTER TABLE files ADD COLUMN original_path bytea DEFAULT NULL;
+
+			INSERT INTO migrations (schema_version) VALUES (5);
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v4 -> v5)")
+		}
+		fallthrough
+
+	case 5:
+		// Upgrade from schema version 5 to 6
+		// Changes:
+		//   * Added `is_readme` and `content` columns to the `files` table, and the constraint & the
+		//     index they entail. See sqlite3.go (v1 -> v2) for details; unlike SQLite, PostgreSQL
+		//     supports partial indices, hence is_readme is a (non-NULL) boolean.
+		zap.L().Warn("Updating database schema from 5 to 6... (this might take a while)")
+		_, err = tx.Exec(`
+			ALTER TABLE files ADD COLUMN is_readme BOOLEAN NOT NULL DEFAULT FALSE;
+			ALTER TABLE files ADD COLUMN content   TEXT DEFAULT NULL;
+			ALTER TABLE files ADD CONSTRAINT files_readme_content CHECK (is_readme = (content IS NOT NULL));
+			CREATE UNIQUE INDEX idx_files_readme ON files (torrent_id) WHERE is_readme;
+
+			INSERT INTO migrations (schema_version) VALUES (6);
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v5 -> v6)")
+		}
+		fallthrough
+
+	case 6:
+		// Upgrade from schema version 6 to 7
+		// Changes:
+		//   * Added `tags` column to the `torrents` table. See sqlite3.go (v8 -> v9) for details.
+		zap.L().Warn("Updating database schema from 6 to 7... (this might take a while)")
+		_, err = tx.Exec(`
+			ALTER TABLE torrents ADD COLUMN tags TEXT DEFAULT NULL;
+
+			INSERT INTO migrations (schema_version) VALUES (7);
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v6 -> v7)")
+		}
+		fallthrough
+
+	case 7:
+		// Upgrade from schema version 7 to 8
+		// Changes:
+		//   * Added `category` and `sub_category` columns to the `torrents` table, and the
+		//     indices they entail. See sqlite3.go (v9 -> v10) for details; the uncategorised
+		//     torrents have a partial index of their own as well.
+		zap.L().Warn("Updating database schema from 7 to 8... (this might take a while)")
+		_, err = tx.Exec(`
+			ALTER TABLE torrents ADD COLUMN category     TEXT DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN sub_category TEXT DEFAULT NULL;
+			CREATE INDEX idx_torrents_category ON torrents (category, sub_category);
+			CREATE INDEX idx_torrents_uncategorised ON torrents (id) WHERE category IS NULL;
+
+			INSERT INTO migrations (schema_version) VALUES (8);
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v7 -> v8)")
+		}
+		fallthrough
+
+	case 8:
+		// Upgrade from schema version 8 to 9
+		// Changes:
+		//   * Added the `release_*` columns to the `torrents` table. See sqlite3.go (v10 -> v11)
+		//     for details; titles are compared case-insensitively by their lowercase, hence the
+		//     index on `lower(release_title)`.
+		zap.L().Warn("Updating database schema from 8 to 9... (this might take a while)")
+		_, err = tx.Exec(`
+			ALTER TABLE torrents ADD COLUMN release_title      TEXT DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN release_year       INTEGER DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN release_season     INTEGER DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN release_episode    INTEGER DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN release_resolution TEXT DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN release_source     TEXT DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN release_codec      TEXT DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN release_audio      TEXT DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN release_language   TEXT DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN release_group      TEXT DEFAULT NULL;
+			CREATE INDEX idx_torrents_release_title ON torrents (lower(release_title), release_year);
+			CREATE INDEX idx_torrents_unparsed ON torrents (id) WHERE release_title IS NULL;
+
+			INSERT INTO migrations (schema_version) VALUES (9);
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v8 -> v9)")
+		}
+		fallthrough
+
+	case 9:
+		// Upgrade from schema version 9 to 10
+		// Changes:
+		//   * Added `spam_score` and `quality_flags` columns to the `torrents` table. See
+		//     sqlite3.go (v11 -> v12) for details.
+		zap.L().Warn("Updating database schema from 9 to 10... (this might take a while)")
+		_, err = tx.Exec(`
+			ALTER TABLE torrents ADD COLUMN spam_score    INTEGER DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN quality_flags TEXT DEFAULT NULL;
+
+			INSERT INTO migrations (schema_version) VALUES (10);
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v9 -> v10)")
+		}
+		fallthrough
+
+	case 10:
+		// Upgrade from schema version 10 to 11
+		// Changes:
+		//   * Added `blocklist` and `audit_log` tables. See sqlite3.go (v12 -> v13) for details.
+		zap.L().Warn("Updating database schema from 10 to 11... (this might take a while)")
+		_, err = tx.Exec(`
+			CREATE TABLE blocklist (
+				id           BIGSERIAL PRIMARY KEY,
+				info_hash    bytea UNIQUE,
+				name_pattern TEXT,
+				reason       TEXT NOT NULL,
+				added_by     TEXT NOT NULL,
+				added_on     BIGINT NOT NULL,
+
+				CHECK ((info_hash IS NULL) != (name_pattern IS NULL))
+			);
+			CREATE TABLE audit_log (
+				id           BIGSERIAL PRIMARY KEY,
+				action       TEXT NOT NULL,
+				info_hash    bytea,
+				name_pattern TEXT,
+				actor        TEXT NOT NULL,
+				reason       TEXT NOT NULL,
+				performed_on BIGINT NOT NULL
+			);
+
+			INSERT INTO migrations (schema_version) VALUES (11);
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v10 -> v11)")
+		}
+		fallthrough
+
+	case 11:
+		// Upgrade from schema version 11 to 12
+		// Changes:
+		//   * Added `idx_torrents_name_tsvector` for the full-text search of the names of the
+		//     torrents (see pgNameVector), complementing `idx_torrents_name_gin_trgm` which is used
+		//     for matching the partial words.
+		zap.L().Warn("Updating database schema from 11 to 12... (this might take a while)")
+		_, err = tx.Exec(`
+			CREATE INDEX idx_torrents_name_tsvector ON torrents
+				USING GIN (to_tsvector('simple'::regconfig, regexp_replace(name, '[^[:alnum:]]+', ' ', 'g')));
+
+			INSERT INTO migrations (schema_version) VALUES (12);
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v11 -> v12)")
+		}
+	}
 
 	if err = tx.Commit(); err != nil {
 		return errors.Wrap(err, "sql.Tx.Commit")
@@ -0,0 +1,104 @@
+package persistence
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestPgPlaceholders(t *testing.T) {
+	testCases := []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT 1;", "SELECT 1;"},
+		{"SELECT ? WHERE a = ? AND b IN (?, ?);", "SELECT $1 WHERE a = $2 AND b IN ($3, $4);"},
+		{"LIMIT ?", "LIMIT $1"},
+	}
+
+	for i, tc := range testCases {
+		if actual := pgPlaceholders(tc.query); actual != tc.expected {
+			t.Errorf("Case #%d: expected %q, got %q", i, tc.expected, actual)
+		}
+	}
+}
+
+// openTestPostgres opens the database at MAGNETICO_TEST_POSTGRES (see conformanceEngines), whose
+// tables are truncated, or skips the test if it is not set.
+func openTestPostgres(t *testing.T) Database {
+	rawURL := os.Getenv("MAGNETICO_TEST_POSTGRES")
+	if rawURL == "" {
+		t.Skip("MAGNETICO_TEST_POSTGRES is not set")
+	}
+	db := openConformanceDatabase(t, rawURL)
+	_, err := db.(*postgresDatabase).conn.Exec(
+		"TRUNCATE torrents, files, blocklist, audit_log, failed_fetches RESTART IDENTITY CASCADE;")
+	if err != nil {
+		t.Fatalf("TRUNCATE: %s", err.Error())
+	}
+	return db
+}
+
+// TestPostgresQueryTorrents tests the queries that are particular to PostgreSQL, which are either
+// matched as web search queries or as substrings of the names (see QueryTorrents).
+func TestPostgresQueryTorrents(t *testing.T) {
+	db := openTestPostgres(t)
+	defer db.Close()
+	addConformanceTorrents(t, db)
+
+	now := int64(conformanceBase + 365*86400)
+	for _, c := range []struct {
+		query    string
+		expected []string
+	}{
+		// Partial words are matched by the trigram index.
+		{"buntu", []string{"Ubuntu 20.04 Desktop amd64", "Ubuntu 20.04 Server amd64"}},
+		{"ovie 2019", []string{"The Movie 2019 1080p"}},
+		{`"desktop amd64"`, []string{"Ubuntu 20.04 Desktop amd64"}},
+		{`"amd64 desktop"`, []string{}},
+		{"ubuntu -server", []string{"Ubuntu 20.04 Desktop amd64"}},
+		{"ubuntu or debian", []string{"Ubuntu 20.04 Desktop amd64", "Debian 10 netinst", "Ubuntu 20.04 Server amd64"}},
+		// The words of the names are separated by their punctuation too.
+		{"bluray", []string{"The.Movie.2019.1080p.BluRay.x264-GROUP"}},
+		{"100%", []string{}},
+	} {
+		torrents, err := db.QueryTorrents(c.query, QueryFilter{}, now, ByDiscoveredOn, true, 10, nil, nil)
+		if err != nil {
+			t.Errorf("QueryTorrents(%q): %s", c.query, err.Error())
+		} else if actual := names(torrents); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("QueryTorrents(%q): expected %q, got %q", c.query, c.expected, actual)
+		}
+	}
+
+}
+
+// TestPostgresMigration tests the latest migration by undoing it, and reopening the database.
+func TestPostgresMigration(t *testing.T) {
+	db := openTestPostgres(t)
+	_, err := db.(*postgresDatabase).conn.Exec(`
+		DROP INDEX idx_torrents_name_tsvector;
+		DELETE FROM migrations WHERE schema_version = 12;
+	`)
+	db.Close()
+	if err != nil {
+		t.Fatalf("Exec: %s", err.Error())
+	}
+
+	db = openTestPostgres(t)
+	defer db.Close()
+	conn := db.(*postgresDatabase).conn
+	var version, nIndices int
+	if err = conn.QueryRow("SELECT MAX(schema_version) FROM migrations;").Scan(&version); err != nil || version != 12 {
+		t.Errorf("Schema version: expected 12, got %d %v", version, err)
+	}
+	err = conn.QueryRow("SELECT count(*) FROM pg_indexes WHERE indexname = 'idx_torrents_name_tsvector';").Scan(&nIndices)
+	if err != nil || nIndices != 1 {
+		t.Errorf("Index is not created: %d %v", nIndices, err)
+	}
+
+	addConformanceTorrents(t, db)
+	if torrents, err := db.QueryTorrents("netinst", QueryFilter{}, conformanceBase+86400, ByDiscoveredOn, true, 10, nil, nil); err != nil ||
+		!reflect.DeepEqual(names(torrents), []string{"Debian 10 netinst"}) {
+		t.Errorf("QueryTorrents after the migration: %q %v", names(torrents), err)
+	}
+}
@@ -0,0 +1,517 @@
+package persistence
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// minSpoolBackoff and maxSpoolBackoff are the bounds of the interval between the attempts to
+	// replay the spool, which is doubled after every failed attempt.
+	minSpoolBackoff = time.Second
+	maxSpoolBackoff = 5 * time.Minute
+	// spoolReplayBatchSize is the number of spooled torrents added at once while replaying.
+	spoolReplayBatchSize = 100
+	// spoolStatusInterval is how often the status of the spool is logged.
+	spoolStatusInterval = time.Minute
+)
+
+// spooled is a database which survives the outages of the underlying database (e.g. a restart of
+// PostgreSQL) by spooling the torrents that cannot be added to an append-only file, and replaying
+// them once the underlying database is available again.
+//
+// While it is unavailable, the torrents are spooled right away, and DoesTorrentExist answers from
+// the spool only. The info dictionaries and the readmes of the spooled torrents are spooled with
+// them. All the other methods are passed through.
+type spooled struct {
+	Database
+
+	path string
+
+	mutex sync.Mutex
+	// file is opened when the first record is spooled, and closed when it is moved aside to be
+	// replayed.
+	file      *os.File
+	available bool
+	// spooled are the spooled torrents by all their infohashes (including the truncated v2
+	// infohash), so that they are found by DoesTorrentExist.
+	spooled map[string]struct{}
+	status  SpoolStatus
+
+	unavailable chan struct{}
+	done        chan struct{}
+	stopped     chan struct{}
+}
+
+// spoolRecord is a line of the spool, which is either a torrent, or the info dictionary or the
+// readme of a torrent spooled before it (as they are set after the torrents are added).
+type spoolRecord struct {
+	Torrent  *NewTorrent `json:"torrent,omitempty"`
+	InfoHash []byte      `json:"infoHash,omitempty"`
+	InfoDict []byte      `json:"infoDict,omitempty"`
+	Readme   *Readme     `json:"readme,omitempty"`
+}
+
+// SpoolStatus is the health of a spooled database.
+type SpoolStatus struct {
+	Available bool `json:"available"`
+	// UnavailableSince is when the underlying database became unavailable (if it is).
+	UnavailableSince int64 `json:"unavailableSince,omitempty"`
+	// NSpooled is the number of torrents that are waiting in the spool to be replayed.
+	NSpooled  uint64 `json:"nSpooled"`
+	NReplayed uint64 `json:"nReplayed"`
+	// NDropped is the number of spooled torrents that could not be added even though the underlying
+	// database is available (e.g. as they violate its constraints), which are dropped.
+	NDropped uint64 `json:"nDropped"`
+	// LastError is the error of the last failed write or replay, if any.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// NewSpooled returns a database that spools the torrents to the file at @path (and, while they are
+// replayed, at @path + ".replay") while @database is unavailable. The torrents that are spooled
+// already (e.g. before a restart) are replayed shortly.
+func NewSpooled(database Database, path string) (Database, error) {
+	s := &spooled{
+		Database:    database,
+		path:        path,
+		available:   true,
+		spooled:     make(map[string]struct{}),
+		unavailable: make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+
+	for _, p := range []string{s.replayPath(), s.path} {
+		err := readSpool(p, func(record spoolRecord) error {
+			if record.Torrent != nil {
+				s.index(record.Torrent)
+				s.status.NSpooled++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "readSpool %s", p)
+		}
+	}
+	if s.status.NSpooled > 0 {
+		zap.L().Info("Found spooled torrents, replaying them shortly",
+			zap.String("path", s.path), zap.Uint64("nSpooled", s.status.NSpooled))
+		s.available = false
+		s.status.UnavailableSince = time.Now().Unix()
+	}
+	s.status.Available = s.available
+
+	go s.run()
+	return s, nil
+}
+
+func (s *spooled) replayPath() string {
+	return s.path + ".replay"
+}
+
+func (s *spooled) run() {
+	defer close(s.stopped)
+
+	statusTicker := time.NewTicker(spoolStatusInterval)
+	defer statusTicker.Stop()
+
+	backoff := minSpoolBackoff
+	for {
+		s.mutex.Lock()
+		available := s.available
+		s.mutex.Unlock()
+
+		var retry <-chan time.Time
+		if !available {
+			retry = time.After(backoff)
+		}
+
+		select {
+		case <-s.done:
+			return
+
+		case <-statusTicker.C:
+			zap.L().Info("Database status", zap.String("spool", s.path), zap.Any("status", s.Status()))
+
+		case <-s.unavailable:
+			// The loop is restarted so that the replay is scheduled.
+
+		case <-retry:
+			if err := s.replay(); err != nil {
+				if backoff *= 2; backoff > maxSpoolBackoff {
+					backoff = maxSpoolBackoff
+				}
+				s.mutex.Lock()
+				s.status.LastError = err.Error()
+				s.mutex.Unlock()
+				zap.L().Warn("Could not replay the spool, retrying later",
+					zap.String("path", s.path), zap.Duration("backoff", backoff), zap.Error(err))
+			} else {
+				backoff = minSpoolBackoff
+			}
+		}
+	}
+}
+
+// replay replays the spool until it is empty, at which point the underlying database is available
+// again. The spool is moved aside first so that the torrents can still be spooled meanwhile. As
+// the torrents that exist already are ignored, a failed replay is simply retried from the start.
+func (s *spooled) replay() error {
+	for {
+		s.mutex.Lock()
+		if _, err := os.Stat(s.replayPath()); os.IsNotExist(err) {
+			if s.file == nil && !fileExists(s.path) {
+				s.available = true
+				s.spooled = make(map[string]struct{})
+				s.status.Available = true
+				s.status.UnavailableSince = 0
+				s.mutex.Unlock()
+				zap.L().Info("Database is available again", zap.String("spool", s.path))
+				return nil
+			}
+
+			if s.file != nil {
+				if err = s.file.Close(); err != nil {
+					s.mutex.Unlock()
+					return errors.Wrap(err, "file.Close")
+				}
+				s.file = nil
+			}
+			if err = os.Rename(s.path, s.replayPath()); err != nil {
+				s.mutex.Unlock()
+				return errors.Wrap(err, "os.Rename")
+			}
+		}
+		s.mutex.Unlock()
+
+		nReplayed, err := s.replayFile(s.replayPath())
+		if err != nil {
+			return err
+		}
+		if err = os.Remove(s.replayPath()); err != nil {
+			return errors.Wrap(err, "os.Remove")
+		}
+
+		s.mutex.Lock()
+		s.status.NSpooled -= nReplayed
+		s.status.NReplayed += nReplayed
+		s.mutex.Unlock()
+		zap.L().Info("Replayed spooled torrents", zap.String("spool", s.path), zap.Uint64("n", nReplayed))
+	}
+}
+
+// replayFile replays the spool at @path, and returns the number of torrents replayed (or dropped).
+func (s *spooled) replayFile(path string) (uint64, error) {
+	var nReplayed uint64
+	var batch []NewTorrent
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := AddNewTorrents(s.Database, batch); err != nil {
+			if err = s.addOneByOne(batch, err); err != nil {
+				return err
+			}
+		}
+		nReplayed += uint64(len(batch))
+		batch = nil
+		return nil
+	}
+
+	err := readSpool(path, func(record spoolRecord) error {
+		switch {
+		case record.Torrent != nil:
+			batch = append(batch, *record.Torrent)
+			if len(batch) < spoolReplayBatchSize {
+				return nil
+			}
+			return flush()
+
+		case record.InfoDict != nil:
+			// The info dictionary is added together with its torrent if the latter is not added yet.
+			for i := range batch {
+				if string(batch[i].InfoHash) == string(record.InfoHash) {
+					batch[i].InfoDict = record.InfoDict
+					return nil
+				}
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+			err := s.Database.SetInfoDict(record.InfoHash, record.InfoDict)
+			if err == nil || errors.Cause(err) == NotImplementedError {
+				return nil
+			}
+			// Dropped like the torrents if the underlying database is available (see addOneByOne).
+			if _, pingErr := s.Database.DoesTorrentExist(record.InfoHash); pingErr != nil {
+				return errors.Wrap(err, "SetInfoDict")
+			}
+			zap.L().Error("Dropping a spooled info dictionary that cannot be stored",
+				zap.Binary("infoHash", record.InfoHash), zap.Error(err))
+
+		case record.Readme != nil:
+			if err := flush(); err != nil {
+				return err
+			}
+			// Readmes are nice to have, hence not worth blocking the replay for.
+			if err := s.Database.SetReadme(record.InfoHash, *record.Readme); err != nil &&
+				errors.Cause(err) != NotImplementedError {
+				zap.L().Error("Could not store a spooled readme", zap.Binary("infoHash", record.InfoHash), zap.Error(err))
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	return nReplayed, err
+}
+
+// addOneByOne adds the torrents of a batch that failed with @err one by one, dropping the ones that
+// cannot be added although the underlying database is available, lest they block the replay
+// forever. It returns an error only if the underlying database is unavailable.
+func (s *spooled) addOneByOne(torrents []NewTorrent, err error) error {
+	for _, t := range torrents {
+		if _, pingErr := s.Database.DoesTorrentExist(t.InfoHash); pingErr != nil {
+			return errors.Wrap(err, "AddNewTorrents")
+		}
+		if err = AddNewTorrents(s.Database, []NewTorrent{t}); err == nil {
+			continue
+		}
+		if _, pingErr := s.Database.DoesTorrentExist(t.InfoHash); pingErr != nil {
+			return errors.Wrap(err, "AddNewTorrents")
+		}
+
+		zap.L().Error("Dropping a spooled torrent that cannot be added",
+			zap.Binary("infoHash", t.InfoHash), zap.String("name", t.Name), zap.Error(err))
+		s.mutex.Lock()
+		s.status.NDropped++
+		s.mutex.Unlock()
+	}
+	return nil
+}
+
+// readSpool calls @f with every record of the spool at @path (if it exists). Malformed records
+// (e.g. the last one, if the spool was being written when magneticod crashed) are skipped.
+func readSpool(path string, f func(record spoolRecord) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var record spoolRecord
+			if jsonErr := json.Unmarshal(line, &record); jsonErr != nil {
+				zap.L().Warn("Skipping a malformed record of the spool", zap.String("path", path), zap.Error(jsonErr))
+			} else if err := f(record); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// spool appends @records to the spool, and marks the underlying database unavailable (if it is
+// not already) so that they are replayed. mutex must be held.
+func (s *spooled) spool(records ...spoolRecord) error {
+	if s.file == nil {
+		var err error
+		if s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+			return errors.Wrap(err, "os.OpenFile")
+		}
+	}
+
+	var buf []byte
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return errors.Wrap(err, "json.Marshal")
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	if _, err := s.file.Write(buf); err != nil {
+		return errors.Wrap(err, "file.Write")
+	}
+	if err := s.file.Sync(); err != nil {
+		return errors.Wrap(err, "file.Sync")
+	}
+
+	for _, record := range records {
+		if record.Torrent != nil {
+			s.index(record.Torrent)
+			s.status.NSpooled++
+		}
+	}
+	if s.available {
+		s.setUnavailable(nil)
+	}
+	return nil
+}
+
+// setUnavailable marks the underlying database unavailable due to @err, if it is not already.
+// mutex must be held.
+func (s *spooled) setUnavailable(err error) {
+	if err != nil {
+		s.status.LastError = err.Error()
+	}
+	if !s.available {
+		return
+	}
+
+	s.available = false
+	s.status.Available = false
+	s.status.UnavailableSince = time.Now().Unix()
+	zap.L().Warn("Database is unavailable, spooling the torrents", zap.String("spool", s.path), zap.Error(err))
+	select {
+	case s.unavailable <- struct{}{}:
+	default:
+	}
+}
+
+func (s *spooled) index(t *NewTorrent) {
+	s.spooled[string(t.InfoHash)] = struct{}{}
+	if len(t.InfoHashV2) >= 20 {
+		s.spooled[string(t.InfoHashV2)] = struct{}{}
+		s.spooled[string(t.InfoHashV2[:20])] = struct{}{}
+	}
+}
+
+func (s *spooled) isSpooled(infoHash []byte) bool {
+	_, isSpooled := s.spooled[string(infoHash)]
+	return isSpooled
+}
+
+// Status returns the health of the database and of its spool.
+func (s *spooled) Status() SpoolStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.status
+}
+
+func (s *spooled) isAvailable() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.available
+}
+
+func (s *spooled) DoesTorrentExist(infoHash []byte) (bool, error) {
+	s.mutex.Lock()
+	isSpooled, available := s.isSpooled(infoHash), s.available
+	s.mutex.Unlock()
+	if isSpooled {
+		return true, nil
+	} else if !available {
+		// The metadata of the torrent is fetched, and then either spooled or, if it exists
+		// already, ignored when replayed.
+		return false, nil
+	}
+
+	exists, err := s.Database.DoesTorrentExist(infoHash)
+	if err != nil {
+		s.mutex.Lock()
+		s.setUnavailable(err)
+		s.mutex.Unlock()
+		return false, nil
+	}
+	return exists, nil
+}
+
+func (s *spooled) AddNewTorrent(infoHash []byte, infoHashV2 []byte, name string, files []File, attributes TorrentAttributes) error {
+	return s.AddNewTorrents([]NewTorrent{{
+		InfoHash:   infoHash,
+		InfoHashV2: infoHashV2,
+		Name:       name,
+		Files:      files,
+		Attributes: attributes,
+	}})
+}
+
+func (s *spooled) AddNewTorrents(torrents []NewTorrent) error {
+	var err error
+	if s.isAvailable() {
+		if err = AddNewTorrents(s.Database, torrents); err == nil {
+			return nil
+		}
+	}
+
+	records := make([]spoolRecord, len(torrents))
+	for i := range torrents {
+		records[i].Torrent = &torrents[i]
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.setUnavailable(err)
+	return s.spool(records...)
+}
+
+func (s *spooled) SetInfoDict(infoHash []byte, infoDict []byte) error {
+	s.mutex.Lock()
+	isSpooled, available := s.isSpooled(infoHash), s.available
+	s.mutex.Unlock()
+
+	var err error
+	if !isSpooled && available {
+		if err = s.Database.SetInfoDict(infoHash, infoDict); err == nil || errors.Cause(err) == NotImplementedError {
+			return err
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.setUnavailable(err)
+	return s.spool(spoolRecord{InfoHash: infoHash, InfoDict: infoDict})
+}
+
+// SetReadme spools the readme only if its torrent is spooled, or if the underlying database is
+// unavailable already, since readmes are not worth spooling for.
+func (s *spooled) SetReadme(infoHash []byte, readme Readme) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.isSpooled(infoHash) || !s.available {
+		return s.spool(spoolRecord{InfoHash: infoHash, Readme: &readme})
+	}
+
+	return s.Database.SetReadme(infoHash, readme)
+}
+
+// Close stops replaying the spool, which is replayed when the database is opened again, and closes
+// the underlying database.
+func (s *spooled) Close() error {
+	close(s.done)
+	<-s.stopped
+
+	s.mutex.Lock()
+	if s.file != nil {
+		if err := s.file.Close(); err != nil {
+			zap.L().Error("Could not close the spool", zap.String("path", s.path), zap.Error(err))
+		}
+		s.file = nil
+	}
+	s.mutex.Unlock()
+
+	zap.L().Info("Closing spooled database", zap.String("spool", s.path), zap.Any("status", s.Status()))
+	return s.Database.Close()
+}
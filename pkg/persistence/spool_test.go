@@ -0,0 +1,54 @@
+package persistence
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSpooled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnetico-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spoolPath := path.Join(dir, "spool.jsonl")
+
+	underlying := &batchDatabase{err: fmt.Errorf("unavailable")}
+	database, err := NewSpooled(underlying, spoolPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = database.AddNewTorrent([]byte("a"), nil, "a", nil, TorrentAttributes{}); err != nil {
+		t.Fatalf("Torrent is not spooled: %s", err.Error())
+	}
+	_ = database.SetInfoDict([]byte("a"), []byte("d"))
+	if exists, _ := database.DoesTorrentExist([]byte("a")); !exists {
+		t.Error("Spooled torrent does not exist")
+	}
+	if status := database.(*spooled).Status(); status.Available || status.NSpooled != 1 {
+		t.Errorf("Wrong status: %+v", status)
+	}
+	_ = database.Close()
+
+	// The spool survives restarts, and is replayed once the database is available again.
+	underlying.err = nil
+	if database, err = NewSpooled(underlying, spoolPath); err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	for i := 0; i < 100 && !database.(*spooled).Status().Available; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if status := database.(*spooled).Status(); !status.Available || status.NSpooled != 0 || status.NReplayed != 1 {
+		t.Errorf("Wrong status after replay: %+v", status)
+	}
+	underlying.mutex.Lock()
+	defer underlying.mutex.Unlock()
+	if len(underlying.batches) != 1 || underlying.infoDicts != 1 {
+		t.Errorf("Spooled torrent (with its info dictionary) is not replayed: %v", underlying.batches)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"strings"
 	"text/template"
 	"time"
 
@@ -18,6 +19,9 @@ import (
 // Close your rows lest you get "database table is locked" error(s)!
 // See https://github.com/mattn/go-sqlite3/issues/2741
 
+// notPadding is the condition on the `files` table to exclude the padding files (see BEP 47).
+const notPadding = "(files.attributes IS NULL OR instr(files.attributes, 'p') = 0)"
+
 type sqlite3Database struct {
 	conn *sql.DB
 }
@@ -81,7 +85,12 @@ func (db *sqlite3Database) Engine() databaseEngine {
 }
 
 func (db *sqlite3Database) DoesTorrentExist(infoHash []byte) (bool, error) {
-	rows, err := db.conn.Query("SELECT 1 FROM torrents WHERE info_hash = ?;", infoHash)
+	// A 20 bytes long infohash might as well be a truncated v2 infohash, hence the second
+	// condition.
+	rows, err := db.conn.Query(
+		"SELECT 1 FROM torrents WHERE info_hash = ? OR substr(info_hash_v2, 1, 20) = ?;",
+		infoHash, infoHash,
+	)
 	if err != nil {
 		return false, err
 	}
@@ -97,7 +106,17 @@ func (db *sqlite3Database) DoesTorrentExist(infoHash []byte) (bool, error) {
 	return exists, nil
 }
 
-func (db *sqlite3Database) AddNewTorrent(infoHash []byte, name string, files []File) error {
+func (db *sqlite3Database) AddNewTorrent(infoHash []byte, infoHashV2 []byte, name string, files []File, attributes TorrentAttributes) error {
+	return db.AddNewTorrents([]NewTorrent{{
+		InfoHash:   infoHash,
+		InfoHashV2: infoHashV2,
+		Name:       name,
+		Files:      files,
+		Attributes: attributes,
+	}})
+}
+
+func (db *sqlite3Database) AddNewTorrents(torrents []NewTorrent) error {
 	tx, err := db.conn.Begin()
 	if err != nil {
 		return errors.Wrap(err, "conn.Begin")
@@ -108,92 +127,154 @@ func (db *sqlite3Database) AddNewTorrent(infoHash []byte, name string, files []F
 	// is nice.
 	defer tx.Rollback()
 
-	var totalSize uint64 = 0
-	for _, file := range files {
-		totalSize += uint64(file.Size)
-	}
-
-	// This is a workaround for a bug: the database will not accept total_size to be zero.
-	if totalSize == 0 {
-		zap.L().Debug("Ignoring a torrent whose total size is zero.")
-		return nil
-	}
-
-	// Although we check whether the torrent exists in the database before asking MetadataSink to
-	// fetch its metadata, the torrent can also exists in the Sink before that:
-	//
-	// If the torrent is complete (i.e. its metadata) and if its waiting in the channel to be
-	// received, a race condition arises when we query the database and seeing that it doesn't
-	// exists there, add it to the sink.
-	//
-	// Do NOT try to be clever and attempt to use INSERT OR IGNORE INTO or INSERT OR REPLACE INTO
-	// without understanding their consequences fully:
-	//
-	// https://www.sqlite.org/lang_conflict.html
-	//
-	//   INSERT OR IGNORE INTO
-	//     INSERT OR IGNORE INTO will ignore:
-	//       1. CHECK constraint violations
-	//       2. UNIQUE or PRIMARY KEY constraint violations
-	//       3. NOT NULL constraint violations
-	//
-	//     You would NOT want to ignore #1 and #2 as they are likely to indicate programmer errors.
-	//     Instead of silently ignoring them, let the program err and investigate the causes.
-	//
-	//   INSERT OR REPLACE INTO
-	//     INSERT OR REPLACE INTO will replace on:
-	//       1. UNIQUE or PRIMARY KEY constraint violations (by "deleting pre-existing rows that are
-	//          causing the constraint violation prior to inserting or updating the current row")
-	//
-	//     INSERT OR REPLACE INTO will abort on:
-	//       2. CHECK constraint violations
-	//       3. NOT NULL constraint violations (if "the column has no default value")
-	//
-	//     INSERT OR REPLACE INTO is definitely much closer to what you may want, but deleting
-	//     pre-existing rows means that you might cause users loose data (such as seeder and leecher
-	//     information, readme, and so on) at the expense of /your/ own laziness...
-	if exist, err := db.DoesTorrentExist(infoHash); exist || err != nil {
-		return err
+	// The statements are prepared once per transaction rather than once per torrent.
+	existsStmt, err := tx.Prepare("SELECT 1 FROM torrents WHERE info_hash = ? OR substr(info_hash_v2, 1, 20) = ?;")
+	if err != nil {
+		return errors.Wrap(err, "tx.Prepare (SELECT FROM torrents)")
 	}
+	defer existsStmt.Close()
 
-	res, err := tx.Exec(`
+	torrentStmt, err := tx.Prepare(`
 		INSERT INTO torrents (
 			info_hash,
+			info_hash_v2,
 			name,
 			total_size,
-			discovered_on
-		) VALUES (?, ?, ?, ?);
-	`, infoHash, name, totalSize, time.Now().Unix())
+			discovered_on,
+			piece_length,
+			private,
+			source,
+			encoding,
+			original_name,
+			undecodable,
+			tags,
+			category,
+			sub_category,
+			spam_score,
+			quality_flags,
+			info_dict,
+			` + releaseColumns + `
+		) VALUES (?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?, ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''),
+			?, NULLIF(?, ''), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`)
 	if err != nil {
-		return errors.Wrap(err, "tx.Exec (INSERT OR REPLACE INTO torrents)")
+		return errors.Wrap(err, "tx.Prepare (INSERT INTO torrents)")
 	}
+	defer torrentStmt.Close()
 
-	var lastInsertId int64
-	if lastInsertId, err = res.LastInsertId(); err != nil {
-		return errors.Wrap(err, "sql.Result.LastInsertId")
+	fileStmt, err := tx.Prepare("INSERT INTO files (torrent_id, size, path, attributes, original_path) VALUES (?, ?, ?, NULLIF(?, ''), ?);")
+	if err != nil {
+		return errors.Wrap(err, "tx.Prepare (INSERT INTO files)")
 	}
+	defer fileStmt.Close()
 
-	// > last_insert_rowid()
-	// >   The last_insert_rowid() function returns the ROWID of the last row insert from the
-	// >   database connection which invoked the function. If no successful INSERTs into rowid
-	// >   tables have ever occurred on the database connection, then last_insert_rowid() returns
-	// >   zero.
-	// https://www.sqlite.org/lang_corefunc.html#last_insert_rowid
-	// https://www.sqlite.org/c3ref/last_insert_rowid.html
-	//
-	// Now, last_insert_rowid() should never return zero (or any negative values really) as we
-	// insert into torrents and handle any errors accordingly right afterwards.
-	if lastInsertId <= 0 {
-		zap.L().Panic("last_insert_rowid() <= 0 (this should have never happened!)",
-			zap.Int64("lastInsertId", lastInsertId))
+	// The torrent might have been in the retry queue, in which case it is no longer needed there.
+	// Retry queue is keyed by the infohashes found in the DHT, which are truncated for v2 torrents.
+	failedFetchStmt, err := tx.Prepare("DELETE FROM failed_fetches WHERE info_hash = ? OR info_hash = substr(?, 1, 20);")
+	if err != nil {
+		return errors.Wrap(err, "tx.Prepare (DELETE FROM failed_fetches)")
 	}
+	defer failedFetchStmt.Close()
+
+	for _, t := range torrents {
+		totalSize := t.totalSize()
+		// This is a workaround for a bug: the database will not accept total_size to be zero.
+		if totalSize == 0 {
+			zap.L().Debug("Ignoring a torrent whose total size is zero.")
+			continue
+		}
 
-	for _, file := range files {
-		_, err = tx.Exec("INSERT INTO files (torrent_id, size, path) VALUES (?, ?, ?);",
-			lastInsertId, file.Size, file.Path,
-		)
+		// Although we check whether the torrent exists in the database before asking MetadataSink
+		// to fetch its metadata, the torrent can also exists in the Sink before that:
+		//
+		// If the torrent is complete (i.e. its metadata) and if its waiting in the channel to be
+		// received, a race condition arises when we query the database and seeing that it doesn't
+		// exists there, add it to the sink.
+		//
+		// Do NOT try to be clever and attempt to use INSERT OR IGNORE INTO or INSERT OR REPLACE INTO
+		// without understanding their consequences fully:
+		//
+		// https://www.sqlite.org/lang_conflict.html
+		//
+		//   INSERT OR IGNORE INTO
+		//     INSERT OR IGNORE INTO will ignore:
+		//       1. CHECK constraint violations
+		//       2. UNIQUE or PRIMARY KEY constraint violations
+		//       3. NOT NULL constraint violations
+		//
+		//     You would NOT want to ignore #1 and #2 as they are likely to indicate programmer errors.
+		//     Instead of silently ignoring them, let the program err and investigate the causes.
+		//
+		//   INSERT OR REPLACE INTO
+		//     INSERT OR REPLACE INTO will replace on:
+		//       1. UNIQUE or PRIMARY KEY constraint violations (by "deleting pre-existing rows that are
+		//          causing the constraint violation prior to inserting or updating the current row")
+		//
+		//     INSERT OR REPLACE INTO will abort on:
+		//       2. CHECK constraint violations
+		//       3. NOT NULL constraint violations (if "the column has no default value")
+		//
+		//     INSERT OR REPLACE INTO is definitely much closer to what you may want, but deleting
+		//     pre-existing rows means that you might cause users loose data (such as seeder and leecher
+		//     information, readme, and so on) at the expense of /your/ own laziness...
+		//
+		// The torrents of the same batch are checked against each other as well, since the ones
+		// inserted already are visible to the transaction.
+		var exists int
+		err = existsStmt.QueryRow(t.InfoHash, t.InfoHash).Scan(&exists)
+		if err == nil {
+			continue
+		} else if err != sql.ErrNoRows {
+			return errors.Wrap(err, "Stmt.QueryRow (SELECT FROM torrents)")
+		}
+
+		var infoDict []byte
+		if t.InfoDict != nil {
+			if infoDict, err = compress(t.InfoDict); err != nil {
+				return errors.Wrap(err, "compress")
+			}
+		}
+
+		attributes := t.Attributes
+		res, err := torrentStmt.Exec(append([]interface{}{t.InfoHash, t.InfoHashV2, t.Name, totalSize, t.discoveredOn(),
+			attributes.PieceLength, attributes.Private, attributes.Source,
+			attributes.Encoding, attributes.OriginalName, attributes.Undecodable,
+			strings.Join(attributes.Tags, ","), attributes.Category, attributes.SubCategory,
+			attributes.SpamScore, strings.Join(attributes.QualityFlags, ","), infoDict},
+			releaseValues(attributes.Release)...)...)
 		if err != nil {
-			return errors.Wrap(err, "tx.Exec (INSERT INTO files)")
+			return errors.Wrap(err, "Stmt.Exec (INSERT INTO torrents)")
+		}
+
+		var lastInsertId int64
+		if lastInsertId, err = res.LastInsertId(); err != nil {
+			return errors.Wrap(err, "sql.Result.LastInsertId")
+		}
+
+		// > last_insert_rowid()
+		// >   The last_insert_rowid() function returns the ROWID of the last row insert from the
+		// >   database connection which invoked the function. If no successful INSERTs into rowid
+		// >   tables have ever occurred on the database connection, then last_insert_rowid() returns
+		// >   zero.
+		// https://www.sqlite.org/lang_corefunc.html#last_insert_rowid
+		// https://www.sqlite.org/c3ref/last_insert_rowid.html
+		//
+		// Now, last_insert_rowid() should never return zero (or any negative values really) as we
+		// insert into torrents and handle any errors accordingly right afterwards.
+		if lastInsertId <= 0 {
+			zap.L().Panic("last_insert_rowid() <= 0 (this should have never happened!)",
+				zap.Int64("lastInsertId", lastInsertId))
+		}
+
+		for _, file := range t.Files {
+			_, err = fileStmt.Exec(lastInsertId, file.Size, file.Path, file.Attributes, file.OriginalPath)
+			if err != nil {
+				return errors.Wrap(err, "Stmt.Exec (INSERT INTO files)")
+			}
+		}
+
+		if _, err = failedFetchStmt.Exec(t.InfoHash, t.InfoHashV2); err != nil {
+			return errors.Wrap(err, "Stmt.Exec (DELETE FROM failed_fetches)")
 		}
 	}
 
@@ -237,6 +318,7 @@ func (db *sqlite3Database) GetNumberOfTorrents() (uint, error) {
 
 func (db *sqlite3Database) QueryTorrents(
 	query string,
+	filter QueryFilter,
 	epoch int64,
 	orderBy OrderingCriteria,
 	ascending bool,
@@ -253,15 +335,25 @@ func (db *sqlite3Database) QueryTorrents(
 
 	doJoin := query != ""
 	firstPage := lastID == nil
+	conditions, conditionValues := filter.conditions(Sqlite3)
 
 	// executeTemplate is used to prepare the SQL query, WITH PLACEHOLDERS FOR USER INPUT.
 	sqlQuery := executeTemplate(`
 		SELECT id 
              , info_hash
+			 , info_hash_v2
 			 , name
 			 , total_size
 			 , discovered_on
-			 , (SELECT COUNT(*) FROM files WHERE torrents.id = files.torrent_id) AS n_files
+			 , (SELECT COUNT(*) FROM files WHERE torrents.id = files.torrent_id AND `+notPadding+`) AS n_files
+			 , piece_length
+			 , private
+			 , source
+			 , category
+			 , sub_category
+			 , IFNULL(spam_score, 0)
+			 , quality_flags
+			 , `+releaseColumns+`
 	{{ if .DoJoin }}
 			 , idx.rank
 	{{ else }}
@@ -277,21 +369,26 @@ func (db *sqlite3Database) QueryTorrents(
 		) AS idx USING(id)
 	{{ end }}
 		WHERE     modified_on <= ?
+	{{ range .Conditions }}
+			  AND {{ . }}
+	{{ end }}
 	{{ if not .FirstPage }}
 			  AND ( {{.OrderOn}}, id ) {{GTEorLTE .Ascending}} (?, ?) -- https://www.sqlite.org/rowvalue.html#row_value_comparisons
 	{{ end }}
 		ORDER BY {{.OrderOn}} {{AscOrDesc .Ascending}}, id {{AscOrDesc .Ascending}}
 		LIMIT ?;	
 	`, struct {
-		DoJoin    bool
-		FirstPage bool
-		OrderOn   string
-		Ascending bool
+		DoJoin     bool
+		FirstPage  bool
+		OrderOn    string
+		Ascending  bool
+		Conditions []string
 	}{
-		DoJoin:    doJoin,
-		FirstPage: firstPage,
-		OrderOn:   orderOn(orderBy),
-		Ascending: ascending,
+		DoJoin:     doJoin,
+		FirstPage:  firstPage,
+		OrderOn:    orderOn(orderBy),
+		Ascending:  ascending,
+		Conditions: conditions,
 	}, template.FuncMap{
 		"GTEorLTE": func(ascending bool) string {
 			if ascending {
@@ -315,6 +412,7 @@ func (db *sqlite3Database) QueryTorrents(
 		queryArgs = append(queryArgs, query)
 	}
 	queryArgs = append(queryArgs, epoch)
+	queryArgs = append(queryArgs, conditionValues...)
 	if !firstPage {
 		queryArgs = append(queryArgs, lastOrderedValue)
 		queryArgs = append(queryArgs, lastID)
@@ -330,18 +428,33 @@ func (db *sqlite3Database) QueryTorrents(
 	torrents := make([]TorrentMetadata, 0)
 	for rows.Next() {
 		var torrent TorrentMetadata
-		err = rows.Scan(
+		var pieceLength sql.NullInt64
+		var source, category, subCategory, qualityFlags sql.NullString
+		var release nullRelease
+		dest := []interface{}{
 			&torrent.ID,
 			&torrent.InfoHash,
+			&torrent.InfoHashV2,
 			&torrent.Name,
 			&torrent.Size,
 			&torrent.DiscoveredOn,
 			&torrent.NFiles,
-			&torrent.Relevance,
-		)
-		if err != nil {
+			&pieceLength,
+			&torrent.Private,
+			&source,
+			&category,
+			&subCategory,
+			&torrent.SpamScore,
+			&qualityFlags,
+		}
+		dest = append(dest, release.destinations()...)
+		if err = rows.Scan(append(dest, &torrent.Relevance)...); err != nil {
 			return nil, err
 		}
+		torrent.PieceLength, torrent.Source = pieceLength.Int64, source.String
+		torrent.Category, torrent.SubCategory = category.String, subCategory.String
+		torrent.QualityFlags = splitTags(qualityFlags.String)
+		torrent.Release = release.release()
 		torrents = append(torrents, torrent)
 	}
 
@@ -371,13 +484,23 @@ func (db *sqlite3Database) GetTorrent(infoHash []byte) (*TorrentMetadata, error)
 	rows, err := db.conn.Query(`
 		SELECT
 			info_hash,
+			info_hash_v2,
 			name,
 			total_size,
 			discovered_on,
-			(SELECT COUNT(*) FROM files WHERE torrent_id = torrents.id) AS n_files
+			(SELECT COUNT(*) FROM files WHERE torrent_id = torrents.id AND `+notPadding+`) AS n_files,
+			piece_length,
+			private,
+			source,
+			tags,
+			category,
+			sub_category,
+			IFNULL(spam_score, 0),
+			quality_flags,
+			`+releaseColumns+`
 		FROM torrents
-		WHERE info_hash = ?`,
-		infoHash,
+		WHERE info_hash = ? OR info_hash_v2 = ?`,
+		infoHash, infoHash,
 	)
 	defer closeRows(rows)
 	if err != nil {
@@ -389,17 +512,27 @@ func (db *sqlite3Database) GetTorrent(infoHash []byte) (*TorrentMetadata, error)
 	}
 
 	var tm TorrentMetadata
-	if err = rows.Scan(&tm.InfoHash, &tm.Name, &tm.Size, &tm.DiscoveredOn, &tm.NFiles); err != nil {
+	var pieceLength sql.NullInt64
+	var source, tags, category, subCategory, qualityFlags sql.NullString
+	var release nullRelease
+	err = rows.Scan(append([]interface{}{&tm.InfoHash, &tm.InfoHashV2, &tm.Name, &tm.Size, &tm.DiscoveredOn,
+		&tm.NFiles, &pieceLength, &tm.Private, &source, &tags, &category, &subCategory, &tm.SpamScore,
+		&qualityFlags}, release.destinations()...)...)
+	if err != nil {
 		return nil, err
 	}
+	tm.PieceLength, tm.Source, tm.Tags = pieceLength.Int64, source.String, splitTags(tags.String)
+	tm.Category, tm.SubCategory = category.String, subCategory.String
+	tm.QualityFlags = splitTags(qualityFlags.String)
+	tm.Release = release.release()
 
 	return &tm, nil
 }
 
 func (db *sqlite3Database) GetFiles(infoHash []byte) ([]File, error) {
 	rows, err := db.conn.Query(
-		"SELECT size, path FROM files, torrents WHERE files.torrent_id = torrents.id AND torrents.info_hash = ?;",
-		infoHash)
+		"SELECT size, path, IFNULL(attributes, '') FROM files, torrents WHERE files.torrent_id = torrents.id AND (torrents.info_hash = ? OR torrents.info_hash_v2 = ?) AND "+notPadding+";",
+		infoHash, infoHash)
 	defer closeRows(rows)
 	if err != nil {
 		return nil, err
@@ -408,7 +541,7 @@ func (db *sqlite3Database) GetFiles(infoHash []byte) ([]File, error) {
 	var files []File
 	for rows.Next() {
 		var file File
-		if err = rows.Scan(&file.Size, &file.Path); err != nil {
+		if err = rows.Scan(&file.Size, &file.Path, &file.Attributes); err != nil {
 			return nil, err
 		}
 		files = append(files, file)
@@ -434,8 +567,10 @@ func (db *sqlite3Database) GetStatistics(from string, n uint) (*Statistics, erro
 		toTime = fromTime.AddDate(0, int(n), 0)
 		timef = "%Y-%m"
 	case Week:
+		// SQLite does not support the ISO 8601 week numbering (unlike `%W`, which counts the weeks
+		// from the first Monday of the year), hence the days are summed up into their weeks below.
 		toTime = fromTime.AddDate(0, 0, int(n)*7)
-		timef = "%Y-%W"
+		timef = "%Y-%m-%d"
 	case Day:
 		toTime = fromTime.AddDate(0, 0, int(n))
 		timef = "%Y-%m-%d"
@@ -452,6 +587,7 @@ func (db *sqlite3Database) GetStatistics(from string, n uint) (*Statistics, erro
                  , count(DISTINCT files.id) AS nF
 			FROM torrents, files
  			WHERE     torrents.id = files.torrent_id
+                  AND `+notPadding+`
                   AND discovered_on >= ?
                   AND discovered_on <= ?
 			GROUP BY dt;`,
@@ -473,14 +609,428 @@ func (db *sqlite3Database) GetStatistics(from string, n uint) (*Statistics, erro
 			}
 			return nil, err
 		}
-		stats.NDiscovered[dT] = nD
-		stats.TotalSize[dT] = tS
-		stats.NFiles[dT] = nF
+		if gran == Week {
+			day, err := time.Parse("2006-01-02", dT)
+			if err != nil {
+				return nil, errors.Wrap(err, "time.Parse")
+			}
+			year, week := day.ISOWeek()
+			dT = fmt.Sprintf("%04d-W%02d", year, week)
+		}
+		stats.NDiscovered[dT] += nD
+		stats.TotalSize[dT] += tS
+		stats.NFiles[dT] += nF
+	}
+
+	stats.RetryQueue = new(RetryQueueStatistics)
+	err = db.conn.QueryRow(`
+		SELECT count(next_attempt_on)
+		     , count(*) - count(next_attempt_on)
+		FROM failed_fetches;
+	`).Scan(&stats.RetryQueue.NPending, &stats.RetryQueue.NAbandoned)
+	if err != nil {
+		return nil, errors.Wrap(err, "QueryRow (failed_fetches)")
 	}
 
 	return stats, nil
 }
 
+func (db *sqlite3Database) GetUnparsedTorrents(limit uint) ([]TorrentMetadata, error) {
+	rows, err := db.conn.Query("SELECT info_hash, name FROM torrents WHERE release_title IS NULL LIMIT ?;", limit)
+	defer closeRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var torrents []TorrentMetadata
+	for rows.Next() {
+		var torrent TorrentMetadata
+		if err = rows.Scan(&torrent.InfoHash, &torrent.Name); err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, torrent)
+	}
+
+	return torrents, nil
+}
+
+func (db *sqlite3Database) SetRelease(infoHash []byte, release Release) error {
+	_, err := db.conn.Exec(`
+		UPDATE torrents
+		SET (`+releaseColumns+`) = (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		WHERE info_hash = ? OR info_hash_v2 = ?;`,
+		append(releaseValues(&release), infoHash, infoHash)...,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Exec (UPDATE torrents)")
+	}
+
+	return nil
+}
+
+func (db *sqlite3Database) GetUncategorisedTorrents(limit uint) ([][]byte, error) {
+	rows, err := db.conn.Query("SELECT info_hash FROM torrents WHERE category IS NULL LIMIT ?;", limit)
+	defer closeRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var infoHashes [][]byte
+	for rows.Next() {
+		var infoHash []byte
+		if err = rows.Scan(&infoHash); err != nil {
+			return nil, err
+		}
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	return infoHashes, nil
+}
+
+func (db *sqlite3Database) SetCategory(infoHash []byte, category string, subCategory string) error {
+	_, err := db.conn.Exec(
+		"UPDATE torrents SET category = ?, sub_category = NULLIF(?, '') WHERE info_hash = ? OR info_hash_v2 = ?;",
+		category, subCategory, infoHash, infoHash,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Exec (UPDATE torrents)")
+	}
+
+	return nil
+}
+
+func (db *sqlite3Database) SetInfoDict(infoHash []byte, infoDict []byte) error {
+	compressed, err := compress(infoDict)
+	if err != nil {
+		return errors.Wrap(err, "compress")
+	}
+
+	_, err = db.conn.Exec(
+		"UPDATE torrents SET info_dict = ? WHERE info_hash = ? OR info_hash_v2 = ?;",
+		compressed, infoHash, infoHash,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Exec (UPDATE torrents)")
+	}
+
+	return nil
+}
+
+func (db *sqlite3Database) GetInfoDict(infoHash []byte) ([]byte, error) {
+	var compressed []byte
+	err := db.conn.QueryRow(
+		"SELECT info_dict FROM torrents WHERE info_hash = ? OR info_hash_v2 = ?;",
+		infoHash, infoHash,
+	).Scan(&compressed)
+	if err == sql.ErrNoRows || (err == nil && compressed == nil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "QueryRow (torrents)")
+	}
+
+	return decompress(compressed)
+}
+
+func (db *sqlite3Database) SetReadme(infoHash []byte, readme Readme) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return errors.Wrap(err, "conn.Begin")
+	}
+	// If everything goes as planned and no error occurs, we will commit the transaction before
+	// returning from the function so the tx.Rollback() call will fail, trying to rollback a
+	// committed transaction. BUT, if an error occurs, we'll get our transaction rollback'ed, which
+	// is nice.
+	defer tx.Rollback()
+
+	var torrentID int64
+	err = tx.QueryRow(
+		"SELECT id FROM torrents WHERE info_hash = ? OR info_hash_v2 = ?;",
+		infoHash, infoHash,
+	).Scan(&torrentID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no such torrent")
+	} else if err != nil {
+		return errors.Wrap(err, "tx.QueryRow (SELECT id FROM torrents)")
+	}
+
+	// A torrent can have one readme at most (see readme_index), hence the previous one is unmarked
+	// first.
+	_, err = tx.Exec(
+		"UPDATE files SET is_readme = NULL, content = NULL WHERE torrent_id = ? AND is_readme = 1;",
+		torrentID,
+	)
+	if err != nil {
+		return errors.Wrap(err, "tx.Exec (UPDATE files, unmark)")
+	}
+
+	// Paths are not necessarily unique within a torrent, in which case the first file is chosen.
+	res, err := tx.Exec(`
+		UPDATE files SET is_readme = 1, content = ?
+		WHERE id = (SELECT id FROM files WHERE torrent_id = ? AND path = ? ORDER BY id LIMIT 1);`,
+		readme.Content, torrentID, readme.Path,
+	)
+	if err != nil {
+		return errors.Wrap(err, "tx.Exec (UPDATE files, mark)")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "RowsAffected")
+	} else if n == 0 {
+		return fmt.Errorf("no such file: %s", readme.Path)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.Wrap(err, "tx.Commit")
+	}
+
+	return nil
+}
+
+func (db *sqlite3Database) GetReadme(infoHash []byte) (*Readme, error) {
+	readme := new(Readme)
+	err := db.conn.QueryRow(`
+		SELECT files.path, files.content
+		FROM files, torrents
+		WHERE files.torrent_id = torrents.id
+			AND (torrents.info_hash = ? OR torrents.info_hash_v2 = ?)
+			AND files.is_readme = 1;`,
+		infoHash, infoHash,
+	).Scan(&readme.Path, &readme.Content)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "QueryRow (files)")
+	}
+
+	return readme, nil
+}
+
+func (db *sqlite3Database) DeleteTorrent(infoHash []byte) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return errors.Wrap(err, "conn.Begin")
+	}
+	// If everything goes as planned and no error occurs, we will commit the transaction before
+	// returning from the function so the tx.Rollback() call will fail, trying to rollback a
+	// committed transaction. BUT, if an error occurs, we'll get our transaction rollback'ed, which
+	// is nice.
+	defer tx.Rollback()
+
+	if err = db.deleteTorrent(tx, infoHash); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.Wrap(err, "tx.Commit")
+	}
+
+	return nil
+}
+
+func (db *sqlite3Database) deleteTorrent(tx *sql.Tx, infoHash []byte) error {
+	// Files are deleted explicitly, since foreign keys might not be enforced (see
+	// `_foreign_keys` of go-sqlite3).
+	_, err := tx.Exec(`
+		DELETE FROM files WHERE torrent_id IN (SELECT id FROM torrents WHERE info_hash = ? OR info_hash_v2 = ?);
+		`, infoHash, infoHash)
+	if err != nil {
+		return errors.Wrap(err, "tx.Exec (DELETE FROM files)")
+	}
+
+	_, err = tx.Exec("DELETE FROM torrents WHERE info_hash = ? OR info_hash_v2 = ?;", infoHash, infoHash)
+	if err != nil {
+		return errors.Wrap(err, "tx.Exec (DELETE FROM torrents)")
+	}
+
+	return nil
+}
+
+// AddBlockAndDelete adds the block, deletes its torrent, and appends the audit entries in a single
+// transaction (see persistence.AddBlockAndDelete).
+func (db *sqlite3Database) AddBlockAndDelete(block Block, entries []AuditEntry) (uint64, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "conn.Begin")
+	}
+	defer tx.Rollback()
+
+	id, err := db.addBlock(tx, block)
+	if err != nil {
+		return 0, err
+	}
+	if block.InfoHash != nil {
+		if err = db.deleteTorrent(tx, block.InfoHash); err != nil {
+			return 0, err
+		}
+	}
+	for _, entry := range entries {
+		if err = db.addAuditEntry(tx, entry); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "tx.Commit")
+	}
+
+	return id, nil
+}
+
+func (db *sqlite3Database) AddBlock(block Block) (uint64, error) {
+	return db.addBlock(db.conn, block)
+}
+
+func (db *sqlite3Database) addBlock(execer sqlExecer, block Block) (uint64, error) {
+	res, err := execer.Exec(`
+		INSERT INTO blocklist (info_hash, name_pattern, reason, added_by, added_on)
+		VALUES (?, NULLIF(?, ''), ?, ?, ?);
+	`, block.InfoHash, block.NamePattern, block.Reason, block.AddedBy, time.Now().Unix())
+	if err != nil {
+		return 0, errors.Wrap(err, "Exec (INSERT INTO blocklist)")
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, errors.Wrap(err, "sql.Result.LastInsertId")
+	}
+
+	return uint64(id), nil
+}
+
+func (db *sqlite3Database) RemoveBlock(id uint64) error {
+	res, err := db.conn.Exec("DELETE FROM blocklist WHERE id = ?;", id)
+	if err != nil {
+		return errors.Wrap(err, "Exec (DELETE FROM blocklist)")
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "sql.Result.RowsAffected")
+	} else if n == 0 {
+		return fmt.Errorf("no such block: %d", id)
+	}
+
+	return nil
+}
+
+func (db *sqlite3Database) GetBlocks() ([]Block, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, info_hash, IFNULL(name_pattern, ''), reason, added_by, added_on
+		FROM blocklist
+		ORDER BY id ASC;`)
+	defer closeRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]Block, 0)
+	for rows.Next() {
+		var b Block
+		if err = rows.Scan(&b.ID, &b.InfoHash, &b.NamePattern, &b.Reason, &b.AddedBy, &b.AddedOn); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+
+	return blocks, nil
+}
+
+func (db *sqlite3Database) AddAuditEntry(entry AuditEntry) error {
+	return db.addAuditEntry(db.conn, entry)
+}
+
+func (db *sqlite3Database) addAuditEntry(execer sqlExecer, entry AuditEntry) error {
+	_, err := execer.Exec(`
+		INSERT INTO audit_log (action, info_hash, name_pattern, actor, reason, performed_on)
+		VALUES (?, ?, NULLIF(?, ''), ?, ?, ?);
+	`, entry.Action, entry.InfoHash, entry.NamePattern, entry.Actor, entry.Reason, time.Now().Unix())
+	if err != nil {
+		return errors.Wrap(err, "Exec (INSERT INTO audit_log)")
+	}
+
+	return nil
+}
+
+func (db *sqlite3Database) GetAuditLog(limit uint) ([]AuditEntry, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, action, info_hash, IFNULL(name_pattern, ''), actor, reason, performed_on
+		FROM audit_log
+		ORDER BY id DESC
+		LIMIT ?;`,
+		limit,
+	)
+	defer closeRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		var ae AuditEntry
+		if err = rows.Scan(&ae.ID, &ae.Action, &ae.InfoHash, &ae.NamePattern, &ae.Actor, &ae.Reason, &ae.PerformedOn); err != nil {
+			return nil, err
+		}
+		entries = append(entries, ae)
+	}
+
+	return entries, nil
+}
+
+func (db *sqlite3Database) AddFailedFetch(infoHash []byte, reason string, nextAttemptOn int64) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO failed_fetches (info_hash, reason, last_failed_on, next_attempt_on)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (info_hash) DO UPDATE SET
+			reason         = excluded.reason,
+			last_failed_on = excluded.last_failed_on;
+	`, infoHash, reason, time.Now().Unix(), nextAttemptOn)
+	if err != nil {
+		return errors.Wrap(err, "Exec (INSERT INTO failed_fetches)")
+	}
+
+	return nil
+}
+
+func (db *sqlite3Database) GetDueFailedFetches(now int64, limit uint) ([]FailedFetch, error) {
+	rows, err := db.conn.Query(`
+		SELECT info_hash, reason, n_attempts, last_failed_on, next_attempt_on
+		FROM failed_fetches
+		WHERE next_attempt_on <= ?
+		ORDER BY next_attempt_on ASC
+		LIMIT ?;`,
+		now, limit,
+	)
+	defer closeRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	failedFetches := make([]FailedFetch, 0)
+	for rows.Next() {
+		var ff FailedFetch
+		if err = rows.Scan(&ff.InfoHash, &ff.Reason, &ff.NAttempts, &ff.LastFailedOn, &ff.NextAttemptOn); err != nil {
+			return nil, err
+		}
+		failedFetches = append(failedFetches, ff)
+	}
+
+	return failedFetches, nil
+}
+
+func (db *sqlite3Database) UpdateFailedFetch(infoHash []byte, nAttempts uint, nextAttemptOn *int64) error {
+	_, err := db.conn.Exec(
+		"UPDATE failed_fetches SET n_attempts = ?, next_attempt_on = ? WHERE info_hash = ?;",
+		nAttempts, nextAttemptOn, infoHash,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Exec (UPDATE failed_fetches)")
+	}
+
+	return nil
+}
+
+func (db *sqlite3Database) DumpTorrents(afterID uint64, limit uint, withInfoDicts bool) ([]DumpedTorrent, error) {
+	return sqlDumpTorrents(db.conn, sqlIdentity, afterID, limit, withInfoDicts)
+}
+
 func (db *sqlite3Database) setupDatabase() error {
 	// Enable Write-Ahead Logging for SQLite as "WAL provides more concurrency as readers do not
 	// block writers and a writer does not block readers. Reading and writing can proceed
@@ -672,6 +1222,234 @@ func (db *sqlite3Database) setupDatabase() error {
 		if err != nil {
 			return errors.Wrap(err, "sql.Tx.Exec (v2 -> v3)")
 		}
+		fallthrough
+
+	case 3:
+		// Upgrade from user_version 3 to 4
+		// Changes:
+		//   * Created `failed_fetches` table, which is the retry queue of the torrents whose
+		//     metadata could not be fetched from any of their peers.
+		//
+		//     `next_attempt_on` is NULL for the fetches that are abandoned after too many attempts;
+		//     we keep them around so that we do not keep retrying them, and for statistics.
+		zap.L().Warn("Updating database schema from 3 to 4... (this might take a while)")
+		_, err = tx.Exec(`
+			CREATE TABLE failed_fetches (
+				info_hash        BLOB PRIMARY KEY,
+				reason           TEXT NOT NULL,
+				n_attempts       INTEGER NOT NULL DEFAULT 0 CHECK (n_attempts >= 0),
+				last_failed_on   INTEGER NOT NULL CHECK (last_failed_on > 0),
+				next_attempt_on  INTEGER DEFAULT NULL
+			);
+
+			CREATE INDEX next_attempt_on_index ON failed_fetches (next_attempt_on);
+
+			PRAGMA user_version = 4;
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v3 -> v4)")
+		}
+		fallthrough
+
+	case 4:
+		// Upgrade from user_version 4 to 5
+		// Changes:
+		//   * Added `info_hash_v2` column to the `torrents` table for BitTorrent v2 (BEP 52) and
+		//     hybrid torrents.
+		//
+		//     `info_hash` is the SHA-1 infohash of v1 and hybrid torrents, and the SHA-256 infohash
+		//     of v2-only torrents (in which case both columns are equal). `info_hash_v2` is NULL for
+		//     v1-only torrents.
+		//
+		//     The DHT uses the first 20 bytes of v2 infohashes, hence the index on the truncated
+		//     column.
+		zap.L().Warn("Updating database schema from 4 to 5... (this might take a while)")
+		_, err = tx.Exec(`
+			ALTER TABLE torrents ADD COLUMN info_hash_v2 BLOB CHECK (info_hash_v2 IS NULL OR length(info_hash_v2) = 32) DEFAULT NULL;
+			CREATE UNIQUE INDEX info_hash_v2_index ON torrents (info_hash_v2);
+			CREATE INDEX info_hash_v2_truncated_index ON torrents (substr(info_hash_v2, 1, 20));
+
+			PRAGMA user_version = 5;
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v4 -> v5)")
+		}
+		fallthrough
+
+	case 5:
+		// Upgrade from user_version 5 to 6
+		// Changes:
+		//   * Added `info_dict` column to the `torrents` table, which is the zlib-compressed
+		//     bencoded info dictionary of the torrent (if stored), so that .torrent files can be
+		//     served and the metadata can be re-parsed later on.
+		zap.L().Warn("Updating database schema from 5 to 6... (this might take a while)")
+		_, err = tx.Exec(`
+			ALTER TABLE torrents ADD COLUMN info_dict BLOB DEFAULT NULL;
+
+			PRAGMA user_version = 6;
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v5 -> v6)")
+		}
+		fallthrough
+
+	case 6:
+		// Upgrade from user_version 6 to 7
+		// Changes:
+		//   * Added `piece_length`, `private`, and `source` columns to the `torrents` table.
+		//     `piece_length` is NULL for the torrents that are added before.
+		//   * Added `attributes` column to the `files` table, which holds the BEP 47 attributes of
+		//     the file (if any). Padding files are hidden from the file lists, the file counts, and
+		//     the total sizes using `notPadding`.
+		zap.L().Warn("Updating database schema from 6 to 7... (this might take a while)")
+		_, err = tx.Exec(`
+			ALTER TABLE torrents ADD COLUMN piece_length INTEGER CHECK (piece_length IS NULL OR piece_length >= 0) DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN private      INTEGER NOT NULL CHECK (private IN (0, 1)) DEFAULT 0;
+			ALTER TABLE torrents ADD COLUMN source       TEXT DEFAULT NULL;
+
+			ALTER TABLE files ADD COLUMN attributes TEXT DEFAULT NULL;
+
+			PRAGMA user_version = 7;
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v6 -> v7)")
+		}
+		fallthrough
+
+	case 7:
+		// Upgrade from user_version 7 to 8
+		// Changes:
+		//   * Added `encoding`, `original_name`, and `undecodable` columns to the `torrents` table,
+		//     and `original_path` column to the `files` table.
+		//
+		//     Names and paths are always stored in UTF-8 (hence can be tokenised by FTS), but if
+		//     they were not UTF-8 originally, the original bytes are kept for later reprocessing,
+		//     alongside the charset they are decoded from. `undecodable` torrents are the ones
+		//     whose charset could not be detected, and whose invalid bytes are replaced.
+		zap.L().Warn("Updating database schema from 7 to 8... (this might take a while)")
+		_, err = tx.Exec(`
+			ALTER TABLE torrents ADD COLUMN encoding      TEXT DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN original_name BLOB DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN undecodable   INTEGER NOT NULL CHECK (undecodable IN (0, 1)) DEFAULT 0;
+
+			ALTER TABLE files ADD COLUMN original_path BLOB DEFAULT NULL;
+
+			PRAGMA user_version = 8;
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v7 -> v8)")
+		}
+		fallthrough
+
+	case 8:
+		// Upgrade from user_version 8 to 9
+		// Changes:
+		//   * Added `tags` column to the `torrents` table, which holds the (comma-separated) tags
+		//     added by the content filter rules of magneticod.
+		zap.L().Warn("Updating database schema from 8 to 9... (this might take a while)")
+		_, err = tx.Exec(`
+			ALTER TABLE torrents ADD COLUMN tags TEXT DEFAULT NULL;
+			PRAGMA user_version = 9;
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v8 -> v9)")
+		}
+		fallthrough
+
+	case 9:
+		// Upgrade from user_version 9 to 10
+		// Changes:
+		//   * Added `category` and `sub_category` columns to the `torrents` table, and the index
+		//     on `category` (which is also used to find the uncategorised torrents to backfill,
+		//     i.e. whose category is NULL).
+		zap.L().Warn("Updating database schema from 9 to 10... (this might take a while)")
+		_, err = tx.Exec(`
+			ALTER TABLE torrents ADD COLUMN category     TEXT DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN sub_category TEXT DEFAULT NULL;
+			CREATE INDEX category_index ON torrents (category, sub_category);
+			PRAGMA user_version = 10;
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v9 -> v10)")
+		}
+		fallthrough
+
+	case 10:
+		// Upgrade from user_version 10 to 11
+		// Changes:
+		//   * Added the `release_*` columns to the `torrents` table, of the release parsed from
+		//     the name of the torrent (see pkg/release), and the index on `release_title` (which is
+		//     also used to find the unparsed torrents to backfill, i.e. whose title is NULL).
+		//     Titles are compared case-insensitively.
+		zap.L().Warn("Updating database schema from 10 to 11... (this might take a while)")
+		_, err = tx.Exec(`
+			ALTER TABLE torrents ADD COLUMN release_title      TEXT COLLATE NOCASE DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN release_year       INTEGER DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN release_season     INTEGER DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN release_episode    INTEGER DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN release_resolution TEXT DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN release_source     TEXT DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN release_codec      TEXT DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN release_audio      TEXT DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN release_language   TEXT DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN release_group      TEXT DEFAULT NULL;
+			CREATE INDEX release_title_index ON torrents (release_title, release_year);
+			PRAGMA user_version = 11;
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v10 -> v11)")
+		}
+		fallthrough
+
+	case 11:
+		// Upgrade from user_version 11 to 12
+		// Changes:
+		//   * Added `spam_score` and `quality_flags` columns to the `torrents` table (see
+		//     pkg/spam). Both are NULL for the torrents that are added before, which are
+		//     therefore never excluded as flagged.
+		zap.L().Warn("Updating database schema from 11 to 12... (this might take a while)")
+		_, err = tx.Exec(`
+			ALTER TABLE torrents ADD COLUMN spam_score    INTEGER DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN quality_flags TEXT DEFAULT NULL;
+			PRAGMA user_version = 12;
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v11 -> v12)")
+		}
+		fallthrough
+
+	case 12:
+		// Upgrade from user_version 12 to 13
+		// Changes:
+		//   * Added `blocklist` table, each row of which blocks either an infohash (v1 or v2) or
+		//     the names matching a pattern.
+		//   * Added `audit_log` table, which is append-only.
+		zap.L().Warn("Updating database schema from 12 to 13... (this might take a while)")
+		_, err = tx.Exec(`
+			CREATE TABLE blocklist (
+				id           INTEGER PRIMARY KEY,
+				info_hash    BLOB UNIQUE,
+				name_pattern TEXT,
+				reason       TEXT NOT NULL,
+				added_by     TEXT NOT NULL,
+				added_on     INTEGER NOT NULL,
+
+				CHECK ((info_hash IS NULL) != (name_pattern IS NULL))
+			);
+			CREATE TABLE audit_log (
+				id           INTEGER PRIMARY KEY,
+				action       TEXT NOT NULL,
+				info_hash    BLOB,
+				name_pattern TEXT,
+				actor        TEXT NOT NULL,
+				reason       TEXT NOT NULL,
+				performed_on INTEGER NOT NULL
+			);
+			PRAGMA user_version = 13;
+		`)
+		if err != nil {
+			return errors.Wrap(err, "sql.Tx.Exec (v12 -> v13)")
+		}
 	}
 
 	if err = tx.Commit(); err != nil {
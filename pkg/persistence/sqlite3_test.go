@@ -0,0 +1,62 @@
+package persistence
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openTestSqlite3 opens a database in a temporary directory, or skips the test if SQLite is built
+// without FTS5 (see conformanceEngines).
+func openTestSqlite3(t *testing.T) Database {
+	dir, err := ioutil.TempDir("", "magnetico-conformance")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err.Error())
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	u := url.URL{Scheme: "sqlite3", Path: filepath.Join(dir, "database.sqlite3"), RawQuery: "_foreign_keys=true"}
+	db, err := MakeDatabase(u.String(), nil)
+	if err != nil && strings.Contains(err.Error(), "no such module: fts5") {
+		t.Skip("SQLite is built without FTS5 (see `-tags fts5`)")
+	} else if err != nil {
+		t.Fatalf("MakeDatabase: %s", err.Error())
+	}
+	return db
+}
+
+func TestSqlite3AddBlockAndDeleteRollback(t *testing.T) {
+	db := openTestSqlite3(t)
+	defer db.Close()
+	addConformanceTorrents(t, db)
+
+	// The audit entries of the takedowns fail to be added.
+	_, err := db.(*sqlite3Database).conn.Exec(`
+		CREATE TRIGGER fail_delete BEFORE INSERT ON audit_log WHEN NEW.action = 'delete'
+		BEGIN SELECT RAISE(ABORT, 'failed'); END;`)
+	if err != nil {
+		t.Fatalf("CREATE TRIGGER: %s", err.Error())
+	}
+
+	block := Block{InfoHash: infoHash(1, false), Reason: "Notice #1", AddedBy: "admin"}
+	_, err = AddBlockAndDelete(db, block, []AuditEntry{
+		{Action: "block", InfoHash: block.InfoHash, Actor: "admin", Reason: "Notice #1"},
+		{Action: "delete", InfoHash: block.InfoHash, Actor: "admin", Reason: "Notice #1"},
+	})
+	if err == nil {
+		t.Fatal("Failure of the audit entry is not an error")
+	}
+
+	if blocks, err := db.GetBlocks(); err != nil || len(blocks) != 0 {
+		t.Errorf("Block is added nevertheless: %v %v", blocks, err)
+	}
+	if torrent, err := db.GetTorrent(block.InfoHash); err != nil || torrent == nil {
+		t.Errorf("Torrent is deleted nevertheless: %+v %v", torrent, err)
+	}
+	if entries, err := db.GetAuditLog(10); err != nil || len(entries) != 0 {
+		t.Errorf("Audit entry of the block is added nevertheless: %+v %v", entries, err)
+	}
+}
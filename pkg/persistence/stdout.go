@@ -32,11 +32,14 @@ func (s *stdout) DoesTorrentExist(infoHash []byte) (bool, error) {
 	return false, nil
 }
 
-func (s *stdout) AddNewTorrent(infoHash []byte, name string, files []File) error {
+func (s *stdout) AddNewTorrent(infoHash []byte, infoHashV2 []byte, name string, files []File, attributes TorrentAttributes) error {
 	err := s.encoder.Encode(SimpleTorrentSummary{
-		InfoHash: hex.EncodeToString(infoHash),
-		Name:     name,
-		Files:    files,
+		InfoHash:   hex.EncodeToString(infoHash),
+		InfoHashV2: hex.EncodeToString(infoHashV2),
+		Name:       name,
+		Files:      files,
+
+		TorrentAttributes: attributes,
 	})
 	if err != nil {
 		return errors.Wrap(err, "DB engine stdout encode error")
@@ -55,6 +58,7 @@ func (s *stdout) GetNumberOfTorrents() (uint, error) {
 
 func (s *stdout) QueryTorrents(
 	query string,
+	filter QueryFilter,
 	epoch int64,
 	orderBy OrderingCriteria,
 	ascending bool,
@@ -76,3 +80,75 @@ func (s *stdout) GetFiles(infoHash []byte) ([]File, error) {
 func (s *stdout) GetStatistics(from string, n uint) (*Statistics, error) {
 	return nil, NotImplementedError
 }
+
+func (s *stdout) DeleteTorrent(infoHash []byte) error {
+	return NotImplementedError
+}
+
+func (s *stdout) AddBlock(block Block) (uint64, error) {
+	return 0, NotImplementedError
+}
+
+func (s *stdout) RemoveBlock(id uint64) error {
+	return NotImplementedError
+}
+
+func (s *stdout) GetBlocks() ([]Block, error) {
+	return nil, NotImplementedError
+}
+
+func (s *stdout) AddAuditEntry(entry AuditEntry) error {
+	return NotImplementedError
+}
+
+func (s *stdout) GetAuditLog(limit uint) ([]AuditEntry, error) {
+	return nil, NotImplementedError
+}
+
+func (s *stdout) GetUnparsedTorrents(limit uint) ([]TorrentMetadata, error) {
+	return nil, NotImplementedError
+}
+
+func (s *stdout) SetRelease(infoHash []byte, release Release) error {
+	return NotImplementedError
+}
+
+func (s *stdout) GetUncategorisedTorrents(limit uint) ([][]byte, error) {
+	return nil, NotImplementedError
+}
+
+func (s *stdout) SetCategory(infoHash []byte, category string, subCategory string) error {
+	return NotImplementedError
+}
+
+func (s *stdout) SetInfoDict(infoHash []byte, infoDict []byte) error {
+	return NotImplementedError
+}
+
+func (s *stdout) GetInfoDict(infoHash []byte) ([]byte, error) {
+	return nil, NotImplementedError
+}
+
+func (s *stdout) SetReadme(infoHash []byte, readme Readme) error {
+	return NotImplementedError
+}
+
+func (s *stdout) GetReadme(infoHash []byte) (*Readme, error) {
+	return nil, NotImplementedError
+}
+
+func (s *stdout) AddFailedFetch(infoHash []byte, reason string, nextAttemptOn int64) error {
+	return NotImplementedError
+}
+
+func (s *stdout) GetDueFailedFetches(now int64, limit uint) ([]FailedFetch, error) {
+	return nil, NotImplementedError
+}
+
+func (s *stdout) UpdateFailedFetch(infoHash []byte, nAttempts uint, nextAttemptOn *int64) error {
+	return NotImplementedError
+}
+
+func (s *stdout) DumpTorrents(afterID uint64, limit uint, withInfoDicts bool) ([]DumpedTorrent, error) {
+	return nil, NotImplementedError
+}
@@ -0,0 +1,129 @@
+package persistence
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWebhook(t *testing.T) {
+	var mutex sync.Mutex
+	var payloads []string
+	// failures is the number of the requests to fail with 503 before succeeding, and the requests
+	// whose payloads contain failing (unless empty) fail too.
+	failures := 1
+	failing := ""
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		if r.Header.Get("X-Magnetico-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("Wrong signature: %s", r.Header.Get("X-Magnetico-Signature"))
+		}
+		if username, password, _ := r.BasicAuth(); username != "user" || password != "pass" {
+			t.Errorf("Wrong credentials: %s:%s", username, password)
+		}
+		if r.Header.Get("X-Token") != "token" || r.URL.RawQuery != "key=value" {
+			t.Errorf("Wrong header or query: %v %s", r.Header, r.URL.RawQuery)
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failures > 0 {
+			failures--
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		} else if failing != "" && strings.Contains(string(body), failing) {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		payloads = append(payloads, string(body))
+	}))
+	defer server.Close()
+
+	u := strings.Replace(server.URL, "http://", "http://user:pass@", 1) +
+		"/?key=value&webhook-secret=secret&webhook-header=X-Token:%20token&webhook-retries=1"
+	db, err := MakeDatabase(u, nil)
+	if err != nil {
+		t.Fatalf("MakeDatabase: %s", err.Error())
+	}
+	defer db.Close()
+	db.(*webhook).minBackoff = 0
+	files := []File{{Size: 1, Path: "a"}}
+
+	// The first attempt fails, and the retry succeeds.
+	if err = db.AddNewTorrent([]byte{0x01}, nil, "a", files, TorrentAttributes{}); err != nil {
+		t.Fatalf("AddNewTorrent: %s", err.Error())
+	}
+	if exists, err := db.DoesTorrentExist([]byte{0x01}); !exists || err != nil {
+		t.Errorf("Delivered torrent is not cached: %v %v", exists, err)
+	}
+	if len(payloads) != 1 {
+		t.Fatalf("Torrent is not delivered once: %v", payloads)
+	}
+	var summary SimpleTorrentSummary
+	if err = json.Unmarshal([]byte(payloads[0]), &summary); err != nil || summary.InfoHash != "01" {
+		t.Errorf("Wrong payload: %s", payloads[0])
+	}
+
+	// Both of the attempts fail, after which the endpoint is unavailable for a while (or until a
+	// delivery succeeds), lest nothing is ever added to be delivered again.
+	failures = 2
+	if err = db.AddNewTorrent([]byte{0x02}, nil, "b", files, TorrentAttributes{}); err == nil {
+		t.Error("Failed delivery is not an error")
+	}
+	if _, err = db.DoesTorrentExist([]byte{0x01}); err == nil {
+		t.Error("Unavailable endpoint is not an error")
+	}
+	db.(*webhook).unavailability = 0
+	if exists, err := db.DoesTorrentExist([]byte{0x01}); !exists || err != nil {
+		t.Errorf("Endpoint is unavailable for good: %v %v", exists, err)
+	}
+
+	db.(*webhook).batch = true
+	err = AddNewTorrents(db, []NewTorrent{{InfoHash: []byte{0x02}, Name: "b", Files: files}, {InfoHash: []byte{0x03}, Name: "c", Files: files}})
+	if err != nil {
+		t.Fatalf("AddNewTorrents: %s", err.Error())
+	}
+	var batch []SimpleTorrentSummary
+	if err = json.Unmarshal([]byte(payloads[1]), &batch); err != nil || len(batch) != 2 {
+		t.Errorf("Wrong batch: %s", payloads[1])
+	}
+	if exists, err := db.DoesTorrentExist([]byte{0x03}); !exists || err != nil {
+		t.Errorf("Delivered batch is not cached: %v %v", exists, err)
+	}
+
+	// The torrents in the cache are not delivered again, hence when the delivery of a torrent
+	// fails, only the rest are delivered once all of them are added again.
+	db.(*webhook).batch = false
+	torrents := []NewTorrent{{InfoHash: []byte{0x03}, Name: "c", Files: files}, {InfoHash: []byte{0x04}, Name: "d", Files: files},
+		{InfoHash: []byte{0x05}, Name: "e", Files: files}, {InfoHash: []byte{0x06}, Name: "f", Files: files}}
+	mutex.Lock()
+	payloads, failing = nil, `"name":"e"`
+	mutex.Unlock()
+	if err = AddNewTorrents(db, torrents); err == nil {
+		t.Error("Failed delivery is not an error")
+	}
+	mutex.Lock()
+	failing = ""
+	mutex.Unlock()
+	if err = AddNewTorrents(db, torrents); err != nil {
+		t.Fatalf("AddNewTorrents: %s", err.Error())
+	}
+	var names []string
+	for _, payload := range payloads {
+		var summary SimpleTorrentSummary
+		_ = json.Unmarshal([]byte(payload), &summary)
+		names = append(names, summary.Name)
+	}
+	if strings.Join(names, "") != "def" {
+		t.Errorf("Torrents are not delivered exactly once: %q", names)
+	}
+}
@@ -0,0 +1,203 @@
+// Package release parses the names of the torrents that follow the scene/P2P naming conventions
+// (e.g. `The.Movie.2019.1080p.BluRay.x264.DTS-GROUP`) into structured metadata.
+//
+// Parsing is heuristic by its nature: each field is recognised by its own pattern wherever it is
+// in the name, the title is what precedes the first field recognised, and the release group is
+// what follows the last hyphen (or what is in the leading brackets, as is customary for anime).
+package release
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+// field is a pattern whose first submatch is normalised into the value of a field, using its
+// canonical names (keyed by the lowercase submatch) if any.
+type field struct {
+	re        *regexp.Regexp
+	canonical map[string]string
+}
+
+// Patterns are delimited by word boundaries, which do not match at underscores (a word character
+// in RE2), hence underscores are replaced by spaces before matching.
+var (
+	resolution = field{regexp.MustCompile(`(?i)\b(480p|576p|720p|1080[pi]|2160p|4320p|4k|uhd)\b`),
+		map[string]string{"1080i": "1080i", "4k": "2160p", "uhd": "2160p"}}
+	source = field{regexp.MustCompile(`(?i)\b(blu-?ray|bd-?rip|br-?rip|bd-?remux|remux|web-?dl|web-?rip|web|hdtv|pdtv|dvd-?rip|dvd-?r|dvd|hd-?rip|hdcam|cam-?rip|cam|telesync|hd-?ts|ts|vhs-?rip)\b`),
+		map[string]string{
+			"bluray": "BluRay", "blu-ray": "BluRay", "bdrip": "BluRay", "bd-rip": "BluRay", "brrip": "BluRay",
+			"br-rip": "BluRay", "bdremux": "Remux", "bd-remux": "Remux", "remux": "Remux",
+			"web-dl": "WEB-DL", "webdl": "WEB-DL", "webrip": "WEBRip", "web-rip": "WEBRip", "web": "WEB",
+			"hdtv": "HDTV", "pdtv": "HDTV",
+			"dvdrip": "DVD", "dvd-rip": "DVD", "dvdr": "DVD", "dvd-r": "DVD", "dvd": "DVD",
+			"hdrip": "HDRip", "hd-rip": "HDRip", "vhsrip": "VHS", "vhs-rip": "VHS",
+			"hdcam": "CAM", "camrip": "CAM", "cam-rip": "CAM", "cam": "CAM",
+			"telesync": "TS", "hdts": "TS", "hd-ts": "TS", "ts": "TS",
+		}}
+	codec = field{regexp.MustCompile(`(?i)\b(x\.?264|h\.?264|avc|x\.?265|h\.?265|hevc|xvid|divx|av1|vp9)\b`),
+		map[string]string{
+			"x264": "H.264", "x.264": "H.264", "h264": "H.264", "h.264": "H.264", "avc": "H.264",
+			"x265": "H.265", "x.265": "H.265", "h265": "H.265", "h.265": "H.265", "hevc": "H.265",
+			"xvid": "XviD", "divx": "DivX", "av1": "AV1", "vp9": "VP9",
+		}}
+	audio = field{regexp.MustCompile(`(?i)\b(dts-?hd(?:[ .-]?ma)?|dts-?x|dts|truehd|atmos|ddp|dd\+|e-?ac-?3|dd|ac-?3|aac|flac|mp3|opus|lpcm)(?:[ .]?[257]\.[01])?\b`),
+		map[string]string{
+			"dts-hd": "DTS-HD", "dtshd": "DTS-HD", "dts-hd ma": "DTS-HD MA", "dts-hd.ma": "DTS-HD MA",
+			"dts-hd-ma": "DTS-HD MA", "dts-hdma": "DTS-HD MA", "dtshd ma": "DTS-HD MA", "dtshd.ma": "DTS-HD MA",
+			"dtshd-ma": "DTS-HD MA", "dtshdma": "DTS-HD MA", "dts-x": "DTS:X", "dtsx": "DTS:X", "dts": "DTS",
+			"truehd": "TrueHD", "atmos": "Atmos",
+			"ddp": "E-AC3", "dd+": "E-AC3", "eac3": "E-AC3", "e-ac3": "E-AC3", "eac-3": "E-AC3", "e-ac-3": "E-AC3",
+			"dd": "AC3", "ac3": "AC3", "ac-3": "AC3",
+			"aac": "AAC", "flac": "FLAC", "mp3": "MP3", "opus": "Opus", "lpcm": "LPCM",
+		}}
+	language = field{regexp.MustCompile(`(?i)\b(multi|dual|eng|english|truefrench|french|vostfr|german|ita|italian|spanish|esp|latino|rus|russian|japanese|korean|chinese|hindi|portuguese|dutch|polish|swedish|turkish)\b`),
+		map[string]string{
+			"multi": "multi", "dual": "multi", "eng": "en", "english": "en", "truefrench": "fr", "french": "fr",
+			"vostfr": "fr", "german": "de", "ita": "it", "italian": "it", "spanish": "es", "esp": "es",
+			"latino": "es", "rus": "ru", "russian": "ru", "japanese": "ja", "korean": "ko", "chinese": "zh",
+			"hindi": "hi", "portuguese": "pt", "dutch": "nl", "polish": "pl", "swedish": "sv", "turkish": "tr",
+		}}
+
+	year = regexp.MustCompile(`\b(19\d{2}|20\d{2})\b`)
+	// Episodes are either `S01E02`, `1x02`, `Season 1`, `S01` or (for anime) ` - 02 `.
+	seasonEpisode = regexp.MustCompile(`(?i)\bS(\d{1,2})[ .]?E(\d{1,4})\b|\b(\d{1,2})x(\d{2,3})\b`)
+	season        = regexp.MustCompile(`(?i)\bS(\d{1,2})\b|\bSeason[ .]?(\d{1,2})\b`)
+	animeEpisode  = regexp.MustCompile(` - (\d{2,4})\b`)
+
+	// extension is stripped, since the names of single-file torrents are the names of the files.
+	extension    = regexp.MustCompile(`(?i)\.(avi|m2ts|m4v|mkv|mov|mp4|mpg|ts|webm|wmv)$`)
+	leadingGroup = regexp.MustCompile(`^\[([^\]]+)\]\s*`)
+	trailing     = regexp.MustCompile(`(\s*\[[^\]]*\])+$`)
+	group        = regexp.MustCompile(`-\s?([A-Za-z0-9]+)$`)
+	separators   = regexp.MustCompile(`[\s._]+`)
+)
+
+// span is the position of a field recognised in the name.
+type span struct{ start, end int }
+
+// Parse parses the given name of a torrent. The Title of the release is never empty for a non-empty
+// name, since it falls back to the name itself if no field is recognised, or if nothing is left of
+// the name once the fields are (e.g. `[Group] .mkv`).
+func Parse(name string) persistence.Release {
+	r := parse(name)
+	// The databases tell the torrents whose names are not parsed yet by their empty titles, hence a
+	// name that is parsed into an empty title would be parsed again and again by the backfill.
+	if r.Title == "" {
+		r.Title = fallbackTitle(name)
+	}
+	return r
+}
+
+func parse(name string) persistence.Release {
+	var r persistence.Release
+
+	name = strings.TrimSpace(extension.ReplaceAllString(strings.TrimSpace(name), ""))
+	if m := leadingGroup.FindStringSubmatch(name); m != nil {
+		r.Group = strings.TrimSpace(m[1])
+		name = name[len(m[0]):]
+	}
+	// Underscores are replaced one-to-one so that the positions of the fields are kept.
+	s := strings.ReplaceAll(name, "_", " ")
+
+	var spans []span
+	find := func(f field) string {
+		loc := f.re.FindStringSubmatchIndex(s)
+		if loc == nil {
+			return ""
+		}
+		spans = append(spans, span{loc[0], loc[1]})
+		match := s[loc[2]:loc[3]]
+		if canonical, ok := f.canonical[strings.ToLower(match)]; ok {
+			return canonical
+		}
+		return strings.ToLower(match)
+	}
+	r.Resolution = find(resolution)
+	r.Source = find(source)
+	r.Codec = find(codec)
+	r.Audio = find(audio)
+	r.Language = find(language)
+
+	if loc := seasonEpisode.FindStringSubmatchIndex(s); loc != nil {
+		spans = append(spans, span{loc[0], loc[1]})
+		if loc[2] != -1 {
+			r.Season, r.Episode = atoi(s[loc[2]:loc[3]]), atoi(s[loc[4]:loc[5]])
+		} else {
+			r.Season, r.Episode = atoi(s[loc[6]:loc[7]]), atoi(s[loc[8]:loc[9]])
+		}
+	} else if loc := season.FindStringSubmatchIndex(s); loc != nil {
+		spans = append(spans, span{loc[0], loc[1]})
+		if loc[2] != -1 {
+			r.Season = atoi(s[loc[2]:loc[3]])
+		} else {
+			r.Season = atoi(s[loc[4]:loc[5]])
+		}
+	} else if loc := animeEpisode.FindStringSubmatchIndex(s); loc != nil {
+		spans = append(spans, span{loc[0], loc[1]})
+		r.Episode = atoi(s[loc[2]:loc[3]])
+	}
+
+	// The year is the last one that is not at the very beginning, since titles might start with
+	// (or be) a year too, as in `2001: A Space Odyssey 1968`.
+	var yearLoc []int
+	for _, loc := range year.FindAllStringSubmatchIndex(s, -1) {
+		if loc[0] > 0 {
+			yearLoc = loc
+		}
+	}
+	if yearLoc != nil {
+		spans = append(spans, span{yearLoc[0], yearLoc[1]})
+		r.Year = atoi(s[yearLoc[2]:yearLoc[3]])
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+
+	// The group is taken from the end of the name unless it is a part of a field (e.g. `WEB-DL`).
+	rest := trailing.ReplaceAllString(s, "")
+	if loc := group.FindStringSubmatchIndex(rest); loc != nil && r.Group == "" && len(spans) > 0 {
+		inField := false
+		for _, sp := range spans {
+			if sp.start <= loc[0] && loc[0] < sp.end {
+				inField = true
+			}
+		}
+		if !inField {
+			r.Group = rest[loc[2]:loc[3]]
+		}
+	}
+
+	// Names that do not follow the conventions are kept as they are.
+	if len(spans) == 0 {
+		r.Title = name
+		return r
+	}
+	r.Title = clean(s[:spans[0].start])
+	if r.Title == "" {
+		r.Title = clean(rest)
+	}
+
+	return r
+}
+
+// fallbackTitle returns @name, trimmed unless it is all whitespace.
+func fallbackTitle(name string) string {
+	if trimmed := strings.TrimSpace(name); trimmed != "" {
+		return trimmed
+	}
+	return name
+}
+
+// clean turns the separators into spaces, and trims the title of the punctuation that separates it
+// from the fields.
+func clean(title string) string {
+	title = separators.ReplaceAllString(title, " ")
+	return strings.Trim(title, " -([{")
+}
+
+func atoi(s string) int {
+	i, _ := strconv.Atoi(s)
+	return i
+}
@@ -0,0 +1,46 @@
+package release
+
+import (
+	"testing"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		name     string
+		expected persistence.Release
+	}{
+		{"The.Matrix.1999.1080p.BluRay.x264.DTS-HD.MA.5.1-FGT",
+			persistence.Release{Title: "The Matrix", Year: 1999, Resolution: "1080p", Source: "BluRay", Codec: "H.264", Audio: "DTS-HD MA", Group: "FGT"}},
+		{"Some.Show.S02E05.720p.WEB-DL.DDP5.1.H.264-NTb",
+			persistence.Release{Title: "Some Show", Season: 2, Episode: 5, Resolution: "720p", Source: "WEB-DL", Codec: "H.264", Audio: "E-AC3", Group: "NTb"}},
+		{"Some Show Season 3 Complete 1080p WEBRip x265 HEVC",
+			persistence.Release{Title: "Some Show", Season: 3, Resolution: "1080p", Source: "WEBRip", Codec: "H.265"}},
+		{"Blade Runner 2049 (2017) 2160p UHD BluRay REMUX HDR HEVC Atmos-EPSiLON.mkv",
+			persistence.Release{Title: "Blade Runner 2049", Year: 2017, Resolution: "2160p", Source: "BluRay", Codec: "H.265", Audio: "Atmos", Group: "EPSiLON"}},
+		{"2012.2009.GERMAN.DVDRip.XviD-AMIABLE",
+			persistence.Release{Title: "2012", Year: 2009, Source: "DVD", Codec: "XviD", Language: "de", Group: "AMIABLE"}},
+		{"[SubsPlease] Some Anime - 07 [1080p] [ABCDEF01].mkv",
+			persistence.Release{Title: "Some Anime", Episode: 7, Resolution: "1080p", Group: "SubsPlease"}},
+		{"Show_Name_1x03_HDTV_XviD",
+			persistence.Release{Title: "Show Name", Season: 1, Episode: 3, Source: "HDTV", Codec: "XviD"}},
+		// No field is recognised, hence neither the group.
+		{"ubuntu-20.04.1-desktop-amd64.iso",
+			persistence.Release{Title: "ubuntu-20.04.1-desktop-amd64.iso"}},
+		{"Pink Floyd - The Dark Side of the Moon (1973) [FLAC]",
+			persistence.Release{Title: "Pink Floyd - The Dark Side of the Moon", Year: 1973, Audio: "FLAC"}},
+		// Nothing is left of the name once the group and the extension are stripped, hence the
+		// title falls back to the name.
+		{"[Group]", persistence.Release{Title: "[Group]", Group: "Group"}},
+		{".mkv", persistence.Release{Title: ".mkv"}},
+		{" [Group] .mkv ", persistence.Release{Title: "[Group] .mkv", Group: "Group"}},
+		{"1080p", persistence.Release{Title: "1080p", Resolution: "1080p"}},
+	}
+
+	for i, tc := range testCases {
+		if release := Parse(tc.name); release != tc.expected {
+			t.Errorf("Case #%d: expected %+v, got %+v", i, tc.expected, release)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Package spam assesses how likely a torrent is to be a fake, spam, or bait for malware, judged by
+// its name and its files.
+package spam
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/boramalper/magnetico/pkg/category"
+	"github.com/boramalper/magnetico/pkg/persistence"
+	"github.com/boramalper/magnetico/pkg/release"
+)
+
+// Quality flags, each of which is raised by a heuristic.
+const (
+	// FakeVideo is raised for the torrents that are named like videos, but contain no videos and
+	// only small executables or shortcuts instead.
+	FakeVideo = "fake-video"
+	// DoubleExtension is raised for the torrents with files such as `movie.mp4.exe`.
+	DoubleExtension = "double-extension"
+	// ExecutableInMedia is raised for the video or audio torrents with executables or shortcuts.
+	ExecutableInMedia = "executable-in-media"
+	// PasswordArchive is raised for the torrents with archives whose passwords are to be found
+	// elsewhere (typically on a website that serves ads or malware).
+	PasswordArchive = "password-archive"
+	// KeywordStuffing is raised for the torrents whose names are stuffed with keywords.
+	KeywordStuffing = "keyword-stuffing"
+)
+
+// weights are how much each flag adds to the score, which is at most 100.
+var weights = map[string]int{
+	FakeVideo:         60,
+	DoubleExtension:   50,
+	ExecutableInMedia: 30,
+	PasswordArchive:   40,
+	KeywordStuffing:   30,
+}
+
+// smallExecutable is the size below which an executable is too small to be a legitimate
+// installer of a video player or a codec pack, let alone a video.
+const smallExecutable = 10 << 20
+
+var (
+	executable = regexp.MustCompile(`(?i)\.(exe|scr|lnk|bat|cmd|com|pif|vbs|vbe|js|jse|wsf|msi|hta|ps1)$`)
+	// doubleExtension is a media (or document) extension followed by an executable one.
+	doubleExtension = regexp.MustCompile(`(?i)\.(avi|mkv|mp4|wmv|mov|mpg|mp3|flac|jpg|png|pdf|doc|docx|txt)\.(exe|scr|lnk|bat|cmd|com|pif|vbs|js|msi|hta)$`)
+	archive         = regexp.MustCompile(`(?i)\.(rar|zip|7z)$`)
+	// passwordHint matches the names of the files (and the torrents) that point to the password of
+	// an archive, as well as the shortcuts to websites.
+	passwordHint = regexp.MustCompile(`(?i)(^|[^a-z])(pass(word|wort)?|pwd?)([^a-z]|$)|\.url$`)
+	videoName    = regexp.MustCompile(`(?i)\.(avi|mkv|mp4|wmv|mov|m4v)$`)
+	words        = regexp.MustCompile(`[\pL\pN]+`)
+	resolutions  = regexp.MustCompile(`(?i)\b(480p|720p|1080p|2160p|4k)\b`)
+)
+
+// stuffedKeywords are the words that the stuffed names tend to repeat, in lowercase.
+var stuffedKeywords = map[string]bool{
+	"free": true, "download": true, "full": true, "movie": true, "watch": true, "online": true,
+	"torrent": true, "crack": true, "cracked": true, "keygen": true, "latest": true, "new": true,
+	"hd": true, "best": true, "hot": true, "leaked": true,
+}
+
+// Assess returns the quality flags raised for the torrent with the given name and files, and its
+// score (from 0, for none, to 100). Padding files are ignored.
+func Assess(name string, files []persistence.File) (score int, flags []string) {
+	var nFiles, nVideos, nExecutables, nSmallExecutables, nArchives int
+	var doubleExt, passwordFile bool
+	for _, file := range files {
+		if file.IsPadding() {
+			continue
+		}
+		nFiles++
+
+		base := path.Base(file.Path)
+		if videoName.MatchString(base) {
+			nVideos++
+		}
+		if executable.MatchString(base) {
+			nExecutables++
+			if file.Size < smallExecutable {
+				nSmallExecutables++
+			}
+		}
+		if archive.MatchString(base) {
+			nArchives++
+		}
+		doubleExt = doubleExt || doubleExtension.MatchString(base)
+		passwordFile = passwordFile || passwordHint.MatchString(strings.TrimSuffix(base, path.Ext(base)))
+	}
+
+	if nFiles > 0 && nVideos == 0 && nSmallExecutables > 0 && isVideoName(name) {
+		flags = append(flags, FakeVideo)
+	}
+
+	if doubleExt {
+		flags = append(flags, DoubleExtension)
+	}
+
+	if nExecutables > 0 {
+		if c, _ := category.Classify(files); c == category.Video || c == category.Audio {
+			flags = append(flags, ExecutableInMedia)
+		}
+	}
+
+	if nArchives > 0 && (passwordFile || passwordHint.MatchString(name)) {
+		flags = append(flags, PasswordArchive)
+	}
+
+	if isStuffed(name) {
+		flags = append(flags, KeywordStuffing)
+	}
+
+	for _, flag := range flags {
+		score += weights[flag]
+	}
+	if score > 100 {
+		score = 100
+	}
+
+	return score, flags
+}
+
+// isVideoName returns true if the name of the torrent looks like that of a video release.
+func isVideoName(name string) bool {
+	if videoName.MatchString(name) {
+		return true
+	}
+	r := release.Parse(name)
+	return r.Resolution != "" || r.Codec != "" || r.Season != 0 || r.Episode != 0
+}
+
+// isStuffed returns true if the name repeats its words, lists multiple resolutions, or is made of
+// the keywords of the spammers.
+func isStuffed(name string) bool {
+	if len(resolutions.FindAllString(name, 3)) >= 3 {
+		return true
+	}
+
+	ws := words.FindAllString(strings.ToLower(name), -1)
+	if len(ws) < 8 {
+		return false
+	}
+
+	seen := make(map[string]bool)
+	nKeywords := 0
+	for _, w := range ws {
+		seen[w] = true
+		if stuffedKeywords[w] {
+			nKeywords++
+		}
+	}
+
+	return float64(len(seen)) < 0.6*float64(len(ws)) || nKeywords >= 4
+}
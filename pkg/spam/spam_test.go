@@ -0,0 +1,42 @@
+package spam
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/boramalper/magnetico/pkg/persistence"
+)
+
+func TestAssess(t *testing.T) {
+	testCases := []struct {
+		name  string
+		files []persistence.File
+		score int
+		flags []string
+	}{
+		{"The.Movie.2020.1080p.WEB-DL.x264-GRP", []persistence.File{{Size: 3 << 30, Path: "The.Movie.2020.1080p.WEB-DL.x264-GRP.mkv"}, {Size: 1 << 10, Path: "GRP.nfo"}},
+			0, nil},
+		{"The.Movie.2020.1080p.WEB-DL.x264-GRP", []persistence.File{{Size: 700 << 10, Path: "The.Movie.2020.1080p.WEB-DL.x264-GRP.exe"}, {Size: 1 << 10, Path: "readme.txt"}},
+			60, []string{FakeVideo}},
+		{"The Movie 2020", []persistence.File{{Size: 1 << 20, Path: "The Movie 2020.mp4.lnk"}},
+			50, []string{DoubleExtension}},
+		{"Album (2019) [FLAC]", []persistence.File{{Size: 40 << 20, Path: "01.flac"}, {Size: 40 << 20, Path: "02.flac"}, {Size: 2 << 20, Path: "codec_installer.exe"}},
+			30, []string{ExecutableInMedia}},
+		{"The Movie 2020 1080p", []persistence.File{{Size: 2 << 30, Path: "The Movie 2020 1080p.rar"}, {Size: 1 << 10, Path: "Password.txt"}},
+			40, []string{PasswordArchive}},
+		{"The Movie 2020 Full Movie Free Download HD 1080p 720p 480p Watch Online", []persistence.File{{Size: 2 << 30, Path: "movie.mp4"}},
+			30, []string{KeywordStuffing}},
+		{"The Movie 1080p", []persistence.File{{Size: 100 << 10, Path: "movie.avi.exe"}, {Size: 1 << 10, Path: "pass.url"}, {Size: 1 << 20, Path: "movie.zip"}},
+			100, []string{FakeVideo, DoubleExtension, PasswordArchive}},
+		// Padding files are ignored.
+		{"ubuntu-20.04-desktop-amd64.iso", []persistence.File{{Size: 2 << 30, Path: "ubuntu-20.04-desktop-amd64.iso"}, {Size: 1 << 10, Path: ".pad/1024", Attributes: "p"}},
+			0, nil},
+	}
+
+	for i, tc := range testCases {
+		score, flags := Assess(tc.name, tc.files)
+		if score != tc.score || !reflect.DeepEqual(flags, tc.flags) {
+			t.Errorf("Case #%d: expected %d %v, got %d %v", i, tc.score, tc.flags, score, flags)
+		}
+	}
+}
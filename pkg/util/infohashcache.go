@@ -0,0 +1,42 @@
+package util
+
+import "container/list"
+
+// InfoHashCache is a set of infohashes that evicts the least recently added ones beyond its size.
+// It is not safe for concurrent use.
+type InfoHashCache struct {
+	size     int
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func NewInfoHashCache(size int) *InfoHashCache {
+	return &InfoHashCache{size: size, order: list.New(), elements: make(map[string]*list.Element)}
+}
+
+func (c *InfoHashCache) Add(infoHash []byte) {
+	if c.size == 0 {
+		return
+	}
+	if element, ok := c.elements[string(infoHash)]; ok {
+		c.order.MoveToFront(element)
+		return
+	}
+	c.elements[string(infoHash)] = c.order.PushFront(string(infoHash))
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.elements, oldest.Value.(string))
+	}
+}
+
+func (c *InfoHashCache) Contains(infoHash []byte) bool {
+	_, ok := c.elements[string(infoHash)]
+	return ok
+}
+
+// Clear removes all of the infohashes.
+func (c *InfoHashCache) Clear() {
+	c.order.Init()
+	c.elements = make(map[string]*list.Element)
+}
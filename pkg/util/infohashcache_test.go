@@ -0,0 +1,20 @@
+package util
+
+import "testing"
+
+func TestInfoHashCache(t *testing.T) {
+	c := NewInfoHashCache(2)
+	c.Add([]byte("a"))
+	c.Add([]byte("b"))
+	c.Add([]byte("a"))
+	c.Add([]byte("c"))
+	if !c.Contains([]byte("a")) || c.Contains([]byte("b")) || !c.Contains([]byte("c")) {
+		t.Errorf("Least recently added infohash is not evicted: %v", c.elements)
+	}
+
+	c.Clear()
+	c.Add([]byte("d"))
+	if c.Contains([]byte("a")) || !c.Contains([]byte("d")) {
+		t.Errorf("Cleared infohashes are not removed: %v", c.elements)
+	}
+}